@@ -5,14 +5,15 @@ go 1.19
 require (
 	github.com/ipthomas/tukcnst v1.3.4
 	github.com/ipthomas/tukdbint v1.3.17
+	github.com/ipthomas/tukhttp v1.3.8
+	github.com/ipthomas/tukpdq v1.3.9
 	github.com/ipthomas/tukutil v1.3.8
 	github.com/ipthomas/tukxdw v1.3.11
+	github.com/lib/pq v1.10.9
 )
 
 require (
 	github.com/go-sql-driver/mysql v1.7.0 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/ipthomas/tukdsub v1.3.14 // indirect
-	github.com/ipthomas/tukhttp v1.3.8 // indirect
-	github.com/ipthomas/tukpdq v1.3.9 // indirect
 )
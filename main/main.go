@@ -1,24 +1,29 @@
 package main
 
 import (
+	"fmt"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/ipthomas/tukcnst"
 	"github.com/ipthomas/tukdbint"
 	"github.com/ipthomas/tukutil"
-	"github.com/ipthomas/tukxdw"
+	_ "github.com/lib/pq"
+
+	"tukxdw-client/tukflow"
+	"tukxdw-client/tuksrvc"
+	"tukxdw-client/tukstore"
 )
 
 var (
 	pathway               = "pathalert"
 	nhs                   = "9999999468"
 	initlogging           = true
-	initdb                = true
 	registerEventServices = true
 	registerXdws          = false
 	initTmplts            = false
@@ -27,7 +32,8 @@ var (
 	contentConsumer       = false
 	contentUpdator        = false
 	//TUK_DB_URL_AWS          = "https://5k2o64mwt5.execute-api.eu-west-1.amazonaws.com/beta/"
-	DSUB_BROKER_URL       = "http://spirit-test-01.tianispirit.co.uk:8081/SpiritXDSDsub/Dsub"
+	DSUB_BROKER_URL       = ""
+	DSUB_BROKER_TIMEOUT   time.Duration
 	DSUB_CONSUMER_URL_AWS = "https://fwa7l2kp71.execute-api.eu-west-1.amazonaws.com/beta/eventservice/event"
 	//DSUB_CONSUMER_URL_Local = "http://tukeventserver.ddns.net:8081/eventservice/event"
 	user       = "pbradley"
@@ -40,82 +46,124 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	initVars()
 	initLog()
-	initDB()
-	initTemplates()
-	initServices()
-	initStaticFiles()
-	RegisterXDWs()
-	ContentCreator()
-	ContentConsumer()
+	store, err := tukstore.Open("")
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	initTemplates(store)
+	initServices(store)
+	initStaticFiles(store)
+	RegisterXDWs(store)
+	ContentCreator(store)
+	ContentConsumer(store)
 	ContentUpdator()
-	tukdbint.DBConn.Close()
+	store.Close()
 	LogFile.Close()
 }
 func initVars() {
 	log.Println("Base Folder " + os.Getenv(tukcnst.ENV_TUK_CONFIG))
 	log.Println("Config file " + os.Getenv(tukcnst.ENV_TUK_CONFIG_FILE) + ".json")
 }
-func initServices() {
+
+// initServices validates and stores the service config files, and sets DSUB_BROKER_URL and DSUB_BROKER_TIMEOUT to the endpoint
+// and context timeout of the event service broker. Invalid configs are logged and still stored in the store, so one invalid
+// service does not stop the others being updated
+func initServices(store tukstore.Store) {
+	if _, err := tuksrvc.LoadRegistry(tuksrvc.SERVICES_DIR); err != nil {
+		log.Println(err.Error())
+	}
+	if broker, err := eventBroker(tuksrvc.SERVICES_DIR); err == nil {
+		DSUB_BROKER_URL = broker.Endpoint()
+		DSUB_BROKER_TIMEOUT = broker.Timeout()
+		log.Println("DSUB Broker URL " + DSUB_BROKER_URL)
+	} else {
+		log.Println(err.Error())
+	}
 	if registerEventServices {
 		log.Println("Processing Event Service Config Files")
-		if srvcs, err := tukutil.GetFolderFiles("./config/services/"); err == nil {
+		if srvcs, err := tukutil.GetFolderFiles(tuksrvc.SERVICES_DIR); err == nil {
 			for _, file := range srvcs {
 				if strings.HasSuffix(file.Name(), ".json") {
-					if filebytes := loadFile(file, "./config/services/"); filebytes != nil {
+					if filebytes := loadFile(file, tuksrvc.SERVICES_DIR); filebytes != nil {
 						srvcs := tukdbint.ServiceStates{Action: tukcnst.DELETE}
 						srvc := tukdbint.ServiceState{Name: strings.TrimSuffix(file.Name(), ".json")}
 						srvcs.ServiceState = append(srvcs.ServiceState, srvc)
-						tukdbint.NewDBEvent(&srvcs)
+						if err := tukstore.NewStoreEvent(store, &srvcs); err != nil {
+							continue
+						}
 						srvcs = tukdbint.ServiceStates{Action: tukcnst.INSERT}
 						srvc = tukdbint.ServiceState{Name: strings.TrimSuffix(file.Name(), ".json"), Service: string(filebytes)}
 						srvcs.ServiceState = append(srvcs.ServiceState, srvc)
-						tukdbint.NewDBEvent(&srvcs)
+						tukstore.NewStoreEvent(store, &srvcs)
 					}
 				}
 			}
 		}
 	}
 }
+
+// eventBroker returns the validated broker service of the event service. Only the two services are loaded, so the broker is found
+// when an unrelated service is invalid
+func eventBroker(dir string) (tuksrvc.Service, error) {
+	srvc, err := tuksrvc.LoadService(dir, STORE_SERVICE)
+	if err != nil {
+		return srvc, err
+	}
+	ref, ok := srvc.References()[tuksrvc.BROKER_SRVC]
+	if !ok {
+		return tuksrvc.Service{}, fmt.Errorf("%s service has no %s", STORE_SERVICE, tuksrvc.BROKER_SRVC)
+	}
+	broker, err := tuksrvc.LoadService(dir, ref)
+	if err != nil {
+		return broker, err
+	}
+	return broker, broker.Validate()
+}
 func ContentUpdator() {
 	if contentUpdator {
 		log.Printf("Updating %s Workflow for NHS ID %s", pathway, nhs)
 	}
 }
-func ContentConsumer() {
+func ContentConsumer(store tukstore.Store) {
 	if contentConsumer {
-		trans := tukxdw.Transaction{
-			Actor:   tukcnst.XDW_ACTOR_CONTENT_CONSUMER,
-			Pathway: pathway,
-			NHS_ID:  nhs,
-			User:    user,
-			Org:     org,
-			Role:    role,
-		}
-		if err := tukxdw.Execute(&trans); err != nil {
+		trans := tukflow.Transaction{Store: store}
+		trans.Actor = tukcnst.XDW_ACTOR_CONTENT_CONSUMER
+		trans.Pathway = pathway
+		trans.NHS_ID = nhs
+		trans.User, trans.Org, trans.Role = user, org, role
+		if err := tukflow.Execute(&trans); err != nil {
 			log.Println(err.Error())
 		}
 		log.Printf("Consumed Workflow %s, current status %s - Is Overdue %v - Complete by %s - Workflow duration to date %s - Total Events to Date %v", trans.Pathway+trans.NHS_ID, trans.XDWState.Status, trans.XDWState.IsOverdue, trans.XDWState.CompleteBy, trans.XDWState.PrettyWorkflowDuration, trans.XDWEvents.Count)
 	}
 }
-func ContentCreator() {
+func ContentCreator(store tukstore.Store) {
 	if contentCreator {
-		trans := tukxdw.Transaction{
-			Actor:   tukcnst.XDW_ACTOR_CONTENT_CREATOR,
-			Pathway: pathway,
-			NHS_ID:  nhs,
-			Request: []byte(notes),
-			User:    user,
-			Org:     org,
-			Role:    role,
-		}
-		if err := tukxdw.Execute(&trans); err != nil {
+		trans := tukflow.Transaction{Store: store}
+		trans.Actor = tukcnst.XDW_ACTOR_CONTENT_CREATOR
+		trans.Pathway = pathway
+		trans.NHS_ID = nhs
+		trans.Request = []byte(notes)
+		trans.User, trans.Org, trans.Role = user, org, role
+		if err := tukflow.Execute(&trans); err != nil {
 			log.Println(err.Error())
 		}
 	}
 }
-func RegisterXDWs() {
+
+// RegisterXDWs registers the pathway definition and xds meta config files in the store. Registering the definition replaces the pathway broker
+// subscriptions
+func RegisterXDWs(store tukstore.Store) {
 	if registerXdws {
 		log.Println("Processing XDW Config Files")
 		if xdwconfigs, err := tukutil.GetFolderFiles("./config/xdwconfig/"); err == nil {
@@ -134,81 +182,47 @@ func RegisterXDWs() {
 						continue
 					}
 					if filebytes := loadFile(file, "./config/xdwconfig/"); filebytes != nil {
-						trans := tukxdw.Transaction{
-							Actor:            tukcnst.XDW_ADMIN_REGISTER_DEFINITION,
-							Pathway:          pathway,
-							DSUB_BrokerURL:   DSUB_BROKER_URL,
-							DSUB_ConsumerURL: DSUB_CONSUMER_URL_AWS,
-							Request:          filebytes,
-						}
+						trans := tukflow.Transaction{Store: store}
+						trans.Actor = tukcnst.XDW_ADMIN_REGISTER_DEFINITION
+						trans.Pathway = pathway
+						trans.DSUB_BrokerURL = DSUB_BROKER_URL
+						trans.DSUB_Timeout = DSUB_BROKER_TIMEOUT
+						trans.DSUB_ConsumerURL = DSUB_CONSUMER_URL_AWS
+						trans.Request = filebytes
 						if suffix == "_meta.json" {
 							trans.Actor = tukcnst.XDW_ADMIN_REGISTER_XDS_META
 						}
-						tukxdw.Execute(&trans)
+						tukflow.Execute(&trans)
 					}
 				}
 			}
 		}
 	}
 }
-func initStaticFiles() {
+func initStaticFiles(store tukstore.Store) {
 	if initStatic {
-		if staticfiles, err := tukutil.GetFolderFiles("./config/static/"); err == nil {
-			for _, file := range staticfiles {
-				filebytes := loadFile(file, "./config/static/")
-				if filebytes != nil {
-					log.Printf("Persisting static file %s", file.Name())
-					statics := tukdbint.Statics{Action: tukcnst.DELETE}
-					static := tukdbint.Static{Name: file.Name()}
-					statics.Static = append(statics.Static, static)
-					tukdbint.NewDBEvent(&statics)
-					statics = tukdbint.Statics{Action: tukcnst.INSERT}
-					static = tukdbint.Static{Name: file.Name(), Content: filebytes}
-					statics.Static = append(statics.Static, static)
-					tukdbint.NewDBEvent(&statics)
-				}
-			}
-		}
+		syncAssets(store, tukstore.ASSET_STATIC)
 	}
 }
-func initTemplates() {
+func initTemplates(store tukstore.Store) {
 	if initTmplts {
-		if xmlTmplts, err := tukutil.GetFolderFiles("./config/templates/xml/"); err == nil {
-			for _, file := range xmlTmplts {
-				if strings.HasSuffix(file.Name(), ".xml") {
-					filebytes := loadFile(file, "./config/templates/xml/")
-					if filebytes != nil {
-						log.Printf("Persisting XML Template %s", file.Name())
-						tmplts := tukdbint.Templates{Action: tukcnst.DELETE}
-						tmplt := tukdbint.Template{Name: strings.TrimSuffix(file.Name(), ".xml"), IsXML: true}
-						tmplts.Templates = append(tmplts.Templates, tmplt)
-						tukdbint.NewDBEvent(&tmplts)
-						tmplts = tukdbint.Templates{Action: tukcnst.INSERT}
-						tmplt = tukdbint.Template{Name: strings.TrimSuffix(file.Name(), ".xml"), IsXML: true, Template: string(filebytes)}
-						tmplts.Templates = append(tmplts.Templates, tmplt)
-						tukdbint.NewDBEvent(&tmplts)
-					}
-				}
-			}
-		}
-		if htmlTmplts, err := tukutil.GetFolderFiles("./config/templates/html/"); err == nil {
-			for _, file := range htmlTmplts {
-				if strings.HasSuffix(file.Name(), ".html") {
-					filebytes := loadFile(file, "./config/templates/html/")
-					if filebytes != nil {
-						log.Printf("Persisting HTML Template %s", file.Name())
-						tmplts := tukdbint.Templates{Action: tukcnst.DELETE}
-						tmplt := tukdbint.Template{Name: strings.TrimSuffix(file.Name(), ".html")}
-						tmplts.Templates = append(tmplts.Templates, tmplt)
-						tukdbint.NewDBEvent(&tmplts)
-						tmplts = tukdbint.Templates{Action: tukcnst.INSERT}
-						tmplt = tukdbint.Template{Name: strings.TrimSuffix(file.Name(), ".html"), Template: string(filebytes)}
-						tmplts.Templates = append(tmplts.Templates, tmplt)
-						tukdbint.NewDBEvent(&tmplts)
-					}
-				}
-			}
-		}
+		syncAssets(store, tukstore.ASSET_XML_TEMPLATE, tukstore.ASSET_HTML_TEMPLATE)
+	}
+}
+
+// syncAssets adds a new active version of each changed template or static file of the kinds in ./config to the store
+func syncAssets(store tukstore.Store, kinds ...string) {
+	assets, err := tukstore.LoadAssets("./config", kinds...)
+	if err != nil {
+		return
+	}
+	changes, err := tukstore.SyncAssets(store, assets)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, change := range changes {
+		log.Printf("Persisted %s %s asset %s version %v", change.Status, change.Kind, change.Name, change.Version)
 	}
 }
 func loadFile(file fs.DirEntry, folder string) []byte {
@@ -228,17 +242,3 @@ func initLog() {
 		log.Println("Loaded log file - " + LogFile.Name())
 	}
 }
-func initDB() {
-	if initdb {
-		dbconn := tukdbint.TukDBConnection{
-			DBUser:     "root",
-			DBPassword: "rootPass",
-			DBHost:     "tuk.coil1nnpqdlr.eu-west-1.rds.amazonaws.com",
-			DBPort:     "3306",
-			DBName:     "tuk",
-		}
-		if err := tukdbint.NewDBEvent(&dbconn); err != nil {
-			log.Println(err.Error())
-		}
-	}
-}
@@ -0,0 +1,106 @@
+// Package tukclock provides the Clock used for XDW deadline, duration and event timestamp calculations. Wall is the default
+// clock and reads the system time. Fake is a virtual clock that is only moved by calls to Set and Advance, for use in tests,
+// simulations and the evaluation of workflows at historical points in time.
+package tukclock
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ipthomas/tukutil"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+type Wall struct{}
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Default is the clock used when no clock is provided
+var Default Clock = Wall{}
+
+// london is the Europe/London location, or nil if the time zone database can not be loaded
+var london = loadLondon()
+
+// Now returns the system time
+func (Wall) Now() time.Time {
+	return time.Now()
+}
+
+// NewFake returns a fake clock set to the time t
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the fake clock time
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set sets the fake clock time
+func (c *Fake) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// Advance moves the fake clock forward by the duration d and returns the new time
+func (c *Fake) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// AdvanceOHT moves the fake clock forward by an OASIS Human Task duration eg. `hour(2)` and returns the new time
+func (c *Fake) AdvanceOHT(htDate string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = tukutil.OHT_FutureDate(c.now, htDate)
+	return c.now
+}
+
+// Or returns c, or the Default clock if c is nil
+func Or(c Clock) Clock {
+	if c == nil {
+		return Default
+	}
+	return c
+}
+
+// Since returns the time elapsed since t according to the clock c
+func Since(c Clock, t time.Time) time.Duration {
+	return Or(c).Now().Sub(t)
+}
+
+// Until returns the duration until t according to the clock c
+func Until(c Clock, t time.Time) time.Duration {
+	return t.Sub(Or(c).Now())
+}
+
+// TimeNow returns the clock time as an RFC3339 string in the Europe/London location. It is the clock aware equivalent of tukutil.Time_Now
+func TimeNow(c Clock) string {
+	return Format(Or(c).Now())
+}
+
+// Format returns the time as an RFC3339 string in the Europe/London location, as used for all XDW document times
+func Format(t time.Time) string {
+	if london == nil {
+		return t.Format(time.RFC3339)
+	}
+	return t.In(london).Format(time.RFC3339)
+}
+func loadLondon() *time.Location {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+	return loc
+}
@@ -0,0 +1,351 @@
+// Package tukdiagram renders XDW workflow definitions, and the current state of XDW workflow documents, as Mermaid flowcharts and Graphviz DOT digraphs.
+//
+// Tasks are rendered as nodes annotated with their deadlines. Task outputs that are inputs to other tasks are rendered as solid
+// edges labelled with the document type and `task(n)` completion conditions are rendered as dashed edges. Consecutive tasks with
+// neither edge between them are joined by an unlabelled ordering edge, so every task is connected in definition order.
+package tukdiagram
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"strings"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+
+	"tukxdw-client/tukclock"
+	"tukxdw-client/tukflow"
+)
+
+const (
+	MERMAID        = "mermaid"
+	DOT            = "dot"
+	NODE_START     = "xdwstart"
+	NODE_END       = "xdwend"
+	EDGE_DOCUMENT  = "document"
+	EDGE_TASK      = "task"
+	EDGE_ORDER     = "order"
+	STATUS_OVERDUE = "OVERDUE"
+)
+
+type Diagram struct {
+	Name  string
+	Nodes []Node
+	Edges []Edge
+}
+type Node struct {
+	ID        string
+	TaskID    string
+	Name      string
+	TaskType  string
+	Notes     []string
+	Status    string
+	IsOverdue bool
+}
+type Edge struct {
+	From  string
+	To    string
+	Label string
+	Kind  string
+}
+
+// NewDiagram returns the Diagram for an XDW workflow definition
+func NewDiagram(def tukxdw.WorkflowDefinition) Diagram {
+	d := Diagram{Name: def.Ref}
+	d.Nodes = append(d.Nodes, Node{ID: NODE_START, Name: "Start"})
+	for _, task := range def.Tasks {
+		node := Node{ID: nodeId(task.ID), TaskID: task.ID, Name: task.Name, TaskType: task.Tasktype}
+		if task.StartByTime != "" {
+			node.Notes = append(node.Notes, "start by "+task.StartByTime)
+		}
+		if task.CompleteByTime != "" {
+			node.Notes = append(node.Notes, "complete by "+task.CompleteByTime)
+		}
+		if task.ExpirationTime != "" {
+			node.Notes = append(node.Notes, "escalate "+task.ExpirationTime)
+		}
+		d.Nodes = append(d.Nodes, node)
+	}
+	end := Node{ID: NODE_END, Name: "Complete"}
+	if def.CompleteByTime != "" {
+		end.Notes = append(end.Notes, "complete by "+def.CompleteByTime)
+	}
+	if def.ExpirationTime != "" {
+		end.Notes = append(end.Notes, "escalate "+def.ExpirationTime)
+	}
+	d.Nodes = append(d.Nodes, end)
+
+	if len(def.Tasks) > 0 {
+		d.Edges = append(d.Edges, Edge{From: NODE_START, To: nodeId(def.Tasks[0].ID), Kind: EDGE_TASK})
+	}
+	for _, task := range def.Tasks {
+		for _, out := range task.Output {
+			for _, dependant := range def.Tasks {
+				if dependant.ID == task.ID {
+					continue
+				}
+				for _, inp := range dependant.Input {
+					if inp.Name == out.Name {
+						d.Edges = append(d.Edges, Edge{From: nodeId(task.ID), To: nodeId(dependant.ID), Label: tukutil.SplitExpression(out.Name), Kind: EDGE_DOCUMENT})
+					}
+				}
+			}
+		}
+		for _, cb := range task.CompletionBehavior {
+			for _, taskid := range conditionTasks(cb.Completion.Condition) {
+				if taskid != task.ID {
+					d.Edges = append(d.Edges, Edge{From: nodeId(taskid), To: nodeId(task.ID), Label: "task(" + taskid + ")", Kind: EDGE_TASK})
+				}
+			}
+		}
+	}
+	for _, cb := range def.CompletionBehavior {
+		for _, taskid := range conditionTasks(cb.Completion.Condition) {
+			d.Edges = append(d.Edges, Edge{From: nodeId(taskid), To: NODE_END, Label: "task(" + taskid + ")", Kind: EDGE_TASK})
+		}
+	}
+	for k := 1; k < len(def.Tasks); k++ {
+		from, to := nodeId(def.Tasks[k-1].ID), nodeId(def.Tasks[k].ID)
+		if !d.connected(from, to) {
+			d.Edges = append(d.Edges, Edge{From: from, To: to, Kind: EDGE_ORDER})
+		}
+	}
+	return d
+}
+
+// NewStateDiagram returns the Diagram for an XDW workflow definition overlaid with the task statuses and overdue state of an XDW workflow document.
+// Tasks are overdue at the clock time, a nil clock is tukclock.Default
+func NewStateDiagram(def tukxdw.WorkflowDefinition, doc tukxdw.XDWWorkflowDocument, clock tukclock.Clock) Diagram {
+	d := NewDiagram(def)
+	trans := tukflow.Transaction{Clock: clock}
+	trans.XDWDefinition = def
+	trans.XDWDocument = doc
+	for k, node := range d.Nodes {
+		switch node.ID {
+		case NODE_START:
+			d.Nodes[k].Status = tukcnst.COMPLETE
+		case NODE_END:
+			d.Nodes[k].Status = doc.WorkflowStatus
+		default:
+			for _, task := range doc.TaskList.XDWTask {
+				if task.TaskData.TaskDetails.ID == node.TaskID {
+					d.Nodes[k].Status = task.TaskData.TaskDetails.Status
+				}
+			}
+			trans.Task_ID = tukutil.GetIntFromString(node.TaskID)
+			if hasDeadline(def, trans.Task_ID) && trans.Task_ID <= len(doc.TaskList.XDWTask) {
+				d.Nodes[k].IsOverdue = trans.IsTaskOverdue()
+			}
+		}
+	}
+	return d
+}
+
+// Mermaid returns the Mermaid flowchart for an XDW workflow definition
+func Mermaid(def tukxdw.WorkflowDefinition) string {
+	d := NewDiagram(def)
+	return d.Mermaid()
+}
+
+// MermaidState returns the Mermaid flowchart for an XDW workflow definition overlaid with the state of an XDW workflow document
+func MermaidState(def tukxdw.WorkflowDefinition, doc tukxdw.XDWWorkflowDocument, clock tukclock.Clock) string {
+	d := NewStateDiagram(def, doc, clock)
+	return d.Mermaid()
+}
+
+// Graphviz returns the Graphviz DOT digraph for an XDW workflow definition
+func Graphviz(def tukxdw.WorkflowDefinition) string {
+	d := NewDiagram(def)
+	return d.DOT()
+}
+
+// GraphvizState returns the Graphviz DOT digraph for an XDW workflow definition overlaid with the state of an XDW workflow document
+func GraphvizState(def tukxdw.WorkflowDefinition, doc tukxdw.XDWWorkflowDocument, clock tukclock.Clock) string {
+	d := NewStateDiagram(def, doc, clock)
+	return d.DOT()
+}
+
+// Render takes a format (mermaid or dot), a json XDW workflow definition and an optional XDW workflow document xml and returns the diagram,
+// with the document tasks that are overdue at the clock time
+func Render(format string, xdwdef string, xdwdoc string, clock tukclock.Clock) (string, error) {
+	def := tukxdw.WorkflowDefinition{}
+	if err := json.Unmarshal([]byte(xdwdef), &def); err != nil {
+		log.Println(err.Error())
+		return "", err
+	}
+	d := NewDiagram(def)
+	if xdwdoc != "" {
+		doc := tukxdw.XDWWorkflowDocument{}
+		if err := xml.Unmarshal([]byte(xdwdoc), &doc); err != nil {
+			log.Println(err.Error())
+			return "", err
+		}
+		d = NewStateDiagram(def, doc, clock)
+	}
+	if strings.EqualFold(format, DOT) {
+		return d.DOT(), nil
+	}
+	return d.Mermaid(), nil
+}
+
+// Mermaid returns the Diagram as a Mermaid flowchart
+func (i *Diagram) Mermaid() string {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for _, node := range i.Nodes {
+		label := mermaidEscape(strings.Join(node.labelLines(), "<br/>"))
+		switch node.ID {
+		case NODE_START, NODE_END:
+			b.WriteString("  " + node.ID + "((\"" + label + "\"))\n")
+		default:
+			b.WriteString("  " + node.ID + "[\"" + label + "\"]\n")
+		}
+	}
+	for _, edge := range i.Edges {
+		arrow := " --> "
+		switch edge.Kind {
+		case EDGE_TASK:
+			arrow = " -.-> "
+		case EDGE_ORDER:
+			arrow = " ==> "
+		}
+		if edge.Label != "" {
+			arrow = strings.TrimSuffix(arrow, " ") + "|\"" + mermaidEscape(edge.Label) + "\"| "
+		}
+		b.WriteString("  " + edge.From + arrow + edge.To + "\n")
+	}
+	b.WriteString("  classDef created fill:#f8f9fa,stroke:#6c757d\n")
+	b.WriteString("  classDef inprogress fill:#fff3cd,stroke:#ffc107\n")
+	b.WriteString("  classDef complete fill:#d4edda,stroke:#28a745\n")
+	b.WriteString("  classDef overdue fill:#f8d7da,stroke:#dc3545,stroke-width:3px\n")
+	for _, node := range i.Nodes {
+		if class := node.class(); class != "" {
+			b.WriteString("  class " + node.ID + " " + class + "\n")
+		}
+	}
+	return b.String()
+}
+
+// DOT returns the Diagram as a Graphviz DOT digraph
+func (i *Diagram) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph \"" + dotEscape(i.Name) + "\" {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=\"rounded,filled\", fillcolor=\"#ffffff\", fontname=\"Helvetica\"];\n")
+	for _, node := range i.Nodes {
+		attrs := "label=\"" + dotEscape(strings.Join(node.labelLines(), "\n")) + "\""
+		if node.ID == NODE_START || node.ID == NODE_END {
+			attrs = attrs + ", shape=circle"
+		}
+		switch node.class() {
+		case "created":
+			attrs = attrs + ", fillcolor=\"#f8f9fa\", color=\"#6c757d\""
+		case "inprogress":
+			attrs = attrs + ", fillcolor=\"#fff3cd\", color=\"#ffc107\""
+		case "complete":
+			attrs = attrs + ", fillcolor=\"#d4edda\", color=\"#28a745\""
+		case "overdue":
+			attrs = attrs + ", fillcolor=\"#f8d7da\", color=\"#dc3545\", penwidth=3"
+		}
+		b.WriteString("  " + node.ID + " [" + attrs + "];\n")
+	}
+	for _, edge := range i.Edges {
+		attrs := ""
+		if edge.Label != "" {
+			attrs = "label=\"" + dotEscape(edge.Label) + "\""
+		}
+		style := ""
+		switch edge.Kind {
+		case EDGE_TASK:
+			style = "style=dashed"
+		case EDGE_ORDER:
+			style = "style=dotted"
+		}
+		if style != "" {
+			if attrs != "" {
+				attrs = attrs + ", "
+			}
+			attrs = attrs + style
+		}
+		if attrs != "" {
+			attrs = " [" + attrs + "]"
+		}
+		b.WriteString("  " + edge.From + " -> " + edge.To + attrs + ";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// connected returns true if the diagram has an edge from either node to the other
+func (i *Diagram) connected(a string, b string) bool {
+	for _, edge := range i.Edges {
+		if (edge.From == a && edge.To == b) || (edge.From == b && edge.To == a) {
+			return true
+		}
+	}
+	return false
+}
+func (i *Node) labelLines() []string {
+	var lines []string
+	if i.TaskID != "" {
+		lines = append(lines, i.TaskID+". "+i.Name)
+	} else {
+		lines = append(lines, i.Name)
+	}
+	if i.TaskType != "" {
+		lines = append(lines, i.TaskType)
+	}
+	lines = append(lines, i.Notes...)
+	if i.Status != "" && i.TaskID != "" {
+		lines = append(lines, "status "+i.Status)
+	}
+	if i.IsOverdue {
+		lines = append(lines, STATUS_OVERDUE)
+	}
+	return lines
+}
+func (i *Node) class() string {
+	if i.IsOverdue {
+		return "overdue"
+	}
+	switch i.Status {
+	case tukcnst.CREATED, tukcnst.OPEN:
+		return "created"
+	case tukcnst.IN_PROGRESS:
+		return "inprogress"
+	case tukcnst.COMPLETE, tukcnst.CLOSED:
+		return "complete"
+	}
+	return ""
+}
+
+// conditionTasks returns the task ids referenced by `task(n)` functions in a completion condition
+func conditionTasks(condition string) []string {
+	var taskids []string
+	for _, cond := range strings.Split(condition, " and ") {
+		cond = strings.TrimSpace(cond)
+		if strings.HasPrefix(cond, "task(") && strings.HasSuffix(cond, ")") {
+			taskids = append(taskids, strings.TrimSuffix(strings.TrimPrefix(cond, "task("), ")"))
+		}
+	}
+	return taskids
+}
+func hasDeadline(def tukxdw.WorkflowDefinition, taskid int) bool {
+	if taskid < 1 || taskid > len(def.Tasks) {
+		return false
+	}
+	return def.Tasks[taskid-1].CompleteByTime != "" || def.CompleteByTime != ""
+}
+func nodeId(taskid string) string {
+	return "t" + taskid
+}
+func mermaidEscape(s string) string {
+	return strings.ReplaceAll(s, "\"", "#quot;")
+}
+func dotEscape(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	return strings.ReplaceAll(s, "\n", "\\n")
+}
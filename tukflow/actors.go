@@ -0,0 +1,517 @@
+package tukflow
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+
+	"tukxdw-client/tukclock"
+	"tukxdw-client/tukstore"
+)
+
+// UPDATE_ATTEMPTS is the number of times the content updater is run when it conflicts with a concurrent update of the same workflow
+const UPDATE_ATTEMPTS = 3
+
+// BACKFILL_PAGE_SIZE is the number of workflows read per query by BackfillWorkflowSummaries
+const BACKFILL_PAGE_SIZE = 500
+
+// XDW_ACTOR_ACKNOWLEDGER acknowledges, as the transaction User, Org and Role, the events of the transaction Task_ID task of the
+// workflow, or the events of every task if Task_ID is 0
+const XDW_ACTOR_ACKNOWLEDGER = "XDW_Acknowledger"
+
+// Execute runs the IHE XDW actor set in the transaction Actor against the transaction Store. It supports the same actors as
+// tukxdw.Execute, and XDW_ACTOR_ACKNOWLEDGER. If DSUB_BrokerURL is set, registering a definition replaces the broker subscriptions
+// of the pathway after the definition is stored, see CancelSubscriptions.
+// The registration, creator and updater writes are made in a single store transaction, which is rolled back if any write fails
+func Execute(i *Transaction) error {
+	return ExecuteContext(context.Background(), i)
+}
+
+// ExecuteContext runs Execute with the transaction Store operations in the context, so the caller, eg. a server handler with the
+// request context, can cancel the actor or set its deadline. An actor cancelled during a store transaction is rolled back
+func ExecuteContext(ctx context.Context, i *Transaction) error {
+	if i.Store == nil {
+		return errors.New("transaction store is not set")
+	}
+	store := i.Store
+	defer func() { i.Store = store }()
+	i.Store = store.WithContext(ctx)
+	switch i.Actor {
+	case tukcnst.XDW_ADMIN_REGISTER_DEFINITION:
+		if err := i.atomic(func() error { return i.registerDefinition(false) }); err != nil || i.DSUB_BrokerURL == "" {
+			return err
+		}
+		return i.subscribeDefinition(ctx)
+	case tukcnst.XDW_ADMIN_REGISTER_XDS_META:
+		return i.atomic(func() error { return i.registerDefinition(true) })
+	case tukcnst.XDW_ACTOR_CONTENT_CREATOR:
+		return i.atomic(i.contentCreator)
+	case tukcnst.XDW_ACTOR_CONTENT_UPDATER:
+		return i.update()
+	case tukcnst.XDW_ACTOR_CONTENT_CONSUMER:
+		return i.contentConsumer()
+	case XDW_ACTOR_ACKNOWLEDGER:
+		return i.atomic(i.acknowledger)
+	}
+	return errors.New("unsupported actor " + i.Actor)
+}
+
+// atomic runs fn with the transaction Store replaced by a store transaction
+func (i *Transaction) atomic(fn func() error) error {
+	store := i.Store
+	defer func() { i.Store = store }()
+	return tukstore.WithTx(store, func(tx tukstore.Store) error {
+		i.Store = tx
+		i.storeErr = nil
+		return fn()
+	})
+}
+func (i *Transaction) registerDefinition(ismeta bool) error {
+	if i.Pathway == "" {
+		return errors.New("pathway is not set")
+	}
+	if len(i.Request) == 0 {
+		return errors.New("request bytes is not set")
+	}
+	name := i.Pathway
+	if ismeta {
+		name = i.Pathway + "_meta"
+		if err := json.Unmarshal(i.Request, &i.XDSDocumentMeta); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+	} else if err := json.Unmarshal(i.Request, &i.XDWDefinition); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err := tukstore.SetXDW(i.Store, name, ismeta, string(i.Request)); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	log.Printf("Registered %s", name)
+	return nil
+}
+
+// IHE XDW Content Creator
+func (i *Transaction) contentCreator() error {
+	log.Printf("Creating New Workflow for Pathway %s NHS ID %s", i.Pathway, i.NHS_ID)
+	if err := i.loadWorkflowConfig(); err != nil {
+		return err
+	}
+	if err := i.deprecateWorkflow(); err != nil {
+		return err
+	}
+	i.CreateWorkflow(i.newEventID)
+	if i.storeErr != nil {
+		return i.storeErr
+	}
+	wfs := tukdbint.Workflows{Action: tukcnst.INSERT}
+	wf := i.workflow()
+	xdwDefBytes, _ := json.Marshal(i.XDWDefinition)
+	wf.XDW_Def = string(xdwDefBytes)
+	wfs.Workflows = append(wfs.Workflows, wf)
+	if err := i.Store.Workflows(&wfs); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err := i.Store.SetWorkflowSummary(i.summary()); err != nil {
+		return err
+	}
+	log.Printf("Persisted Workflow Version %v for Pathway %s NHS ID %s", i.XDWVersion, i.Pathway, i.NHS_ID)
+	return nil
+}
+func (i *Transaction) loadWorkflowConfig() error {
+	meta, err := tukstore.GetXDW(i.Store, i.Pathway+"_meta", true)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err = json.Unmarshal([]byte(meta.XDW), &i.XDSDocumentMeta); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	def, err := tukstore.GetXDW(i.Store, i.Pathway, false)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err = json.Unmarshal([]byte(def.XDW), &i.XDWDefinition); err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+func (i *Transaction) deprecateWorkflow() error {
+	wfs := tukdbint.Workflows{Action: tukcnst.DEPRECATE}
+	wfs.Workflows = append(wfs.Workflows, tukdbint.Workflow{XDW_Key: strings.ToUpper(i.Pathway) + i.NHS_ID})
+	if err := i.Store.Workflows(&wfs); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	evs := tukdbint.Events{Action: tukcnst.DEPRECATE}
+	evs.Events = append(evs.Events, tukdbint.Event{Pathway: i.Pathway, NhsId: i.NHS_ID})
+	if err := i.Store.Events(&evs); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// update runs the content updater in a store transaction. If another updater has changed the workflow since it was read, the
+// workflow is reloaded and the update retried, up to UPDATE_ATTEMPTS times
+func (i *Transaction) update() error {
+	var err error
+	for attempt := 1; attempt <= UPDATE_ATTEMPTS; attempt++ {
+		if err = i.atomic(func() error {
+			_, err := i.contentUpdater()
+			return err
+		}); !errors.Is(err, tukstore.ErrConflict) {
+			return err
+		}
+		log.Printf("Workflow update conflict on attempt %v of %v", attempt, UPDATE_ATTEMPTS)
+	}
+	return err
+}
+
+// IHE XDW Content Updater. Every update increments the workflow document sequence number, and is persisted only if the stored
+// sequence number is still that of the document read
+func (i *Transaction) contentUpdater() ([]Transition, error) {
+	log.Printf("Updating %s Workflow Version %v for NHS ID %s", i.Pathway, i.XDWVersion, i.NHS_ID)
+	if err := i.loadWorkflow(); err != nil {
+		return nil, err
+	}
+	evs, err := tukstore.GetEvents(i.Store, "", i.Pathway, i.NHS_ID, "", -1, i.XDWVersion)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	i.XDWEvents = tukdbint.Events{Action: tukcnst.SELECT}
+	for _, ev := range evs.Events {
+		if ev.Id != 0 && !i.isEventRegistered(ev.Id) {
+			i.XDWEvents.Events = append(i.XDWEvents.Events, ev)
+			i.XDWEvents.Count = i.XDWEvents.Count + 1
+		}
+	}
+	if i.XDWEvents.Count == 0 {
+		log.Println("No new workflow events")
+		return nil, nil
+	}
+	log.Printf("Updating Workflow with %v new events", i.XDWEvents.Count)
+	expected := SequenceNumber(i.XDWDocument)
+	transitions := i.UpdateXDWDocumentTasks(i.newEventID)
+	if i.storeErr != nil {
+		return transitions, i.storeErr
+	}
+	if SequenceNumber(i.XDWDocument) <= expected {
+		i.XDWDocument.WorkflowDocumentSequenceNumber = strconv.Itoa(expected + 1)
+	}
+	if err := i.Store.UpdateWorkflow(i.workflow(), SequenceNumber(i.XDWDocument), expected); err != nil {
+		log.Println(err.Error())
+		return transitions, err
+	}
+	if err := i.Store.SetWorkflowSummary(i.summary()); err != nil {
+		return transitions, err
+	}
+	log.Printf("Persisted Workflow Version %v for Pathway %s NHS ID %s", i.XDWVersion, i.Pathway, i.NHS_ID)
+	return transitions, nil
+}
+
+// IHE XDW Content Consumer. The workflow is read from the store reader, or from the writer if the updater has just persisted new events
+func (i *Transaction) contentConsumer() error {
+	if err := i.update(); err != nil {
+		return err
+	}
+	if i.XDWEvents.Count > 0 {
+		store := i.Store
+		defer func() { i.Store = store }()
+		i.Store = tukstore.Writer(store)
+	}
+	if err := i.loadWorkflow(); err != nil {
+		return err
+	}
+	i.SetXDWStates()
+	i.XDWState.IsPublished = i.Workflows.Workflows[1].Published
+	if err := i.setTaskAcks(); err != nil {
+		return err
+	}
+	evs, err := tukstore.GetEvents(i.Store, "", i.Pathway, i.NHS_ID, "", -1, i.XDWVersion)
+	if err != nil {
+		return err
+	}
+	i.XDWEvents = evs
+	doc, def := i.XDWDocument, i.XDWDefinition
+	if err := i.SetDashboardState(); err != nil {
+		return err
+	}
+	i.XDWDocument, i.XDWDefinition = doc, def
+	return nil
+}
+func (i *Transaction) acknowledger() error {
+	if i.User == "" {
+		return errors.New("user is not set")
+	}
+	if err := i.loadWorkflow(); err != nil {
+		return err
+	}
+	if i.Task_ID < 0 || i.Task_ID > len(i.XDWDocument.TaskList.XDWTask) {
+		return fmt.Errorf("%s workflow has no task %v", i.Pathway, i.Task_ID)
+	}
+	var ids []int64
+	for k := range i.XDWDocument.TaskList.XDWTask {
+		if i.Task_ID == 0 || i.Task_ID == k+1 {
+			ids = append(ids, TaskEventIDs(i.XDWDocument, k+1)...)
+		}
+	}
+	if len(ids) == 0 {
+		return errors.New("no task events to acknowledge")
+	}
+	for _, id := range ids {
+		if _, err := i.AcknowledgeEvent(id); err != nil {
+			return err
+		}
+	}
+	return i.setTaskAcks()
+}
+
+// AcknowledgeEvent records the acknowledgement of the event by the transaction User, Org and Role at the clock time, and returns
+// it. If the user has already acknowledged the event, the existing acknowledgement is returned
+func (i *Transaction) AcknowledgeEvent(eventid int64) (tukdbint.EventAck, error) {
+	evs, err := tukstore.FindEvents(i.Store, tukstore.NewEventQuery().Where("id", tukstore.OP_EQ, eventid))
+	if err != nil {
+		return tukdbint.EventAck{}, err
+	}
+	if evs.Count == 0 {
+		return tukdbint.EventAck{}, fmt.Errorf("no event with id %v", eventid)
+	}
+	acks, err := GetEventAcks(i.Store, eventid)
+	if err != nil {
+		return tukdbint.EventAck{}, err
+	}
+	for _, ack := range acks {
+		if strings.EqualFold(ack.User, i.User) {
+			return ack, nil
+		}
+	}
+	ack := tukdbint.EventAck{CreationTime: i.TimeNow(), EventID: eventid, User: i.User, Org: i.Org, Role: i.Role}
+	eventacks := tukdbint.EventAcks{Action: tukcnst.INSERT}
+	eventacks.EventAck = append(eventacks.EventAck, ack)
+	if err := i.Store.EventAcks(&eventacks); err != nil {
+		log.Println(err.Error())
+		return tukdbint.EventAck{}, err
+	}
+	ack.Id = eventacks.LastInsertId
+	log.Printf("User %s acknowledged event %v", i.User, eventid)
+	return ack, nil
+}
+
+// GetEventAcks returns the acknowledgements of the events, oldest first
+func GetEventAcks(s tukstore.Store, eventids ...int64) ([]tukdbint.EventAck, error) {
+	var acks []tukdbint.EventAck
+	if len(eventids) == 0 {
+		return acks, nil
+	}
+	var ids []interface{}
+	for _, id := range eventids {
+		ids = append(ids, id)
+	}
+	q := tukstore.Query{}
+	err := s.Find(tukcnst.EVENT_ACKS, *q.Filter("eventid", tukstore.OP_IN, ids...).Sort("creationtime", false), &acks)
+	return acks, err
+}
+
+// setTaskAcks sets the XDWTaskAcks of the transaction XDWDocument
+func (i *Transaction) setTaskAcks() error {
+	var ids []int64
+	for k := range i.XDWDocument.TaskList.XDWTask {
+		ids = append(ids, TaskEventIDs(i.XDWDocument, k+1)...)
+	}
+	acks, err := GetEventAcks(i.Store, ids...)
+	if err != nil {
+		return err
+	}
+	i.XDWTaskAcks = TaskAcks(i.XDWDocument, acks)
+	return nil
+}
+func (i *Transaction) loadWorkflow() error {
+	var err error
+	if i.Workflows, err = tukstore.GetWorkflows(i.Store, i.Pathway, i.NHS_ID, "", "", i.XDWVersion, false, ""); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if i.Workflows.Count != 1 {
+		return errors.New("no " + i.Pathway + " workflow found for nhs id " + i.NHS_ID)
+	}
+	wf := i.Workflows.Workflows[1]
+	if err = json.Unmarshal([]byte(wf.XDW_Def), &i.XDWDefinition); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	i.XDWDocument = tukxdw.XDWWorkflowDocument{}
+	if err = xml.Unmarshal([]byte(wf.XDW_Doc), &i.XDWDocument); err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+func (i *Transaction) isEventRegistered(id int64) bool {
+	evid := tukutil.GetStringFromInt(int(id))
+	for _, task := range i.XDWDocument.TaskList.XDWTask {
+		for _, taskevent := range task.TaskEventHistory.TaskEvent {
+			if taskevent.ID == evid {
+				return true
+			}
+		}
+	}
+	for _, docevent := range i.XDWDocument.WorkflowStatusHistory.DocumentEvent {
+		if docevent.EventType == tukcnst.COMPLETE && docevent.TaskEventIdentifier == evid {
+			return true
+		}
+	}
+	return false
+}
+func (i *Transaction) workflow() tukdbint.Workflow {
+	wf := tukdbint.Workflow{
+		Pathway: i.Pathway,
+		NHSId:   i.NHS_ID,
+		XDW_Key: strings.ToUpper(i.Pathway) + i.NHS_ID,
+		XDW_UID: i.XDWDocument.ID.Extension,
+		Version: i.XDWVersion,
+		Status:  i.XDWDocument.WorkflowStatus,
+	}
+	xdwDocBytes, _ := xml.MarshalIndent(i.XDWDocument, "", "  ")
+	wf.XDW_Doc = string(xdwDocBytes)
+	return wf
+}
+
+func (i *Transaction) summary() tukstore.WorkflowSummary {
+	return WorkflowSummary(i.XDWDocument, i.XDWDefinition, i.Pathway, i.NHS_ID, i.XDWVersion)
+}
+
+// newEventID persists a workflow event in the store events table and returns its ID. A failure is recorded in storeErr and returns 0
+func (i *Transaction) newEventID(expression string, taskid int) int64 {
+	ev := tukdbint.Event{
+		Creationtime:       i.TimeNow(),
+		DocName:            strings.ToUpper(i.Pathway) + "-" + i.NHS_ID,
+		ClassCode:          i.XDSDocumentMeta.Classcode,
+		ConfCode:           i.XDSDocumentMeta.Confcode,
+		FormatCode:         i.XDSDocumentMeta.Formatcode,
+		FacilityCode:       i.XDSDocumentMeta.Facilitycode,
+		PracticeCode:       i.XDSDocumentMeta.Practicesettingcode,
+		Expression:         expression,
+		Authors:            i.Role + " " + i.User,
+		XdsDocEntryUid:     i.XDWDocument.ID.Extension,
+		RepositoryUniqueId: i.XDSDocumentMeta.Repositoryuniqueid,
+		NhsId:              i.NHS_ID,
+		User:               i.User,
+		Org:                i.Org,
+		Role:               i.Role,
+		Topic:              tukstore.CREATION_EVENT_TOPIC,
+		Pathway:            i.Pathway,
+		Comments:           string(i.Request),
+		Version:            0,
+		TaskId:             taskid,
+	}
+	evs := tukdbint.Events{Action: tukcnst.INSERT}
+	evs.Events = append(evs.Events, ev)
+	if err := i.Store.Events(&evs); err != nil {
+		log.Println(err.Error())
+		if i.storeErr == nil {
+			i.storeErr = err
+		}
+		return 0
+	}
+	return evs.LastInsertId
+}
+
+// GetXDWDefinition returns the workflow definition registered in the store for the pathway
+func GetXDWDefinition(s tukstore.Store, pathway string) (tukxdw.WorkflowDefinition, error) {
+	def := tukxdw.WorkflowDefinition{}
+	xdw, err := tukstore.GetXDW(s, pathway, false)
+	if err != nil {
+		return def, err
+	}
+	err = json.Unmarshal([]byte(xdw.XDW), &def)
+	return def, err
+}
+
+// WorkflowSummary returns the derived workflows columns of the workflow document, which are independent of the current time
+func WorkflowSummary(doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition, pathway string, nhsid string, version int) tukstore.WorkflowSummary {
+	latest := LatestWorkflowEventTime(doc)
+	sum := tukstore.WorkflowSummary{
+		Pathway:       pathway,
+		NHSId:         nhsid,
+		Version:       version,
+		LastEventTime: tukclock.Format(latest),
+		TargetMissed:  IsWorkflowTargetMissed(doc, def, latest),
+		SeqNo:         SequenceNumber(doc),
+	}
+	if def.CompleteByTime != "" {
+		sum.CompleteBy = tukclock.Format(WorkflowCompleteBy(doc, def))
+	}
+	if def.ExpirationTime != "" {
+		sum.EscalateBy = tukclock.Format(WorkflowEscalateBy(doc, def))
+	}
+	if doc.WorkflowStatus == tukcnst.CLOSED {
+		sum.ClosedTime = sum.LastEventTime
+	}
+	for k, task := range doc.TaskList.XDWTask {
+		if task.TaskData.TaskDetails.Status != tukcnst.COMPLETE {
+			sum.CurrentTask = k + 1
+			break
+		}
+	}
+	return sum
+}
+
+// SequenceNumber returns the WorkflowDocumentSequenceNumber of the document, or 0 if it is not set
+func SequenceNumber(doc tukxdw.XDWWorkflowDocument) int {
+	seqnum, _ := strconv.Atoi(doc.WorkflowDocumentSequenceNumber)
+	return seqnum
+}
+
+// ParseWorkflowSummary returns the summary of the workflow from its XDW document and definition
+func ParseWorkflowSummary(wf tukdbint.Workflow) (tukstore.WorkflowSummary, error) {
+	doc := tukxdw.XDWWorkflowDocument{}
+	def := tukxdw.WorkflowDefinition{}
+	if err := xml.Unmarshal([]byte(wf.XDW_Doc), &doc); err != nil {
+		return tukstore.WorkflowSummary{}, fmt.Errorf("%s workflow version %v for NHS ID %s has an invalid XDW document: %w", wf.Pathway, wf.Version, wf.NHSId, err)
+	}
+	if err := json.Unmarshal([]byte(wf.XDW_Def), &def); err != nil {
+		return tukstore.WorkflowSummary{}, fmt.Errorf("%s workflow version %v for NHS ID %s has an invalid XDW definition: %w", wf.Pathway, wf.Version, wf.NHSId, err)
+	}
+	return WorkflowSummary(doc, def, wf.Pathway, wf.NHSId, wf.Version), nil
+}
+
+// BackfillWorkflowSummaries sets the derived columns of every workflow in the store from its XDW document and definition, a
+// page of BACKFILL_PAGE_SIZE workflows at a time. It returns the number of workflows updated
+func BackfillWorkflowSummaries(s tukstore.Store) (int, error) {
+	count := 0
+	for page := 1; ; page++ {
+		wfs, err := tukstore.FindWorkflows(s, tukstore.NewWorkflowQuery().Page(page, BACKFILL_PAGE_SIZE))
+		if err != nil {
+			return count, err
+		}
+		for _, wf := range wfs.Workflows {
+			sum, err := ParseWorkflowSummary(wf)
+			if err != nil {
+				log.Printf("Skipping %s", err.Error())
+				continue
+			}
+			if err := s.SetWorkflowSummary(sum); err != nil {
+				return count, err
+			}
+			count = count + 1
+		}
+		if wfs.Count < BACKFILL_PAGE_SIZE {
+			return count, nil
+		}
+	}
+}
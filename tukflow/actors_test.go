@@ -0,0 +1,218 @@
+package tukflow
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+
+	"tukxdw-client/tukclock"
+	"tukxdw-client/tukstore"
+)
+
+// testTransaction returns a transaction for the actor on the lab workflow of 9999999468
+func testTransaction(s tukstore.Store, clock tukclock.Clock, actor string) *Transaction {
+	return &Transaction{Transaction: tukxdw.Transaction{Actor: actor, Pathway: "lab", NHS_ID: "9999999468", User: "u", Org: "o", Role: "r"}, Clock: clock, Store: s}
+}
+
+// testStore returns a mem store with the lab definition and xds meta registered and a lab workflow created for 9999999468
+func testStore(t *testing.T, clock tukclock.Clock) tukstore.Store {
+	t.Helper()
+	s := tukstore.NewMemStore()
+	def, _ := json.Marshal(testDefinition(t, ""))
+	for actor, request := range map[string][]byte{tukcnst.XDW_ADMIN_REGISTER_DEFINITION: def, tukcnst.XDW_ADMIN_REGISTER_XDS_META: []byte(`{"classcode": "lab"}`)} {
+		i := testTransaction(s, clock, actor)
+		i.Request = request
+		if err := Execute(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Execute(testTransaction(s, clock, tukcnst.XDW_ACTOR_CONTENT_CREATOR)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// addEvent inserts a lab workflow event with the expression at the clock time
+func addEvent(t *testing.T, s tukstore.Store, clock tukclock.Clock, expression string) {
+	t.Helper()
+	evs := tukdbint.Events{Action: tukcnst.INSERT}
+	evs.Events = append(evs.Events, tukdbint.Event{Creationtime: tukclock.TimeNow(clock), Pathway: "lab", NhsId: "9999999468", Expression: expression, User: "u", Org: "o", Role: "r"})
+	if err := s.Events(&evs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedDocument returns the stored lab workflow document of 9999999468
+func storedDocument(t *testing.T, s tukstore.Store) tukxdw.XDWWorkflowDocument {
+	t.Helper()
+	wfs, err := tukstore.GetWorkflows(s, "lab", "9999999468", "", "", 0, false, "")
+	if err != nil || wfs.Count != 1 {
+		t.Fatalf("workflow select returned %+v, %v", wfs, err)
+	}
+	doc := tukxdw.XDWWorkflowDocument{}
+	if err := xml.Unmarshal([]byte(wfs.Workflows[1].XDW_Doc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// racingStore is a store without transactions that runs race before its first workflow update is applied
+type racingStore struct {
+	tukstore.Store
+	race    func()
+	updates int
+}
+
+func (s *racingStore) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	s.updates = s.updates + 1
+	if s.updates == 1 {
+		s.race()
+	}
+	return s.Store.UpdateWorkflow(wf, seqno, expected)
+}
+func (s *racingStore) Begin() (tukstore.Tx, error) {
+	return racingTx{s}, nil
+}
+func (s *racingStore) WithContext(ctx context.Context) tukstore.Store {
+	return s
+}
+
+type racingTx struct {
+	*racingStore
+}
+
+func (racingTx) Commit() error {
+	return nil
+}
+func (racingTx) Rollback() error {
+	return nil
+}
+
+func TestContentUpdaterConflict(t *testing.T) {
+	clock := tukclock.NewFake(testStart)
+	s := testStore(t, clock)
+	addEvent(t, s, clock, "Lab_Request")
+	racing := &racingStore{Store: s}
+	racing.race = func() {
+		addEvent(t, s, clock, "Lab_Request_Claimed")
+		if err := Execute(testTransaction(s, clock, tukcnst.XDW_ACTOR_CONTENT_UPDATER)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Execute(testTransaction(racing, clock, tukcnst.XDW_ACTOR_CONTENT_UPDATER)); err != nil {
+		t.Fatal(err)
+	}
+	if racing.updates != 1 {
+		t.Fatalf("updater made %v workflow updates, want 1 conflicting update", racing.updates)
+	}
+	doc := storedDocument(t, s)
+	if SequenceNumber(doc) != 3 || len(doc.TaskList.XDWTask[0].TaskEventHistory.TaskEvent) != 3 {
+		t.Fatalf("stored document seqno is %v with task 1 events %+v, want the competing update", SequenceNumber(doc), doc.TaskList.XDWTask[0].TaskEventHistory.TaskEvent)
+	}
+}
+
+func TestContentActors(t *testing.T) {
+	clock := tukclock.NewFake(testStart)
+	s := testStore(t, clock)
+	created := storedDocument(t, s)
+	if created.WorkflowStatus != tukcnst.OPEN || SequenceNumber(created) != 1 {
+		t.Fatalf("created workflow is %s with seqno %v", created.WorkflowStatus, SequenceNumber(created))
+	}
+	clock.Advance(time.Hour)
+	addEvent(t, s, clock, "Lab_Request")
+	addEvent(t, s, clock, "Lab_Request_Claimed")
+	if err := Execute(testTransaction(s, clock, tukcnst.XDW_ACTOR_CONTENT_UPDATER)); err != nil {
+		t.Fatal(err)
+	}
+	consumer := testTransaction(s, clock, tukcnst.XDW_ACTOR_CONTENT_CONSUMER)
+	if err := Execute(consumer); err != nil {
+		t.Fatal(err)
+	}
+	if consumer.XDWState.Status != tukcnst.OPEN || consumer.XDWTaskStates[0].Status != tukcnst.COMPLETE || consumer.XDWTaskStates[1].Status == tukcnst.COMPLETE {
+		t.Fatalf("consumed workflow is %s with task states %+v", consumer.XDWState.Status, consumer.XDWTaskStates)
+	}
+	clock.Advance(time.Hour)
+	addEvent(t, s, clock, "Lab_Result")
+	consumer = testTransaction(s, clock, tukcnst.XDW_ACTOR_CONTENT_CONSUMER)
+	if err := Execute(consumer); err != nil {
+		t.Fatal(err)
+	}
+	if consumer.XDWState.Status != tukcnst.CLOSED || consumer.XDWTaskStates[1].Status != tukcnst.COMPLETE {
+		t.Fatalf("consumed workflow is %s with task states %+v", consumer.XDWState.Status, consumer.XDWTaskStates)
+	}
+	if doc := storedDocument(t, s); doc.WorkflowStatus != tukcnst.CLOSED || SequenceNumber(doc) != 4 {
+		t.Fatalf("stored workflow is %s with seqno %v", doc.WorkflowStatus, SequenceNumber(doc))
+	}
+	dashboard, err := tukstore.GetDashboard(s, tukstore.NewWorkflowQuery(), clock.Now())
+	if err != nil || dashboard.Total != 1 || dashboard.Complete != 1 || dashboard.TargetMet != 1 {
+		t.Fatalf("dashboard is %+v, %v", dashboard, err)
+	}
+}
+
+func TestImportedWorkflowEvents(t *testing.T) {
+	clock := tukclock.NewFake(testStart)
+	s := testStore(t, clock)
+	addEvent(t, s, clock, "Lab_Request")
+	if err := Execute(testTransaction(s, clock, tukcnst.XDW_ACTOR_CONTENT_UPDATER)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := tukstore.ExportBackup(s, tukcnst.XDWS, tukcnst.WORKFLOWS, tukcnst.EVENTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := tukstore.NewMemStore()
+	addEvent(t, target, clock, "Other")
+	if _, err := tukstore.ImportBackup(target, b, tukstore.CONFLICT_SKIP, ParseWorkflowSummary); err != nil {
+		t.Fatal(err)
+	}
+	evs, err := tukstore.FindEvents(target, tukstore.NewEventQuery().Where("expression", tukstore.OP_EQ, "Lab_Request"))
+	if err != nil || len(evs.Events) != 1 {
+		t.Fatalf("imported events are %+v, %v", evs, err)
+	}
+	doc := storedDocument(t, target)
+	if ids := TaskEventIDs(doc, 1); len(ids) != 1 || ids[0] != evs.Events[0].Id || ids[0] == TaskEventIDs(storedDocument(t, s), 1)[0] {
+		t.Fatalf("imported task event ids are %v, want the imported event %v", ids, evs.Events[0].Id)
+	}
+	wfs, err := tukstore.FindWorkflows(target, tukstore.NewWorkflowQuery().Where("seqno", tukstore.OP_EQ, SequenceNumber(doc)).Where("currenttask", tukstore.OP_EQ, 1))
+	if err != nil || wfs.Count != 1 {
+		t.Fatalf("%v imported workflows have the summary of seqno %v, %v", wfs.Count, SequenceNumber(doc), err)
+	}
+}
+
+func TestOverdueWorkflowSummary(t *testing.T) {
+	clock := tukclock.NewFake(testStart)
+	s := testStore(t, clock)
+	overdue := func(now time.Time) int {
+		wfs, err := tukstore.FindWorkflows(s, tukstore.NewWorkflowQuery().Overdue(now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wfs.Count
+	}
+	missed := func() int {
+		wfs, err := tukstore.FindWorkflows(s, tukstore.NewWorkflowQuery().Where("targetmissed", tukstore.OP_EQ, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wfs.Count
+	}
+	if overdue(testStart.Add(time.Hour)) != 0 || overdue(testStart.Add(48*time.Hour)) != 1 || missed() != 0 {
+		t.Fatal("open workflow is not overdue after its complete by time only")
+	}
+	clock.Advance(48 * time.Hour)
+	for _, expression := range []string{"Lab_Request", "Lab_Request_Claimed", "Lab_Result"} {
+		addEvent(t, s, clock, expression)
+	}
+	if err := Execute(testTransaction(s, clock, tukcnst.XDW_ACTOR_CONTENT_UPDATER)); err != nil {
+		t.Fatal(err)
+	}
+	if overdue(clock.Now()) != 0 || missed() != 1 {
+		t.Fatal("workflow closed after its complete by time is not target missed")
+	}
+}
@@ -0,0 +1,336 @@
+package tukflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+
+	"tukxdw-client/tuksrvc"
+	"tukxdw-client/tukstore"
+)
+
+// DSUB_UNSUBSCRIBE_ACTION is the WS-BaseNotification Unsubscribe SOAP action, as set in the tukcnst.GO_TEMPLATE_DSUB_CANCEL
+// WS-Addressing header. tukcnst.SOAP_ACTION_UNSUBSCRIBE_REQUEST is missing the hyphen in bw-2
+const DSUB_UNSUBSCRIBE_ACTION = "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/UnsubscribeRequest"
+
+// DSUBBroker is the url of a DSUB broker and the timeout of each request sent to it, eg. the endpoint and contexttimeout of the
+// event service brokersrvc. A Timeout of 0 leaves requests to the context deadline
+type DSUBBroker struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// NewDSUBBroker returns the DSUBBroker of the broker service
+func NewDSUBBroker(broker tuksrvc.Service) DSUBBroker {
+	return DSUBBroker{URL: broker.Endpoint(), Timeout: broker.Timeout()}
+}
+
+// DSUBFault is a SOAP fault returned by the DSUB broker. Code is the fault code value, eg. soap:Receiver, Subcode the first
+// subcode value and Detail the name of the first detail element, eg. ResourceUnknownFault
+type DSUBFault struct {
+	Code    string
+	Subcode string
+	Reason  string
+	Detail  string
+}
+
+func (e *DSUBFault) Error() string {
+	msg := "dsub broker fault " + e.Code
+	if e.Subcode != "" {
+		msg = msg + " " + e.Subcode
+	}
+	if e.Detail != "" {
+		msg = msg + " " + e.Detail
+	}
+	if e.Reason != "" {
+		msg = msg + ". " + e.Reason
+	}
+	return msg
+}
+
+// ResourceUnknown returns true if the broker does not hold the subscription, eg. it has expired or was already cancelled
+func (e *DSUBFault) ResourceUnknown() bool {
+	return strings.Contains(e.Subcode+" "+e.Detail, "ResourceUnknown")
+}
+
+// dsubResponse is a SOAP 1.2 envelope with a SubscribeResponse, UnsubscribeResponse or Fault body
+type dsubResponse struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		SubscribeResponse *struct {
+			SubscriptionReference struct {
+				Address string `xml:"Address"`
+			} `xml:"SubscriptionReference"`
+		} `xml:"SubscribeResponse"`
+		UnsubscribeResponse *struct{} `xml:"UnsubscribeResponse"`
+		Fault               *struct {
+			Code struct {
+				Value   string `xml:"Value"`
+				Subcode struct {
+					Value string `xml:"Value"`
+				} `xml:"Subcode"`
+			} `xml:"Code"`
+			Reason struct {
+				Text string `xml:"Text"`
+			} `xml:"Reason"`
+			Detail struct {
+				Elements []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			} `xml:"Detail"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+// DSUBCancellation is the result of cancelling the broker subscriptions of a pathway. Cancelled and Failed are the broker
+// references that were and were not cancelled. Deleted is the number of subscriptions rows deleted
+type DSUBCancellation struct {
+	Pathway   string
+	Cancelled []string
+	Failed    map[string]error
+	Deleted   int
+}
+
+// Subscribe sends a WS-BaseNotification Subscribe request for the document type code expression to the broker, with notifications
+// sent to the consumer url, and returns the broker reference of the subscription
+func Subscribe(ctx context.Context, broker DSUBBroker, consumerURL string, expression string) (string, error) {
+	req := struct {
+		BrokerURL   string
+		ConsumerURL string
+		Topic       string
+		Expression  string
+	}{BrokerURL: xmlText(broker.URL), ConsumerURL: xmlText(consumerURL), Topic: tukcnst.DSUB_TOPIC_TYPE_CODE, Expression: xmlText(expression)}
+	rsp, err := dsubRequest(ctx, broker, tukcnst.SOAP_ACTION_SUBSCRIBE_REQUEST, tukcnst.SUBSCRIBE, tukcnst.GO_TEMPLATE_DSUB_SUBSCRIBE, req)
+	if err != nil {
+		return "", err
+	}
+	if rsp.Body.SubscribeResponse == nil || rsp.Body.SubscribeResponse.SubscriptionReference.Address == "" {
+		err := errors.New("dsub broker subscribe response has no subscription reference")
+		log.Println(err.Error())
+		return "", err
+	}
+	return rsp.Body.SubscribeResponse.SubscriptionReference.Address, nil
+}
+
+// Unsubscribe sends a WS-BaseNotification Unsubscribe request for the broker reference to the broker. It returns nil if the broker
+// responds with an UnsubscribeResponse, or a DSUBFault if it responds with a SOAP fault
+func Unsubscribe(ctx context.Context, broker DSUBBroker, brokerRef string) error {
+	req := struct {
+		UUID      string
+		BrokerRef string
+	}{UUID: tukutil.NewUuid(), BrokerRef: xmlText(brokerRef)}
+	rsp, err := dsubRequest(ctx, broker, DSUB_UNSUBSCRIBE_ACTION, "cancel", tukcnst.GO_TEMPLATE_DSUB_CANCEL, req)
+	if err != nil {
+		return err
+	}
+	if rsp.Body.UnsubscribeResponse == nil {
+		err := errors.New("dsub broker response is not an " + tukcnst.UNSUBSCRIBE_RESPONSE)
+		log.Println(err.Error())
+		return err
+	}
+	log.Printf("Cancelled broker subscription %s", brokerRef)
+	return nil
+}
+
+// CancelSubscriptions sends an Unsubscribe request to the broker for each broker reference of the pathway subscriptions, and
+// deletes the subscriptions rows of the references that were cancelled, or are unknown to the broker. Rows without a broker
+// reference are deleted. The rows of references that could not be cancelled are kept, so they can be cancelled later, and an
+// error is returned with the cancellation
+func CancelSubscriptions(ctx context.Context, s tukstore.Store, broker DSUBBroker, pathway string) (DSUBCancellation, error) {
+	cancellation := DSUBCancellation{Pathway: pathway, Failed: make(map[string]error)}
+	if pathway == "" {
+		return cancellation, errors.New("pathway is not set")
+	}
+	subs := tukdbint.Subscriptions{Action: tukcnst.SELECT}
+	subs.Subscriptions = append(subs.Subscriptions, tukdbint.Subscription{Pathway: pathway})
+	if err := s.Subscriptions(&subs); err != nil {
+		log.Println(err.Error())
+		return cancellation, err
+	}
+	refs := make(map[string][]int64)
+	for _, sub := range subs.Subscriptions[1:] {
+		refs[sub.BrokerRef] = append(refs[sub.BrokerRef], sub.Id)
+	}
+	var sorted []string
+	for ref := range refs {
+		sorted = append(sorted, ref)
+	}
+	sort.Strings(sorted)
+	for _, ref := range sorted {
+		if ref != "" {
+			if err := Unsubscribe(ctx, broker, ref); err != nil {
+				fault := &DSUBFault{}
+				if !errors.As(err, &fault) || !fault.ResourceUnknown() {
+					cancellation.Failed[ref] = err
+					continue
+				}
+				log.Printf("Broker subscription %s is unknown to the broker", ref)
+			}
+			cancellation.Cancelled = append(cancellation.Cancelled, ref)
+		}
+		for _, id := range refs[ref] {
+			delsubs := tukdbint.Subscriptions{Action: tukcnst.DELETE}
+			delsubs.Subscriptions = append(delsubs.Subscriptions, tukdbint.Subscription{Id: id})
+			if err := s.Subscriptions(&delsubs); err != nil {
+				log.Println(err.Error())
+				return cancellation, err
+			}
+			cancellation.Deleted = cancellation.Deleted + 1
+		}
+	}
+	log.Printf("Cancelled %v broker subscriptions and deleted %v subscriptions for pathway %s", len(cancellation.Cancelled), cancellation.Deleted, pathway)
+	if len(cancellation.Failed) > 0 {
+		return cancellation, fmt.Errorf("%v broker subscriptions for pathway %s were not cancelled", len(cancellation.Failed), pathway)
+	}
+	return cancellation, nil
+}
+
+// subscribeDefinition replaces the broker subscriptions of the registered pathway with a subscription for each XDS registered task
+// input and output of the definition. A subscription that could not be cancelled is kept for its expression
+func (i *Transaction) subscribeDefinition(ctx context.Context) error {
+	cancellation, err := CancelSubscriptions(ctx, i.Store, i.broker(), i.Pathway)
+	if err != nil && len(cancellation.Failed) == 0 {
+		return err
+	}
+	subs := tukdbint.Subscriptions{Action: tukcnst.SELECT}
+	subs.Subscriptions = append(subs.Subscriptions, tukdbint.Subscription{Pathway: i.Pathway})
+	if err := i.Store.Subscriptions(&subs); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	subscribed := make(map[string]bool)
+	for _, sub := range subs.Subscriptions[1:] {
+		subscribed[sub.Expression] = true
+	}
+	for _, expression := range i.subscriptionExpressions() {
+		if subscribed[expression] {
+			log.Printf("Keeping the broker subscription for pathway %s expression %s", i.Pathway, expression)
+			continue
+		}
+		ref, err := Subscribe(ctx, i.broker(), i.DSUB_ConsumerURL, expression)
+		if err != nil {
+			return err
+		}
+		newsubs := tukdbint.Subscriptions{Action: tukcnst.INSERT}
+		newsubs.Subscriptions = append(newsubs.Subscriptions, tukdbint.Subscription{BrokerRef: ref, Pathway: i.Pathway, Topic: tukcnst.DSUB_TOPIC_TYPE_CODE, Expression: expression})
+		if err := i.Store.Subscriptions(&newsubs); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		log.Printf("Subscribed pathway %s to expression %s with broker reference %s", i.Pathway, expression, ref)
+	}
+	return err
+}
+
+// broker returns the DSUBBroker of the transaction DSUB_BrokerURL and DSUB_Timeout
+func (i *Transaction) broker() DSUBBroker {
+	return DSUBBroker{URL: i.DSUB_BrokerURL, Timeout: i.DSUB_Timeout}
+}
+
+// subscriptionExpressions returns the names of the XDS registered task inputs and outputs of the definition, which are the
+// document type codes the pathway subscribes to
+func (i *Transaction) subscriptionExpressions() []string {
+	names := make(map[string]bool)
+	for _, task := range i.XDWDefinition.Tasks {
+		for _, inp := range task.Input {
+			if inp.AccessType == tukcnst.XDS_REGISTERED {
+				names[inp.Name] = true
+			}
+		}
+		for _, out := range task.Output {
+			if out.AccessType == tukcnst.XDS_REGISTERED {
+				names[out.Name] = true
+			}
+		}
+	}
+	var expressions []string
+	for name := range names {
+		expressions = append(expressions, name)
+	}
+	sort.Strings(expressions)
+	return expressions
+}
+
+// dsubRequest executes the named template with the request and posts it to the broker with the SOAP action, and returns the
+// response envelope, or a DSUBFault if the broker responds with a SOAP fault. The request is limited to the broker Timeout
+func dsubRequest(ctx context.Context, broker DSUBBroker, action string, name string, tmplt string, data interface{}) (dsubResponse, error) {
+	rsp := dsubResponse{}
+	if broker.URL == "" {
+		return rsp, errors.New("dsub broker url is not set")
+	}
+	t, err := template.New(name).Funcs(tukutil.TemplateFuncMap()).Parse(tmplt)
+	if err != nil {
+		log.Println(err.Error())
+		return rsp, err
+	}
+	var body bytes.Buffer
+	if err := t.ExecuteTemplate(&body, name, data); err != nil {
+		log.Println(err.Error())
+		return rsp, err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if broker.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, broker.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, broker.URL, &body)
+	if err != nil {
+		log.Println(err.Error())
+		return rsp, err
+	}
+	req.Header.Set(tukcnst.SOAP_ACTION, action)
+	req.Header.Set(tukcnst.CONTENT_TYPE, tukcnst.SOAP_XML)
+	httprsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println(err.Error())
+		return rsp, err
+	}
+	defer httprsp.Body.Close()
+	rspbody, err := io.ReadAll(io.LimitReader(httprsp.Body, 1<<20))
+	if err != nil {
+		log.Println(err.Error())
+		return rsp, err
+	}
+	if err := xml.Unmarshal(rspbody, &rsp); err != nil {
+		err = fmt.Errorf("dsub broker responded with status %s and an invalid soap envelope: %w", httprsp.Status, err)
+		log.Println(err.Error())
+		return rsp, err
+	}
+	if fault := rsp.Body.Fault; fault != nil {
+		dsubfault := &DSUBFault{Code: fault.Code.Value, Subcode: fault.Code.Subcode.Value, Reason: strings.TrimSpace(fault.Reason.Text)}
+		if len(fault.Detail.Elements) > 0 {
+			dsubfault.Detail = fault.Detail.Elements[0].XMLName.Local
+		}
+		log.Println(dsubfault.Error())
+		return rsp, dsubfault
+	}
+	if httprsp.StatusCode != http.StatusOK && httprsp.StatusCode != http.StatusAccepted {
+		err := fmt.Errorf("dsub broker responded with status %s", httprsp.Status)
+		log.Println(err.Error())
+		return rsp, err
+	}
+	return rsp, nil
+}
+
+// xmlText returns the string escaped for use as xml character data or an attribute value
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
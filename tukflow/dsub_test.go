@@ -0,0 +1,114 @@
+package tukflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+
+	"tukxdw-client/tukstore"
+)
+
+// testBroker serves Unsubscribe requests, answering ref-cancelled with an UnsubscribeResponse, ref-unknown with a ResourceUnknown
+// fault, ref-failed with a receiver fault and ref-slow after the request is cancelled
+func testBroker(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(tukcnst.SOAP_ACTION) != DSUB_UNSUBSCRIBE_ACTION {
+			t.Errorf("unsubscribe request has soap action %s", r.Header.Get(tukcnst.SOAP_ACTION))
+		}
+		var rsp string
+		switch {
+		case strings.Contains(string(body), ">ref-cancelled<"):
+			rsp = `<UnsubscribeResponse xmlns="http://docs.oasis-open.org/wsn/b-2"/>`
+		case strings.Contains(string(body), ">ref-unknown<"):
+			w.WriteHeader(http.StatusInternalServerError)
+			rsp = soapFault("wsrf-r:ResourceUnknownFault", "ResourceUnknownFault")
+		case strings.Contains(string(body), ">ref-failed<"):
+			w.WriteHeader(http.StatusInternalServerError)
+			rsp = soapFault("wsn-b:UnableToDestroySubscriptionFault", "UnableToDestroySubscriptionFault")
+		case strings.Contains(string(body), ">ref-slow<"):
+			<-r.Context().Done()
+			return
+		default:
+			t.Errorf("unexpected unsubscribe request %s", body)
+		}
+		fmt.Fprintf(w, `<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"><soap:Body>%s</soap:Body></soap:Envelope>`, rsp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// soapFault returns a SOAP 1.2 receiver fault with the subcode and detail element
+func soapFault(subcode string, detail string) string {
+	return fmt.Sprintf(`<soap:Fault><soap:Code><soap:Value>soap:Receiver</soap:Value><soap:Subcode><soap:Value>%s</soap:Value></soap:Subcode></soap:Code><soap:Reason><soap:Text>%s</soap:Text></soap:Reason><soap:Detail><%s xmlns="http://docs.oasis-open.org/wsrf/r-2"/></soap:Detail></soap:Fault>`, subcode, detail, detail)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	broker := DSUBBroker{URL: testBroker(t).URL, Timeout: 200 * time.Millisecond}
+	if err := Unsubscribe(context.Background(), broker, "ref-cancelled"); err != nil {
+		t.Fatalf("unsubscribe returned %v", err)
+	}
+	for ref, unknown := range map[string]bool{"ref-unknown": true, "ref-failed": false} {
+		fault := &DSUBFault{}
+		if err := Unsubscribe(context.Background(), broker, ref); !errors.As(err, &fault) || fault.ResourceUnknown() != unknown {
+			t.Errorf("unsubscribe %s returned %v, want a fault with ResourceUnknown %v", ref, err, unknown)
+		}
+	}
+	if err := Unsubscribe(context.Background(), broker, "ref-slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unsubscribe ref-slow returned %v, want the broker timeout", err)
+	}
+}
+
+func TestCancelSubscriptions(t *testing.T) {
+	broker := DSUBBroker{URL: testBroker(t).URL, Timeout: 200 * time.Millisecond}
+	s := tukstore.NewMemStore()
+	for _, sub := range []tukdbint.Subscription{
+		{BrokerRef: "ref-cancelled", Pathway: "lab", Expression: "Lab_Request"},
+		{BrokerRef: "ref-cancelled", Pathway: "lab", Expression: "Lab_Result"},
+		{BrokerRef: "ref-unknown", Pathway: "lab", Expression: "Lab_Claimed"},
+		{BrokerRef: "ref-failed", Pathway: "lab", Expression: "Lab_Report"},
+		{BrokerRef: "ref-slow", Pathway: "lab", Expression: "Lab_Published"},
+		{Pathway: "lab", Expression: "Lab_Unsubscribed"},
+		{BrokerRef: "ref-other", Pathway: "rad", Expression: "Rad_Request"},
+	} {
+		subs := tukdbint.Subscriptions{Action: tukcnst.INSERT}
+		sub.Topic = tukcnst.DSUB_TOPIC_TYPE_CODE
+		subs.Subscriptions = append(subs.Subscriptions, sub)
+		if err := s.Subscriptions(&subs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancellation, err := CancelSubscriptions(context.Background(), s, broker, "lab")
+	if err == nil {
+		t.Fatal("cancellation with failed references returned no error")
+	}
+	if strings.Join(cancellation.Cancelled, ",") != "ref-cancelled,ref-unknown" || cancellation.Deleted != 4 {
+		t.Errorf("cancelled %v and deleted %v subscriptions, want ref-cancelled and ref-unknown and 4", cancellation.Cancelled, cancellation.Deleted)
+	}
+	if len(cancellation.Failed) != 2 || cancellation.Failed["ref-failed"] == nil || cancellation.Failed["ref-slow"] == nil {
+		t.Errorf("failed references are %v, want ref-failed and ref-slow", cancellation.Failed)
+	}
+	subs := tukdbint.Subscriptions{Action: tukcnst.SELECT}
+	subs.Subscriptions = append(subs.Subscriptions, tukdbint.Subscription{})
+	if err := s.Subscriptions(&subs); err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, sub := range subs.Subscriptions[1:] {
+		kept = append(kept, sub.BrokerRef)
+	}
+	sort.Strings(kept)
+	if strings.Join(kept, ",") != "ref-failed,ref-other,ref-slow" {
+		t.Errorf("kept subscriptions %v, want the failed references and the other pathway", kept)
+	}
+}
@@ -0,0 +1,188 @@
+package tukflow
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+
+	"tukxdw-client/tukclock"
+	"tukxdw-client/tukstore"
+)
+
+// Transaction extends tukxdw.Transaction with the Clock used for all deadline, duration and event timestamp calculations, and
+// the Store used by Execute. The deadline methods shadow the tukxdw.Transaction methods of the same name, which read the system
+// time. A nil Clock is wall time
+type Transaction struct {
+	tukxdw.Transaction
+	Clock tukclock.Clock
+	Store tukstore.Store
+	// DSUB_Timeout limits each request to the DSUB_BrokerURL broker, eg. the broker service contexttimeout
+	DSUB_Timeout time.Duration
+	// XDWTaskAcks is the acknowledgement state of each workflow task, set by the content consumer and acknowledger
+	XDWTaskAcks []TaskAck
+	// storeErr is the first error persisting a workflow event, which newEventID cannot return
+	storeErr error
+}
+
+// Now returns the transaction clock time
+func (i *Transaction) Now() time.Time {
+	return tukclock.Or(i.Clock).Now()
+}
+
+// TimeNow returns the transaction clock time as an RFC3339 string in the Europe/London location
+func (i *Transaction) TimeNow() string {
+	return tukclock.TimeNow(i.Clock)
+}
+
+// CreateWorkflow sets the transaction XDWDocument to a new workflow document for the transaction XDWDefinition, created at the clock time
+func (i *Transaction) CreateWorkflow(newEventID EventIDFunc) {
+	i.XDWDocument = CreateWorkflowDocument(i.XDWDefinition, i.Pathway, i.NHS_ID, i.author(), i.Now(), newEventID)
+	i.Response, _ = xml.MarshalIndent(i.XDWDocument, "", "  ")
+	i.XDWVersion = 0
+}
+
+// UpdateXDWDocumentTasks applies the transaction XDWEvents to the transaction XDWDocument at the clock time
+func (i *Transaction) UpdateXDWDocumentTasks(newEventID EventIDFunc) []Transition {
+	return UpdateWorkflowDocument(&i.XDWDocument, i.XDWDefinition, i.XDWEvents.Events, i.author(), i.Now(), newEventID)
+}
+
+// IsTaskOverdue returns true if the transaction Task_ID task is overdue at the clock time
+func (i *Transaction) IsTaskOverdue() bool {
+	return IsTaskOverdue(i.XDWDocument, i.XDWDefinition, i.Task_ID, i.Now())
+}
+
+// GetTaskCompleteByDate returns the complete by time of the transaction Task_ID task
+func (i *Transaction) GetTaskCompleteByDate() time.Time {
+	return TaskCompleteBy(i.XDWDocument, i.XDWDefinition, i.Task_ID)
+}
+
+// GetTaskDuration returns the pretty printed duration of the transaction Task_ID task at the clock time
+func (i *Transaction) GetTaskDuration() string {
+	return tukutil.PrettyPrintDuration(TaskDuration(i.XDWDocument, i.Task_ID, i.Now()))
+}
+
+// GetTaskTimeRemaining returns the pretty printed time remaining until the transaction Task_ID task complete by time, or "0" if it has passed
+func (i *Transaction) GetTaskTimeRemaining() string {
+	return timeRemaining(i.Now(), i.GetTaskCompleteByDate())
+}
+
+// GetWorkflowCompleteByDate returns the complete by time of the workflow
+func (i *Transaction) GetWorkflowCompleteByDate() time.Time {
+	return WorkflowCompleteBy(i.XDWDocument, i.XDWDefinition)
+}
+
+// GetWorkflowTimeRemaining returns the pretty printed time remaining until the workflow complete by time, or "0" if it has passed
+func (i *Transaction) GetWorkflowTimeRemaining() string {
+	return timeRemaining(i.Now(), i.GetWorkflowCompleteByDate())
+}
+
+// SetWorkflowDuration sets the XDWState workflow duration at the clock time
+func (i *Transaction) SetWorkflowDuration() {
+	i.XDWState.WorkflowDuration = WorkflowDuration(i.XDWDocument, i.Now())
+	i.XDWState.PrettyWorkflowDuration = tukutil.PrettyPrintDuration(i.XDWState.WorkflowDuration)
+}
+
+// IsWorkflowTargetMissed returns true if the workflow was closed after its complete by time
+func (i *Transaction) IsWorkflowTargetMissed() bool {
+	return IsWorkflowTargetMissed(i.XDWDocument, i.XDWDefinition, i.Now())
+}
+
+// IsWorkflowEscalated returns true if the clock time is after the workflow expiration time
+func (i *Transaction) IsWorkflowEscalated() bool {
+	return IsWorkflowEscalated(i.XDWDocument, i.XDWDefinition, i.Now())
+}
+
+// SetXDWStates sets the XDWState and XDWTaskStates of the transaction XDWDocument at the clock time
+func (i *Transaction) SetXDWStates() {
+	i.XDWState.Created = i.XDWDocument.EffectiveTime.Value
+	i.XDWState.Status = i.XDWDocument.WorkflowStatus
+	i.XDWState.LatestWorkflowEventTime = LatestWorkflowEventTime(i.XDWDocument)
+	i.XDWState.CompleteBy = "Non Specified"
+	if i.XDWDefinition.CompleteByTime != "" {
+		i.XDWState.CompleteBy = tukclock.Format(i.GetWorkflowCompleteByDate())
+	}
+	i.XDWState.IsOverdue = i.IsWorkflowTargetMissed()
+	i.SetWorkflowDuration()
+	i.XDWTaskStates = []tukxdw.XDWTaskState{}
+	for k, task := range i.XDWDocument.TaskList.XDWTask {
+		if k >= len(i.XDWDefinition.Tasks) {
+			break
+		}
+		tstate := tukxdw.XDWTaskState{
+			TaskID:              k + 1,
+			Created:             task.TaskData.TaskDetails.CreatedTime,
+			CompleteBy:          tukclock.Format(TaskCompleteBy(i.XDWDocument, i.XDWDefinition, k+1)),
+			Status:              task.TaskData.TaskDetails.Status,
+			IsOverdue:           IsTaskOverdue(i.XDWDocument, i.XDWDefinition, k+1, i.Now()),
+			LatestTaskEventTime: tukxdw.GetLatestTaskEventTime(i.XDWDocument, task.TaskData.TaskDetails.ID),
+			TaskDuration:        TaskDuration(i.XDWDocument, k+1, i.Now()),
+		}
+		tstate.PrettyTaskDuration = tukutil.PrettyPrintDuration(tstate.TaskDuration)
+		if tstate.LatestTaskEventTime.After(i.XDWState.LatestTaskEventTime) {
+			i.XDWState.LatestTaskEventTime = tstate.LatestTaskEventTime
+		}
+		i.XDWTaskStates = append(i.XDWTaskStates, tstate)
+	}
+}
+
+// SetDashboardState sets the Dashboard counts and the open, closed, escalated, overdue and target met workflow sets for the
+// transaction Workflows at the clock time
+func (i *Transaction) SetDashboardState() error {
+	i.Dashboard = tukxdw.Dashboard{}
+	for _, wf := range i.Workflows.Workflows {
+		if len(wf.XDW_Doc) == 0 {
+			continue
+		}
+		doc := tukxdw.XDWWorkflowDocument{}
+		def := tukxdw.WorkflowDefinition{}
+		if err := xml.Unmarshal([]byte(wf.XDW_Doc), &doc); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		if err := json.Unmarshal([]byte(wf.XDW_Def), &def); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		UpdateDashboard(&i.Dashboard, doc, def, i.Now())
+		if doc.WorkflowStatus == tukcnst.OPEN {
+			i.OpenWorkflows.Workflows = append(i.OpenWorkflows.Workflows, wf)
+			i.OpenWorkflows.Count = i.OpenWorkflows.Count + 1
+			if IsWorkflowEscalated(doc, def, i.Now()) {
+				i.EscalteWorkflows.Workflows = append(i.EscalteWorkflows.Workflows, wf)
+				i.EscalteWorkflows.Count = i.EscalteWorkflows.Count + 1
+			}
+		} else {
+			i.ClosedWorkflows.Workflows = append(i.ClosedWorkflows.Workflows, wf)
+			i.ClosedWorkflows.Count = i.ClosedWorkflows.Count + 1
+		}
+		if IsWorkflowTargetMissed(doc, def, i.Now()) {
+			i.OverdueWorkflows.Workflows = append(i.OverdueWorkflows.Workflows, wf)
+			i.OverdueWorkflows.Count = i.OverdueWorkflows.Count + 1
+		} else if doc.WorkflowStatus == tukcnst.CLOSED {
+			i.TargetMetWorkflows.Workflows = append(i.TargetMetWorkflows.Workflows, wf)
+			i.TargetMetWorkflows.Count = i.TargetMetWorkflows.Count + 1
+		}
+		i.XDWDocument = doc
+		i.XDWDefinition = def
+	}
+	return nil
+}
+func (i *Transaction) author() Author {
+	author := Author{User: i.User, Org: i.Org, Role: i.Role}
+	if i.Store != nil {
+		author.OID = tukstore.GetIDMapsLocalId(i.Store, i.Org)
+		author.HomeCommunityId = tukstore.GetIDMapsLocalId(i.Store, tukcnst.XDSDOMAIN)
+	}
+	return author
+}
+func timeRemaining(now time.Time, completeBy time.Time) string {
+	if now.After(completeBy) {
+		return "0"
+	}
+	return tukutil.PrettyPrintDuration(completeBy.Sub(now))
+}
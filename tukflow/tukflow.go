@@ -0,0 +1,392 @@
+// Package tukflow implements the IHE XDW content creator and content updater logic, and the workflow deadline and dashboard
+// state calculations, as functions of an explicit time. It performs no database, broker or http calls so it can be used to
+// evaluate workflows at historical or simulated points in time.
+//
+// Task ID's passed to the deadline functions are the 1 based XDW task ID's, as used by tukxdw.Transaction.
+package tukflow
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+
+	"tukxdw-client/tukclock"
+	"tukxdw-client/tukstore"
+)
+
+const (
+	TRANSITION_TASK     = "task"
+	TRANSITION_WORKFLOW = "workflow"
+)
+
+// Author identifies the user creating or updating a workflow. OID is the local ID of the users organisation and HomeCommunityId
+// the local ID of the XDS domain, both of which tukxdw obtains from the idmaps table
+type Author struct {
+	User            string
+	Org             string
+	Role            string
+	OID             string
+	HomeCommunityId string
+}
+
+// Transition records a change of status of a workflow task, or of the workflow when TaskID is 0
+type Transition struct {
+	Kind    string
+	TaskID  int
+	Name    string
+	From    string
+	To      string
+	Time    string
+	EventID int64
+}
+
+// EventIDFunc returns a new event ID for a workflow task. tukxdw persists an event in the events table to obtain the ID
+type EventIDFunc func(expression string, taskid int) int64
+
+// CreateWorkflowDocument returns a new XDW workflow document for the definition, created at the given time with all tasks in CREATED status
+func CreateWorkflowDocument(def tukxdw.WorkflowDefinition, pathway string, nhs string, author Author, created time.Time, newEventID EventIDFunc) tukxdw.XDWWorkflowDocument {
+	var doc tukxdw.XDWWorkflowDocument
+	var wfid = tukutil.Newid()
+	var effectiveTime = tukclock.Format(created)
+	doc.Xdw = tukcnst.XDWNameSpace
+	doc.Hl7 = tukcnst.HL7NameSpace
+	doc.WsHt = tukcnst.WHTNameSpace
+	doc.Xsi = tukcnst.XMLNS_XSI
+	doc.XMLName.Local = tukcnst.XDWNameLocal
+	doc.SchemaLocation = tukcnst.WorkflowDocumentSchemaLocation
+	doc.ID.Root = strings.ReplaceAll(tukcnst.WorkflowInstanceId, "^", "")
+	doc.ID.Extension = wfid
+	doc.ID.AssigningAuthorityName = strings.ToUpper(author.Org)
+	doc.EffectiveTime.Value = effectiveTime
+	doc.ConfidentialityCode.Code = def.Confidentialitycode
+	doc.Patient.ID.Root = tukcnst.NHS_OID_DEFAULT
+	doc.Patient.ID.Extension = nhs
+	doc.Patient.ID.AssigningAuthorityName = "NHS"
+	doc.Author.AssignedAuthor.ID.Root = author.OID
+	doc.Author.AssignedAuthor.ID.Extension = strings.ToUpper(author.Org)
+	doc.Author.AssignedAuthor.ID.AssigningAuthorityName = author.OID
+	doc.Author.AssignedAuthor.AssignedPerson.Name.Family = author.User
+	doc.Author.AssignedAuthor.AssignedPerson.Name.Prefix = author.Role
+	doc.WorkflowInstanceId = wfid + tukcnst.WorkflowInstanceId
+	doc.WorkflowDocumentSequenceNumber = "1"
+	doc.WorkflowStatus = tukcnst.OPEN
+	doc.WorkflowDefinitionReference = strings.ToUpper(pathway)
+	for _, t := range def.Tasks {
+		task := tukxdw.XDWTask{}
+		task.TaskData.TaskDetails.ID = t.ID
+		task.TaskData.TaskDetails.TaskType = t.Tasktype
+		task.TaskData.TaskDetails.Name = t.Name
+		task.TaskData.TaskDetails.ActualOwner = t.ActualOwner
+		task.TaskData.TaskDetails.CreatedBy = author.Role + " " + author.User
+		task.TaskData.TaskDetails.CreatedTime = effectiveTime
+		task.TaskData.TaskDetails.RenderingMethodExists = "false"
+		task.TaskData.TaskDetails.LastModifiedTime = effectiveTime
+		task.TaskData.Description = t.Description
+		task.TaskData.TaskDetails.Status = tukcnst.CREATED
+		for _, inp := range t.Input {
+			docinput := tukxdw.Input{}
+			docinput.Part.Name = inp.Name
+			docinput.Part.AttachmentInfo.Name = inp.Name
+			docinput.Part.AttachmentInfo.AccessType = inp.AccessType
+			docinput.Part.AttachmentInfo.ContentType = inp.Contenttype
+			docinput.Part.AttachmentInfo.ContentCategory = tukcnst.MEDIA_TYPES
+			task.TaskData.Input = append(task.TaskData.Input, docinput)
+		}
+		for _, outp := range t.Output {
+			docoutput := tukxdw.Output{}
+			docoutput.Part.Name = outp.Name
+			docoutput.Part.AttachmentInfo.Name = outp.Name
+			docoutput.Part.AttachmentInfo.AccessType = outp.AccessType
+			docoutput.Part.AttachmentInfo.ContentType = outp.Contenttype
+			docoutput.Part.AttachmentInfo.ContentCategory = tukcnst.MEDIA_TYPES
+			task.TaskData.Output = append(task.TaskData.Output, docoutput)
+		}
+		tev := tukxdw.TaskEvent{}
+		tev.EventTime = effectiveTime
+		tev.ID = tukutil.GetStringFromInt(int(newEventID(t.Name, tukutil.GetIntFromString(t.ID))))
+		tev.Identifier = t.ID
+		tev.EventType = tukcnst.XDW_TASKEVENTTYPE_CREATED
+		tev.Status = tukcnst.XDW_TASKEVENTTYPE_COMPLETE
+		task.TaskEventHistory.TaskEvent = append(task.TaskEventHistory.TaskEvent, tev)
+		doc.TaskList.XDWTask = append(doc.TaskList.XDWTask, task)
+	}
+	docevent := tukxdw.DocumentEvent{}
+	docevent.Author = author.User + " " + author.Role
+	docevent.TaskEventIdentifier = "1"
+	docevent.EventTime = effectiveTime
+	docevent.EventType = tukcnst.XDW_TASKEVENTTYPE_CREATED
+	docevent.ActualStatus = tukcnst.OPEN
+	doc.WorkflowStatusHistory.DocumentEvent = append(doc.WorkflowStatusHistory.DocumentEvent, docevent)
+	log.Printf("%s Created new %s Workflow for Patient %s", author.User, doc.WorkflowDefinitionReference, nhs)
+	return doc
+}
+
+// UpdateWorkflowDocument applies the events to the workflow document tasks with matching input or output parts, sets the status of
+// tasks whose completion behaviour is met and closes the workflow if the workflow completion behaviour is met. It returns the
+// resulting task and workflow status transitions
+func UpdateWorkflowDocument(doc *tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition, events []tukdbint.Event, author Author, now time.Time, newEventID EventIDFunc) []Transition {
+	var transitions []Transition
+	for _, ev := range events {
+		if ev.Id == 0 {
+			continue
+		}
+		for k := range doc.TaskList.XDWTask {
+			task := &doc.TaskList.XDWTask[k]
+			from := task.TaskData.TaskDetails.Status
+			matched := false
+			for inp := range task.TaskData.Input {
+				if ev.Expression == task.TaskData.Input[inp].Part.Name && !isRegistered(task.TaskData.Input[inp].Part, ev) {
+					attach(task, &task.TaskData.Input[inp].Part, ev, author)
+					matched = true
+				}
+			}
+			for oup := range task.TaskData.Output {
+				if ev.Expression == task.TaskData.Output[oup].Part.Name && !isRegistered(task.TaskData.Output[oup].Part, ev) {
+					attach(task, &task.TaskData.Output[oup].Part, ev, author)
+					matched = true
+				}
+			}
+			if matched {
+				log.Printf("Updated Workflow Task %s with Event ID %v", task.TaskData.TaskDetails.ID, ev.Id)
+				task.TaskEventHistory.TaskEvent = append(task.TaskEventHistory.TaskEvent, tukxdw.TaskEvent{
+					ID:         tukutil.GetStringFromInt(int(ev.Id)),
+					EventTime:  ev.Creationtime,
+					Identifier: task.TaskData.TaskDetails.ID,
+					EventType:  task.TaskData.TaskDetails.TaskType,
+					Status:     tukcnst.COMPLETE,
+				})
+				wfseqnum, _ := strconv.ParseInt(doc.WorkflowDocumentSequenceNumber, 0, 0)
+				doc.WorkflowDocumentSequenceNumber = strconv.Itoa(int(wfseqnum + 1))
+				doc.WorkflowStatusHistory.DocumentEvent = append(doc.WorkflowStatusHistory.DocumentEvent, tukxdw.DocumentEvent{
+					Author:              ev.User + " " + ev.Org + " " + ev.Role,
+					TaskEventIdentifier: task.TaskData.TaskDetails.ID,
+					EventTime:           ev.Creationtime,
+					EventType:           task.TaskData.TaskDetails.TaskType,
+					PreviousStatus:      latestDocumentStatus(*doc),
+					ActualStatus:        tukcnst.IN_PROGRESS,
+				})
+				if from != task.TaskData.TaskDetails.Status {
+					transitions = append(transitions, Transition{Kind: TRANSITION_TASK, TaskID: k + 1, Name: task.TaskData.TaskDetails.Name, From: from, To: task.TaskData.TaskDetails.Status, Time: ev.Creationtime, EventID: ev.Id})
+				}
+			}
+		}
+	}
+	for k := range doc.TaskList.XDWTask {
+		task := &doc.TaskList.XDWTask[k]
+		if task.TaskData.TaskDetails.Status != tukcnst.COMPLETE && k < len(def.Tasks) {
+			if tukxdw.IsTaskCompleteBehaviorMet(*doc, def, k) {
+				transitions = append(transitions, Transition{Kind: TRANSITION_TASK, TaskID: k + 1, Name: task.TaskData.TaskDetails.Name, From: task.TaskData.TaskDetails.Status, To: tukcnst.COMPLETE, Time: task.TaskData.TaskDetails.LastModifiedTime})
+				task.TaskData.TaskDetails.Status = tukcnst.COMPLETE
+			}
+		}
+	}
+	if doc.WorkflowStatus != tukcnst.CLOSED && tukxdw.IsWorkflowCompleteBehaviorMet(*doc, def, doc.Patient.ID.Extension) {
+		closed := tukclock.Format(now)
+		evid := newEventID(tukcnst.COMPLETE, 0)
+		doc.WorkflowStatusHistory.DocumentEvent = append(doc.WorkflowStatusHistory.DocumentEvent, tukxdw.DocumentEvent{
+			Author:              author.User,
+			TaskEventIdentifier: strconv.Itoa(int(evid)),
+			EventTime:           closed,
+			EventType:           tukcnst.COMPLETE,
+			PreviousStatus:      latestDocumentStatus(*doc),
+			ActualStatus:        tukcnst.COMPLETE,
+		})
+		for k := range doc.TaskList.XDWTask {
+			task := &doc.TaskList.XDWTask[k]
+			if task.TaskData.TaskDetails.Status != tukcnst.COMPLETE {
+				transitions = append(transitions, Transition{Kind: TRANSITION_TASK, TaskID: k + 1, Name: task.TaskData.TaskDetails.Name, From: task.TaskData.TaskDetails.Status, To: tukcnst.COMPLETE, Time: closed})
+				task.TaskData.TaskDetails.Status = tukcnst.COMPLETE
+			}
+		}
+		transitions = append(transitions, Transition{Kind: TRANSITION_WORKFLOW, Name: doc.WorkflowDefinitionReference, From: doc.WorkflowStatus, To: tukcnst.CLOSED, Time: closed, EventID: evid})
+		doc.WorkflowStatus = tukcnst.CLOSED
+		log.Println("Closed Workflow. Total Workflow Document Events " + strconv.Itoa(len(doc.WorkflowStatusHistory.DocumentEvent)))
+	}
+	return transitions
+}
+
+// TaskCompleteBy returns the time the task must be completed by. Tasks without a complete by time inherit the workflow complete by time
+func TaskCompleteBy(doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition, task int) time.Time {
+	if def.Tasks[task-1].CompleteByTime == "" {
+		return WorkflowCompleteBy(doc, def)
+	}
+	return tukutil.OHT_FutureDate(tukutil.GetTimeFromString(doc.EffectiveTime.Value), def.Tasks[task-1].CompleteByTime)
+}
+
+// IsTaskOverdue returns true if the task complete by time is before now and the task was not completed before it
+func IsTaskOverdue(doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition, task int, now time.Time) bool {
+	completeBy := TaskCompleteBy(doc, def, task)
+	if now.Before(completeBy) {
+		return false
+	}
+	if doc.TaskList.XDWTask[task-1].TaskData.TaskDetails.Status == tukcnst.COMPLETE {
+		return !tukutil.GetTimeFromString(doc.TaskList.XDWTask[task-1].TaskData.TaskDetails.LastModifiedTime).Before(completeBy)
+	}
+	return true
+}
+
+// TaskDuration returns the time from workflow creation to the latest task event for complete tasks, or to now for incomplete tasks
+func TaskDuration(doc tukxdw.XDWWorkflowDocument, task int, now time.Time) time.Duration {
+	created := tukutil.GetTimeFromString(doc.EffectiveTime.Value)
+	if doc.TaskList.XDWTask[task-1].TaskData.TaskDetails.Status == tukcnst.COMPLETE {
+		return tukutil.GetTimeFromString(doc.TaskList.XDWTask[task-1].TaskData.TaskDetails.LastModifiedTime).Sub(created)
+	}
+	return now.Sub(created)
+}
+
+// WorkflowCompleteBy returns the time the workflow must be completed by
+func WorkflowCompleteBy(doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition) time.Time {
+	return tukutil.OHT_FutureDate(tukutil.GetTimeFromString(doc.EffectiveTime.Value), def.CompleteByTime)
+}
+
+// WorkflowEscalateBy returns the time an open workflow is escalated. The zero time is returned if the definition has no expiration time
+func WorkflowEscalateBy(doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition) time.Time {
+	if def.ExpirationTime == "" {
+		return time.Time{}
+	}
+	return tukutil.OHT_FutureDate(tukutil.GetTimeFromString(doc.EffectiveTime.Value), def.ExpirationTime)
+}
+
+// IsWorkflowEscalated returns true if the definition has an expiration time and now is after it
+func IsWorkflowEscalated(doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition, now time.Time) bool {
+	if def.ExpirationTime == "" {
+		return false
+	}
+	return now.After(WorkflowEscalateBy(doc, def))
+}
+
+// IsWorkflowTargetMissed returns true if the workflow is closed and its latest event was after the workflow complete by time.
+// Open workflows are reported as escalated rather than target missed
+func IsWorkflowTargetMissed(doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition, now time.Time) bool {
+	if def.CompleteByTime == "" {
+		return false
+	}
+	completeBy := WorkflowCompleteBy(doc, def)
+	if !now.After(completeBy) || doc.WorkflowStatus != tukcnst.CLOSED {
+		return false
+	}
+	return LatestWorkflowEventTime(doc).After(completeBy)
+}
+
+// LatestWorkflowEventTime returns the time of the latest task event in the workflow document
+func LatestWorkflowEventTime(doc tukxdw.XDWWorkflowDocument) time.Time {
+	latest := tukutil.GetTimeFromString(doc.EffectiveTime.Value)
+	for _, task := range doc.TaskList.XDWTask {
+		for _, taskevent := range task.TaskEventHistory.TaskEvent {
+			if taskevent.EventTime != "" {
+				if etime := tukutil.GetTimeFromString(taskevent.EventTime); etime.After(latest) {
+					latest = etime
+				}
+			}
+		}
+	}
+	return latest
+}
+
+// WorkflowDuration returns the time from workflow creation to the latest workflow event for closed workflows, or to now for open workflows
+func WorkflowDuration(doc tukxdw.XDWWorkflowDocument, now time.Time) time.Duration {
+	created := tukutil.GetTimeFromString(doc.EffectiveTime.Value)
+	if doc.WorkflowStatus == tukcnst.CLOSED {
+		return LatestWorkflowEventTime(doc).Sub(created)
+	}
+	return now.Sub(created)
+}
+
+// UpdateDashboard adds the workflow to the dashboard counts using the same classification as tukxdw.Transaction.SetDashboardState
+func UpdateDashboard(dashboard *tukxdw.Dashboard, doc tukxdw.XDWWorkflowDocument, def tukxdw.WorkflowDefinition, now time.Time) {
+	dashboard.Total = dashboard.Total + 1
+	if doc.WorkflowStatus == tukcnst.OPEN {
+		dashboard.InProgress = dashboard.InProgress + 1
+		if IsWorkflowEscalated(doc, def, now) {
+			dashboard.Escalated = dashboard.Escalated + 1
+		}
+	} else {
+		dashboard.Complete = dashboard.Complete + 1
+	}
+	if IsWorkflowTargetMissed(doc, def, now) {
+		dashboard.TargetMissed = dashboard.TargetMissed + 1
+	} else if doc.WorkflowStatus == tukcnst.CLOSED {
+		dashboard.TargetMet = dashboard.TargetMet + 1
+	}
+}
+
+// TaskAck is the acknowledgement state of a workflow task, for the events in its task event history
+type TaskAck struct {
+	TaskID         int
+	EventIDs       []int64
+	Unacknowledged int
+	Acks           []tukdbint.EventAck
+}
+
+// TaskEventIDs returns the ID's of the events in the task event history of the task, other than its creation event
+func TaskEventIDs(doc tukxdw.XDWWorkflowDocument, task int) []int64 {
+	var ids []int64
+	if task < 1 || task > len(doc.TaskList.XDWTask) {
+		return ids
+	}
+	for _, taskevent := range doc.TaskList.XDWTask[task-1].TaskEventHistory.TaskEvent {
+		if taskevent.EventType == tukcnst.XDW_TASKEVENTTYPE_CREATED {
+			continue
+		}
+		if id, err := strconv.ParseInt(taskevent.ID, 10, 64); err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// TaskAcks returns the TaskAck of each workflow task for the event acknowledgements
+func TaskAcks(doc tukxdw.XDWWorkflowDocument, acks []tukdbint.EventAck) []TaskAck {
+	var taskacks []TaskAck
+	for k := range doc.TaskList.XDWTask {
+		taskack := TaskAck{TaskID: k + 1, EventIDs: TaskEventIDs(doc, k+1)}
+		for _, id := range taskack.EventIDs {
+			acked := false
+			for _, ack := range acks {
+				if ack.EventID == id {
+					taskack.Acks = append(taskack.Acks, ack)
+					acked = true
+				}
+			}
+			if !acked {
+				taskack.Unacknowledged = taskack.Unacknowledged + 1
+			}
+		}
+		taskacks = append(taskacks, taskack)
+	}
+	return taskacks
+}
+func attach(task *tukxdw.XDWTask, part *tukxdw.Part, ev tukdbint.Event, author Author) {
+	part.AttachmentInfo.AttachedTime = ev.Creationtime
+	part.AttachmentInfo.AttachedBy = ev.User + " " + ev.Org + " " + ev.Role
+	part.AttachmentInfo.HomeCommunityId = author.HomeCommunityId
+	if strings.HasSuffix(part.AttachmentInfo.AccessType, tukcnst.XDS_REGISTERED) {
+		part.AttachmentInfo.Identifier = ev.XdsDocEntryUid
+	} else {
+		part.AttachmentInfo.Identifier = tukstore.EVENT_ATTACHMENT + tukutil.GetStringFromInt(int(ev.Id))
+	}
+	task.TaskData.TaskDetails.LastModifiedTime = ev.Creationtime
+	task.TaskData.TaskDetails.ActualOwner = ev.User + " " + ev.Org + " " + ev.Role
+	task.TaskData.TaskDetails.Status = tukcnst.IN_PROGRESS
+	if task.TaskData.TaskDetails.ActivationTime == "" {
+		task.TaskData.TaskDetails.ActivationTime = ev.Creationtime
+	}
+}
+func isRegistered(part tukxdw.Part, ev tukdbint.Event) bool {
+	if strings.HasSuffix(part.AttachmentInfo.AccessType, tukcnst.XDS_REGISTERED) {
+		return part.AttachmentInfo.Identifier != "" && part.AttachmentInfo.Identifier == ev.XdsDocEntryUid
+	}
+	return part.AttachmentInfo.Identifier == tukstore.EVENT_ATTACHMENT+tukutil.GetStringFromInt(int(ev.Id))
+}
+func latestDocumentStatus(doc tukxdw.XDWWorkflowDocument) string {
+	if len(doc.WorkflowStatusHistory.DocumentEvent) == 0 {
+		return ""
+	}
+	return doc.WorkflowStatusHistory.DocumentEvent[len(doc.WorkflowStatusHistory.DocumentEvent)-1].ActualStatus
+}
@@ -0,0 +1,138 @@
+package tukflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukxdw"
+
+	"tukxdw-client/tukclock"
+)
+
+// testStart is the fake clock time workflows are created at in the tests
+var testStart = time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC)
+
+func testDefinition(t *testing.T, expiration string) tukxdw.WorkflowDefinition {
+	t.Helper()
+	def := tukxdw.WorkflowDefinition{}
+	err := json.Unmarshal([]byte(`{"ref": "lab", "name": "Lab Test", "completebytime": "day(1)", "expirationtime": "`+expiration+`",
+		"completionBehavior": [{"completion": {"condition": "task(2)"}}], "tasks": [
+		{"id": "1", "name": "Request", "completebytime": "hour(2)",
+			"completionBehavior": [{"completion": {"condition": "output(Lab_Request_Claimed)"}}],
+			"input": [{"name": "Lab_Request", "accesstype": "XDSregistered"}],
+			"output": [{"name": "Lab_Request_Claimed", "accesstype": "XDSregistered"}]},
+		{"id": "2", "name": "Result",
+			"completionBehavior": [{"completion": {"condition": "output(Lab_Result)"}}],
+			"output": [{"name": "Lab_Result", "accesstype": "XDSregistered"}]}]}`), &def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
+
+// testDocument returns a new workflow document created at the clock time
+func testDocument(def tukxdw.WorkflowDefinition, clock tukclock.Clock) tukxdw.XDWWorkflowDocument {
+	var id int64
+	return CreateWorkflowDocument(def, "lab", "9999999468", Author{User: "u", Org: "o", Role: "r"}, clock.Now(), func(string, int) int64 {
+		id = id + 1
+		return id
+	})
+}
+
+// completeTask sets the task status to COMPLETE at the clock time, with a task event
+func completeTask(doc *tukxdw.XDWWorkflowDocument, task int, clock tukclock.Clock) {
+	details := &doc.TaskList.XDWTask[task-1].TaskData.TaskDetails
+	details.Status = tukcnst.COMPLETE
+	details.LastModifiedTime = tukclock.TimeNow(clock)
+	history := &doc.TaskList.XDWTask[task-1].TaskEventHistory
+	history.TaskEvent = append(history.TaskEvent, tukxdw.TaskEvent{EventTime: tukclock.TimeNow(clock), EventType: tukcnst.COMPLETE})
+}
+
+func TestIsTaskOverdue(t *testing.T) {
+	tests := []struct {
+		name      string
+		task      int
+		completed time.Duration
+		at        time.Duration
+		want      bool
+	}{
+		{name: "open before complete by", task: 1, at: time.Hour, want: false},
+		{name: "open after complete by", task: 1, at: 3 * time.Hour, want: true},
+		{name: "completed before complete by", task: 1, completed: time.Hour, at: 3 * time.Hour, want: false},
+		{name: "completed after complete by", task: 1, completed: 150 * time.Minute, at: 3 * time.Hour, want: true},
+		{name: "inherits workflow complete by", task: 2, at: 3 * time.Hour, want: false},
+		{name: "open after workflow complete by", task: 2, at: 25 * time.Hour, want: true},
+	}
+	def := testDefinition(t, "")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := tukclock.NewFake(testStart)
+			doc := testDocument(def, clock)
+			if test.completed > 0 {
+				clock.Set(testStart.Add(test.completed))
+				completeTask(&doc, test.task, clock)
+			}
+			clock.Set(testStart.Add(test.at))
+			if got := IsTaskOverdue(doc, def, test.task, clock.Now()); got != test.want {
+				t.Errorf("IsTaskOverdue = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsWorkflowEscalated(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration string
+		at         time.Duration
+		want       bool
+	}{
+		{name: "no expiration time", at: 48 * time.Hour, want: false},
+		{name: "before expiration time", expiration: "hour(12)", at: 11 * time.Hour, want: false},
+		{name: "after expiration time", expiration: "hour(12)", at: 13 * time.Hour, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def := testDefinition(t, test.expiration)
+			clock := tukclock.NewFake(testStart)
+			doc := testDocument(def, clock)
+			clock.Advance(test.at)
+			if got := IsWorkflowEscalated(doc, def, clock.Now()); got != test.want {
+				t.Errorf("IsWorkflowEscalated = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsWorkflowTargetMissed(t *testing.T) {
+	tests := []struct {
+		name   string
+		closed time.Duration
+		at     time.Duration
+		want   bool
+	}{
+		{name: "open after complete by", at: 25 * time.Hour, want: false},
+		{name: "closed before complete by", closed: 2 * time.Hour, at: 25 * time.Hour, want: false},
+		{name: "closed after complete by", closed: 26 * time.Hour, at: 27 * time.Hour, want: true},
+		{name: "clock before complete by", closed: 2 * time.Hour, at: 3 * time.Hour, want: false},
+	}
+	def := testDefinition(t, "")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := tukclock.NewFake(testStart)
+			doc := testDocument(def, clock)
+			if test.closed > 0 {
+				clock.Set(testStart.Add(test.closed))
+				completeTask(&doc, 1, clock)
+				completeTask(&doc, 2, clock)
+				doc.WorkflowStatus = tukcnst.CLOSED
+			}
+			clock.Set(testStart.Add(test.at))
+			if got := IsWorkflowTargetMissed(doc, def, clock.Now()); got != test.want {
+				t.Errorf("IsWorkflowTargetMissed = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+// Package tukhtd converts XDW workflow definitions to and from OASIS WS-HumanTask (htd) task definitions.
+//
+// WS-HumanTask has no notion of XDW task inputs and outputs, task types or workflow level deadlines, so these are carried
+// in `xdwWorkflow` and `xdwTask` extension elements in the TUK namespace. Durations are exchanged as XPath duration
+// literals in `htd:for` deadline expressions, eg. 'P3D' for the OASIS Human Task api function day(3).
+package tukhtd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	HTDNameSpace            = "http://docs.oasis-open.org/ns/bpel4people/ws-humantask/200803"
+	TUKNameSpace            = "urn:tuk:xdw:2023"
+	DEADLINE_START_BY       = "startby"
+	DEADLINE_COMPLETE_BY    = "completeby"
+	DEADLINE_EXPIRATION     = "expiration"
+	ESCALATION_EXPIRATION   = "expire"
+	TARGET_NAMESPACE_PREFIX = "urn:tuk:xdw:pathway:"
+)
+
+type HumanInteractions struct {
+	XMLName         xml.Name    `xml:"http://docs.oasis-open.org/ns/bpel4people/ws-humantask/200803 humanInteractions"`
+	TargetNamespace string      `xml:"targetNamespace,attr"`
+	Documentation   string      `xml:"documentation,omitempty"`
+	XDWWorkflow     XDWWorkflow `xml:"urn:tuk:xdw:2023 xdwWorkflow"`
+	Tasks           []HumanTask `xml:"tasks>task"`
+}
+type XDWWorkflow struct {
+	Ref                 string             `xml:"ref,attr"`
+	Name                string             `xml:"name,attr"`
+	Confidentialitycode string             `xml:"confidentialitycode,attr"`
+	StartByTime         string             `xml:"startbytime,attr,omitempty"`
+	CompleteByTime      string             `xml:"completebytime,attr,omitempty"`
+	ExpirationTime      string             `xml:"expirationtime,attr,omitempty"`
+	CompletionBehavior  CompletionBehavior `xml:"completionBehavior"`
+}
+type HumanTask struct {
+	Name                 string               `xml:"name,attr"`
+	Documentation        string               `xml:"documentation,omitempty"`
+	XDWTask              XDWTask              `xml:"urn:tuk:xdw:2023 xdwTask"`
+	PeopleAssignments    PeopleAssignments    `xml:"peopleAssignments"`
+	CompletionBehavior   CompletionBehavior   `xml:"completionBehavior"`
+	PresentationElements PresentationElements `xml:"presentationElements"`
+	Deadlines            *Deadlines           `xml:"deadlines,omitempty"`
+}
+type XDWTask struct {
+	ID          string    `xml:"id,attr"`
+	TaskType    string    `xml:"tasktype,attr"`
+	ActualOwner string    `xml:"actualowner,attr,omitempty"`
+	IsSkipable  bool      `xml:"isskipable,attr"`
+	Input       []XDWPart `xml:"input"`
+	Output      []XDWPart `xml:"output"`
+}
+type XDWPart struct {
+	Name        string `xml:"name,attr"`
+	ContentType string `xml:"contenttype,attr"`
+	AccessType  string `xml:"accesstype,attr"`
+}
+type PeopleAssignments struct {
+	PotentialOwners []PotentialOwners `xml:"potentialOwners"`
+}
+type PotentialOwners struct {
+	Users []string `xml:"from>literal>organizationalEntity>users>user"`
+}
+type CompletionBehavior struct {
+	Completion []Completion `xml:"completion"`
+}
+type Completion struct {
+	Condition string `xml:"condition"`
+}
+type PresentationElements struct {
+	Name        string `xml:"name"`
+	Subject     string `xml:"subject,omitempty"`
+	Description string `xml:"description"`
+}
+type Deadlines struct {
+	StartDeadline      []Deadline `xml:"startDeadline"`
+	CompletionDeadline []Deadline `xml:"completionDeadline"`
+}
+type Deadline struct {
+	Name       string      `xml:"name,attr"`
+	For        string      `xml:"for"`
+	Escalation *Escalation `xml:"escalation,omitempty"`
+}
+type Escalation struct {
+	Name string `xml:"name,attr"`
+}
+
+// xdwDefinition mirrors the json shape of tukxdw.WorkflowDefinition, whose task and completion types are anonymous
+type xdwDefinition struct {
+	Ref                 string          `json:"ref"`
+	Name                string          `json:"name"`
+	Confidentialitycode string          `json:"confidentialitycode"`
+	StartByTime         string          `json:"startbytime"`
+	CompleteByTime      string          `json:"completebytime"`
+	ExpirationTime      string          `json:"expirationtime"`
+	CompletionBehavior  []xdwCompletion `json:"completionBehavior"`
+	Tasks               []xdwTask       `json:"tasks"`
+}
+type xdwCompletion struct {
+	Completion struct {
+		Condition string `json:"condition"`
+	} `json:"completion"`
+}
+type xdwTask struct {
+	ID                 string          `json:"id"`
+	Tasktype           string          `json:"tasktype"`
+	Name               string          `json:"name"`
+	Description        string          `json:"description"`
+	ActualOwner        string          `json:"actualowner"`
+	ExpirationTime     string          `json:"expirationtime"`
+	StartByTime        string          `json:"startbytime"`
+	CompleteByTime     string          `json:"completebytime"`
+	IsSkipable         bool            `json:"isskipable"`
+	PotentialOwners    []xdwOwner      `json:"potentialOwners"`
+	CompletionBehavior []xdwCompletion `json:"completionBehavior"`
+	Input              []xdwPart       `json:"input,omitempty"`
+	Output             []xdwPart       `json:"output,omitempty"`
+}
+type xdwOwner struct {
+	OrganizationalEntity struct {
+		User string `json:"user"`
+	} `json:"organizationalEntity"`
+}
+type xdwPart struct {
+	Name        string `json:"name"`
+	Contenttype string `json:"contenttype"`
+	AccessType  string `json:"accesstype"`
+}
+
+// Export returns the WS-HumanTask htd:humanInteractions xml for the provided XDW workflow definition
+func Export(def tukxdw.WorkflowDefinition) ([]byte, error) {
+	xdwdef := xdwDefinition{}
+	if err := convert(def, &xdwdef); err != nil {
+		return nil, err
+	}
+	htd, err := newHumanInteractions(xdwdef)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	htdbytes, err := xml.MarshalIndent(htd, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	log.Printf("Exported %s Workflow Definition with %v Tasks as WS-HumanTask xml", xdwdef.Ref, len(htd.Tasks))
+	return append([]byte(xml.Header), htdbytes...), nil
+}
+
+// Import parses WS-HumanTask htd:humanInteractions xml and returns the equivalent XDW workflow definition
+func Import(htdxml []byte) (tukxdw.WorkflowDefinition, error) {
+	def := tukxdw.WorkflowDefinition{}
+	htd := HumanInteractions{}
+	if err := xml.Unmarshal(htdxml, &htd); err != nil {
+		log.Println(err.Error())
+		return def, err
+	}
+	xdwdef, err := htd.newXDWDefinition()
+	if err != nil {
+		log.Println(err.Error())
+		return def, err
+	}
+	err = convert(xdwdef, &def)
+	if err == nil {
+		log.Printf("Imported %s Workflow Definition with %v Tasks from WS-HumanTask xml", def.Ref, len(def.Tasks))
+	}
+	return def, err
+}
+
+// ExportJSON returns the WS-HumanTask xml for a json XDW workflow definition, as found in config/xdwconfig/*_def.json
+func ExportJSON(defjson []byte) ([]byte, error) {
+	def := tukxdw.WorkflowDefinition{}
+	if err := json.Unmarshal(defjson, &def); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return Export(def)
+}
+
+// ImportJSON returns the json XDW workflow definition for WS-HumanTask xml
+func ImportJSON(htdxml []byte) ([]byte, error) {
+	def, err := Import(htdxml)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(def, "", "  ")
+}
+func newHumanInteractions(def xdwDefinition) (HumanInteractions, error) {
+	htd := HumanInteractions{
+		TargetNamespace: TARGET_NAMESPACE_PREFIX + def.Ref,
+		Documentation:   def.Name,
+		XDWWorkflow: XDWWorkflow{
+			Ref:                 def.Ref,
+			Name:                def.Name,
+			Confidentialitycode: def.Confidentialitycode,
+			StartByTime:         def.StartByTime,
+			CompleteByTime:      def.CompleteByTime,
+			ExpirationTime:      def.ExpirationTime,
+			CompletionBehavior:  newCompletionBehavior(def.CompletionBehavior),
+		},
+	}
+	for _, task := range def.Tasks {
+		httask := HumanTask{
+			Name:          task.Name,
+			Documentation: task.Description,
+			XDWTask: XDWTask{
+				ID:          task.ID,
+				TaskType:    task.Tasktype,
+				ActualOwner: task.ActualOwner,
+				IsSkipable:  task.IsSkipable,
+			},
+			CompletionBehavior: newCompletionBehavior(task.CompletionBehavior),
+			PresentationElements: PresentationElements{
+				Name:        task.Name,
+				Description: task.Description,
+			},
+		}
+		for _, owner := range task.PotentialOwners {
+			httask.PeopleAssignments.PotentialOwners = append(httask.PeopleAssignments.PotentialOwners, PotentialOwners{Users: []string{owner.OrganizationalEntity.User}})
+		}
+		for _, inp := range task.Input {
+			httask.XDWTask.Input = append(httask.XDWTask.Input, XDWPart{Name: inp.Name, ContentType: inp.Contenttype, AccessType: inp.AccessType})
+		}
+		for _, out := range task.Output {
+			httask.XDWTask.Output = append(httask.XDWTask.Output, XDWPart{Name: out.Name, ContentType: out.Contenttype, AccessType: out.AccessType})
+		}
+		deadlines := Deadlines{}
+		if task.StartByTime != "" {
+			dur, err := OHTToDuration(task.StartByTime)
+			if err != nil {
+				return htd, err
+			}
+			deadlines.StartDeadline = append(deadlines.StartDeadline, Deadline{Name: DEADLINE_START_BY, For: "'" + dur + "'"})
+		}
+		if task.CompleteByTime != "" {
+			dur, err := OHTToDuration(task.CompleteByTime)
+			if err != nil {
+				return htd, err
+			}
+			deadlines.CompletionDeadline = append(deadlines.CompletionDeadline, Deadline{Name: DEADLINE_COMPLETE_BY, For: "'" + dur + "'"})
+		}
+		if task.ExpirationTime != "" {
+			dur, err := OHTToDuration(task.ExpirationTime)
+			if err != nil {
+				return htd, err
+			}
+			deadlines.CompletionDeadline = append(deadlines.CompletionDeadline, Deadline{Name: DEADLINE_EXPIRATION, For: "'" + dur + "'", Escalation: &Escalation{Name: ESCALATION_EXPIRATION}})
+		}
+		if len(deadlines.StartDeadline) > 0 || len(deadlines.CompletionDeadline) > 0 {
+			httask.Deadlines = &deadlines
+		}
+		htd.Tasks = append(htd.Tasks, httask)
+	}
+	return htd, nil
+}
+func (i *HumanInteractions) newXDWDefinition() (xdwDefinition, error) {
+	def := xdwDefinition{
+		Ref:                 i.XDWWorkflow.Ref,
+		Name:                i.XDWWorkflow.Name,
+		Confidentialitycode: i.XDWWorkflow.Confidentialitycode,
+		StartByTime:         i.XDWWorkflow.StartByTime,
+		CompleteByTime:      i.XDWWorkflow.CompleteByTime,
+		ExpirationTime:      i.XDWWorkflow.ExpirationTime,
+		CompletionBehavior:  newXDWCompletions(i.XDWWorkflow.CompletionBehavior),
+	}
+	if def.Ref == "" {
+		def.Ref = strings.TrimPrefix(i.TargetNamespace, TARGET_NAMESPACE_PREFIX)
+	}
+	if def.Name == "" {
+		def.Name = i.Documentation
+	}
+	if def.Ref == "" {
+		return def, errors.New("unable to determine pathway. no xdwWorkflow ref or targetNamespace found")
+	}
+	for k, httask := range i.Tasks {
+		task := xdwTask{
+			ID:                 httask.XDWTask.ID,
+			Tasktype:           httask.XDWTask.TaskType,
+			Name:               httask.PresentationElements.Name,
+			Description:        httask.PresentationElements.Description,
+			ActualOwner:        httask.XDWTask.ActualOwner,
+			IsSkipable:         httask.XDWTask.IsSkipable,
+			CompletionBehavior: newXDWCompletions(httask.CompletionBehavior),
+		}
+		if task.ID == "" {
+			task.ID = strconv.Itoa(k + 1)
+		}
+		if task.Name == "" {
+			task.Name = httask.Name
+		}
+		if task.Description == "" {
+			task.Description = httask.Documentation
+		}
+		for _, owners := range httask.PeopleAssignments.PotentialOwners {
+			for _, user := range owners.Users {
+				owner := xdwOwner{}
+				owner.OrganizationalEntity.User = user
+				task.PotentialOwners = append(task.PotentialOwners, owner)
+			}
+		}
+		for _, inp := range httask.XDWTask.Input {
+			task.Input = append(task.Input, xdwPart{Name: inp.Name, Contenttype: inp.ContentType, AccessType: inp.AccessType})
+		}
+		for _, out := range httask.XDWTask.Output {
+			task.Output = append(task.Output, xdwPart{Name: out.Name, Contenttype: out.ContentType, AccessType: out.AccessType})
+		}
+		if httask.Deadlines != nil {
+			var err error
+			for _, deadline := range httask.Deadlines.StartDeadline {
+				if task.StartByTime, err = DurationToOHT(deadline.For); err != nil {
+					return def, err
+				}
+			}
+			for _, deadline := range httask.Deadlines.CompletionDeadline {
+				oht, err := DurationToOHT(deadline.For)
+				if err != nil {
+					return def, err
+				}
+				if deadline.Name == DEADLINE_EXPIRATION || deadline.Escalation != nil {
+					task.ExpirationTime = oht
+				} else {
+					task.CompleteByTime = oht
+				}
+			}
+		}
+		def.Tasks = append(def.Tasks, task)
+	}
+	return def, nil
+}
+func newCompletionBehavior(completions []xdwCompletion) CompletionBehavior {
+	cb := CompletionBehavior{}
+	for _, c := range completions {
+		cb.Completion = append(cb.Completion, Completion{Condition: c.Completion.Condition})
+	}
+	return cb
+}
+func newXDWCompletions(cb CompletionBehavior) []xdwCompletion {
+	var completions []xdwCompletion
+	for _, c := range cb.Completion {
+		completion := xdwCompletion{}
+		completion.Completion.Condition = strings.TrimSpace(c.Condition)
+		completions = append(completions, completion)
+	}
+	return completions
+}
+
+// OHTToDuration takes an OASIS Human Task api period function eg. day(3) and returns the equivalent xs:duration eg. P3D
+func OHTToDuration(oht string) (string, error) {
+	if !strings.Contains(oht, "(") || !strings.HasSuffix(oht, ")") {
+		return "", errors.New("invalid period " + oht + ". valid periods are min(x), hour(x), day(x), month(x) and year(x)")
+	}
+	period := strings.Split(oht, "(")[0]
+	count, err := strconv.Atoi(strings.TrimSuffix(strings.Split(oht, "(")[1], ")"))
+	if err != nil {
+		return "", errors.New("invalid period count in " + oht)
+	}
+	switch period {
+	case "min":
+		return "PT" + strconv.Itoa(count) + "M", nil
+	case "hour":
+		return "PT" + strconv.Itoa(count) + "H", nil
+	case "day":
+		return "P" + strconv.Itoa(count) + "D", nil
+	case "month":
+		return "P" + strconv.Itoa(count) + "M", nil
+	case "year":
+		return "P" + strconv.Itoa(count) + "Y", nil
+	}
+	return "", errors.New("invalid period " + oht + ". valid periods are min(x), hour(x), day(x), month(x) and year(x)")
+}
+
+// DurationToOHT takes an xs:duration, optionally quoted as an XPath literal, and returns the equivalent OASIS Human Task api period function.
+// A duration with a single component maps directly, eg. PT2H returns hour(2). Mixed day and time durations are returned in the smallest unit used, eg. P1DT2H returns hour(26)
+func DurationToOHT(duration string) (string, error) {
+	dur := strings.Trim(strings.TrimSpace(duration), "'\"")
+	if !strings.HasPrefix(dur, "P") || len(dur) < 3 {
+		return "", errors.New("invalid xs:duration " + duration)
+	}
+	var years, months, days, hours, mins int
+	var num string
+	istime := false
+	for _, c := range dur[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			num = num + string(c)
+			continue
+		case c == 'T':
+			istime = true
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return "", errors.New("invalid xs:duration " + duration)
+		}
+		num = ""
+		switch {
+		case c == 'Y' && !istime:
+			years = n
+		case c == 'M' && !istime:
+			months = n
+		case c == 'W' && !istime:
+			days = days + n*7
+		case c == 'D' && !istime:
+			days = days + n
+		case c == 'H' && istime:
+			hours = n
+		case c == 'M' && istime:
+			mins = n
+		default:
+			return "", errors.New("unsupported xs:duration component in " + duration)
+		}
+	}
+	if num != "" {
+		return "", errors.New("invalid xs:duration " + duration)
+	}
+	if (years > 0 || months > 0) && (days > 0 || hours > 0 || mins > 0) {
+		return "", errors.New("unsupported xs:duration " + duration + ". year and month periods cannot be combined with day or time periods")
+	}
+	switch {
+	case years > 0 && months > 0:
+		return "month(" + strconv.Itoa(years*12+months) + ")", nil
+	case years > 0:
+		return "year(" + strconv.Itoa(years) + ")", nil
+	case months > 0:
+		return "month(" + strconv.Itoa(months) + ")", nil
+	case mins > 0:
+		return "min(" + strconv.Itoa(days*24*60+hours*60+mins) + ")", nil
+	case hours > 0:
+		return "hour(" + strconv.Itoa(days*24+hours) + ")", nil
+	}
+	return "day(" + strconv.Itoa(days) + ")", nil
+}
+func convert(from interface{}, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err = json.Unmarshal(b, to); err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package tukhtd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ipthomas/tukxdw"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests, err := filepath.Glob(filepath.Join("..", "config", "xdwconfig", "*_def.json"))
+	if err != nil || len(tests) == 0 {
+		t.Fatalf("no definitions found, %v", err)
+	}
+	for _, file := range tests {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			defjson, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tukxdw.WorkflowDefinition{}
+			if err := json.Unmarshal(defjson, &want); err != nil {
+				t.Fatal(err)
+			}
+			htdxml, err := Export(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Import(htdxml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				wantjson, _ := json.MarshalIndent(want, "", "  ")
+				gotjson, _ := json.MarshalIndent(got, "", "  ")
+				t.Errorf("imported definition differs from the exported definition\nexported %s\nimported %s", wantjson, gotjson)
+			}
+		})
+	}
+}
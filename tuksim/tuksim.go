@@ -0,0 +1,451 @@
+// Package tuksim simulates XDW workflows against a scripted stream of events using a tukclock.Fake virtual clock. Workflows are created and
+// updated with the tukflow content creator and updater logic, so no database, broker or http services are required.
+//
+// A script lists events with offsets relative to workflow creation, expressed as OASIS Human Task durations eg. `min(30)`,
+// `hour(2)` or `day(1)`. Each event can have a random jitter and a probability of occurring, so running a script across many
+// generated patients produces a spread of timings from which aggregate projections are calculated.
+package tuksim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+
+	"tukxdw-client/tukclock"
+	"tukxdw-client/tukflow"
+)
+
+const (
+	POINT_EVENT         = "event"
+	POINT_TASK          = "task"
+	POINT_WORKFLOW      = "workflow"
+	POINT_OVERDUE       = "overdue"
+	POINT_ESCALATED     = "escalated"
+	POINT_TARGET_MET    = "targetmet"
+	POINT_TARGET_MISSED = "targetmissed"
+)
+
+type Script struct {
+	Pathway string        `json:"pathway"`
+	Start   string        `json:"start"`
+	Stagger string        `json:"stagger"`
+	Until   string        `json:"until"`
+	Seed    int64         `json:"seed"`
+	User    string        `json:"user"`
+	Org     string        `json:"org"`
+	Role    string        `json:"role"`
+	Events  []ScriptEvent `json:"events"`
+}
+
+// ScriptEvent is an event of a script. Probability is the chance, from 0 to 1, of the event occurring in a workflow. An event
+// without a probability always occurs, and an event with probability 0 never does
+type ScriptEvent struct {
+	Offset         string   `json:"offset"`
+	Jitter         string   `json:"jitter"`
+	Probability    *float64 `json:"probability,omitempty"`
+	Expression     string   `json:"expression"`
+	User           string   `json:"user"`
+	Org            string   `json:"org"`
+	Role           string   `json:"role"`
+	XdsDocEntryUid string   `json:"xdsdocentryuid"`
+	Comments       string   `json:"comments"`
+}
+type Simulator struct {
+	XDWDefinition tukxdw.WorkflowDefinition
+	Script        Script
+	Clock         *tukclock.Fake
+	eventid       int64
+	rnd           *rand.Rand
+}
+type Point struct {
+	Time   time.Time
+	Offset time.Duration
+	Kind   string
+	TaskID int
+	Detail string
+}
+type TaskResult struct {
+	TaskID     int
+	Name       string
+	Status     string
+	CompleteBy time.Time
+	Duration   time.Duration
+	IsActive   bool
+	IsOverdue  bool
+}
+type Result struct {
+	NHS_ID      string
+	Created     time.Time
+	Evaluated   time.Time
+	Status      string
+	Duration    time.Duration
+	IsEscalated bool
+	Points      []Point
+	Tasks       []TaskResult
+	Dashboard   tukxdw.Dashboard
+	XDWDocument tukxdw.XDWWorkflowDocument
+}
+type Stats struct {
+	Count  int
+	Min    time.Duration
+	Mean   time.Duration
+	Median time.Duration
+	P90    time.Duration
+	Max    time.Duration
+}
+type TaskProjection struct {
+	TaskID    int
+	Name      string
+	Completed int
+	Overdue   int
+	Duration  Stats
+}
+type Projection struct {
+	Pathway   string
+	Patients  int
+	Closed    int
+	Escalated int
+	Dashboard tukxdw.Dashboard
+	Duration  Stats
+	Tasks     []TaskProjection
+	Results   []Result
+}
+
+// Simulate runs the json script for the number of patients against the json workflow definition
+func Simulate(xdwdef []byte, script []byte, patients int) (Projection, error) {
+	sim := Simulator{}
+	if err := json.Unmarshal(xdwdef, &sim.XDWDefinition); err != nil {
+		log.Println(err.Error())
+		return Projection{}, err
+	}
+	if err := json.Unmarshal(script, &sim.Script); err != nil {
+		log.Println(err.Error())
+		return Projection{}, err
+	}
+	return sim.Run(patients)
+}
+
+// Run validates the script and runs it for the number of generated patients, returning the aggregated projection
+func (i *Simulator) Run(patients int) (Projection, error) {
+	if err := i.validate(); err != nil {
+		log.Println(err.Error())
+		return Projection{}, err
+	}
+	if patients < 1 {
+		patients = 1
+	}
+	start := tukclock.Default.Now()
+	if i.Script.Start != "" {
+		start = tukutil.GetTimeFromString(i.Script.Start)
+	}
+	i.rnd = rand.New(rand.NewSource(i.Script.Seed))
+	proj := Projection{Pathway: i.pathway(), Patients: patients}
+	created := start
+	for _, nhs := range NHSNumbers(patients) {
+		proj.Results = append(proj.Results, i.RunPatient(nhs, created))
+		created = tukutil.OHT_FutureDate(created, i.Script.Stagger)
+	}
+	proj.aggregate(i.XDWDefinition)
+	return proj, nil
+}
+
+// RunPatient creates a workflow for the patient at the created time, advances the virtual clock through the scripted events and
+// the workflow deadlines and returns the state of the workflow at the end of the simulation
+func (i *Simulator) RunPatient(nhs string, created time.Time) Result {
+	if i.rnd == nil {
+		i.rnd = rand.New(rand.NewSource(i.Script.Seed))
+	}
+	if i.Clock == nil {
+		i.Clock = tukclock.NewFake(created)
+	}
+	i.Clock.Set(created)
+	result := Result{NHS_ID: nhs, Created: created}
+	author := tukflow.Author{User: i.Script.User, Org: i.Script.Org, Role: i.Script.Role}
+	doc := tukflow.CreateWorkflowDocument(i.XDWDefinition, i.pathway(), nhs, author, i.Clock.Now(), i.newEventID)
+	result.addPoint(i.Clock.Now(), created, POINT_WORKFLOW, 0, "created workflow "+doc.WorkflowDefinitionReference)
+
+	events := i.scheduleEvents(created)
+	checkpoints := []time.Time{}
+	for _, ev := range events {
+		checkpoints = append(checkpoints, tukutil.GetTimeFromString(ev.Creationtime))
+	}
+	for task := range i.XDWDefinition.Tasks {
+		checkpoints = append(checkpoints, tukflow.TaskCompleteBy(doc, i.XDWDefinition, task+1))
+	}
+	if i.XDWDefinition.CompleteByTime != "" {
+		checkpoints = append(checkpoints, tukflow.WorkflowCompleteBy(doc, i.XDWDefinition))
+	}
+	if i.XDWDefinition.ExpirationTime != "" {
+		checkpoints = append(checkpoints, tukflow.WorkflowEscalateBy(doc, i.XDWDefinition).Add(time.Second))
+	}
+	end := tukutil.OHT_FutureDate(created, i.Script.Until)
+	if i.Script.Until == "" {
+		for _, cp := range checkpoints {
+			if cp.After(end) {
+				end = cp
+			}
+		}
+	}
+	checkpoints = append(checkpoints, end)
+	sort.Slice(checkpoints, func(a, b int) bool { return checkpoints[a].Before(checkpoints[b]) })
+
+	overdue := make([]bool, len(doc.TaskList.XDWTask))
+	workflowOverdue := false
+	for _, cp := range checkpoints {
+		if cp.After(end) {
+			break
+		}
+		i.Clock.Set(cp)
+		for len(events) > 0 && !tukutil.GetTimeFromString(events[0].Creationtime).After(i.Clock.Now()) {
+			ev := events[0]
+			events = events[1:]
+			result.addPoint(i.Clock.Now(), created, POINT_EVENT, ev.TaskId, ev.Expression+" from "+strings.TrimSpace(ev.User+" "+ev.Org+" "+ev.Role))
+			for _, t := range tukflow.UpdateWorkflowDocument(&doc, i.XDWDefinition, []tukdbint.Event{ev}, author, i.Clock.Now(), i.newEventID) {
+				if t.Kind == tukflow.TRANSITION_WORKFLOW {
+					result.addPoint(i.Clock.Now(), created, POINT_WORKFLOW, 0, "workflow "+t.From+" -> "+t.To)
+					if tukflow.IsWorkflowTargetMissed(doc, i.XDWDefinition, tukflow.WorkflowCompleteBy(doc, i.XDWDefinition).Add(time.Second)) {
+						result.addPoint(i.Clock.Now(), created, POINT_TARGET_MISSED, 0, "workflow closed after complete by time "+i.XDWDefinition.CompleteByTime)
+					} else {
+						result.addPoint(i.Clock.Now(), created, POINT_TARGET_MET, 0, "workflow closed within complete by time")
+					}
+				} else {
+					result.addPoint(i.Clock.Now(), created, POINT_TASK, t.TaskID, t.Name+" "+t.From+" -> "+t.To)
+				}
+			}
+		}
+		for task := range doc.TaskList.XDWTask {
+			if !overdue[task] && task < len(i.XDWDefinition.Tasks) && tukflow.IsTaskOverdue(doc, i.XDWDefinition, task+1, i.Clock.Now()) {
+				overdue[task] = true
+				result.addPoint(i.Clock.Now(), created, POINT_OVERDUE, task+1, doc.TaskList.XDWTask[task].TaskData.TaskDetails.Name+" is overdue")
+			}
+		}
+		if doc.WorkflowStatus == tukcnst.OPEN {
+			if !workflowOverdue && i.XDWDefinition.CompleteByTime != "" && !i.Clock.Now().Before(tukflow.WorkflowCompleteBy(doc, i.XDWDefinition)) {
+				workflowOverdue = true
+				result.addPoint(i.Clock.Now(), created, POINT_OVERDUE, 0, "workflow is open after complete by time "+i.XDWDefinition.CompleteByTime)
+			}
+			if !result.IsEscalated && tukflow.IsWorkflowEscalated(doc, i.XDWDefinition, i.Clock.Now()) {
+				result.IsEscalated = true
+				result.addPoint(i.Clock.Now(), created, POINT_ESCALATED, 0, "workflow escalated after expiration time "+i.XDWDefinition.ExpirationTime)
+			}
+		}
+	}
+	i.Clock.Set(end)
+	result.Evaluated = end
+	result.Status = doc.WorkflowStatus
+	result.Duration = tukflow.WorkflowDuration(doc, end)
+	for task := range doc.TaskList.XDWTask {
+		if task >= len(i.XDWDefinition.Tasks) {
+			break
+		}
+		result.Tasks = append(result.Tasks, TaskResult{
+			TaskID:     task + 1,
+			Name:       doc.TaskList.XDWTask[task].TaskData.TaskDetails.Name,
+			Status:     doc.TaskList.XDWTask[task].TaskData.TaskDetails.Status,
+			CompleteBy: tukflow.TaskCompleteBy(doc, i.XDWDefinition, task+1),
+			Duration:   tukflow.TaskDuration(doc, task+1, end),
+			IsActive:   doc.TaskList.XDWTask[task].TaskData.TaskDetails.ActivationTime != "",
+			IsOverdue:  tukflow.IsTaskOverdue(doc, i.XDWDefinition, task+1, end),
+		})
+	}
+	tukflow.UpdateDashboard(&result.Dashboard, doc, i.XDWDefinition, end)
+	result.XDWDocument = doc
+	return result
+}
+
+// NHSNumbers returns count generated NHS numbers. Generated numbers are in the 999 test range and have a valid modulus 11 check digit
+func NHSNumbers(count int) []string {
+	var nhsids []string
+	for seq := 0; len(nhsids) < count && seq < 1000000; seq++ {
+		base := "999" + strconv.Itoa(1000000 + seq)[1:]
+		sum := 0
+		for d := 0; d < 9; d++ {
+			sum = sum + int(base[d]-'0')*(10-d)
+		}
+		check := (11 - sum%11) % 11
+		if check != 10 {
+			nhsids = append(nhsids, base+strconv.Itoa(check))
+		}
+	}
+	return nhsids
+}
+func (i *Simulator) validate() error {
+	if len(i.XDWDefinition.Tasks) == 0 {
+		return errors.New("workflow definition " + i.XDWDefinition.Ref + " has no tasks")
+	}
+	for _, ev := range i.Script.Events {
+		if ev.Expression == "" {
+			return errors.New("script event with offset " + ev.Offset + " has no expression")
+		}
+		if len(i.taskIds(ev.Expression)) == 0 {
+			return errors.New("script event expression " + ev.Expression + " does not match any task input or output in workflow definition " + i.XDWDefinition.Ref)
+		}
+		if ev.Probability != nil && (*ev.Probability < 0 || *ev.Probability > 1) {
+			return errors.New("script event " + ev.Expression + " probability must be between 0 and 1")
+		}
+	}
+	return nil
+}
+func (i *Simulator) scheduleEvents(created time.Time) []tukdbint.Event {
+	var events []tukdbint.Event
+	for _, sev := range i.Script.Events {
+		if sev.Probability != nil && i.rnd.Float64() >= *sev.Probability {
+			continue
+		}
+		evtime := tukutil.OHT_FutureDate(created, sev.Offset)
+		if sev.Jitter != "" {
+			if jitter := tukutil.OHT_FutureDate(created, sev.Jitter).Sub(created); jitter > 0 {
+				evtime = evtime.Add(time.Duration(i.rnd.Int63n(int64(jitter/time.Second)+1)) * time.Second)
+			}
+		}
+		ev := tukdbint.Event{
+			Creationtime:   tukclock.Format(evtime),
+			Expression:     sev.Expression,
+			User:           sev.User,
+			Org:            sev.Org,
+			Role:           sev.Role,
+			XdsDocEntryUid: sev.XdsDocEntryUid,
+			Comments:       sev.Comments,
+			Pathway:        i.pathway(),
+			TaskId:         i.taskIds(sev.Expression)[0],
+		}
+		events = append(events, ev)
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		return tukutil.GetTimeFromString(events[a].Creationtime).Before(tukutil.GetTimeFromString(events[b].Creationtime))
+	})
+	for k := range events {
+		events[k].Id = i.newEventID(events[k].Expression, events[k].TaskId)
+		if events[k].XdsDocEntryUid == "" {
+			events[k].XdsDocEntryUid = "2.25." + strconv.FormatInt(events[k].Id, 10)
+		}
+	}
+	return events
+}
+func (i *Simulator) taskIds(expression string) []int {
+	var ids []int
+	for _, task := range i.XDWDefinition.Tasks {
+		matched := false
+		for _, inp := range task.Input {
+			matched = matched || inp.Name == expression
+		}
+		for _, out := range task.Output {
+			matched = matched || out.Name == expression
+		}
+		if matched {
+			ids = append(ids, tukutil.GetIntFromString(task.ID))
+		}
+	}
+	return ids
+}
+func (i *Simulator) newEventID(expression string, taskid int) int64 {
+	i.eventid = i.eventid + 1
+	return i.eventid
+}
+func (i *Simulator) pathway() string {
+	if i.Script.Pathway != "" {
+		return i.Script.Pathway
+	}
+	return i.XDWDefinition.Ref
+}
+func (i *Result) addPoint(t time.Time, created time.Time, kind string, taskid int, detail string) {
+	i.Points = append(i.Points, Point{Time: t, Offset: t.Sub(created), Kind: kind, TaskID: taskid, Detail: detail})
+}
+func (i *Projection) aggregate(def tukxdw.WorkflowDefinition) {
+	var durations []time.Duration
+	taskDurations := make([][]time.Duration, len(def.Tasks))
+	for _, task := range def.Tasks {
+		i.Tasks = append(i.Tasks, TaskProjection{TaskID: tukutil.GetIntFromString(task.ID), Name: task.Name})
+	}
+	for _, result := range i.Results {
+		i.Dashboard.Total = i.Dashboard.Total + result.Dashboard.Total
+		i.Dashboard.InProgress = i.Dashboard.InProgress + result.Dashboard.InProgress
+		i.Dashboard.Complete = i.Dashboard.Complete + result.Dashboard.Complete
+		i.Dashboard.Escalated = i.Dashboard.Escalated + result.Dashboard.Escalated
+		i.Dashboard.TargetMet = i.Dashboard.TargetMet + result.Dashboard.TargetMet
+		i.Dashboard.TargetMissed = i.Dashboard.TargetMissed + result.Dashboard.TargetMissed
+		if result.IsEscalated {
+			i.Escalated = i.Escalated + 1
+		}
+		if result.Status == tukcnst.CLOSED {
+			i.Closed = i.Closed + 1
+			durations = append(durations, result.Duration)
+		}
+		for k, task := range result.Tasks {
+			if task.IsOverdue {
+				i.Tasks[k].Overdue = i.Tasks[k].Overdue + 1
+			}
+			if task.Status == tukcnst.COMPLETE {
+				i.Tasks[k].Completed = i.Tasks[k].Completed + 1
+				// tasks closed with the workflow without any events have no meaningful duration
+				if task.IsActive {
+					taskDurations[k] = append(taskDurations[k], task.Duration)
+				}
+			}
+		}
+	}
+	i.Duration = NewStats(durations)
+	for k := range i.Tasks {
+		i.Tasks[k].Duration = NewStats(taskDurations[k])
+	}
+}
+
+// NewStats returns the count, min, mean, median, 90th percentile and max of the durations
+func NewStats(durations []time.Duration) Stats {
+	stats := Stats{Count: len(durations)}
+	if len(durations) == 0 {
+		return stats
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	var total time.Duration
+	for _, d := range sorted {
+		total = total + d
+	}
+	stats.Min = sorted[0]
+	stats.Max = sorted[len(sorted)-1]
+	stats.Mean = (total / time.Duration(len(sorted))).Round(time.Second)
+	stats.Median = sorted[(len(sorted)-1)/2]
+	stats.P90 = sorted[(len(sorted)*9+9)/10-1]
+	return stats
+}
+
+// Report returns a plain text report of the projection. The timeline of each patient workflow is included when verbose is true
+func (i *Projection) Report(verbose bool) string {
+	var b strings.Builder
+	b.WriteString("Simulated " + strconv.Itoa(i.Patients) + " " + i.Pathway + " workflows\n")
+	b.WriteString(fmt.Sprintf("Dashboard - Total %v In Progress %v Complete %v Escalated %v Target Met %v Target Missed %v\n", i.Dashboard.Total, i.Dashboard.InProgress, i.Dashboard.Complete, i.Dashboard.Escalated, i.Dashboard.TargetMet, i.Dashboard.TargetMissed))
+	b.WriteString(fmt.Sprintf("Workflows closed %v escalated %v\n", i.Closed, i.Escalated))
+	b.WriteString("Workflow duration " + i.Duration.String() + "\n")
+	for _, task := range i.Tasks {
+		b.WriteString(fmt.Sprintf("Task %v %s - completed %v overdue %v - duration %s\n", task.TaskID, task.Name, task.Completed, task.Overdue, task.Duration.String()))
+	}
+	if verbose {
+		for _, result := range i.Results {
+			b.WriteString(fmt.Sprintf("\nNHS ID %s created %s status %s duration %s\n", result.NHS_ID, tukclock.Format(result.Created), result.Status, tukutil.PrettyPrintDuration(result.Duration)))
+			for _, point := range result.Points {
+				b.WriteString(fmt.Sprintf("  +%-10s %-12s %s\n", point.Offset.String(), point.Kind, point.Detail))
+			}
+		}
+	}
+	return b.String()
+}
+
+// String returns the stats formatted as durations
+func (i Stats) String() string {
+	if i.Count == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("min %s mean %s median %s p90 %s max %s", i.Min, i.Mean, i.Median, i.P90, i.Max)
+}
@@ -0,0 +1,232 @@
+package tuksrvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tukxdw-client/tukstore"
+)
+
+// Health statuses and the probes used to check a service
+const (
+	HEALTH_UP      = "up"
+	HEALTH_DOWN    = "down"
+	PROBE_DB       = "db"
+	PROBE_SOAP     = "soap"
+	PROBE_FHIR     = "fhir"
+	PROBE_HTTP     = "http"
+	DB_SERVICE     = "db"
+	HEALTH_TIMEOUT = 5 * time.Second
+)
+
+// soapProbe is an empty SOAP 1.2 envelope. A SOAP service answers it with a response or a SOAP fault, either of which shows it is up
+const soapProbe = `<?xml version="1.0" encoding="UTF-8"?><soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"><soap:Header/><soap:Body/></soap:Envelope>`
+
+// Health is the result of probing a service. Latency is the time taken by the probe
+type Health struct {
+	Service    string        `json:"service"`
+	Probe      string        `json:"probe"`
+	Endpoint   string        `json:"endpoint,omitempty"`
+	Status     string        `json:"status"`
+	StatusCode int           `json:"statuscode,omitempty"`
+	Latency    time.Duration `json:"-"`
+	LatencyMS  float64       `json:"latencyms"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Probe returns the probe for the service with the id. The patient identity feed pixmsrvc is a FHIR server, the broker, pdqv3,
+// registry and repository services are SOAP services and other services are probed with a GET of their endpoint
+func (r *Registry) Probe(id string) string {
+	role := id
+	for _, srvc := range r.services {
+		for refrole, ref := range srvc.References() {
+			if ref == id {
+				role = refrole
+			}
+		}
+	}
+	switch role {
+	case PIXM_SRVC:
+		return PROBE_FHIR
+	case BROKER_SRVC, PDQV3_SRVC, XDSREG_SRVC, XDSREP_SRVC:
+		return PROBE_SOAP
+	}
+	return PROBE_HTTP
+}
+
+// Dependencies returns the sorted ids of the services referenced by other services, which are the external services the event
+// service depends on
+func (r *Registry) Dependencies() []string {
+	var ids []string
+	for _, id := range r.IDs() {
+		for _, srvc := range r.services {
+			if srvc.Id != id && contains(srvc.References(), id) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// Health probes the services with the ids concurrently, or the store and every dependency if no ids are given. DB_SERVICE is the
+// store, which is pinged if s is not nil. Each probe is limited to the service context timeout, or HEALTH_TIMEOUT if it has none
+func (r *Registry) Health(ctx context.Context, s tukstore.Store, ids ...string) []Health {
+	if len(ids) == 0 {
+		ids = r.Dependencies()
+		if s != nil {
+			ids = append([]string{DB_SERVICE}, ids...)
+		}
+	}
+	checks := make([]Health, len(ids))
+	var wg sync.WaitGroup
+	for k, id := range ids {
+		wg.Add(1)
+		go func(k int, id string) {
+			defer wg.Done()
+			checks[k] = r.check(ctx, s, id)
+		}(k, id)
+	}
+	wg.Wait()
+	return checks
+}
+
+// Healthy returns true if every check is up
+func Healthy(checks []Health) bool {
+	for _, check := range checks {
+		if check.Status != HEALTH_UP {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthHandler returns a handler for /healthz, which reports the process is serving with the store CacheStats, and /readyz, which
+// probes the store and dependencies and responds 503 Service Unavailable if any is down. Both respond with json
+func (r *Registry) HealthHandler(s tukstore.Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		health := struct {
+			Status string                         `json:"status"`
+			Cache  map[string]tukstore.CacheStats `json:"cache,omitempty"`
+		}{Status: HEALTH_UP}
+		if cache := tukstore.Cache(s); cache != nil {
+			health.Cache = cache.Stats()
+		}
+		writeHealth(w, http.StatusOK, health)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		checks := r.Health(req.Context(), s)
+		status, code := HEALTH_UP, http.StatusOK
+		if !Healthy(checks) {
+			status, code = HEALTH_DOWN, http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, struct {
+			Status   string   `json:"status"`
+			Services []Health `json:"services"`
+		}{status, checks})
+	})
+	return mux
+}
+func writeHealth(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// check runs the probe of the service with the id
+func (r *Registry) check(ctx context.Context, s tukstore.Store, id string) Health {
+	check := Health{Service: id, Probe: PROBE_DB}
+	timeout := HEALTH_TIMEOUT
+	var srvc Service
+	if id != DB_SERVICE || s == nil {
+		var err error
+		if srvc, err = r.Service(id); err != nil {
+			check.Status, check.Error = HEALTH_DOWN, err.Error()
+			return check
+		}
+		check.Probe = r.Probe(id)
+		check.Endpoint = srvc.Endpoint()
+		if srvc.Timeout() > 0 {
+			timeout = srvc.Timeout()
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	var err error
+	switch check.Probe {
+	case PROBE_DB:
+		err = tukstore.Ping(s.WithContext(ctx))
+	case PROBE_SOAP:
+		check.StatusCode, err = probe(ctx, http.MethodPost, check.Endpoint, func(code int, body []byte) bool {
+			return code < 300 || bytes.Contains(body, []byte("Envelope"))
+		})
+	case PROBE_FHIR:
+		check.Endpoint = strings.TrimSuffix(strings.TrimSuffix(check.Endpoint, "/"), "/Patient") + "/metadata"
+		check.StatusCode, err = probe(ctx, http.MethodGet, check.Endpoint, func(code int, body []byte) bool {
+			return code == http.StatusOK && bytes.Contains(body, []byte("CapabilityStatement"))
+		})
+	default:
+		check.StatusCode, err = probe(ctx, http.MethodGet, check.Endpoint, func(code int, body []byte) bool {
+			return code < 500
+		})
+	}
+	check.Latency = time.Since(start)
+	check.LatencyMS = float64(check.Latency.Microseconds()) / 1000
+	check.Status = HEALTH_UP
+	if err != nil {
+		check.Status, check.Error = HEALTH_DOWN, err.Error()
+	}
+	return check
+}
+
+// probe sends a request to the url and returns the response status code, and an error if the request fails or up returns false
+// for the response
+func probe(ctx context.Context, method string, url string, up func(code int, body []byte) bool) (int, error) {
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(soapProbe)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	switch method {
+	case http.MethodPost:
+		req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+	default:
+		req.Header.Set("Accept", "application/fhir+json, application/json, */*")
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	rspbody, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return rsp.StatusCode, err
+	}
+	if !up(rsp.StatusCode, rspbody) {
+		return rsp.StatusCode, fmt.Errorf("unexpected response %s", rsp.Status)
+	}
+	return rsp.StatusCode, nil
+}
+func contains(refs map[string]string, id string) bool {
+	for _, ref := range refs {
+		if ref == id {
+			return true
+		}
+	}
+	return false
+}
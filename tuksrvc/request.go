@@ -0,0 +1,90 @@
+package tuksrvc
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ipthomas/tukhttp"
+	"github.com/ipthomas/tukpdq"
+)
+
+// The vendored tukpdq and tukhttp requests do not accept a context. The functions in this file run them in one, limiting the
+// request timeout in seconds to the context deadline and returning the context error as soon as the context is done
+
+// Context returns the context limited to the ContextTimeout of the service, or the context with a cancel func if it has none
+func (s Service) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Timeout() > 0 {
+		return context.WithTimeout(ctx, s.Timeout())
+	}
+	return context.WithCancel(ctx)
+}
+
+// PDQ runs the tukpdq query for the NHS id in the context, with the query of the service with the id, see PDQQuery. The query
+// is limited to the ContextTimeout of the patient service
+func (r *Registry) PDQ(ctx context.Context, id string, nhsid string) (tukpdq.PDQQuery, error) {
+	query, err := r.PDQQuery(id)
+	if err != nil {
+		return query, err
+	}
+	srvc, _ := r.Service(id)
+	pdq, err := r.patientService(srvc)
+	if err != nil {
+		return query, err
+	}
+	ctx, cancel := pdq.Context(ctx)
+	defer cancel()
+	query.NHS_ID = nhsid
+	err = PDQ(ctx, &query)
+	return query, err
+}
+
+// PDQ runs tukpdq.New_Transaction for the query in the context. The query is unchanged if the context is done first
+func PDQ(ctx context.Context, query *tukpdq.PDQQuery) error {
+	return withContext(ctx, query, func(q *tukpdq.PDQQuery) *int64 { return &q.Timeout }, func(q *tukpdq.PDQQuery) error {
+		return tukpdq.New_Transaction(q)
+	})
+}
+
+// SOAPRequest sends the tukhttp SOAP request in the context. The request is unchanged if the context is done first
+func SOAPRequest(ctx context.Context, req *tukhttp.SOAPRequest) error {
+	return withContext(ctx, req, func(r *tukhttp.SOAPRequest) *int64 { return &r.Timeout }, func(r *tukhttp.SOAPRequest) error {
+		return tukhttp.NewRequest(r)
+	})
+}
+
+// PIXmRequest sends the tukhttp PIXm request in the context. The request is unchanged if the context is done first
+func PIXmRequest(ctx context.Context, req *tukhttp.PIXmRequest) error {
+	return withContext(ctx, req, func(r *tukhttp.PIXmRequest) *int64 { return &r.Timeout }, func(r *tukhttp.PIXmRequest) error {
+		return tukhttp.NewRequest(r)
+	})
+}
+
+// withContext runs call with a copy of the request, whose timeout in seconds is set to no more than the time to the context
+// deadline, rounded up, and copies the result to the request when call returns. If the context is done first, the context error
+// is returned and call is left to its own timeout
+func withContext[T any](ctx context.Context, req *T, timeout func(*T) *int64, call func(*T) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rc := *req
+	if deadline, ok := ctx.Deadline(); ok {
+		secs := int64((time.Until(deadline) + time.Second - 1) / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		if t := timeout(&rc); *t == 0 || *t > secs {
+			*t = secs
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- call(&rc) }()
+	select {
+	case err := <-done:
+		*req = rc
+		return err
+	case <-ctx.Done():
+		log.Println(ctx.Err().Error())
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,82 @@
+package tuksrvc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukhttp"
+)
+
+// testService returns an http service of the test server
+func testService(t *testing.T, id string, srv *httptest.Server, contexttimeout int) Service {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return Service{Id: id, Scheme: "http", Host: host, Port: p, URL: "Patient", ContextTimeout: contexttimeout}
+}
+
+func TestRegistryPDQTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	pixm := testService(t, "pixmsrvc", srv, 200)
+	event := testService(t, "eventsrvc", srv, 0)
+	event.PatientSrvc, event.PIXmSrvc, event.XDSDomain = tukcnst.PDQ_SERVER_TYPE_IHE_PIXM, pixm.Id, "2.16.840.1.113883.2.1.3.31.2.1.1"
+	registry, err := NewRegistry(pixm, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := registry.PDQ(context.Background(), event.Id, "9999999468"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the pixmsrvc context timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("pdq returned after %v, expected the 200ms pixmsrvc context timeout", elapsed)
+	}
+}
+
+func TestSOAPRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("<Envelope/>"))
+	}))
+	defer srv.Close()
+	req := tukhttp.SOAPRequest{URL: srv.URL, SOAPAction: "test", Body: []byte("<Envelope/>")}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := SOAPRequest(ctx, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.StatusCode != http.StatusOK || string(req.Response) != "<Envelope/>" || req.Timeout != 3 {
+		t.Errorf("unexpected request status %v response %s timeout %v", req.StatusCode, req.Response, req.Timeout)
+	}
+	slow := tukhttp.SOAPRequest{URL: srv.URL + "/slow", Body: []byte("<Envelope/>")}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := SOAPRequest(ctx, &slow); !errors.Is(err, context.DeadlineExceeded) || slow.Timeout != 0 {
+		t.Errorf("expected the context deadline with the request unchanged, got %v and timeout %v", err, slow.Timeout)
+	}
+}
@@ -0,0 +1,291 @@
+// Package tuksrvc parses the service definitions in config/services/*.json, which initServices stores in the servicestates table,
+// into typed Services. A Registry validates the services and the references between them, eg. the event service brokersrvc, and
+// returns the ready to use endpoint url of each service.
+package tuksrvc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukpdq"
+	"github.com/ipthomas/tukutil"
+
+	"tukxdw-client/tukstore"
+)
+
+// Service reference roles, the json keys of a service that name another service
+const (
+	BROKER_SRVC  = "brokersrvc"
+	PDQV3_SRVC   = "pdqv3srvc"
+	PIXM_SRVC    = "pixmsrvc"
+	XDSREG_SRVC  = "xdsregsrvc"
+	XDSREP_SRVC  = "xdsrepsrvc"
+	SERVICES_DIR = "./config/services/"
+)
+
+// Service is a service definition. The endpoint path is URL, or BaseURLPath and EventURL for the event service. ContextTimeout
+// is in milliseconds, 0 being no timeout. CertPath, Certs and Keys are the TLS certificate and key files of a service served over
+// https, and Secret and Token its credentials
+type Service struct {
+	Id             string `json:"id"`
+	Desc           string `json:"desc"`
+	Enabled        bool   `json:"enabled"`
+	Scheme         string `json:"scheme"`
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	URL            string `json:"url,omitempty"`
+	BaseURLPath    string `json:"baseurlpath,omitempty"`
+	EventURL       string `json:"eventurl,omitempty"`
+	ContextTimeout int    `json:"contexttimeout"`
+	DebugMode      bool   `json:"debugmode"`
+	DemoMode       bool   `json:"demomode,omitempty"`
+	FilesPath      string `json:"filespath,omitempty"`
+	Secret         string `json:"secret,omitempty"`
+	Token          string `json:"token,omitempty"`
+	CertPath       string `json:"certpath,omitempty"`
+	Certs          string `json:"certs,omitempty"`
+	Keys           string `json:"keys,omitempty"`
+	XDSDomain      string `json:"xdsdomain,omitempty"`
+	CacheTimeout   int    `json:"cachetimeout,omitempty"`
+	CacheEnabled   bool   `json:"cacheenabled,omitempty"`
+	PatientSrvc    string `json:"patientsrvc,omitempty"`
+	BrokerSrvc     string `json:"brokersrvc,omitempty"`
+	PDQv3Srvc      string `json:"pdqv3srvc,omitempty"`
+	PIXmSrvc       string `json:"pixmsrvc,omitempty"`
+	XDSRegSrvc     string `json:"xdsregsrvc,omitempty"`
+	XDSRepSrvc     string `json:"xdsrepsrvc,omitempty"`
+}
+
+// ParseService returns the service in the json config. If the config has no id, the service is given the name
+func ParseService(name string, config []byte) (Service, error) {
+	srvc := Service{}
+	if err := json.Unmarshal(config, &srvc); err != nil {
+		log.Println(err.Error())
+		return srvc, fmt.Errorf("invalid %s service config. %s", name, err.Error())
+	}
+	if srvc.Id == "" {
+		srvc.Id = name
+	}
+	return srvc, nil
+}
+
+// LoadService returns the service in the <id>.json file in dir
+func LoadService(dir string, id string) (Service, error) {
+	config, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		log.Println(err.Error())
+		return Service{}, err
+	}
+	return ParseService(id, config)
+}
+
+// Validate returns an error if the scheme is not http or https, the host or port are invalid, the timeouts are negative or
+// only one of the TLS certificate and key files is set
+func (s Service) Validate() error {
+	switch {
+	case s.Scheme != "http" && s.Scheme != "https":
+		return fmt.Errorf("%s service scheme %s is not http or https", s.Id, s.Scheme)
+	case s.Host == "" || strings.ContainsAny(s.Host, "/: "):
+		return fmt.Errorf("%s service host %s is not a host name", s.Id, s.Host)
+	case s.Port < 1 || s.Port > 65535:
+		return fmt.Errorf("%s service port %v is not between 1 and 65535", s.Id, s.Port)
+	case s.ContextTimeout < 0 || s.CacheTimeout < 0:
+		return fmt.Errorf("%s service timeouts can not be negative", s.Id)
+	case (s.Certs == "") != (s.Keys == ""):
+		return fmt.Errorf("%s service requires both certs and keys for tls", s.Id)
+	}
+	return nil
+}
+
+// Path returns the endpoint path of the service
+func (s Service) Path() string {
+	if s.URL != "" || s.BaseURLPath == "" {
+		return strings.TrimPrefix(s.URL, "/")
+	}
+	return strings.Trim(s.BaseURLPath, "/") + "/" + strings.TrimPrefix(s.EventURL, "/")
+}
+
+// Endpoint returns the url of the service
+func (s Service) Endpoint() string {
+	return tukutil.GetServiceUrl(s.Port, s.Scheme, s.Host, s.Path())
+}
+
+// Timeout returns the ContextTimeout duration
+func (s Service) Timeout() time.Duration {
+	return time.Duration(s.ContextTimeout) * time.Millisecond
+}
+
+// TLS returns the certificate and key files of the service, and false if it is not served over https with a certificate
+func (s Service) TLS() (string, string, bool) {
+	if s.Scheme != "https" || s.Certs == "" {
+		return "", "", false
+	}
+	return filepath.Join(s.CertPath, s.Certs), filepath.Join(s.CertPath, s.Keys), true
+}
+
+// References returns the ids of the services the service references, by role
+func (s Service) References() map[string]string {
+	refs := make(map[string]string)
+	for role, id := range map[string]string{BROKER_SRVC: s.BrokerSrvc, PDQV3_SRVC: s.PDQv3Srvc, PIXM_SRVC: s.PIXmSrvc, XDSREG_SRVC: s.XDSRegSrvc, XDSREP_SRVC: s.XDSRepSrvc} {
+		if id != "" {
+			refs[role] = id
+		}
+	}
+	return refs
+}
+
+// Registry is a validated set of services whose references are to services in the registry
+type Registry struct {
+	services map[string]Service
+}
+
+// NewRegistry returns a Registry of the services, or an error if a service is invalid, an id is used by more than one service,
+// a reference is to a service that is not in the registry, or a patient service has no service for its mode
+func NewRegistry(services ...Service) (*Registry, error) {
+	r := Registry{services: make(map[string]Service)}
+	for _, srvc := range services {
+		if err := srvc.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := r.services[srvc.Id]; ok {
+			return nil, errors.New("more than one service has the id " + srvc.Id)
+		}
+		r.services[srvc.Id] = srvc
+	}
+	for _, srvc := range r.services {
+		for role, id := range srvc.References() {
+			if _, ok := r.services[id]; !ok {
+				return nil, fmt.Errorf("%s service %s references unknown service %s", srvc.Id, role, id)
+			}
+		}
+		if srvc.PatientSrvc != "" {
+			if _, err := r.patientService(srvc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &r, nil
+}
+
+// LoadRegistry returns the Registry of the *.json service configs in dir
+func LoadRegistry(dir string) (*Registry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	var services []Service
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		config, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		srvc, err := ParseService(strings.TrimSuffix(file.Name(), ".json"), config)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, srvc)
+	}
+	return NewRegistry(services...)
+}
+
+// GetRegistry returns the Registry of the service configs in the store servicestates table
+func GetRegistry(s tukstore.Store) (*Registry, error) {
+	srvcs := tukdbint.ServiceStates{Action: tukcnst.SELECT}
+	srvcs.ServiceState = append(srvcs.ServiceState, tukdbint.ServiceState{})
+	if err := s.ServiceStates(&srvcs); err != nil {
+		return nil, err
+	}
+	var services []Service
+	for _, state := range srvcs.ServiceState[1:] {
+		srvc, err := ParseService(state.Name, []byte(state.Service))
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, srvc)
+	}
+	return NewRegistry(services...)
+}
+
+// IDs returns the sorted service ids
+func (r *Registry) IDs() []string {
+	var ids []string
+	for id := range r.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Service returns the service with the id
+func (r *Registry) Service(id string) (Service, error) {
+	srvc, ok := r.services[id]
+	if !ok {
+		return srvc, errors.New("no service with id " + id)
+	}
+	return srvc, nil
+}
+
+// Endpoint returns the url of the service with the id
+func (r *Registry) Endpoint(id string) (string, error) {
+	srvc, err := r.Service(id)
+	return srvc.Endpoint(), err
+}
+
+// Reference returns the service referenced by the service with the id in the role, eg. BROKER_SRVC
+func (r *Registry) Reference(id string, role string) (Service, error) {
+	srvc, err := r.Service(id)
+	if err != nil {
+		return srvc, err
+	}
+	ref, ok := srvc.References()[role]
+	if !ok {
+		return Service{}, fmt.Errorf("%s service has no %s", id, role)
+	}
+	return r.Service(ref)
+}
+
+// PDQQuery returns a tukpdq.PDQQuery for the patient service of the service with the id, with the server mode and url of its
+// patientsrvc mode, the XDS domain as the regional oid and the timeout and cache of the patient service
+func (r *Registry) PDQQuery(id string) (tukpdq.PDQQuery, error) {
+	srvc, err := r.Service(id)
+	if err != nil {
+		return tukpdq.PDQQuery{}, err
+	}
+	if srvc.PatientSrvc == "" {
+		return tukpdq.PDQQuery{}, fmt.Errorf("%s service has no patientsrvc", id)
+	}
+	pdq, err := r.patientService(srvc)
+	if err != nil {
+		return tukpdq.PDQQuery{}, err
+	}
+	query := tukpdq.PDQQuery{Server_Mode: srvc.PatientSrvc, Server_URL: pdq.Endpoint(), REG_OID: srvc.XDSDomain, Cache: srvc.CacheEnabled}
+	if pdq.ContextTimeout > 0 {
+		query.Timeout = int64((pdq.Timeout() + time.Second - 1) / time.Second)
+	}
+	return query, nil
+}
+
+// patientService returns the service referenced for the patientsrvc mode of the service
+func (r *Registry) patientService(srvc Service) (Service, error) {
+	switch srvc.PatientSrvc {
+	case tukcnst.PDQ_SERVER_TYPE_IHE_PIXM:
+		return r.Reference(srvc.Id, PIXM_SRVC)
+	case tukcnst.PDQ_SERVER_TYPE_IHE_PDQV3:
+		return r.Reference(srvc.Id, PDQV3_SRVC)
+	}
+	return Service{}, fmt.Errorf("%s service patientsrvc %s is not %s or %s", srvc.Id, srvc.PatientSrvc, tukcnst.PDQ_SERVER_TYPE_IHE_PIXM, tukcnst.PDQ_SERVER_TYPE_IHE_PDQV3)
+}
@@ -0,0 +1,354 @@
+package tukstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// Asset kinds. HTML and XML templates are served from the templates table and static files from the statics table
+const (
+	ASSET_VERSIONS      = "assetversions"
+	ASSET_HTML_TEMPLATE = "html"
+	ASSET_XML_TEMPLATE  = "xml"
+	ASSET_STATIC        = "static"
+)
+
+// AssetVersion is a row of the assetversions table, a version of a template or static file. The content of the Active version
+// of an asset is the content of its templates or statics row
+type AssetVersion struct {
+	Id       int64  `json:"id"`
+	Created  string `json:"created"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Version  int    `json:"version"`
+	Hash     string `json:"hash"`
+	MimeType string `json:"mimetype"`
+	Content  []byte `json:"content"`
+	Active   bool   `json:"active"`
+}
+
+// AssetVersions is the assetversions table collection, in the form of the tukdbint collections. As the Active filter is always
+// applied to a SELECT or DELETE, use Find to query versions
+type AssetVersions struct {
+	Action        string         `json:"action"`
+	LastInsertId  int64          `json:"lastinsertid"`
+	Count         int            `json:"count"`
+	AssetVersions []AssetVersion `json:"assetversions"`
+}
+
+// Asset is a template or static file to be served by the store
+type Asset struct {
+	Kind    string
+	Name    string
+	Content []byte
+}
+
+// AssetChange is the state of an asset compared with the store. Status is one of new, changed, unchanged or removed
+type AssetChange struct {
+	Kind    string
+	Name    string
+	Status  string
+	Version int
+}
+
+// ContentHash returns the hex sha256 hash of the content
+func ContentHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// AssetMimeType returns the mime type of the asset name, by its extension
+func AssetMimeType(kind string, name string) string {
+	switch kind {
+	case ASSET_HTML_TEMPLATE:
+		return "text/html"
+	case ASSET_XML_TEMPLATE:
+		return "application/xml"
+	}
+	if mimetype := mime.TypeByExtension(filepath.Ext(name)); mimetype != "" {
+		return mimetype
+	}
+	return "application/octet-stream"
+}
+
+// LoadAssets returns the assets of the kinds, or of every kind if none are given, in the config folder. XML templates are the .xml
+// files in <configdir>/templates/xml, HTML templates the .html files in <configdir>/templates/html and static files every file in
+// <configdir>/static. Missing folders are skipped. Templates are named without their extension, as tukxdw expects
+func LoadAssets(configdir string, kinds ...string) ([]Asset, error) {
+	folders := []struct{ kind, folder, ext string }{
+		{ASSET_XML_TEMPLATE, "templates/xml", ".xml"},
+		{ASSET_HTML_TEMPLATE, "templates/html", ".html"},
+		{ASSET_STATIC, "static", ""},
+	}
+	var assets []Asset
+	for _, f := range folders {
+		if len(kinds) > 0 && !contains(kinds, f.kind) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(configdir, f.folder))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), f.ext) {
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(configdir, f.folder, file.Name()))
+			if err != nil {
+				log.Println(err.Error())
+				return nil, err
+			}
+			assets = append(assets, Asset{Kind: f.kind, Name: strings.TrimSuffix(file.Name(), f.ext), Content: content})
+		}
+	}
+	return assets, nil
+}
+
+// GetAssetVersions returns the versions of the asset, oldest first
+func GetAssetVersions(s Store, kind string, name string) ([]AssetVersion, error) {
+	var versions []AssetVersion
+	q := Query{}
+	err := s.Find(ASSET_VERSIONS, *q.Filter("kind", OP_EQ, kind).Filter("name", OP_EQ, name).Sort("version", false), &versions)
+	return versions, err
+}
+
+// GetAsset returns the content served for the asset, and false if it is not in the store
+func GetAsset(s Store, kind string, name string) ([]byte, bool, error) {
+	switch kind {
+	case ASSET_HTML_TEMPLATE, ASSET_XML_TEMPLATE:
+		tmplts := tukdbint.Templates{Action: tukcnst.SELECT}
+		tmplts.Templates = append(tmplts.Templates, tukdbint.Template{Name: name, IsXML: kind == ASSET_XML_TEMPLATE})
+		if err := s.Templates(&tmplts); err != nil || tmplts.Count == 0 {
+			return nil, false, err
+		}
+		return []byte(tmplts.Templates[1].Template), true, nil
+	case ASSET_STATIC:
+		statics := tukdbint.Statics{Action: tukcnst.SELECT}
+		statics.Static = append(statics.Static, tukdbint.Static{Name: name})
+		if err := s.Statics(&statics); err != nil || statics.Count == 0 {
+			return nil, false, err
+		}
+		return statics.Static[1].Content, true, nil
+	}
+	return nil, false, errors.New("unknown asset kind " + kind)
+}
+
+// DiffAssets compares the assets with the content served by the store. Assets of the same kinds that have an active version in the
+// store but are not in assets are returned as removed
+func DiffAssets(s Store, assets []Asset) ([]AssetChange, error) {
+	var changes []AssetChange
+	local := make(map[string]bool)
+	for _, asset := range assets {
+		local[asset.Kind+"/"+asset.Name] = true
+		content, ok, err := GetAsset(s, asset.Kind, asset.Name)
+		if err != nil {
+			return nil, err
+		}
+		change := AssetChange{Kind: asset.Kind, Name: asset.Name, Status: "unchanged"}
+		switch {
+		case !ok:
+			change.Status = "new"
+		case ContentHash(content) != ContentHash(asset.Content):
+			change.Status = "changed"
+		}
+		changes = append(changes, change)
+	}
+	var active []AssetVersion
+	q := Query{}
+	if err := s.Find(ASSET_VERSIONS, *q.Filter("active", OP_EQ, true).Sort("kind", false).Sort("name", false), &active); err != nil {
+		return nil, err
+	}
+	for _, v := range active {
+		if !local[v.Kind+"/"+v.Name] && assetKind(assets, v.Kind) {
+			changes = append(changes, AssetChange{Kind: v.Kind, Name: v.Name, Status: "removed", Version: v.Version})
+		}
+	}
+	return changes, nil
+}
+
+// SyncAssets adds a new active version of each asset whose content differs from the content served by the store, in a single
+// transaction. Unchanged assets are not written. It returns the new versions
+func SyncAssets(s Store, assets []Asset) ([]AssetChange, error) {
+	diffs, err := DiffAssets(s, assets)
+	if err != nil {
+		return nil, err
+	}
+	var changes []AssetChange
+	err = WithTx(s, func(tx Store) error {
+		for k, asset := range assets {
+			if diffs[k].Status == "unchanged" {
+				continue
+			}
+			v, err := addAssetVersion(tx, asset)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, AssetChange{Kind: asset.Kind, Name: asset.Name, Status: diffs[k].Status, Version: v.Version})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Synced %v assets, %v new versions", len(assets), len(changes))
+	return changes, nil
+}
+
+// ActivateAssetVersion serves the content of the asset version, in a single transaction. The templates or statics row is updated
+// in place, so the asset is not missing while it changes
+func ActivateAssetVersion(s Store, kind string, name string, version int) error {
+	return WithTx(s, func(tx Store) error {
+		versions, err := GetAssetVersions(tx, kind, name)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			if v.Version == version {
+				return activate(tx, v, versions)
+			}
+		}
+		return fmt.Errorf("no version %v of %s asset %s", version, kind, name)
+	})
+}
+
+// addAssetVersion inserts the asset as the next version of the asset and activates it
+func addAssetVersion(s Store, asset Asset) (AssetVersion, error) {
+	versions, err := GetAssetVersions(s, asset.Kind, asset.Name)
+	if err != nil {
+		return AssetVersion{}, err
+	}
+	v := AssetVersion{Kind: asset.Kind, Name: asset.Name, Version: 1, Hash: ContentHash(asset.Content), MimeType: AssetMimeType(asset.Kind, asset.Name), Content: asset.Content, Active: true}
+	if len(versions) > 0 {
+		v.Version = versions[len(versions)-1].Version + 1
+	}
+	avs := AssetVersions{Action: tukcnst.INSERT}
+	avs.AssetVersions = append(avs.AssetVersions, v)
+	if err := s.AssetVersions(&avs); err != nil {
+		return v, err
+	}
+	v.Id = avs.LastInsertId
+	log.Printf("Added version %v of %s asset %s", v.Version, v.Kind, v.Name)
+	return v, activate(s, v, versions)
+}
+
+// activate sets the content of the templates or statics row of the asset to the version content, and the version as the only
+// active version of the asset
+func activate(s Store, v AssetVersion, versions []AssetVersion) error {
+	for _, other := range versions {
+		if other.Active && other.Id != v.Id {
+			if err := s.SetColumns(ASSET_VERSIONS, other.Id, map[string]interface{}{"active": false}); err != nil {
+				return err
+			}
+		}
+		if other.Id == v.Id && !other.Active {
+			if err := s.SetColumns(ASSET_VERSIONS, v.Id, map[string]interface{}{"active": true}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := serveAsset(s, v); err != nil {
+		return err
+	}
+	log.Printf("Activated version %v of %s asset %s", v.Version, v.Kind, v.Name)
+	return nil
+}
+func serveAsset(s Store, v AssetVersion) error {
+	if v.Kind == ASSET_STATIC {
+		statics := tukdbint.Statics{Action: tukcnst.SELECT}
+		statics.Static = append(statics.Static, tukdbint.Static{Name: v.Name})
+		if err := s.Statics(&statics); err != nil {
+			return err
+		}
+		if statics.Count == 1 {
+			return s.SetColumns(tukcnst.STATICS, statics.Static[1].Id, map[string]interface{}{"content": v.Content})
+		}
+		if statics.Count > 1 {
+			statics.Action = tukcnst.DELETE
+			statics.Static = statics.Static[:1]
+			if err := s.Statics(&statics); err != nil {
+				return err
+			}
+		}
+		statics = tukdbint.Statics{Action: tukcnst.INSERT}
+		statics.Static = append(statics.Static, tukdbint.Static{Name: v.Name, Content: v.Content})
+		return s.Statics(&statics)
+	}
+	tmplt := tukdbint.Template{Name: v.Name, IsXML: v.Kind == ASSET_XML_TEMPLATE}
+	tmplts := tukdbint.Templates{Action: tukcnst.SELECT}
+	tmplts.Templates = append(tmplts.Templates, tmplt)
+	if err := s.Templates(&tmplts); err != nil {
+		return err
+	}
+	if tmplts.Count == 1 {
+		return s.SetColumns(tukcnst.TEMPLATES, tmplts.Templates[1].Id, map[string]interface{}{"template": string(v.Content)})
+	}
+	if tmplts.Count > 1 {
+		tmplts.Action = tukcnst.DELETE
+		tmplts.Templates = tmplts.Templates[:1]
+		if err := s.Templates(&tmplts); err != nil {
+			return err
+		}
+	}
+	tmplt.Template = string(v.Content)
+	tmplts = tukdbint.Templates{Action: tukcnst.INSERT}
+	tmplts.Templates = append(tmplts.Templates, tmplt)
+	return s.Templates(&tmplts)
+}
+
+// DiffLines returns a line diff of the stored and local content, with removed lines prefixed by - and added lines by +
+func DiffLines(stored []byte, local []byte) []string {
+	a, b := strings.Split(string(stored), "\n"), strings.Split(string(local), "\n")
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] > lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, fmt.Sprintf("-%v: %s", i+1, a[i]))
+			i = i + 1
+		default:
+			diff = append(diff, fmt.Sprintf("+%v: %s", j+1, b[j]))
+			j = j + 1
+		}
+	}
+	return diff
+}
+func assetKind(assets []Asset, kind string) bool {
+	for _, asset := range assets {
+		if asset.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+package tukstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+)
+
+// AWS API Gateway transport
+//
+// An AWS API Gateway store posts its requests with an AWSTransport. Requests that fail with a network error or a 429, 500, 502,
+// 503 or 504 status are retried with exponential backoff and jitter, or after the Retry-After seconds of the response. SELECT,
+// UPDATE, DELETE, query, columns, summary and dashboard requests are idempotent and are retried as they are. INSERT and DEPRECATE
+// requests, batches and conditional workflow updates are not, and are sent with an Idempotency-Key header that is the same for
+// every attempt. The API must respond to a repeated key with the response to the first request that used it rather than executing
+// it again. Requests are signed with AWS Signature Version 4 or sent with a bearer token, and error responses are decoded into an
+// AWSAPIError.
+const (
+	ENV_TUK_STORE_AWS_AUTH    = "TUK_STORE_AWS_AUTH"
+	ENV_TUK_STORE_TOKEN       = "TUK_STORE_TOKEN"
+	ENV_TUK_STORE_AWS_RETRIES = "TUK_STORE_AWS_RETRIES"
+	ENV_AWS_ACCESS_KEY_ID     = "AWS_ACCESS_KEY_ID"
+	ENV_AWS_SECRET_ACCESS_KEY = "AWS_SECRET_ACCESS_KEY"
+	ENV_AWS_SESSION_TOKEN     = "AWS_SESSION_TOKEN"
+	ENV_AWS_REGION            = "AWS_REGION"
+	AWS_AUTH_SIGV4            = "sigv4"
+	AWS_AUTH_BEARER           = "bearer"
+	AWS_SIGV4_SERVICE         = "execute-api"
+	AWS_IDEMPOTENCY_KEY       = "Idempotency-Key"
+	AWS_RETRIES               = 3
+	AWS_RETRY_BACKOFF         = 200 * time.Millisecond
+	AWS_RETRY_MAX_BACKOFF     = 5 * time.Second
+)
+
+// AWSAuth authenticates an AWS API Gateway request. Sign is called for each attempt with the request body
+type AWSAuth interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// BearerAuth sends the Token as an Authorization Bearer token
+type BearerAuth struct {
+	Token string
+}
+
+// SigV4Auth signs requests with AWS Signature Version 4 for the Region and Service, eg. execute-api, with the access key and the
+// session token of temporary credentials. Now returns the signing time, the current time if it is nil
+type SigV4Auth struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	Service         string
+	Now             func() time.Time
+}
+
+// AWSTransport posts AWS API Gateway requests with the Client, or http.DefaultClient if it is nil, authenticated by Auth if it is
+// set. A failed request is retried up to Retries times, after Backoff doubled for each retry up to MaxBackoff
+type AWSTransport struct {
+	Client     *http.Client
+	Auth       AWSAuth
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// AWSAPIError is an AWS API Gateway error response. Code and Message are decoded from a {"code": "...", "message": "..."} or
+// {"error": {"code": "...", "message": "..."}} body, or from the API Gateway x-amzn-ErrorType header and {"message": "..."} body
+type AWSAPIError struct {
+	Resource   string
+	StatusCode int
+	Code       string
+	Message    string
+	RequestId  string
+}
+
+func (e *AWSAPIError) Error() string {
+	msg := fmt.Sprintf("aws api %s request failed with status code %v", e.Resource, e.StatusCode)
+	if e.Code != "" {
+		msg = msg + " " + e.Code
+	}
+	if e.Message != "" {
+		msg = msg + ". " + e.Message
+	}
+	if e.RequestId != "" {
+		msg = msg + " (request id " + e.RequestId + ")"
+	}
+	return msg
+}
+
+// awsResponse is the response to an AWS API Gateway request
+type awsResponse struct {
+	status int
+	body   []byte
+	header http.Header
+}
+
+var (
+	defaultTransport   *AWSTransport
+	defaultTransportMu sync.Mutex
+)
+
+// NewAWSTransport returns an AWSTransport configured by the environment. TUK_STORE_AWS_AUTH is sigv4 to sign requests with the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN credentials for AWS_REGION, or the region of the execute-api url
+// host, or bearer to send the TUK_STORE_TOKEN token. Requests are sent with a bearer token if TUK_STORE_TOKEN is set and
+// TUK_STORE_AWS_AUTH is not. TUK_STORE_AWS_RETRIES is the number of retries, default AWS_RETRIES
+func NewAWSTransport(apiurl string) (*AWSTransport, error) {
+	t := AWSTransport{Retries: AWS_RETRIES, Backoff: AWS_RETRY_BACKOFF, MaxBackoff: AWS_RETRY_MAX_BACKOFF}
+	if env := os.Getenv(ENV_TUK_STORE_AWS_RETRIES); env != "" {
+		retries, err := strconv.Atoi(env)
+		if err != nil || retries < 0 {
+			return nil, errors.New(ENV_TUK_STORE_AWS_RETRIES + " must be a number of retries, eg. 3")
+		}
+		t.Retries = retries
+	}
+	auth := os.Getenv(ENV_TUK_STORE_AWS_AUTH)
+	if auth == "" && os.Getenv(ENV_TUK_STORE_TOKEN) != "" {
+		auth = AWS_AUTH_BEARER
+	}
+	switch auth {
+	case "":
+	case AWS_AUTH_BEARER:
+		if os.Getenv(ENV_TUK_STORE_TOKEN) == "" {
+			return nil, errors.New(ENV_TUK_STORE_TOKEN + " is not set")
+		}
+		t.Auth = BearerAuth{Token: os.Getenv(ENV_TUK_STORE_TOKEN)}
+	case AWS_AUTH_SIGV4:
+		sigv4 := SigV4Auth{AccessKeyId: os.Getenv(ENV_AWS_ACCESS_KEY_ID), SecretAccessKey: os.Getenv(ENV_AWS_SECRET_ACCESS_KEY), SessionToken: os.Getenv(ENV_AWS_SESSION_TOKEN), Region: os.Getenv(ENV_AWS_REGION), Service: AWS_SIGV4_SERVICE}
+		if sigv4.Region == "" {
+			sigv4.Region = awsRegion(apiurl)
+		}
+		if sigv4.AccessKeyId == "" || sigv4.SecretAccessKey == "" || sigv4.Region == "" {
+			return nil, errors.New("sigv4 requires " + ENV_AWS_ACCESS_KEY_ID + ", " + ENV_AWS_SECRET_ACCESS_KEY + " and " + ENV_AWS_REGION + " or an execute-api url")
+		}
+		t.Auth = sigv4
+	default:
+		return nil, fmt.Errorf("%s %s is not %s or %s", ENV_TUK_STORE_AWS_AUTH, auth, AWS_AUTH_SIGV4, AWS_AUTH_BEARER)
+	}
+	return &t, nil
+}
+
+// awsTransport returns the AWSTransport configured by the environment for the url, which is shared by the stores without a Transport
+func awsTransport(apiurl string) (*AWSTransport, error) {
+	defaultTransportMu.Lock()
+	defer defaultTransportMu.Unlock()
+	if defaultTransport == nil {
+		t, err := NewAWSTransport(apiurl)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		defaultTransport = t
+	}
+	return defaultTransport, nil
+}
+
+// post posts the json body to the url, retrying a failed request, and returns the response. key is the Idempotency-Key of a
+// request that is not idempotent, sent with every attempt
+func (t *AWSTransport) post(ctx context.Context, apiurl string, body []byte, key string) (awsResponse, error) {
+	for attempt := 0; ; attempt++ {
+		rsp, err := t.send(ctx, apiurl, body, key)
+		if attempt >= t.Retries || !retryable(rsp.status, err) || ctx.Err() != nil {
+			return rsp, err
+		}
+		wait := t.wait(attempt, rsp.header)
+		log.Printf("Retrying aws api request %s in %s, attempt %v of %v", apiurl, wait, attempt+2, t.Retries+1)
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return rsp, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// send posts a single attempt of the request
+func (t *AWSTransport) send(ctx context.Context, apiurl string, body []byte, key string) (awsResponse, error) {
+	rsp := awsResponse{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiurl, bytes.NewReader(body))
+	if err != nil {
+		log.Println(err.Error())
+		return rsp, err
+	}
+	req.Header.Set(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON_CHARSET_UTF_8)
+	if key != "" {
+		req.Header.Set(AWS_IDEMPOTENCY_KEY, key)
+	}
+	if t.Auth != nil {
+		if err := t.Auth.Sign(req, body); err != nil {
+			log.Println(err.Error())
+			return rsp, err
+		}
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httprsp, err := client.Do(req)
+	if err != nil {
+		log.Println(err.Error())
+		return rsp, err
+	}
+	defer httprsp.Body.Close()
+	rsp.status, rsp.header = httprsp.StatusCode, httprsp.Header
+	if rsp.body, err = io.ReadAll(httprsp.Body); err != nil {
+		log.Println(err.Error())
+	}
+	return rsp, err
+}
+
+// wait returns the time to wait before the retry after the attempt, the Retry-After seconds of the response or the backoff with jitter
+func (t *AWSTransport) wait(attempt int, header http.Header) time.Duration {
+	if secs, err := strconv.Atoi(header.Get("Retry-After")); err == nil && secs >= 0 {
+		if wait := time.Duration(secs) * time.Second; wait < t.MaxBackoff {
+			return wait
+		}
+		return t.MaxBackoff
+	}
+	backoff := t.Backoff << attempt
+	if backoff > t.MaxBackoff || backoff <= 0 {
+		backoff = t.MaxBackoff
+	}
+	return backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1))
+}
+
+// retryable returns true if a request that failed with the status code or error may succeed if it is retried
+func retryable(status int, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// newIdempotencyKey returns a random Idempotency-Key
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// awsAPIError returns the AWSAPIError of the response
+func awsAPIError(resource string, rsp awsResponse) *AWSAPIError {
+	apierr := AWSAPIError{Resource: resource, StatusCode: rsp.status, RequestId: rsp.header.Get("x-amzn-RequestId")}
+	body := struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Error   *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(rsp.body, &body); err == nil {
+		apierr.Code, apierr.Message = body.Code, body.Message
+		if body.Error != nil {
+			apierr.Code, apierr.Message = body.Error.Code, body.Error.Message
+		}
+	} else if len(rsp.body) > 0 && len(rsp.body) < 512 {
+		apierr.Message = strings.TrimSpace(string(rsp.body))
+	}
+	if apierr.Code == "" {
+		apierr.Code, _, _ = strings.Cut(rsp.header.Get("x-amzn-ErrorType"), ":")
+	}
+	return &apierr
+}
+
+// awsRegion returns the region of an execute-api url, eg. eu-west-2 for https://abc123.execute-api.eu-west-2.amazonaws.com/beta/
+func awsRegion(apiurl string) string {
+	u, err := url.Parse(apiurl)
+	if err != nil {
+		return ""
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	for k := 0; k+2 < len(labels); k++ {
+		if labels[k] == AWS_SIGV4_SERVICE && labels[k+2] == "amazonaws" {
+			return labels[k+1]
+		}
+	}
+	return ""
+}
+
+// Sign sets the Authorization header to the bearer token
+func (a BearerAuth) Sign(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// Sign sets the X-Amz-Date, X-Amz-Security-Token and Authorization headers of the request
+func (a SigV4Auth) Sign(req *http.Request, body []byte) error {
+	now := time.Now
+	if a.Now != nil {
+		now = a.Now
+	}
+	t := now().UTC()
+	amzdate, date := t.Format("20060102T150405Z"), t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzdate)
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host, "x-amz-date": amzdate}
+	if a.SessionToken != "" {
+		headers["x-amz-security-token"] = a.SessionToken
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	payload := sha256.Sum256(body)
+	canonical := strings.Join([]string{req.Method, sigv4Path(req.URL), sigv4Query(req.URL), canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payload[:])}, "\n")
+	scope := date + "/" + a.Region + "/" + a.Service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := hmacSHA256([]byte("AWS4"+a.SecretAccessKey), date)
+	for _, part := range []string{a.Region, a.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+a.AccessKeyId+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sigv4Path returns the canonical uri of the url, each segment of its escaped path escaped again as the services other than S3 require
+func sigv4Path(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for k, segment := range segments {
+		segments[k] = sigv4Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sigv4Query returns the canonical query string of the url, its escaped parameters sorted by name and value
+func sigv4Query(u *url.URL) string {
+	var params []string
+	for name, vals := range u.Query() {
+		for _, val := range vals {
+			params = append(params, sigv4Escape(name)+"="+sigv4Escape(val))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// sigv4Escape percent encodes the characters other than the unreserved A-Z, a-z, 0-9, '-', '.', '_' and '~'
+func sigv4Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
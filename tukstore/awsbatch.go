@@ -0,0 +1,205 @@
+package tukstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// AWS API Gateway batch contract
+//
+// A transaction on an AWS API Gateway store buffers its writes and sends them in a single request when it is committed
+//
+//	POST <DB_URL>batch
+//	{"operations": [{"resource": "events", "body": {"action": "insert", "events": [{...}]}}, ...]}
+//
+// Each body is the tukdbint collection json posted to <DB_URL><resource> for a single request. The API must execute the
+// operations in order in one database transaction and respond 200 OK with {"results": [<collection json>, ...]} only when the
+// transaction commits. Any other status means nothing was written. The request is sent with an Idempotency-Key, so a batch that
+// is retried after its response was lost is not executed twice.
+//
+// The id of an inserted row is not known until the batch is executed, so the n'th INSERT of a batch (from 1) is given the
+// provisional LastInsertId AWS_BATCH_PROVISIONAL_ID + n. The API must replace each occurrence of the decimal provisional id in the
+// bodies of later operations, including within string values such as an XDW document, with the id of the inserted row.
+//
+// SELECT requests are sent immediately and do not see the buffered writes.
+const (
+	AWS_BATCH_RESOURCE       = "batch"
+	AWS_BATCH_PROVISIONAL_ID = int64(9000000000000000000)
+	AWS_BATCH_TIMEOUT        = 15 * time.Second
+)
+
+// AWSBatchOperation is a single operation in an AWS API Gateway batch request
+type AWSBatchOperation struct {
+	Resource string          `json:"resource"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// AWSBatchRequest is the body of an AWS API Gateway batch request
+type AWSBatchRequest struct {
+	Operations []AWSBatchOperation `json:"operations"`
+}
+
+// AWSBatchResponse is the body of the response to a committed AWS API Gateway batch request
+type AWSBatchResponse struct {
+	Results []json.RawMessage `json:"results"`
+}
+
+type awsBatchTx struct {
+	*DBStore
+	batch    AWSBatchRequest
+	inserts  int64
+	done     bool
+	conflict error
+}
+
+// Begin starts a transaction. MySQL transactions use the tukdbint connection pool. AWS API Gateway transactions are sent as a
+// single batch request when committed
+func (s *DBStore) Begin() (Tx, error) {
+	if s.Connection.DBReader_Only {
+		return nil, ErrReadOnly
+	}
+	if s.Connection.DB_URL != "" {
+		return &awsBatchTx{DBStore: s}, nil
+	}
+	return s.mysql().Begin()
+}
+func (t *awsBatchTx) Workflows(i *tukdbint.Workflows) error {
+	return t.add(tukcnst.WORKFLOWS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) Events(i *tukdbint.Events) error {
+	return t.add(tukcnst.EVENTS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) Subscriptions(i *tukdbint.Subscriptions) error {
+	return t.add(tukcnst.SUBSCRIPTIONS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) XDWS(i *tukdbint.XDWS) error {
+	return t.add(tukcnst.XDWS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) Templates(i *tukdbint.Templates) error {
+	return t.add(tukcnst.TEMPLATES, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) Statics(i *tukdbint.Statics) error {
+	return t.add(tukcnst.STATICS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) IdMaps(i *tukdbint.IdMaps) error {
+	return t.add(tukcnst.ID_MAPS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) ServiceStates(i *tukdbint.ServiceStates) error {
+	return t.add(tukcnst.SERVICE_STATES, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) EventAcks(i *tukdbint.EventAcks) error {
+	return t.add(tukcnst.EVENT_ACKS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) AssetVersions(i *AssetVersions) error {
+	return t.add(ASSET_VERSIONS, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) WorkflowArchives(i *WorkflowArchives) error {
+	return t.add(WORKFLOW_ARCHIVES, i.Action, i, &i.LastInsertId)
+}
+func (t *awsBatchTx) SubjectAudits(i *SubjectAudits) error {
+	return t.add(SUBJECT_AUDITS, i.Action, i, &i.LastInsertId)
+}
+
+// UpdateWorkflow buffers the workflows/update operation. If the API responds 409 Conflict to the batch, Commit returns a ConflictError
+func (t *awsBatchTx) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	t.conflict = conflict(reflect.ValueOf(wf))
+	return t.add(tukcnst.WORKFLOWS+"/update", tukcnst.UPDATE, workflowUpdate{Workflow: wf, SeqNo: seqno, Expected: expected}, nil)
+}
+func (t *awsBatchTx) SetWorkflowSummary(sum WorkflowSummary) error {
+	return t.add(tukcnst.WORKFLOWS+"/summary", tukcnst.UPDATE, sum, nil)
+}
+func (t *awsBatchTx) SetColumns(table string, id int64, values map[string]interface{}) error {
+	if err := checkColumns(table, values); err != nil {
+		return err
+	}
+	return t.add(table+"/columns", tukcnst.UPDATE, columnsRequest{Id: id, Values: values}, nil)
+}
+
+// WithContext returns the transaction unchanged. The batch is sent with the context of the store the transaction was started on
+func (t *awsBatchTx) WithContext(ctx context.Context) Store {
+	return t
+}
+func (t *awsBatchTx) Begin() (Tx, error) {
+	return nil, errors.New("transaction already started")
+}
+
+// add sends a SELECT immediately and buffers any other action
+func (t *awsBatchTx) add(resource string, action string, i interface{}, lastid *int64) error {
+	if t.done {
+		return errors.New("transaction has already been committed or rolled back")
+	}
+	if action == tukcnst.SELECT {
+		return NewStoreEvent(t.DBStore, i)
+	}
+	body, err := json.Marshal(i)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	t.batch.Operations = append(t.batch.Operations, AWSBatchOperation{Resource: resource, Body: body})
+	if action == tukcnst.INSERT {
+		t.inserts = t.inserts + 1
+		*lastid = AWS_BATCH_PROVISIONAL_ID + t.inserts
+	}
+	return nil
+}
+
+// Commit sends the buffered writes to the AWS API Gateway batch resource
+func (t *awsBatchTx) Commit() error {
+	if t.done {
+		return errors.New("transaction has already been committed or rolled back")
+	}
+	t.done = true
+	if len(t.batch.Operations) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(t.batch)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	awsrsp, err := t.awsPost(AWS_BATCH_RESOURCE, body, AWS_BATCH_TIMEOUT, newIdempotencyKey())
+	if err != nil {
+		return err
+	}
+	if awsrsp.status == http.StatusConflict && t.conflict != nil {
+		log.Println(t.conflict.Error())
+		return t.conflict
+	}
+	if awsrsp.status != http.StatusOK {
+		err := fmt.Errorf("batch of %v operations: %w", len(t.batch.Operations), awsAPIError(AWS_BATCH_RESOURCE, awsrsp))
+		log.Println(err.Error())
+		return err
+	}
+	rsp := AWSBatchResponse{}
+	if err := json.Unmarshal(awsrsp.body, &rsp); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	log.Printf("Committed aws api batch of %v operations", len(rsp.Results))
+	return nil
+}
+
+// Rollback discards the buffered writes
+func (t *awsBatchTx) Rollback() error {
+	t.done = true
+	t.batch = AWSBatchRequest{}
+	return nil
+}
+
+// Close rolls back the transaction if it has not been committed
+func (t *awsBatchTx) Close() error {
+	if t.done {
+		return nil
+	}
+	return t.Rollback()
+}
@@ -0,0 +1,288 @@
+package tukstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// AWSStandIn is an http.Handler implementing the AWS API Gateway store json contract with a Store, so an AWS API Gateway store
+// and its transport can be run against a local server, eg. a mem:// or file:// store. Requests must be POST requests to
+//
+//	<table>                 tukdbint collection json, responds with the collection json
+//	<table>/query           {"query": <Query json>}, responds with {"rows": [...]}
+//	<table>/columns         {"id": <id>, "values": {...}}
+//	workflows/summary       WorkflowSummary json
+//	workflows/update        {"workflow": <tukdbint.Workflow json>, "seqno": <seqno>, "expected": <expected>}, responds 409 on conflict
+//	workflows/dashboard     {"query": <Query json>, "now": <RFC3339 time>}, responds with the tukxdw.Dashboard json
+//	batch                   AWSBatchRequest json, responds with AWSBatchResponse json
+//
+// under any path prefix, eg. a stage name. If Token is set, requests must have a bearer Authorization header with the token. The
+// response to a request with an Idempotency-Key is replayed for later requests with the key. Errors are returned as
+// {"code": "...", "message": "..."} with a 400, 401, 404, 405, 409 or 500 status
+type AWSStandIn struct {
+	Store       Store
+	Token       string
+	mu          sync.Mutex
+	responses   map[string]standInResponse
+	unavailable int
+}
+
+// standInDigits matches the numbers in a batch operation body that may be provisional ids
+var standInDigits = regexp.MustCompile(`[0-9]+`)
+
+type standInResponse struct {
+	status int
+	body   []byte
+}
+
+// standInError is an error returned by the stand in with its status code and error code
+type standInError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *standInError) Error() string {
+	return e.err.Error()
+}
+
+// NewAWSStandIn returns an AWSStandIn for the store, which requires the bearer token if it is not empty
+func NewAWSStandIn(s Store, token string) *AWSStandIn {
+	return &AWSStandIn{Store: s, Token: token, responses: make(map[string]standInResponse)}
+}
+
+// Unavailable makes the stand in respond 503 Service Unavailable to the next n requests, to exercise the transport retries
+func (h *AWSStandIn) Unavailable(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unavailable = n
+}
+
+// ServeHTTP executes the request against the store. Requests are executed one at a time
+func (h *AWSStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.unavailable > 0 {
+		h.unavailable = h.unavailable - 1
+		w.Header().Set("Retry-After", "0")
+		h.write(w, "", standInResponse{}, &standInError{http.StatusServiceUnavailable, "ServiceUnavailable", errors.New("the stand in is unavailable")})
+		return
+	}
+	if h.Token != "" && r.Header.Get("Authorization") != "Bearer "+h.Token {
+		h.write(w, "", standInResponse{}, &standInError{http.StatusUnauthorized, "Unauthorized", errors.New("invalid bearer token")})
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.write(w, "", standInResponse{}, &standInError{http.StatusMethodNotAllowed, "MethodNotAllowed", errors.New(r.Method + " requests are not supported")})
+		return
+	}
+	key := r.Header.Get(AWS_IDEMPOTENCY_KEY)
+	if rsp, ok := h.responses[key]; ok && key != "" {
+		log.Printf("Replaying the response to idempotency key %s", key)
+		h.write(w, "", rsp, nil)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.write(w, key, standInResponse{}, &standInError{http.StatusBadRequest, "BadRequest", err})
+		return
+	}
+	rspbody, err := h.execute(h.Store, standInResource(r.URL.Path), body)
+	h.write(w, key, standInResponse{status: http.StatusOK, body: rspbody}, err)
+}
+
+// write writes the response, or the json error, and keeps it for the idempotency key
+func (h *AWSStandIn) write(w http.ResponseWriter, key string, rsp standInResponse, err error) {
+	if err != nil {
+		log.Println(err.Error())
+		apierr := &standInError{}
+		if !errors.As(err, &apierr) {
+			apierr = &standInError{http.StatusInternalServerError, "InternalServerError", err}
+			if errors.Is(err, ErrConflict) {
+				apierr = &standInError{http.StatusConflict, "Conflict", err}
+			}
+		}
+		rsp.status = apierr.status
+		rsp.body, _ = json.Marshal(struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}{Code: apierr.code, Message: apierr.err.Error()})
+	}
+	if key != "" && rsp.status != http.StatusServiceUnavailable {
+		h.responses[key] = rsp
+	}
+	w.Header().Set(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON_CHARSET_UTF_8)
+	w.WriteHeader(rsp.status)
+	w.Write(rsp.body)
+}
+
+// execute executes the request body for the resource against the store and returns the response body
+func (h *AWSStandIn) execute(s Store, resource string, body []byte) ([]byte, error) {
+	table, op, _ := strings.Cut(resource, "/")
+	if table == AWS_BATCH_RESOURCE && op == "" {
+		return h.batch(s, body)
+	}
+	rowtype, ok := TableRows[table]
+	if !ok {
+		return nil, &standInError{http.StatusNotFound, "NotFound", errors.New("unknown resource " + resource)}
+	}
+	switch {
+	case op == "":
+		i := newCollection(table)
+		if err := json.Unmarshal(body, i); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		if err := NewStoreEvent(s, i); err != nil {
+			return nil, err
+		}
+		return json.Marshal(i)
+	case op == "query":
+		req := struct {
+			Query Query `json:"query"`
+		}{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		rows := reflect.New(reflect.SliceOf(rowtype))
+		rows.Elem().Set(reflect.MakeSlice(reflect.SliceOf(rowtype), 0, 0))
+		if err := s.Find(table, req.Query, rows.Interface()); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		return json.Marshal(struct {
+			Rows interface{} `json:"rows"`
+		}{Rows: rows.Elem().Interface()})
+	case op == "columns":
+		req := columnsRequest{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		if err := checkColumns(table, req.Values); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		return []byte("{}"), s.SetColumns(table, req.Id, req.Values)
+	case table == tukcnst.WORKFLOWS && op == "summary":
+		sum := WorkflowSummary{}
+		if err := json.Unmarshal(body, &sum); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		return []byte("{}"), s.SetWorkflowSummary(sum)
+	case table == tukcnst.WORKFLOWS && op == "update":
+		req := workflowUpdate{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		return []byte("{}"), s.UpdateWorkflow(req.Workflow, req.SeqNo, req.Expected)
+	case table == tukcnst.WORKFLOWS && op == "dashboard":
+		req := struct {
+			Query Query  `json:"query"`
+			Now   string `json:"now"`
+		}{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		now, err := time.Parse(time.RFC3339, req.Now)
+		if err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		dashboard, err := s.Dashboard(req.Query, now)
+		if err != nil {
+			return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+		}
+		return json.Marshal(dashboard)
+	}
+	return nil, &standInError{http.StatusNotFound, "NotFound", errors.New("unknown resource " + resource)}
+}
+
+// batch executes the batch operations in a store transaction, replacing the provisional id of each INSERT in the bodies of the
+// later operations with the id of the inserted row
+func (h *AWSStandIn) batch(s Store, body []byte) ([]byte, error) {
+	req := AWSBatchRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, &standInError{http.StatusBadRequest, "BadRequest", err}
+	}
+	rsp := AWSBatchResponse{}
+	err := WithTx(s, func(tx Store) error {
+		ids := make(map[string][]byte)
+		for k, op := range req.Operations {
+			body := standInDigits.ReplaceAllFunc(op.Body, func(digits []byte) []byte {
+				if id, ok := ids[string(digits)]; ok {
+					return id
+				}
+				return digits
+			})
+			result, err := h.execute(tx, op.Resource, body)
+			if err != nil {
+				return fmt.Errorf("batch operation %v %s: %w", k+1, op.Resource, err)
+			}
+			rsp.Results = append(rsp.Results, result)
+			insert := struct {
+				Action       string `json:"action"`
+				LastInsertId int64  `json:"lastinsertid"`
+			}{}
+			if json.Unmarshal(result, &insert) == nil && insert.Action == tukcnst.INSERT {
+				provisional := strconv.FormatInt(AWS_BATCH_PROVISIONAL_ID+int64(len(ids)+1), 10)
+				ids[provisional] = []byte(strconv.FormatInt(insert.LastInsertId, 10))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rsp)
+}
+
+// standInResource returns the resource of the request path, the table and operation following any path prefix
+func standInResource(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for k, part := range parts {
+		if _, ok := TableRows[part]; ok || part == AWS_BATCH_RESOURCE {
+			return strings.Join(parts[k:], "/")
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// newCollection returns a new tukdbint collection struct for the table
+func newCollection(table string) interface{} {
+	switch table {
+	case tukcnst.WORKFLOWS:
+		return &tukdbint.Workflows{}
+	case tukcnst.EVENTS:
+		return &tukdbint.Events{}
+	case tukcnst.SUBSCRIPTIONS:
+		return &tukdbint.Subscriptions{}
+	case tukcnst.XDWS:
+		return &tukdbint.XDWS{}
+	case tukcnst.TEMPLATES:
+		return &tukdbint.Templates{}
+	case tukcnst.STATICS:
+		return &tukdbint.Statics{}
+	case tukcnst.ID_MAPS:
+		return &tukdbint.IdMaps{}
+	case tukcnst.SERVICE_STATES:
+		return &tukdbint.ServiceStates{}
+	case tukcnst.EVENT_ACKS:
+		return &tukdbint.EventAcks{}
+	case ASSET_VERSIONS:
+		return &AssetVersions{}
+	case WORKFLOW_ARCHIVES:
+		return &WorkflowArchives{}
+	case SUBJECT_AUDITS:
+		return &SubjectAudits{}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package tukstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// standInStore returns an AWS API Gateway store for a stand in serving the backend store
+func standInStore(t *testing.T, backend Store) (*DBStore, *AWSStandIn) {
+	t.Helper()
+	standin := NewAWSStandIn(backend, "secret")
+	srv := httptest.NewServer(standin)
+	t.Cleanup(srv.Close)
+	transport := &AWSTransport{Auth: BearerAuth{Token: "secret"}, Retries: 2, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	return &DBStore{Connection: tukdbint.TukDBConnection{DB_URL: srv.URL + "/beta/"}, Transport: transport}, standin
+}
+
+func TestAWSStandInRetries(t *testing.T) {
+	s, standin := standInStore(t, NewMemStore())
+	standin.Unavailable(2)
+	insertWorkflow(t, s, testWorkflow("lab", "9999999468", "doc1"))
+	if rows := selectWorkflows(t, s, tukdbint.Workflow{Pathway: "lab", Version: -1}); len(rows) != 1 {
+		t.Fatalf("insert retried after 503 responses returned %+v", rows)
+	}
+	standin.Unavailable(3)
+	wfs := tukdbint.Workflows{Action: tukcnst.INSERT}
+	wfs.Workflows = append(wfs.Workflows, testWorkflow("lab", "9999999484", "doc2"))
+	apierr := &AWSAPIError{}
+	if err := s.Workflows(&wfs); !errors.As(err, &apierr) || apierr.StatusCode != http.StatusServiceUnavailable || apierr.Code != "ServiceUnavailable" {
+		t.Fatalf("insert after the retries returned %v, want a 503 AWSAPIError", err)
+	}
+}
+
+func TestAWSStandInIdempotency(t *testing.T) {
+	backend := NewMemStore()
+	s, _ := standInStore(t, backend)
+	body := []byte(`{"action": "insert", "workflows": [{"pathway": "lab", "nhsid": "9999999468", "xdw_key": "lab9999999468", "xdw_doc": "doc"}]}`)
+	key := newIdempotencyKey()
+	first, err := s.awsPost(tukcnst.WORKFLOWS, body, AWS_TIMEOUT, key)
+	if err != nil || first.status != http.StatusOK {
+		t.Fatalf("insert returned %v, %v", first.status, err)
+	}
+	replayed, err := s.awsPost(tukcnst.WORKFLOWS, body, AWS_TIMEOUT, key)
+	if err != nil || replayed.status != http.StatusOK || string(replayed.body) != string(first.body) {
+		t.Fatalf("repeated insert returned %v %s, %v, want the first response %s", replayed.status, replayed.body, err, first.body)
+	}
+	if rows := selectWorkflows(t, backend, tukdbint.Workflow{Pathway: "lab", Version: -1}); len(rows) != 1 {
+		t.Fatalf("repeated insert was executed twice, select returned %+v", rows)
+	}
+}
+
+// lostResponse is a handler that executes the first request and responds 502 Bad Gateway, as if its response was lost
+type lostResponse struct {
+	http.Handler
+	lost bool
+}
+
+func (h *lostResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.lost {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	h.lost = true
+	h.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func TestAWSStandInRetriedDeprecate(t *testing.T) {
+	backend := NewMemStore()
+	insertWorkflow(t, backend, testWorkflow("lab", "9999999468", "doc"))
+	srv := httptest.NewServer(&lostResponse{Handler: NewAWSStandIn(backend, "")})
+	t.Cleanup(srv.Close)
+	s := &DBStore{Connection: tukdbint.TukDBConnection{DB_URL: srv.URL + "/beta/"}, Transport: &AWSTransport{Retries: 2, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}}
+	wfs := tukdbint.Workflows{Action: tukcnst.DEPRECATE}
+	wfs.Workflows = append(wfs.Workflows, tukdbint.Workflow{XDW_Key: "lab9999999468"})
+	if err := s.Workflows(&wfs); err != nil {
+		t.Fatal(err)
+	}
+	if rows := selectWorkflows(t, backend, tukdbint.Workflow{Pathway: "lab", Version: -1}); len(rows) != 1 || rows[0].Version != 1 {
+		t.Fatalf("deprecate retried after a lost response left %+v, want version 1", rows)
+	}
+}
+
+func TestAWSStandInBatch(t *testing.T) {
+	backend := NewMemStore()
+	s, _ := standInStore(t, backend)
+	err := WithTx(s, func(tx Store) error {
+		wfs := tukdbint.Workflows{Action: tukcnst.INSERT}
+		wfs.Workflows = append(wfs.Workflows, testWorkflow("lab", "9999999468", "doc1"))
+		if err := tx.Workflows(&wfs); err != nil {
+			return err
+		}
+		if wfs.LastInsertId != AWS_BATCH_PROVISIONAL_ID+1 {
+			t.Errorf("batch insert id is %v, want the provisional id", wfs.LastInsertId)
+		}
+		return tx.SetColumns(tukcnst.WORKFLOWS, wfs.LastInsertId, map[string]interface{}{"status": tukcnst.CLOSED})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := selectWorkflows(t, backend, tukdbint.Workflow{Pathway: "lab", Version: -1})
+	if len(rows) != 1 || rows[0].Status != tukcnst.CLOSED {
+		t.Fatalf("committed batch did not replace the provisional id, select returned %+v", rows)
+	}
+	if err := backend.SetWorkflowSummary(WorkflowSummary{Pathway: "lab", NHSId: "9999999468", SeqNo: 2}); err != nil {
+		t.Fatal(err)
+	}
+	err = WithTx(s, func(tx Store) error {
+		evs := tukdbint.Events{Action: tukcnst.INSERT}
+		evs.Events = append(evs.Events, tukdbint.Event{Pathway: "lab", NhsId: "9999999468", Expression: "Lab_Request"})
+		if err := tx.Events(&evs); err != nil {
+			return err
+		}
+		return tx.UpdateWorkflow(testWorkflow("lab", "9999999468", "stale"), 2, 1)
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("batch with a stale update returned %v, want a ConflictError", err)
+	}
+	if evs, _ := GetEvents(backend, "", "lab", "9999999468", "", -1, -1); evs.Count != 0 {
+		t.Fatalf("conflicting batch was partly applied, events are %+v", evs.Events)
+	}
+}
@@ -0,0 +1,558 @@
+package tukstore
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+// Backup
+//
+// A Backup is a portable json copy of store tables, used to move a pathway set between environments. The rows are the tukdbint
+// structs with their json tags. ImportBackup restores the tables in one transaction, matching each row to a stored row by its key,
+// eg. the xdws name, and applying a conflict policy to the rows that match.
+const (
+	BACKUP_FORMAT      = "tukstore-backup"
+	BACKUP_VERSION     = 1
+	CONFLICT_SKIP      = "skip"
+	CONFLICT_OVERWRITE = "overwrite"
+	CONFLICT_RENAME    = "rename"
+)
+
+// BackupConfigTables are the tables exported when no tables are given. They hold the pathway definitions and xds meta, templates,
+// static files, service configs and id mappings
+var BackupConfigTables = []string{tukcnst.XDWS, tukcnst.TEMPLATES, tukcnst.STATICS, tukcnst.SERVICE_STATES, tukcnst.ID_MAPS}
+
+// BackupDataTables are the workflow tables that can also be exported
+var BackupDataTables = []string{tukcnst.WORKFLOWS, tukcnst.EVENTS, tukcnst.EVENT_ACKS, tukcnst.SUBSCRIPTIONS}
+
+// EVENT_ATTACHMENT is the prefix of the identifier of a workflow task part attached from an event that is not registered with xds
+const EVENT_ATTACHMENT = "/eventservice/event?act=events&id="
+
+// Backup is a versioned json backup of store tables. Tables are the tables exported, which may have no rows
+type Backup struct {
+	Format        string                  `json:"format"`
+	Version       int                     `json:"version"`
+	Created       string                  `json:"created"`
+	Tables        []string                `json:"tables"`
+	XDWS          []tukdbint.XDW          `json:"xdws,omitempty"`
+	Templates     []tukdbint.Template     `json:"templates,omitempty"`
+	Statics       []tukdbint.Static       `json:"statics,omitempty"`
+	ServiceStates []tukdbint.ServiceState `json:"servicestates,omitempty"`
+	IdMaps        []tukdbint.IdMap        `json:"idmaps,omitempty"`
+	Workflows     []tukdbint.Workflow     `json:"workflows,omitempty"`
+	Events        []tukdbint.Event        `json:"events,omitempty"`
+	EventAcks     []tukdbint.EventAck     `json:"eventacks,omitempty"`
+	Subscriptions []tukdbint.Subscription `json:"subscriptions,omitempty"`
+}
+
+// BackupCount is the number of rows of a table in a backup and what ImportBackup did with them. Unchanged rows match a stored row
+// with the same values
+type BackupCount struct {
+	Table       string `json:"table"`
+	Rows        int    `json:"rows"`
+	Inserted    int    `json:"inserted"`
+	Overwritten int    `json:"overwritten"`
+	Renamed     int    `json:"renamed"`
+	Skipped     int    `json:"skipped"`
+	Unchanged   int    `json:"unchanged"`
+}
+
+// ExportBackup returns a Backup of the tables, or of the BackupConfigTables if no tables are given. A table with hashed columns,
+// eg. workflows and events, can not be exported from an encrypted store, as the hashes can not be reversed or imported into a
+// store with another hash key
+func ExportBackup(s Store, tables ...string) (Backup, error) {
+	if len(tables) == 0 {
+		tables = BackupConfigTables
+	}
+	b := Backup{Format: BACKUP_FORMAT, Version: BACKUP_VERSION, Created: time.Now().Format(time.RFC3339)}
+	keys := StoreKeyring(s)
+	for _, table := range tables {
+		if err := checkBackupTable(table); err != nil {
+			return b, err
+		}
+		if keys != nil && len(keys.Hashed[table]) > 0 {
+			err := fmt.Errorf("table %s has hashed columns %s and can not be exported from an encrypted store", table, strings.Join(keys.Hashed[table], ", "))
+			log.Println(err.Error())
+			return b, err
+		}
+		q := Query{}
+		q.Sort("id", false)
+		var err error
+		switch table {
+		case tukcnst.XDWS:
+			err = s.Find(table, q, &b.XDWS)
+		case tukcnst.TEMPLATES:
+			err = s.Find(table, q, &b.Templates)
+		case tukcnst.STATICS:
+			err = s.Find(table, q, &b.Statics)
+		case tukcnst.SERVICE_STATES:
+			err = s.Find(table, q, &b.ServiceStates)
+		case tukcnst.ID_MAPS:
+			err = s.Find(table, q, &b.IdMaps)
+		case tukcnst.WORKFLOWS:
+			err = s.Find(table, q, &b.Workflows)
+		case tukcnst.EVENTS:
+			err = s.Find(table, q, &b.Events)
+		case tukcnst.EVENT_ACKS:
+			err = s.Find(table, q, &b.EventAcks)
+		case tukcnst.SUBSCRIPTIONS:
+			err = s.Find(table, q, &b.Subscriptions)
+		}
+		if err != nil {
+			return b, err
+		}
+		b.Tables = append(b.Tables, table)
+	}
+	return b, nil
+}
+
+// Rows returns the number of rows of the table in the backup
+func (b Backup) Rows(table string) int {
+	switch table {
+	case tukcnst.XDWS:
+		return len(b.XDWS)
+	case tukcnst.TEMPLATES:
+		return len(b.Templates)
+	case tukcnst.STATICS:
+		return len(b.Statics)
+	case tukcnst.SERVICE_STATES:
+		return len(b.ServiceStates)
+	case tukcnst.ID_MAPS:
+		return len(b.IdMaps)
+	case tukcnst.WORKFLOWS:
+		return len(b.Workflows)
+	case tukcnst.EVENTS:
+		return len(b.Events)
+	case tukcnst.EVENT_ACKS:
+		return len(b.EventAcks)
+	case tukcnst.SUBSCRIPTIONS:
+		return len(b.Subscriptions)
+	}
+	return 0
+}
+
+// WriteBackup writes the backup json to the file
+func WriteBackup(b Backup, file string) error {
+	backupjson, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err := os.WriteFile(file, backupjson, 0o600); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// ReadBackup returns the Backup in the json file, or an error if it is not a backup or has a later version than BACKUP_VERSION
+func ReadBackup(file string) (Backup, error) {
+	b := Backup{}
+	backupjson, err := os.ReadFile(file)
+	if err != nil {
+		log.Println(err.Error())
+		return b, err
+	}
+	if err := json.Unmarshal(backupjson, &b); err != nil {
+		log.Println(err.Error())
+		return b, err
+	}
+	switch {
+	case b.Format != BACKUP_FORMAT:
+		return b, errors.New(filepath.Base(file) + " is not a " + BACKUP_FORMAT + " file")
+	case b.Version < 1 || b.Version > BACKUP_VERSION:
+		return b, fmt.Errorf("%s is backup version %v, this version reads backup versions 1 to %v", filepath.Base(file), b.Version, BACKUP_VERSION)
+	}
+	for _, table := range b.Tables {
+		if err := checkBackupTable(table); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// SummaryFunc returns the summary of a workflow from its XDW document and definition, eg. tukflow.ParseWorkflowSummary
+type SummaryFunc func(wf tukdbint.Workflow) (WorkflowSummary, error)
+
+// ImportBackup restores the backup tables, or the tables given, in one transaction and returns the counts of each table. A row
+// whose key matches a stored row is a conflict, and the policy is CONFLICT_SKIP to keep the stored row, CONFLICT_OVERWRITE to
+// replace its values or CONFLICT_RENAME to insert the row with a new name, eg. pathalert_2. Rows of the tables without a name,
+// idmaps, workflows, events, eventacks and subscriptions, are skipped when the policy is CONFLICT_RENAME. The keys are the name of
+// the xdws, statics and servicestates rows, the name and isxml of templates, the idmaps mid, the workflows xdw_key and version,
+// the events pathway, nhsid, version, taskid, expression and creationtime, the eventacks eventid, user, org, role and
+// creationtime and the subscriptions pathway, topic and expression.
+//
+// Workflow documents and event acknowledgements refer to events by id, so workflows and eventacks are imported with the events
+// table, which is imported first, and their event ids are changed to the ids of the imported or matching stored events. The
+// summary of each inserted or overwritten workflow is set from summary
+func ImportBackup(s Store, b Backup, policy string, summary SummaryFunc, tables ...string) ([]BackupCount, error) {
+	if policy != CONFLICT_SKIP && policy != CONFLICT_OVERWRITE && policy != CONFLICT_RENAME {
+		return nil, errors.New("conflict policy " + policy + " is not " + CONFLICT_SKIP + ", " + CONFLICT_OVERWRITE + " or " + CONFLICT_RENAME)
+	}
+	if len(tables) == 0 {
+		tables = b.Tables
+	}
+	for _, table := range tables {
+		if !contains(b.Tables, table) {
+			return nil, errors.New("backup does not contain table " + table)
+		}
+	}
+	if (contains(tables, tukcnst.WORKFLOWS) || contains(tables, tukcnst.EVENT_ACKS)) && !contains(tables, tukcnst.EVENTS) {
+		return nil, errors.New("workflows and eventacks refer to events by id and are only imported with the events table")
+	}
+	if contains(tables, tukcnst.WORKFLOWS) && summary == nil {
+		return nil, errors.New("workflows are imported with a summary func to set their derived columns")
+	}
+	if contains(tables, tukcnst.EVENTS) {
+		ordered := []string{tukcnst.EVENTS}
+		for _, table := range tables {
+			if table != tukcnst.EVENTS {
+				ordered = append(ordered, table)
+			}
+		}
+		tables = ordered
+	}
+	var counts []BackupCount
+	err := WithTx(s, func(tx Store) error {
+		counts = nil
+		eventids := make(map[int64]int64)
+		for _, table := range tables {
+			var count BackupCount
+			var err error
+			switch table {
+			case tukcnst.XDWS:
+				count, err = importTable(tx, table, b.XDWS, policy, func(r tukdbint.XDW) string { return r.Name }, func(r *tukdbint.XDW) *string { return &r.Name }, nil, nil)
+			case tukcnst.TEMPLATES:
+				count, err = importTable(tx, table, b.Templates, policy, func(r tukdbint.Template) string { return r.Name + "/" + strconv.FormatBool(r.IsXML) }, func(r *tukdbint.Template) *string { return &r.Name }, nil, nil)
+			case tukcnst.STATICS:
+				count, err = importTable(tx, table, b.Statics, policy, func(r tukdbint.Static) string { return r.Name }, func(r *tukdbint.Static) *string { return &r.Name }, nil, nil)
+			case tukcnst.SERVICE_STATES:
+				count, err = importTable(tx, table, b.ServiceStates, policy, func(r tukdbint.ServiceState) string { return r.Name }, func(r *tukdbint.ServiceState) *string { return &r.Name }, nil, nil)
+			case tukcnst.ID_MAPS:
+				count, err = importTable(tx, table, b.IdMaps, policy, func(r tukdbint.IdMap) string { return r.Mid }, nil, nil, nil)
+			case tukcnst.WORKFLOWS:
+				count, err = importTable(tx, table, b.Workflows, policy, func(r tukdbint.Workflow) string {
+					return rowKey(r.XDW_Key, r.Version)
+				}, nil, func(r *tukdbint.Workflow) error {
+					doc, err := importedEventIDs(r.XDW_Doc, eventids)
+					if err != nil {
+						err = fmt.Errorf("%s workflow version %v for NHS ID %s: %w", r.Pathway, r.Version, r.NHSId, err)
+						log.Println(err.Error())
+						return err
+					}
+					r.XDW_Doc = doc
+					return nil
+				}, func(_ int64, r tukdbint.Workflow, _ int64, written bool) error {
+					if !written {
+						return nil
+					}
+					sum, err := summary(r)
+					if err != nil {
+						return err
+					}
+					return tx.SetWorkflowSummary(sum)
+				})
+			case tukcnst.EVENTS:
+				count, err = importTable(tx, table, b.Events, policy, func(r tukdbint.Event) string {
+					return rowKey(strings.ToLower(r.Pathway), r.NhsId, r.Version, r.TaskId, r.Expression, keyTime(r.Creationtime))
+				}, nil, nil, func(backupid int64, _ tukdbint.Event, id int64, _ bool) error {
+					eventids[backupid] = id
+					return nil
+				})
+			case tukcnst.EVENT_ACKS:
+				count, err = importTable(tx, table, b.EventAcks, policy, func(r tukdbint.EventAck) string {
+					return rowKey(r.EventID, r.User, r.Org, r.Role, keyTime(r.CreationTime))
+				}, nil, func(r *tukdbint.EventAck) error {
+					id, ok := eventids[r.EventID]
+					if !ok {
+						err := fmt.Errorf("event acknowledgement by %s refers to event %v, which is not in the backup events", r.User, r.EventID)
+						log.Println(err.Error())
+						return err
+					}
+					r.EventID = id
+					return nil
+				}, nil)
+			case tukcnst.SUBSCRIPTIONS:
+				count, err = importTable(tx, table, b.Subscriptions, policy, func(r tukdbint.Subscription) string {
+					return rowKey(strings.ToLower(r.Pathway), r.Topic, r.Expression)
+				}, nil, nil, nil)
+			}
+			if err != nil {
+				return err
+			}
+			counts = append(counts, count)
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// importedEventIDs returns the XDW document with the event ids of its task events, completion events and event attachments
+// changed to the imported event ids, or the document unchanged if no id changes. It returns an error if an id is not an imported
+// event id
+func importedEventIDs(xdwdoc string, ids map[int64]int64) (string, error) {
+	doc := tukxdw.XDWWorkflowDocument{}
+	if err := xml.Unmarshal([]byte(xdwdoc), &doc); err != nil {
+		log.Println(err.Error())
+		return xdwdoc, err
+	}
+	changed := false
+	remap := func(id *string, prefix string) error {
+		old, err := strconv.ParseInt(strings.TrimPrefix(*id, prefix), 10, 64)
+		if err != nil || old < 1 {
+			return nil
+		}
+		imported, ok := ids[old]
+		if !ok {
+			return fmt.Errorf("the document refers to event %v, which is not in the backup events", old)
+		}
+		if imported != old {
+			*id = prefix + strconv.FormatInt(imported, 10)
+			changed = true
+		}
+		return nil
+	}
+	remapPart := func(part *tukxdw.Part) error {
+		if !strings.HasPrefix(part.AttachmentInfo.Identifier, EVENT_ATTACHMENT) {
+			return nil
+		}
+		return remap(&part.AttachmentInfo.Identifier, EVENT_ATTACHMENT)
+	}
+	for t := range doc.TaskList.XDWTask {
+		task := &doc.TaskList.XDWTask[t]
+		for k := range task.TaskEventHistory.TaskEvent {
+			if err := remap(&task.TaskEventHistory.TaskEvent[k].ID, ""); err != nil {
+				return xdwdoc, err
+			}
+		}
+		for k := range task.TaskData.Input {
+			if err := remapPart(&task.TaskData.Input[k].Part); err != nil {
+				return xdwdoc, err
+			}
+		}
+		for k := range task.TaskData.Output {
+			if err := remapPart(&task.TaskData.Output[k].Part); err != nil {
+				return xdwdoc, err
+			}
+		}
+	}
+	for k := range doc.WorkflowStatusHistory.DocumentEvent {
+		if docevent := &doc.WorkflowStatusHistory.DocumentEvent[k]; docevent.EventType == tukcnst.COMPLETE {
+			if err := remap(&docevent.TaskEventIdentifier, ""); err != nil {
+				return xdwdoc, err
+			}
+		}
+	}
+	if !changed {
+		return xdwdoc, nil
+	}
+	docbytes, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return xdwdoc, err
+	}
+	return string(docbytes), nil
+}
+
+// checkBackupTable returns an error if the table is not a BackupConfigTables or BackupDataTables table
+func checkBackupTable(table string) error {
+	if !contains(BackupConfigTables, table) && !contains(BackupDataTables, table) {
+		return errors.New("table " + table + " can not be backed up, the tables are " + strings.Join(append(append([]string{}, BackupConfigTables...), BackupDataTables...), ", "))
+	}
+	return nil
+}
+
+// importTable imports the rows of the table. key returns the key of a row and name returns its name, which is changed to rename a
+// row, or is nil if the table rows have no name. prepare, if not nil, changes a row before it is matched to the stored rows, and
+// imported, if not nil, is called with the backup id of each row, the row, the id of the row it was imported as or matched and
+// whether the row was written
+func importTable[T any](s Store, table string, rows []T, policy string, key func(T) string, name func(*T) *string, prepare func(*T) error, imported func(backupid int64, row T, id int64, written bool) error) (BackupCount, error) {
+	count := BackupCount{Table: table, Rows: len(rows)}
+	var stored []T
+	if err := s.Find(table, Query{}, &stored); err != nil {
+		return count, err
+	}
+	ids := make(map[string]int64)
+	existing := make(map[string]T)
+	names := make(map[string]bool)
+	for _, row := range stored {
+		ids[key(row)] = reflect.ValueOf(row).FieldByName("Id").Int()
+		existing[key(row)] = row
+		if name != nil {
+			names[*name(&row)] = true
+		}
+	}
+	done := func(backupid int64, row T, id int64, written bool) error {
+		if imported == nil {
+			return nil
+		}
+		return imported(backupid, row, id, written)
+	}
+	for _, row := range rows {
+		backupid := reflect.ValueOf(row).FieldByName("Id").Int()
+		if prepare != nil {
+			if err := prepare(&row); err != nil {
+				return count, err
+			}
+		}
+		k := key(row)
+		id, conflict := ids[k]
+		switch {
+		case !conflict:
+		case sameRow(row, existing[k]):
+			count.Unchanged = count.Unchanged + 1
+			if err := done(backupid, row, id, false); err != nil {
+				return count, err
+			}
+			continue
+		case policy == CONFLICT_OVERWRITE:
+			if err := s.SetColumns(table, id, rowValues(row)); err != nil {
+				return count, err
+			}
+			existing[k] = row
+			count.Overwritten = count.Overwritten + 1
+			if err := done(backupid, row, id, true); err != nil {
+				return count, err
+			}
+			continue
+		case policy == CONFLICT_RENAME && name != nil:
+			*name(&row) = renamed(*name(&row), names)
+			k = key(row)
+			count.Renamed = count.Renamed + 1
+		default:
+			count.Skipped = count.Skipped + 1
+			if err := done(backupid, row, id, false); err != nil {
+				return count, err
+			}
+			continue
+		}
+		reflect.ValueOf(&row).Elem().FieldByName("Id").SetInt(0)
+		id, err := insertRow(s, row)
+		if err != nil {
+			return count, err
+		}
+		ids[k], existing[k] = id, row
+		if name != nil {
+			names[*name(&row)] = true
+		}
+		count.Inserted = count.Inserted + 1
+		if err := done(backupid, row, id, true); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// insertRow inserts the tukdbint row and returns its id
+func insertRow(s Store, row interface{}) (int64, error) {
+	switch r := row.(type) {
+	case tukdbint.XDW:
+		rows := tukdbint.XDWS{Action: tukcnst.INSERT, XDW: []tukdbint.XDW{r}}
+		err := s.XDWS(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.Template:
+		rows := tukdbint.Templates{Action: tukcnst.INSERT, Templates: []tukdbint.Template{r}}
+		err := s.Templates(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.Static:
+		rows := tukdbint.Statics{Action: tukcnst.INSERT, Static: []tukdbint.Static{r}}
+		err := s.Statics(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.ServiceState:
+		rows := tukdbint.ServiceStates{Action: tukcnst.INSERT, ServiceState: []tukdbint.ServiceState{r}}
+		err := s.ServiceStates(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.IdMap:
+		rows := tukdbint.IdMaps{Action: tukcnst.INSERT, LidMap: []tukdbint.IdMap{r}}
+		err := s.IdMaps(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.Workflow:
+		rows := tukdbint.Workflows{Action: tukcnst.INSERT, Workflows: []tukdbint.Workflow{r}}
+		err := s.Workflows(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.Event:
+		rows := tukdbint.Events{Action: tukcnst.INSERT, Events: []tukdbint.Event{r}}
+		err := s.Events(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.EventAck:
+		rows := tukdbint.EventAcks{Action: tukcnst.INSERT, EventAck: []tukdbint.EventAck{r}}
+		err := s.EventAcks(&rows)
+		return rows.LastInsertId, err
+	case tukdbint.Subscription:
+		rows := tukdbint.Subscriptions{Action: tukcnst.INSERT, Subscriptions: []tukdbint.Subscription{r}}
+		err := s.Subscriptions(&rows)
+		return rows.LastInsertId, err
+	}
+	return 0, errors.New("unsupported backup row type")
+}
+
+// rowValues returns the column values of the row, other than id
+func rowValues(row interface{}) map[string]interface{} {
+	v := reflect.ValueOf(row)
+	values := make(map[string]interface{})
+	for f := 0; f < v.NumField(); f++ {
+		if column := strings.ToLower(v.Type().Field(f).Name); column != "id" {
+			values[column] = v.Field(f).Interface()
+		}
+	}
+	return values
+}
+
+// sameRow returns true if the rows have the same column values, other than id. Times are compared as instants
+func sameRow(a interface{}, b interface{}) bool {
+	avals, bvals := rowValues(a), rowValues(b)
+	for column, aval := range avals {
+		if isTimeColumn(column) {
+			aval, bvals[column] = keyTime(aval.(string)), keyTime(bvals[column].(string))
+		}
+		if !reflect.DeepEqual(aval, bvals[column]) {
+			return false
+		}
+	}
+	return true
+}
+
+// renamed returns the name with the lowest _<n> suffix, from 2, that is not taken. The suffix is added before the _meta of an xds
+// meta name and before the extension of a file name, eg. pathalert_2_meta and eventservice_2.css
+func renamed(name string, taken map[string]bool) string {
+	suffix := filepath.Ext(name)
+	if strings.HasSuffix(name, "_meta") {
+		suffix = "_meta"
+	}
+	base := strings.TrimSuffix(name, suffix)
+	for n := 2; ; n++ {
+		if candidate := base + "_" + strconv.Itoa(n) + suffix; !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+// rowKey joins the key values of a row
+func rowKey(vals ...interface{}) string {
+	var key []string
+	for _, val := range vals {
+		key = append(key, fmt.Sprint(val))
+	}
+	return strings.Join(key, "|")
+}
+
+// keyTime returns the RFC3339 time in UTC, so times read from different stores compare equal
+func keyTime(t string) string {
+	if parsed, err := time.Parse(time.RFC3339, t); err == nil {
+		return parsed.UTC().Format(time.RFC3339)
+	}
+	return t
+}
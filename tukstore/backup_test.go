@@ -0,0 +1,128 @@
+package tukstore
+
+import (
+	"encoding/xml"
+	"strconv"
+	"testing"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+// insertEvents inserts the lab events of 9999999468 with the expressions and returns their ids
+func insertEvents(t *testing.T, s Store, expressions ...string) []int64 {
+	t.Helper()
+	var ids []int64
+	for _, expression := range expressions {
+		evs := tukdbint.Events{Action: tukcnst.INSERT}
+		evs.Events = append(evs.Events, tukdbint.Event{Creationtime: "2024-01-01T09:00:00Z", Pathway: "lab", NhsId: "9999999468", Expression: expression, User: "u", Org: "o", Role: "r"})
+		if err := s.Events(&evs); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, evs.LastInsertId)
+	}
+	return ids
+}
+
+// eventDocument returns an XDW document with a created task event, a task event and an output attached from an event, and a
+// completion event
+func eventDocument(t *testing.T, created int64, attached int64, completed int64) string {
+	t.Helper()
+	task := tukxdw.XDWTask{}
+	for _, id := range []int64{created, attached} {
+		task.TaskEventHistory.TaskEvent = append(task.TaskEventHistory.TaskEvent, tukxdw.TaskEvent{ID: strconv.FormatInt(id, 10)})
+	}
+	output := tukxdw.Output{}
+	output.Part.AttachmentInfo.Identifier = EVENT_ATTACHMENT + strconv.FormatInt(attached, 10)
+	task.TaskData.Output = append(task.TaskData.Output, output)
+	doc := tukxdw.XDWWorkflowDocument{}
+	doc.TaskList.XDWTask = append(doc.TaskList.XDWTask, task)
+	doc.WorkflowStatusHistory.DocumentEvent = append(doc.WorkflowStatusHistory.DocumentEvent, tukxdw.DocumentEvent{EventType: tukcnst.COMPLETE, TaskEventIdentifier: strconv.FormatInt(completed, 10)})
+	docbytes, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(docbytes)
+}
+
+func TestExportBackupEncrypted(t *testing.T) {
+	keys, err := ParseKeyring([]byte(`{"current": "k1", "keys": {"k1": "` + NewKey() + `"}, "hashkey": "` + NewKey() + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewEncryptedStore(NewMemStore(), keys)
+	insertWorkflow(t, s, testWorkflow("lab", "9999999468", "doc"))
+	if _, err := ExportBackup(s, tukcnst.XDWS, tukcnst.WORKFLOWS); err == nil {
+		t.Fatal("workflows were exported from an encrypted store")
+	}
+	if _, err := ExportBackup(s, tukcnst.XDWS, tukcnst.SUBSCRIPTIONS); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ExportBackup(NewMemStore(), tukcnst.WORKFLOWS)
+	if err != nil || len(b.Tables) != 1 {
+		t.Fatalf("export from a plaintext store returned %+v, %v", b, err)
+	}
+}
+
+func TestImportBackupEventIDs(t *testing.T) {
+	source := NewMemStore()
+	ids := insertEvents(t, source, "CREATE", "Lab_Request", "COMPLETE")
+	insertWorkflow(t, source, testWorkflow("lab", "9999999468", eventDocument(t, ids[0], ids[1], ids[2])))
+	acks := tukdbint.EventAcks{Action: tukcnst.INSERT}
+	acks.EventAck = append(acks.EventAck, tukdbint.EventAck{CreationTime: "2024-01-01T10:00:00Z", EventID: ids[1], User: "u", Org: "o", Role: "r"})
+	if err := source.EventAcks(&acks); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ExportBackup(source, tukcnst.WORKFLOWS, tukcnst.EVENT_ACKS, tukcnst.EVENTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries := 0
+	summary := func(wf tukdbint.Workflow) (WorkflowSummary, error) {
+		summaries = summaries + 1
+		return WorkflowSummary{Pathway: wf.Pathway, NHSId: wf.NHSId, Version: wf.Version, CurrentTask: 1}, nil
+	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		summaries = 0
+		if _, err := ImportBackup(s, b, CONFLICT_SKIP, summary, tukcnst.WORKFLOWS); err == nil {
+			t.Fatal("workflows were imported without their events")
+		}
+		insertEvents(t, s, "Other_1", "Other_2")
+		if _, err := ImportBackup(s, b, CONFLICT_SKIP, summary); err != nil {
+			t.Fatal(err)
+		}
+		var evs []tukdbint.Event
+		if err := s.Find(tukcnst.EVENTS, Query{}, &evs); err != nil || len(evs) != 5 {
+			t.Fatalf("imported events are %+v, %v", evs, err)
+		}
+		imported := make(map[string]int64)
+		for _, ev := range evs {
+			imported[ev.Expression] = ev.Id
+		}
+		rows := selectWorkflows(t, s, tukdbint.Workflow{Pathway: "lab", NHSId: "9999999468", Version: -1})
+		if len(rows) != 1 || rows[0].XDW_Doc != eventDocument(t, imported["CREATE"], imported["Lab_Request"], imported["COMPLETE"]) {
+			t.Fatalf("imported workflows are %+v, want the event ids %+v", rows, imported)
+		}
+		var stored []tukdbint.EventAck
+		if err := s.Find(tukcnst.EVENT_ACKS, Query{}, &stored); err != nil || len(stored) != 1 || stored[0].EventID != imported["Lab_Request"] {
+			t.Fatalf("imported acks are %+v, %v", stored, err)
+		}
+		wfs, err := FindWorkflows(s, NewWorkflowQuery().Where("currenttask", OP_EQ, 1))
+		if err != nil || wfs.Count != 1 || summaries != 1 {
+			t.Fatalf("%v workflows have the summary after %v summaries, %v", wfs.Count, summaries, err)
+		}
+		counts, err := ImportBackup(s, b, CONFLICT_SKIP, summary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, count := range counts {
+			if count.Unchanged != count.Rows || count.Inserted != 0 {
+				t.Fatalf("second import of %s counted %+v", count.Table, count)
+			}
+		}
+		if summaries != 1 {
+			t.Fatalf("second import made %v summaries", summaries)
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package tukstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	ENV_TUK_STORE_CACHE_TTL = "TUK_STORE_CACHE_TTL"
+	DEFAULT_CACHE_TTL       = 5 * time.Minute
+)
+
+// CachedTables are the tables a CachedStore caches, which are read by every transaction and rarely written
+var CachedTables = []string{tukcnst.XDWS, tukcnst.TEMPLATES, tukcnst.STATICS, tukcnst.ID_MAPS}
+
+// CacheStats are the lookups of a cached table answered from the cache (Hits) and the store (Misses), the number of times the
+// table has been invalidated and the number of cached results
+type CacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+}
+
+// CachedStore answers SELECT actions and queries of the CachedTables from a cache of their results, held for TTL. A write to a
+// cached table through the CachedStore, including SetColumns and writes in a transaction when it commits, invalidates the table,
+// so a workflow definition, xds meta, template, static file or idmap change is seen by the next read. Writes by other processes
+// are seen once the cached results expire. It is safe for concurrent use, and the stores returned by WithContext share its cache
+type CachedStore struct {
+	Store Store
+	TTL   time.Duration
+	cache *storeCache
+	tx    *cachedTx
+}
+
+type storeCache struct {
+	mu      sync.Mutex
+	tables  map[string]*cacheTable
+	entries map[string]cacheEntry
+}
+type cacheTable struct {
+	stats      CacheStats
+	generation int64
+}
+type cacheEntry struct {
+	table   string
+	rows    interface{}
+	expires time.Time
+}
+
+// NewCachedStore returns a CachedStore for the store with results held for ttl
+func NewCachedStore(s Store, ttl time.Duration) *CachedStore {
+	c := storeCache{tables: make(map[string]*cacheTable), entries: make(map[string]cacheEntry)}
+	for _, table := range CachedTables {
+		c.tables[table] = &cacheTable{}
+	}
+	return &CachedStore{Store: s, TTL: ttl, cache: &c}
+}
+
+// Stats returns the CacheStats of each cached table
+func (s *CachedStore) Stats() map[string]CacheStats {
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	stats := make(map[string]CacheStats)
+	for name, table := range s.cache.tables {
+		table.stats.Entries = 0
+		stats[name] = table.stats
+	}
+	for _, entry := range s.cache.entries {
+		st := stats[entry.table]
+		st.Entries = st.Entries + 1
+		stats[entry.table] = st
+	}
+	return stats
+}
+
+// Invalidate discards the cached results of the tables, or of every cached table if none are given
+func (s *CachedStore) Invalidate(tables ...string) {
+	if len(tables) == 0 {
+		tables = CachedTables
+	}
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	for _, name := range tables {
+		table, ok := s.cache.tables[name]
+		if !ok {
+			continue
+		}
+		table.generation = table.generation + 1
+		table.stats.Invalidations = table.stats.Invalidations + 1
+		for key, entry := range s.cache.entries {
+			if entry.table == name {
+				delete(s.cache.entries, key)
+			}
+		}
+	}
+}
+
+// CacheTTL returns the TUK_STORE_CACHE_TTL duration, eg. 30s, or DEFAULT_CACHE_TTL if it is not set. A TTL of 0 disables the cache
+func CacheTTL() (time.Duration, error) {
+	env := os.Getenv(ENV_TUK_STORE_CACHE_TTL)
+	if env == "" {
+		return DEFAULT_CACHE_TTL, nil
+	}
+	ttl, err := time.ParseDuration(env)
+	if err == nil && ttl < 0 {
+		err = errors.New(ENV_TUK_STORE_CACHE_TTL + " can not be negative")
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return ttl, err
+}
+
+// Cache returns the CachedStore of s, or of the store wrapped by an EncryptedStore or ReplicaStore, or nil if it is not cached
+func Cache(s Store) *CachedStore {
+	switch t := s.(type) {
+	case *CachedStore:
+		return t
+	case *EncryptedStore:
+		return Cache(t.Store)
+	case *ReplicaStore:
+		return Cache(t.Writer)
+	}
+	return nil
+}
+func (s *CachedStore) Workflows(i *tukdbint.Workflows) error {
+	return s.Store.Workflows(i)
+}
+func (s *CachedStore) Events(i *tukdbint.Events) error {
+	return s.Store.Events(i)
+}
+func (s *CachedStore) Subscriptions(i *tukdbint.Subscriptions) error {
+	return s.Store.Subscriptions(i)
+}
+func (s *CachedStore) XDWS(i *tukdbint.XDWS) error {
+	return cached(s, tukcnst.XDWS, i.Action, &i.XDW, &i.Count, func(st Store) error { return st.XDWS(i) })
+}
+func (s *CachedStore) Templates(i *tukdbint.Templates) error {
+	return cached(s, tukcnst.TEMPLATES, i.Action, &i.Templates, &i.Count, func(st Store) error { return st.Templates(i) })
+}
+func (s *CachedStore) Statics(i *tukdbint.Statics) error {
+	return cached(s, tukcnst.STATICS, i.Action, &i.Static, &i.Count, func(st Store) error { return st.Statics(i) })
+}
+func (s *CachedStore) IdMaps(i *tukdbint.IdMaps) error {
+	return cached(s, tukcnst.ID_MAPS, i.Action, &i.LidMap, &i.Cnt, func(st Store) error { return st.IdMaps(i) })
+}
+func (s *CachedStore) ServiceStates(i *tukdbint.ServiceStates) error {
+	return s.Store.ServiceStates(i)
+}
+func (s *CachedStore) EventAcks(i *tukdbint.EventAcks) error {
+	return s.Store.EventAcks(i)
+}
+func (s *CachedStore) AssetVersions(i *AssetVersions) error {
+	return s.Store.AssetVersions(i)
+}
+func (s *CachedStore) WorkflowArchives(i *WorkflowArchives) error {
+	return s.Store.WorkflowArchives(i)
+}
+func (s *CachedStore) SubjectAudits(i *SubjectAudits) error {
+	return s.Store.SubjectAudits(i)
+}
+
+// Find answers queries of the cached tables from the cache, which is filled from the writer of a ReplicaStore
+func (s *CachedStore) Find(table string, q Query, rows interface{}) error {
+	if _, ok := s.cache.tables[table]; !ok || s.tx != nil {
+		return s.Store.Find(table, q, rows)
+	}
+	qbytes, _ := json.Marshal(q)
+	key := table + "/query/" + string(qbytes)
+	found := reflect.ValueOf(rows).Elem()
+	if cached, ok := s.cache.get(table, key); ok {
+		found.Set(reflect.AppendSlice(found, reflect.ValueOf(cached)))
+		return nil
+	}
+	generation := s.cache.generation(table)
+	result := reflect.New(found.Type())
+	if err := Writer(s.Store).Find(table, q, result.Interface()); err != nil {
+		return err
+	}
+	s.cache.put(table, key, result.Elem().Interface(), generation, s.TTL)
+	found.Set(reflect.AppendSlice(found, result.Elem()))
+	return nil
+}
+func (s *CachedStore) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	return s.Store.UpdateWorkflow(wf, seqno, expected)
+}
+func (s *CachedStore) SetWorkflowSummary(sum WorkflowSummary) error {
+	return s.Store.SetWorkflowSummary(sum)
+}
+
+// SetColumns invalidates the table if it is cached
+func (s *CachedStore) SetColumns(table string, id int64, values map[string]interface{}) error {
+	defer s.written(table)
+	return s.Store.SetColumns(table, id, values)
+}
+func (s *CachedStore) Dashboard(q Query, now time.Time) (tukxdw.Dashboard, error) {
+	return s.Store.Dashboard(q, now)
+}
+
+// Begin starts a transaction on the store. Reads in the transaction are not cached, and the tables it writes are invalidated when
+// it commits
+func (s *CachedStore) Begin() (Tx, error) {
+	tx, err := s.Store.Begin()
+	if err != nil {
+		return nil, err
+	}
+	t := &cachedTx{tx: tx, tables: make(map[string]bool)}
+	t.CachedStore = &CachedStore{Store: tx, TTL: s.TTL, cache: s.cache, tx: t}
+	return t, nil
+}
+func (s *CachedStore) WithContext(ctx context.Context) Store {
+	return &CachedStore{Store: s.Store.WithContext(ctx), TTL: s.TTL, cache: s.cache, tx: s.tx}
+}
+func (s *CachedStore) Close() error {
+	return s.Store.Close()
+}
+
+// written invalidates the table if it is cached, or when the transaction commits in a transaction
+func (s *CachedStore) written(table string) {
+	if _, ok := s.cache.tables[table]; !ok {
+		return
+	}
+	if s.tx != nil {
+		s.tx.mu.Lock()
+		s.tx.tables[table] = true
+		s.tx.mu.Unlock()
+		return
+	}
+	s.Invalidate(table)
+}
+
+type cachedTx struct {
+	*CachedStore
+	tx     Tx
+	mu     sync.Mutex
+	tables map[string]bool
+}
+
+func (t *cachedTx) Commit() error {
+	err := t.tx.Commit()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for table := range t.tables {
+		t.Invalidate(table)
+	}
+	return err
+}
+func (t *cachedTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// cached returns the rows of a cached table SELECT from the cache, keyed by the filter, and invalidates the table for any other action.
+// A miss is read from the writer of a ReplicaStore, as a lagging reader would cache rows older than the write that invalidated them
+func cached[T any](s *CachedStore, table string, action string, rows *[]T, count *int, exec func(Store) error) error {
+	if action != tukcnst.SELECT {
+		defer s.written(table)
+		return exec(s.Store)
+	}
+	if s.tx != nil || len(*rows) == 0 {
+		return exec(s.Store)
+	}
+	filter, _ := json.Marshal((*rows)[0])
+	key := table + "/" + string(filter)
+	if found, ok := s.cache.get(table, key); ok {
+		*rows = append(*rows, found.([]T)...)
+		*count = len(found.([]T))
+		return nil
+	}
+	generation := s.cache.generation(table)
+	if err := exec(Writer(s.Store)); err != nil {
+		return err
+	}
+	s.cache.put(table, key, append([]T(nil), (*rows)[1:]...), generation, s.TTL)
+	return nil
+}
+func (c *storeCache) get(table string, key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if ok {
+		c.tables[table].stats.Hits = c.tables[table].stats.Hits + 1
+		return entry.rows, true
+	}
+	c.tables[table].stats.Misses = c.tables[table].stats.Misses + 1
+	return nil, false
+}
+func (c *storeCache) generation(table string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tables[table].generation
+}
+
+// put caches the rows unless the table has been invalidated since generation, when the rows may be stale
+func (c *storeCache) put(table string, key string, rows interface{}, generation int64, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tables[table].generation == generation {
+		c.entries[key] = cacheEntry{table: table, rows: rows, expires: time.Now().Add(ttl)}
+	}
+}
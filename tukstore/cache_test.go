@@ -0,0 +1,129 @@
+package tukstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// selectXDWS returns the xdws rows with the name
+func selectXDWS(t *testing.T, s Store, name string) []tukdbint.XDW {
+	xdws := tukdbint.XDWS{Action: tukcnst.SELECT}
+	xdws.XDW = append(xdws.XDW, tukdbint.XDW{Name: name})
+	if err := s.XDWS(&xdws); err != nil {
+		t.Fatal(err)
+	}
+	return xdws.XDW[1:]
+}
+
+// insertXDW inserts an xdws row with the name and definition
+func insertXDW(t *testing.T, s Store, name string, xdw string) {
+	xdws := tukdbint.XDWS{Action: tukcnst.INSERT}
+	xdws.XDW = append(xdws.XDW, tukdbint.XDW{Name: name, XDW: xdw})
+	if err := s.XDWS(&xdws); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectStats fails the test if the xdws table stats are not the hits, misses and invalidations
+func expectStats(t *testing.T, s *CachedStore, hits int64, misses int64, invalidations int64) {
+	t.Helper()
+	st := s.Stats()[tukcnst.XDWS]
+	if st.Hits != hits || st.Misses != misses || st.Invalidations != invalidations {
+		t.Errorf("xdws stats are %+v, want %v hits, %v misses and %v invalidations", st, hits, misses, invalidations)
+	}
+}
+
+func TestCachedStoreWriteInvalidation(t *testing.T) {
+	s := NewCachedStore(NewMemStore(), time.Minute)
+	if rows := selectXDWS(t, s, "pathalert"); len(rows) != 0 {
+		t.Fatalf("selected %v xdws from an empty store", len(rows))
+	}
+	selectXDWS(t, s, "pathalert")
+	expectStats(t, s, 1, 1, 0)
+	insertXDW(t, s, "pathalert", "v1")
+	expectStats(t, s, 1, 1, 1)
+	if rows := selectXDWS(t, s, "pathalert"); len(rows) != 1 || rows[0].XDW != "v1" {
+		t.Fatalf("selected %+v after the insert, want the inserted xdw", rows)
+	}
+	if rows := selectXDWS(t, s, "pathalert"); len(rows) != 1 {
+		t.Fatalf("selected %v cached xdws, want 1", len(rows))
+	}
+	expectStats(t, s, 2, 2, 1)
+	if entries := s.Stats()[tukcnst.XDWS].Entries; entries != 1 {
+		t.Errorf("xdws has %v cached results, want 1", entries)
+	}
+	q := Query{}
+	var found []tukdbint.XDW
+	if err := s.SetColumns(tukcnst.XDWS, selectXDWS(t, s, "pathalert")[0].Id, map[string]interface{}{"xdw": "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Find(tukcnst.XDWS, *q.Filter("name", OP_EQ, "pathalert"), &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].XDW != "v2" {
+		t.Fatalf("found %+v after SetColumns, want the updated xdw", found)
+	}
+	expectStats(t, s, 3, 3, 2)
+}
+
+func TestCachedStoreCommitInvalidation(t *testing.T) {
+	s := NewCachedStore(NewMemStore(), time.Minute)
+	selectXDWS(t, s, "pathalert")
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertXDW(t, tx, "pathalert", "v1")
+	if rows := selectXDWS(t, tx, "pathalert"); len(rows) != 1 {
+		t.Fatalf("selected %v xdws in the transaction, want its insert", len(rows))
+	}
+	expectStats(t, s, 0, 1, 0)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	expectStats(t, s, 0, 1, 0)
+	tx, err = s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertXDW(t, tx, "pathalert", "v1")
+	if rows := selectXDWS(t, s, "pathalert"); len(rows) != 0 {
+		t.Fatalf("selected %v xdws before the commit, want the cached result", len(rows))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectStats(t, s, 1, 1, 1)
+	if rows := selectXDWS(t, s, "pathalert"); len(rows) != 1 {
+		t.Fatalf("selected %v xdws after the commit, want the committed insert", len(rows))
+	}
+	expectStats(t, s, 1, 2, 1)
+}
+
+func TestCachedStoreReplicaMiss(t *testing.T) {
+	writer, reader := NewMemStore(), NewMemStore()
+	s := NewCachedStore(NewReplicaStore(writer, reader), time.Minute)
+	selectXDWS(t, s, "pathalert")
+	insertXDW(t, s, "pathalert", "v1")
+	if rows := selectXDWS(t, reader, "pathalert"); len(rows) != 0 {
+		t.Fatalf("the lagging reader has %v xdws", len(rows))
+	}
+	if rows := selectXDWS(t, s, "pathalert"); len(rows) != 1 {
+		t.Fatalf("selected %v xdws after the insert, want the writer row", len(rows))
+	}
+	q := Query{}
+	var found []tukdbint.XDW
+	if err := s.Find(tukcnst.XDWS, *q.Filter("name", OP_EQ, "pathalert"), &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("found %v xdws after the insert, want the writer row", len(found))
+	}
+	if rows := selectXDWS(t, s, "pathalert"); len(rows) != 1 {
+		t.Fatalf("selected %v cached xdws, want the writer row", len(rows))
+	}
+	expectStats(t, s, 1, 3, 1)
+}
@@ -0,0 +1,239 @@
+package tukstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// AWS_TIMEOUT is the timeout of an AWS API Gateway request made with a context that has no deadline
+const AWS_TIMEOUT = 5 * time.Second
+
+// DBStore is the Store for the tukdbint MySQL and AWS API Gateway connections. tukdbint holds its connection globally, so only one
+// DBStore can be open at a time. AWS API Gateway requests are posted with the Transport, or the AWSTransport configured by the
+// environment if it is nil
+type DBStore struct {
+	Connection tukdbint.TukDBConnection
+	Transport  *AWSTransport
+	ctx        context.Context
+}
+
+// NewDBStore opens the tukdbint connection. If conn.DB_URL is set, requests are sent to the AWS API Gateway url, otherwise a MySQL connection is opened.
+// If conn.DBReader_Only is set, the store sends SELECT requests to its own AWS API Gateway url without replacing the tukdbint
+// connection, and refuses writes. A MySQL reader is a SQLStore, as it needs its own connection pool
+func NewDBStore(conn tukdbint.TukDBConnection) (*DBStore, error) {
+	var transport *AWSTransport
+	if conn.DB_URL != "" {
+		var err error
+		if transport, err = NewAWSTransport(conn.DB_URL); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+	}
+	if conn.DBReader_Only {
+		if conn.DB_URL == "" {
+			return nil, errors.New("a mysql reader connection must be opened with NewSQLStore")
+		}
+		return &DBStore{Connection: conn, Transport: transport}, nil
+	}
+	if err := tukdbint.NewDBEvent(&conn); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return &DBStore{Connection: conn, Transport: transport}, nil
+}
+
+func (s *DBStore) Workflows(i *tukdbint.Workflows) error {
+	return s.event(tukcnst.WORKFLOWS, i.Action, i)
+}
+func (s *DBStore) Events(i *tukdbint.Events) error {
+	return s.event(tukcnst.EVENTS, i.Action, i)
+}
+func (s *DBStore) Subscriptions(i *tukdbint.Subscriptions) error {
+	return s.event(tukcnst.SUBSCRIPTIONS, i.Action, i)
+}
+func (s *DBStore) XDWS(i *tukdbint.XDWS) error {
+	return s.event(tukcnst.XDWS, i.Action, i)
+}
+func (s *DBStore) Templates(i *tukdbint.Templates) error {
+	return s.event(tukcnst.TEMPLATES, i.Action, i)
+}
+func (s *DBStore) Statics(i *tukdbint.Statics) error {
+	return s.event(tukcnst.STATICS, i.Action, i)
+}
+func (s *DBStore) IdMaps(i *tukdbint.IdMaps) error {
+	return s.event(tukcnst.ID_MAPS, i.Action, i)
+}
+func (s *DBStore) ServiceStates(i *tukdbint.ServiceStates) error {
+	return s.event(tukcnst.SERVICE_STATES, i.Action, i)
+}
+
+// EventAcks executes the action with the SQLStore statements on the tukdbint MySQL connection pool, as tukdbint does not
+// implement the eventacks table, or sends it to the AWS API Gateway eventacks resource
+func (s *DBStore) EventAcks(i *tukdbint.EventAcks) error {
+	if s.Connection.DBReader_Only && i.Action != tukcnst.SELECT {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().EventAcks(i)
+	}
+	body, _ := json.Marshal(i)
+	rsp, err := s.awsRequest(tukcnst.EVENT_ACKS, i.Action, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rsp, i)
+}
+
+// AssetVersions executes the action with the SQLStore statements on the tukdbint MySQL connection pool, or sends it to the AWS API
+// Gateway assetversions resource
+func (s *DBStore) AssetVersions(i *AssetVersions) error {
+	if s.Connection.DBReader_Only && i.Action != tukcnst.SELECT {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().AssetVersions(i)
+	}
+	body, _ := json.Marshal(i)
+	rsp, err := s.awsRequest(ASSET_VERSIONS, i.Action, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rsp, i)
+}
+
+// WorkflowArchives executes the action with the SQLStore statements on the tukdbint MySQL connection pool, or sends it to the AWS
+// API Gateway workflowarchives resource
+func (s *DBStore) WorkflowArchives(i *WorkflowArchives) error {
+	if s.Connection.DBReader_Only && i.Action != tukcnst.SELECT {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().WorkflowArchives(i)
+	}
+	body, _ := json.Marshal(i)
+	rsp, err := s.awsRequest(WORKFLOW_ARCHIVES, i.Action, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rsp, i)
+}
+
+// SubjectAudits executes the action with the SQLStore statements on the tukdbint MySQL connection pool, or sends it to the AWS API
+// Gateway subjectaudits resource
+func (s *DBStore) SubjectAudits(i *SubjectAudits) error {
+	if s.Connection.DBReader_Only && i.Action != tukcnst.SELECT {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().SubjectAudits(i)
+	}
+	body, _ := json.Marshal(i)
+	rsp, err := s.awsRequest(SUBJECT_AUDITS, i.Action, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rsp, i)
+}
+
+// Find executes the query with the MySQL connection pool, or sends it to the AWS API Gateway <table>/query resource as
+// {"query": <Query json>}. The API must respond with {"rows": [<tukdbint row json>, ...]} holding the matching rows in query order
+func (s *DBStore) Find(table string, q Query, rows interface{}) error {
+	if s.Connection.DB_URL == "" {
+		return s.mysql().Find(table, q, rows)
+	}
+	if err := q.validate(table, reflect.TypeOf(rows).Elem().Elem()); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	body, _ := json.Marshal(struct {
+		Query Query `json:"query"`
+	}{Query: q})
+	awsrsp, err := s.awsRequest(table+"/query", tukcnst.SELECT, body)
+	if err != nil {
+		return err
+	}
+	rsp := struct {
+		Rows json.RawMessage `json:"rows"`
+	}{}
+	if err := json.Unmarshal(awsrsp, &rsp); err != nil || len(rsp.Rows) == 0 {
+		log.Printf("Invalid aws api %s query response", table)
+		return err
+	}
+	return json.Unmarshal(rsp.Rows, rows)
+}
+
+// SetColumns sets the column values with the MySQL connection pool, or posts {"id": <id>, "values": {<column>: <value>, ...}} to the
+// AWS API Gateway <table>/columns resource
+func (s *DBStore) SetColumns(table string, id int64, values map[string]interface{}) error {
+	if s.Connection.DBReader_Only {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().SetColumns(table, id, values)
+	}
+	if err := checkColumns(table, values); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	body, _ := json.Marshal(columnsRequest{Id: id, Values: values})
+	_, err := s.awsRequest(table+"/columns", tukcnst.UPDATE, body)
+	return err
+}
+
+// columnsRequest is the body of an AWS API Gateway <table>/columns request
+type columnsRequest struct {
+	Id     int64                  `json:"id"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// event executes the collection action. AWS API Gateway requests are posted to the store url, as tukdbint does, with the store
+// context. MySQL actions are executed by tukdbint, or with the SQLStore statements on the tukdbint connection pool if the store
+// has a context, as tukdbint does not accept one. A reader only store refuses any action other than SELECT
+func (s *DBStore) event(resource string, action string, i tukdbint.TUK_DB_Interface) error {
+	if s.Connection.DBReader_Only && action != tukcnst.SELECT {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		if s.ctx == nil {
+			return tukdbint.NewDBEvent(i)
+		}
+		return NewStoreEvent(s.mysql(), i)
+	}
+	body, _ := json.Marshal(i)
+	rsp, err := s.awsRequest(resource, action, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rsp, i)
+}
+
+// mysql returns a SQLStore sharing the tukdbint MySQL connection pool
+func (s *DBStore) mysql() *SQLStore {
+	d, _ := newDialect(tukcnst.MYSQL)
+	return &SQLStore{Dialect: tukcnst.MYSQL, Connection: s.Connection, DB: tukdbint.DBConn, dialect: d, ctx: s.ctx}
+}
+
+// WithContext returns the store with requests and statements run in the context. If the context has no deadline, AWS API Gateway
+// requests are limited to AWS_TIMEOUT and MySQL statements to STATEMENT_TIMEOUT
+func (s *DBStore) WithContext(ctx context.Context) Store {
+	return &DBStore{Connection: s.Connection, Transport: s.Transport, ctx: ctx}
+}
+
+// Close closes the MySQL connection and clears the AWS API Gateway url. Closing a reader only store has no effect
+func (s *DBStore) Close() error {
+	if s.Connection.DBReader_Only {
+		return nil
+	}
+	tukdbint.DB_URL = ""
+	if tukdbint.DBConn != nil {
+		return tukdbint.DBConn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package tukstore
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	POSTGRES = "postgres"
+)
+
+// POSTGRES_DRIVER is the database/sql driver name used for PostgreSQL connections. The binary must register the driver, as main does
+// with import _ "github.com/lib/pq" (driver "postgres"). Set it to use another driver, eg. "pgx" for github.com/jackc/pgx/v5/stdlib
+var POSTGRES_DRIVER = "postgres"
+
+// dialect holds the differences between the SQL databases supported by SQLStore
+type dialect struct {
+	name   string
+	driver string
+	port   string
+}
+
+func newDialect(name string) (dialect, error) {
+	switch name {
+	case tukcnst.MYSQL:
+		return dialect{name: tukcnst.MYSQL, driver: tukcnst.MYSQL, port: "3306"}, nil
+	case POSTGRES:
+		return dialect{name: POSTGRES, driver: POSTGRES_DRIVER, port: "5432"}, nil
+	}
+	return dialect{}, fmt.Errorf("unsupported sql dialect %s", name)
+}
+
+// quote returns the quoted identifier. user is reserved in PostgreSQL
+func (d dialect) quote(name string) string {
+	if d.name == POSTGRES {
+		return `"` + name + `"`
+	}
+	return "`" + name + "`"
+}
+
+// param returns the placeholder for the nth (from 1) statement value
+func (d dialect) param(n int) string {
+	if d.name == POSTGRES {
+		return fmt.Sprintf("$%v", n)
+	}
+	return "?"
+}
+
+// equals returns the where clause comparing the column with the nth value. PostgreSQL string comparisons are case sensitive, so
+// both sides are lower cased to match the default MySQL collation
+func (d dialect) equals(column string, n int, isstring bool) string {
+	if d.name == POSTGRES && isstring {
+		return "lower(" + d.quote(column) + ") = lower(" + d.param(n) + ")"
+	}
+	return d.quote(column) + " = " + d.param(n)
+}
+
+// returning is true when the id of an inserted row is returned by the INSERT statement rather than sql.Result.LastInsertId
+func (d dialect) returning() bool {
+	return d.name == POSTGRES
+}
+
+// dsn returns the data source name for the connection. params are appended as driver options, eg. sslmode=verify-full. MySQL
+// connections set clientFoundRows, so the rows affected by an UPDATE are the rows matched, as for PostgreSQL
+func (d dialect) dsn(conn tukdbint.TukDBConnection, params url.Values) string {
+	if conn.DBUser == "" {
+		conn.DBUser = "root"
+	}
+	if conn.DBPassword == "" {
+		conn.DBPassword = "rootPass"
+	}
+	if conn.DBHost == "" {
+		conn.DBHost = "localhost"
+	}
+	if conn.DBPort = strings.TrimPrefix(conn.DBPort, ":"); conn.DBPort == "" {
+		conn.DBPort = d.port
+	}
+	if conn.DBName == "" {
+		conn.DBName = "tuk"
+	}
+	if conn.DBTimeout = strings.TrimSuffix(conn.DBTimeout, "s"); conn.DBTimeout == "" {
+		conn.DBTimeout = "5"
+	}
+	if conn.DBReadTimeout = strings.TrimSuffix(conn.DBReadTimeout, "s"); conn.DBReadTimeout == "" {
+		conn.DBReadTimeout = "2"
+	}
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if d.name == POSTGRES {
+		dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s connect_timeout=%s", conn.DBHost, conn.DBPort, conn.DBUser, quoteOption(conn.DBPassword), conn.DBName, conn.DBTimeout)
+		for _, key := range keys {
+			dsn = dsn + " " + key + "=" + quoteOption(params.Get(key))
+		}
+		return dsn
+	}
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&clientFoundRows=true&timeout=%ss&readTimeout=%ss", conn.DBUser, conn.DBPassword, conn.DBHost, conn.DBPort, conn.DBName, conn.DBTimeout, conn.DBReadTimeout)
+	for _, key := range keys {
+		dsn = dsn + "&" + key + "=" + url.QueryEscape(params.Get(key))
+	}
+	return dsn
+}
+func quoteOption(val string) string {
+	if val == "" || strings.ContainsAny(val, ` '\`) {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(val) + "'"
+	}
+	return val
+}
@@ -0,0 +1,594 @@
+package tukstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+// Field level encryption
+//
+// An EncryptedStore encrypts the configured columns of the rows it writes and decrypts the rows it reads. Encrypted values are
+// stored as enc:<key id>:<wrapped data key>:<ciphertext>. Each value is encrypted with AES-256-GCM using a new random data key,
+// which is itself encrypted (wrapped) with the current key of the Keyring, so a key can be rotated by re-encrypting the rows with
+// Reencrypt. Encrypted columns can not be used in filters or queries.
+//
+// Hashed columns are stored as hmac:<hex HMAC-SHA256 of the lower case value>, so filters on them still work. The plaintext of a
+// hashed column is restored in the rows read with a filter or query condition on that column, and is otherwise returned as the
+// hash. The hash key can not be rotated, as the plaintext can not be recovered from the hash.
+//
+// Values without the enc: or hmac: prefix are plaintext rows written before encryption was enabled. They are read unchanged and
+// are encrypted by Reencrypt.
+const (
+	ENV_TUK_STORE_KEYS     = "TUK_STORE_KEYS"
+	ENV_TUK_STORE_KEY_FILE = "TUK_STORE_KEY_FILE"
+	ENCRYPTED_PREFIX       = "enc:"
+	HASHED_PREFIX          = "hmac:"
+	REENCRYPT_PAGE_SIZE    = 500
+)
+
+// DefaultEncryptedColumns are the columns encrypted when a Keyring does not configure them
+var DefaultEncryptedColumns = map[string][]string{
+	tukcnst.WORKFLOWS:  {"xdw_doc"},
+	tukcnst.EVENTS:     {"comments", "user", "authors", "docname", "xdspid"},
+	tukcnst.EVENT_ACKS: {"user"},
+	WORKFLOW_ARCHIVES:  {"content"},
+	SUBJECT_AUDITS:     {"pseudonym"},
+}
+
+// DefaultHashedColumns are the columns hashed when a Keyring does not configure them. The workflows xdw_key column is the
+// pathway and nhs id
+var DefaultHashedColumns = map[string][]string{
+	tukcnst.WORKFLOWS: {"nhsid", "xdw_key"},
+	tukcnst.EVENTS:    {"nhsid"},
+	WORKFLOW_ARCHIVES: {"nhsid", "xdw_key"},
+}
+
+// Keyring holds the base64 AES-256 key encryption keys by key id, the id of the key used to encrypt new values, the base64
+// HMAC key used for hashed columns, and the encrypted and hashed columns of the workflows, events, eventacks, workflowarchives and subjectaudits tables. It is read from the
+// json file named in TUK_STORE_KEY_FILE, or from the json value of TUK_STORE_KEYS, eg.
+//
+//	{"current": "2026-10", "keys": {"2026-04": "<base64>", "2026-10": "<base64>"}, "hashkey": "<base64>"}
+type Keyring struct {
+	Current   string              `json:"current"`
+	Keys      map[string]string   `json:"keys"`
+	HashKey   string              `json:"hashkey"`
+	Encrypted map[string][]string `json:"encrypted,omitempty"`
+	Hashed    map[string][]string `json:"hashed,omitempty"`
+	keys      map[string][]byte
+	hashkey   []byte
+}
+
+// LoadKeyring returns the Keyring configured in the environment, or nil if encryption is not configured
+func LoadKeyring() (*Keyring, error) {
+	keysjson := []byte(os.Getenv(ENV_TUK_STORE_KEYS))
+	if keyfile := os.Getenv(ENV_TUK_STORE_KEY_FILE); keyfile != "" {
+		var err error
+		if keysjson, err = os.ReadFile(keyfile); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+	}
+	if len(keysjson) == 0 {
+		return nil, nil
+	}
+	return ParseKeyring(keysjson)
+}
+
+// ParseKeyring returns the Keyring for the json. Keys must be 32 bytes and the current key must be present
+func ParseKeyring(keysjson []byte) (*Keyring, error) {
+	k := Keyring{}
+	if err := json.Unmarshal(keysjson, &k); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	k.keys = make(map[string][]byte)
+	for id, key := range k.Keys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("key id %s contains a colon", id)
+		}
+		keybytes, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(keybytes) != 32 {
+			return nil, fmt.Errorf("key %s is not a base64 32 byte key", id)
+		}
+		k.keys[id] = keybytes
+	}
+	if k.keys[k.Current] == nil {
+		return nil, fmt.Errorf("current key %s is not in the keyring", k.Current)
+	}
+	hashkey, err := base64.StdEncoding.DecodeString(k.HashKey)
+	if err != nil || len(hashkey) < 32 {
+		return nil, errors.New("hash key is not a base64 key of at least 32 bytes")
+	}
+	k.hashkey = hashkey
+	if k.Encrypted == nil {
+		k.Encrypted = DefaultEncryptedColumns
+	}
+	if k.Hashed == nil {
+		k.Hashed = DefaultHashedColumns
+	}
+	return &k, nil
+}
+
+// StoreKeyring returns the Keyring of the EncryptedStore s, or of an EncryptedStore it wraps, or nil if the store is not encrypted
+func StoreKeyring(s Store) *Keyring {
+	switch t := s.(type) {
+	case *EncryptedStore:
+		return t.Keys
+	case *CachedStore:
+		return StoreKeyring(t.Store)
+	case *ReplicaStore:
+		return StoreKeyring(t.Writer)
+	}
+	return nil
+}
+
+// NewKey returns a new random base64 32 byte key for a Keyring
+func NewKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Encrypt returns the value encrypted with a new data key wrapped by the current key
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	datakey := make([]byte, 32)
+	if _, err := rand.Read(datakey); err != nil {
+		return "", err
+	}
+	wrapped, err := sealGCM(k.keys[k.Current], datakey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealGCM(datakey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return ENCRYPTED_PREFIX + k.Current + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(ciphertext), nil
+}
+
+// Decrypt returns the plaintext of an encrypted value. A value without the enc: prefix is returned unchanged
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, ENCRYPTED_PREFIX) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, ENCRYPTED_PREFIX), ":")
+	if len(parts) != 3 {
+		return "", errors.New("invalid encrypted value")
+	}
+	key := k.keys[parts[0]]
+	if key == nil {
+		return "", fmt.Errorf("key %s is not in the keyring", parts[0])
+	}
+	enc := base64.RawStdEncoding
+	wrapped, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	datakey, err := openGCM(key, wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openGCM(datakey, ciphertext)
+	return string(plaintext), err
+}
+
+// Hash returns the keyed hash of the lower case value. A value that is already hashed is returned unchanged
+func (k *Keyring) Hash(value string) string {
+	if strings.HasPrefix(value, HASHED_PREFIX) {
+		return value
+	}
+	mac := hmac.New(sha256.New, k.hashkey)
+	mac.Write([]byte(strings.ToLower(value)))
+	return HASHED_PREFIX + hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsCurrent returns true if the value is encrypted with the current key
+func (k *Keyring) IsCurrent(value string) bool {
+	return strings.HasPrefix(value, ENCRYPTED_PREFIX+k.Current+":")
+}
+func (k *Keyring) isEncrypted(table string, column string) bool {
+	return contains(k.Encrypted[table], column)
+}
+func (k *Keyring) isHashed(table string, column string) bool {
+	return contains(k.Hashed[table], column)
+}
+func sealGCM(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+func openGCM(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("invalid encrypted value")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// EncryptedStore encrypts and hashes the Keyring columns of the Store rows
+type EncryptedStore struct {
+	Store Store
+	Keys  *Keyring
+}
+
+// NewEncryptedStore returns an EncryptedStore for the store and keyring
+func NewEncryptedStore(s Store, keys *Keyring) *EncryptedStore {
+	return &EncryptedStore{Store: s, Keys: keys}
+}
+func (s *EncryptedStore) Workflows(i *tukdbint.Workflows) error {
+	return encrypted(s, tukcnst.WORKFLOWS, i.Action, &i.Workflows, func() error { return s.Store.Workflows(i) })
+}
+func (s *EncryptedStore) Events(i *tukdbint.Events) error {
+	return encrypted(s, tukcnst.EVENTS, i.Action, &i.Events, func() error { return s.Store.Events(i) })
+}
+func (s *EncryptedStore) Subscriptions(i *tukdbint.Subscriptions) error {
+	return s.Store.Subscriptions(i)
+}
+func (s *EncryptedStore) XDWS(i *tukdbint.XDWS) error {
+	return s.Store.XDWS(i)
+}
+func (s *EncryptedStore) Templates(i *tukdbint.Templates) error {
+	return s.Store.Templates(i)
+}
+func (s *EncryptedStore) Statics(i *tukdbint.Statics) error {
+	return s.Store.Statics(i)
+}
+func (s *EncryptedStore) IdMaps(i *tukdbint.IdMaps) error {
+	return s.Store.IdMaps(i)
+}
+func (s *EncryptedStore) ServiceStates(i *tukdbint.ServiceStates) error {
+	return s.Store.ServiceStates(i)
+}
+func (s *EncryptedStore) EventAcks(i *tukdbint.EventAcks) error {
+	return encrypted(s, tukcnst.EVENT_ACKS, i.Action, &i.EventAck, func() error { return s.Store.EventAcks(i) })
+}
+func (s *EncryptedStore) AssetVersions(i *AssetVersions) error {
+	return s.Store.AssetVersions(i)
+}
+func (s *EncryptedStore) WorkflowArchives(i *WorkflowArchives) error {
+	return encrypted(s, WORKFLOW_ARCHIVES, i.Action, &i.WorkflowArchives, func() error { return s.Store.WorkflowArchives(i) })
+}
+func (s *EncryptedStore) SubjectAudits(i *SubjectAudits) error {
+	return encrypted(s, SUBJECT_AUDITS, i.Action, &i.SubjectAudits, func() error { return s.Store.SubjectAudits(i) })
+}
+
+// Find hashes the values of conditions on hashed columns and decrypts the rows found
+func (s *EncryptedStore) Find(table string, q Query, rows interface{}) error {
+	plain, err := s.query(table, &q)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Find(table, q, rows); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(rows).Elem()
+	for k := 0; k < v.Len(); k++ {
+		if err := s.decrypt(table, v.Index(k), plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateWorkflow encrypts the workflow document and hashes the nhs id. A ConflictError holds the plaintext nhs id
+func (s *EncryptedStore) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	row := wf
+	if err := s.encrypt(tukcnst.WORKFLOWS, reflect.ValueOf(&row).Elem(), false); err != nil {
+		return err
+	}
+	if err := s.Store.UpdateWorkflow(row, seqno, expected); err != nil {
+		if errors.Is(err, ErrConflict) {
+			return conflict(reflect.ValueOf(wf))
+		}
+		return err
+	}
+	return nil
+}
+func (s *EncryptedStore) SetWorkflowSummary(sum WorkflowSummary) error {
+	if s.Keys.isHashed(tukcnst.WORKFLOWS, "nhsid") {
+		sum.NHSId = s.Keys.Hash(sum.NHSId)
+	}
+	return s.Store.SetWorkflowSummary(sum)
+}
+
+// SetColumns encrypts or hashes the values of encrypted and hashed columns
+func (s *EncryptedStore) SetColumns(table string, id int64, values map[string]interface{}) error {
+	set := make(map[string]interface{})
+	for column, val := range values {
+		str, ok := val.(string)
+		switch {
+		case !ok || str == "":
+		case s.Keys.isHashed(table, column):
+			val = s.Keys.Hash(str)
+		case s.Keys.isEncrypted(table, column):
+			enc, err := s.Keys.Encrypt(str)
+			if err != nil {
+				return err
+			}
+			val = enc
+		}
+		set[column] = val
+	}
+	return s.Store.SetColumns(table, id, set)
+}
+func (s *EncryptedStore) Dashboard(q Query, now time.Time) (tukxdw.Dashboard, error) {
+	if _, err := s.query(tukcnst.WORKFLOWS, &q); err != nil {
+		return tukxdw.Dashboard{}, err
+	}
+	return s.Store.Dashboard(q, now)
+}
+
+// Begin starts a transaction on the store, which encrypts with the same keys
+func (s *EncryptedStore) Begin() (Tx, error) {
+	tx, err := s.Store.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedTx{EncryptedStore: &EncryptedStore{Store: tx, Keys: s.Keys}, tx: tx}, nil
+}
+func (s *EncryptedStore) WithContext(ctx context.Context) Store {
+	return &EncryptedStore{Store: s.Store.WithContext(ctx), Keys: s.Keys}
+}
+func (s *EncryptedStore) Close() error {
+	return s.Store.Close()
+}
+
+type encryptedTx struct {
+	*EncryptedStore
+	tx Tx
+}
+
+func (t *encryptedTx) Commit() error {
+	return t.tx.Commit()
+}
+func (t *encryptedTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// Reencrypt encrypts the plaintext values and the values not encrypted with the current key, and hashes the plaintext values, of
+// the configured columns of the workflows, events, eventacks, workflowarchives and subjectaudits tables. It returns the number of rows updated
+func (s *EncryptedStore) Reencrypt() (int, error) {
+	count, err := reencrypt[tukdbint.Workflow](s, tukcnst.WORKFLOWS)
+	if err != nil {
+		return count, err
+	}
+	n, err := reencrypt[tukdbint.Event](s, tukcnst.EVENTS)
+	if count = count + n; err != nil {
+		return count, err
+	}
+	n, err = reencrypt[tukdbint.EventAck](s, tukcnst.EVENT_ACKS)
+	if count = count + n; err != nil {
+		return count, err
+	}
+	n, err = reencrypt[WorkflowArchive](s, WORKFLOW_ARCHIVES)
+	if count = count + n; err != nil {
+		return count, err
+	}
+	n, err = reencrypt[SubjectAudit](s, SUBJECT_AUDITS)
+	return count + n, err
+}
+func reencrypt[T any](s *EncryptedStore, table string) (int, error) {
+	count := 0
+	for page := 1; ; page++ {
+		var rows []T
+		q := Query{}
+		if err := Writer(s.Store).Find(table, *q.Paginate(page, REENCRYPT_PAGE_SIZE), &rows); err != nil {
+			return count, err
+		}
+		for _, row := range rows {
+			v := reflect.ValueOf(row)
+			set := make(map[string]interface{})
+			for f := 0; f < v.NumField(); f++ {
+				column := strings.ToLower(v.Type().Field(f).Name)
+				val := v.Field(f)
+				if val.Kind() != reflect.String || val.String() == "" {
+					continue
+				}
+				switch {
+				case s.Keys.isHashed(table, column) && !strings.HasPrefix(val.String(), HASHED_PREFIX):
+					set[column] = s.Keys.Hash(val.String())
+				case s.Keys.isEncrypted(table, column) && !s.Keys.IsCurrent(val.String()):
+					plaintext, err := s.Keys.Decrypt(val.String())
+					if err != nil {
+						return count, err
+					}
+					if set[column], err = s.Keys.Encrypt(plaintext); err != nil {
+						return count, err
+					}
+				}
+			}
+			if len(set) == 0 {
+				continue
+			}
+			if err := s.Store.SetColumns(table, v.FieldByName("Id").Int(), set); err != nil {
+				return count, err
+			}
+			count = count + 1
+		}
+		if len(rows) < REENCRYPT_PAGE_SIZE {
+			log.Printf("Re-encrypted %v %s rows", count, table)
+			return count, nil
+		}
+	}
+}
+
+// encrypted encrypts and hashes the rows before executing the action, then restores the filter and decrypts the selected rows
+func encrypted[T any](s *EncryptedStore, table string, action string, rows *[]T, exec func() error) error {
+	if len(*rows) == 0 {
+		return exec()
+	}
+	original := append([]T{}, *rows...)
+	defer func() {
+		for k := range original {
+			if k < len(*rows) {
+				(*rows)[k] = original[k]
+			}
+		}
+	}()
+	for k := range *rows {
+		row := reflect.ValueOf(&(*rows)[k]).Elem()
+		isfilter := action != tukcnst.INSERT && !(action == tukcnst.UPDATE && k == 0)
+		if err := s.encrypt(table, row, isfilter); err != nil {
+			return err
+		}
+	}
+	if err := exec(); err != nil {
+		return err
+	}
+	if action == tukcnst.SELECT {
+		plain := make(map[string]string)
+		filter := reflect.ValueOf(original[0])
+		for _, column := range s.Keys.Hashed[table] {
+			if val, ok := field(filter, column).(string); ok && val != "" {
+				plain[column] = val
+			}
+		}
+		for k := 1; k < len(*rows); k++ {
+			if err := s.decrypt(table, reflect.ValueOf(&(*rows)[k]).Elem(), plain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encrypt hashes the hashed columns of the row and encrypts the encrypted columns. Encrypted columns can not be used in a filter
+func (s *EncryptedStore) encrypt(table string, row reflect.Value, isfilter bool) error {
+	for f := 0; f < row.NumField(); f++ {
+		column := strings.ToLower(row.Type().Field(f).Name)
+		val := row.Field(f)
+		if val.Kind() != reflect.String || val.String() == "" {
+			continue
+		}
+		switch {
+		case s.Keys.isHashed(table, column):
+			val.SetString(s.Keys.Hash(val.String()))
+		case s.Keys.isEncrypted(table, column):
+			if isfilter {
+				return fmt.Errorf("column %s of table %s is encrypted and can not be used in a filter", column, table)
+			}
+			enc, err := s.Keys.Encrypt(val.String())
+			if err != nil {
+				return err
+			}
+			val.SetString(enc)
+		}
+	}
+	return nil
+}
+
+// decrypt decrypts the encrypted columns of the row and sets the hashed columns to their plaintext filter values. The hashed
+// workflows xdw_key is restored from the pathway and nhs id
+func (s *EncryptedStore) decrypt(table string, row reflect.Value, plain map[string]string) error {
+	defer func() {
+		if table != tukcnst.WORKFLOWS || !strings.HasPrefix(row.FieldByName("XDW_Key").String(), HASHED_PREFIX) {
+			return
+		}
+		if xdwkey := strings.ToUpper(row.FieldByName("Pathway").String()) + row.FieldByName("NHSId").String(); s.Keys.Hash(xdwkey) == row.FieldByName("XDW_Key").String() {
+			row.FieldByName("XDW_Key").SetString(xdwkey)
+		}
+	}()
+	for f := 0; f < row.NumField(); f++ {
+		column := strings.ToLower(row.Type().Field(f).Name)
+		val := row.Field(f)
+		if val.Kind() != reflect.String || val.String() == "" {
+			continue
+		}
+		switch {
+		case s.Keys.isHashed(table, column) && plain[column] != "":
+			val.SetString(plain[column])
+		case s.Keys.isEncrypted(table, column):
+			plaintext, err := s.Keys.Decrypt(val.String())
+			if err != nil {
+				log.Println(err.Error())
+				return err
+			}
+			val.SetString(plaintext)
+		}
+	}
+	return nil
+}
+
+// query hashes the values of conditions on hashed columns and returns the plaintext of single valued conditions on them. Other
+// conditions on hashed columns, and any condition or order on encrypted columns, return an error
+func (s *EncryptedStore) query(table string, q *Query) (map[string]string, error) {
+	plain := make(map[string]string)
+	var where []Condition
+	for _, c := range q.Where {
+		coltable := table
+		if c.Op == OP_EVENT || c.Op == OP_UNACKED {
+			coltable = tukcnst.EVENTS
+		}
+		switch {
+		case s.Keys.isEncrypted(coltable, c.Column):
+			return nil, fmt.Errorf("column %s of table %s is encrypted and can not be queried", c.Column, coltable)
+		case s.Keys.isHashed(coltable, c.Column):
+			if c.Op != OP_EQ && c.Op != OP_NE && c.Op != OP_IN && c.Op != OP_EVENT && c.Op != OP_UNACKED {
+				return nil, fmt.Errorf("column %s of table %s is hashed and can only be compared for equality", c.Column, coltable)
+			}
+			var vals []interface{}
+			for _, val := range c.Values {
+				vals = append(vals, s.Keys.Hash(fmt.Sprint(val)))
+			}
+			if len(c.Values) == 1 && c.Op != OP_NE && c.Op != OP_EVENT && c.Op != OP_UNACKED {
+				plain[c.Column] = fmt.Sprint(c.Values[0])
+			}
+			c.Values = vals
+		}
+		where = append(where, c)
+	}
+	for _, o := range q.OrderBy {
+		if s.Keys.isEncrypted(table, o.Column) || s.Keys.isHashed(table, o.Column) {
+			return nil, fmt.Errorf("column %s of table %s is encrypted and can not be sorted", o.Column, table)
+		}
+	}
+	q.Where = where
+	return plain, nil
+}
@@ -0,0 +1,114 @@
+package tukstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// testKeyring returns a keyring with the current key and the other keys, all sharing the hash key
+func testKeyring(t *testing.T, hashkey string, current string, keys map[string]string) *Keyring {
+	t.Helper()
+	var ids []string
+	for id, key := range keys {
+		ids = append(ids, `"`+id+`": "`+key+`"`)
+	}
+	k, err := ParseKeyring([]byte(`{"current": "` + current + `", "keys": {` + strings.Join(ids, ", ") + `}, "hashkey": "` + hashkey + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyringEncrypt(t *testing.T) {
+	k1, k2 := NewKey(), NewKey()
+	keys := testKeyring(t, NewKey(), "k1", map[string]string{"k1": k1, "k2": k2})
+	first, err := keys.Encrypt("<xdw>9999999468</xdw>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := keys.Encrypt("<xdw>9999999468</xdw>")
+	if first == second || !keys.IsCurrent(first) || strings.Contains(first, "9999999468") {
+		t.Fatalf("encrypted values are %s and %s", first, second)
+	}
+	if plaintext, err := keys.Decrypt(first); err != nil || plaintext != "<xdw>9999999468</xdw>" {
+		t.Fatalf("decrypt returned %s, %v", plaintext, err)
+	}
+	if plaintext, err := keys.Decrypt("plaintext"); err != nil || plaintext != "plaintext" {
+		t.Fatalf("decrypt of a plaintext value returned %s, %v", plaintext, err)
+	}
+	tampered := first[:len(first)-2] + "AA"
+	if _, err := keys.Decrypt(tampered); err == nil {
+		t.Fatal("decrypt of a tampered value succeeded")
+	}
+	if _, err := testKeyring(t, NewKey(), "k2", map[string]string{"k2": k2}).Decrypt(first); err == nil {
+		t.Fatal("decrypt without the key succeeded")
+	}
+	if hash := keys.Hash("LAB9999999468"); hash != keys.Hash("lab9999999468") || keys.Hash(hash) != hash || !strings.HasPrefix(hash, HASHED_PREFIX) {
+		t.Fatalf("hash is %s", hash)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	keys := testKeyring(t, NewKey(), "k1", map[string]string{"k1": NewKey()})
+	forEachStore(t, func(t *testing.T, plain Store) {
+		s := NewEncryptedStore(plain, keys)
+		insertWorkflow(t, s, testWorkflow("lab", "9999999468", "doc1"))
+		stored := selectWorkflows(t, plain, tukdbint.Workflow{Pathway: "lab", Version: -1})
+		if len(stored) != 1 || !keys.IsCurrent(stored[0].XDW_Doc) || stored[0].NHSId != keys.Hash("9999999468") || stored[0].XDW_Key != keys.Hash("lab9999999468") {
+			t.Fatalf("stored workflow is %+v", stored)
+		}
+		rows := selectWorkflows(t, s, tukdbint.Workflow{Pathway: "lab", NHSId: "9999999468", Version: -1})
+		if len(rows) != 1 || rows[0].XDW_Doc != "doc1" || rows[0].NHSId != "9999999468" {
+			t.Fatalf("select returned %+v", rows)
+		}
+		if err := s.SetWorkflowSummary(WorkflowSummary{Pathway: "lab", NHSId: "9999999468", SeqNo: 1}); err != nil {
+			t.Fatal(err)
+		}
+		wf := testWorkflow("lab", "9999999468", "doc2")
+		if err := s.UpdateWorkflow(wf, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+		err := s.UpdateWorkflow(wf, 2, 1)
+		conflict := &ConflictError{}
+		if !errors.As(err, &conflict) || conflict.NHSId != "9999999468" {
+			t.Fatalf("stale update returned %v, want a ConflictError with the plaintext nhs id", err)
+		}
+		found := []tukdbint.Workflow{}
+		q := NewWorkflowQuery().Where("nhsid", OP_EQ, "9999999468")
+		if err := s.Find(tukcnst.WORKFLOWS, q.Query, &found); err != nil || len(found) != 1 || found[0].XDW_Doc != "doc2" || found[0].NHSId != "9999999468" {
+			t.Fatalf("find returned %+v, %v", found, err)
+		}
+		if err := s.Find(tukcnst.WORKFLOWS, NewWorkflowQuery().Where("xdw_doc", OP_EQ, "doc2").Query, &found); err == nil {
+			t.Fatal("find with a condition on an encrypted column succeeded")
+		}
+	})
+}
+
+func TestReencrypt(t *testing.T) {
+	hashkey, k1, k2 := NewKey(), NewKey(), NewKey()
+	plain := NewMemStore()
+	insertWorkflow(t, plain, testWorkflow("lab", "9999999468", "legacy"))
+	insertWorkflow(t, NewEncryptedStore(plain, testKeyring(t, hashkey, "k1", map[string]string{"k1": k1})), testWorkflow("lab", "9999999484", "old key"))
+	keys := testKeyring(t, hashkey, "k2", map[string]string{"k1": k1, "k2": k2})
+	s := NewEncryptedStore(plain, keys)
+	if n, err := s.Reencrypt(); err != nil || n != 2 {
+		t.Fatalf("reencrypt updated %v rows, %v", n, err)
+	}
+	for _, row := range selectWorkflows(t, plain, tukdbint.Workflow{Pathway: "lab", Version: -1}) {
+		if !keys.IsCurrent(row.XDW_Doc) || !strings.HasPrefix(row.NHSId, HASHED_PREFIX) || !strings.HasPrefix(row.XDW_Key, HASHED_PREFIX) {
+			t.Fatalf("reencrypted row is %+v", row)
+		}
+	}
+	for nhsid, doc := range map[string]string{"9999999468": "legacy", "9999999484": "old key"} {
+		if rows := selectWorkflows(t, s, tukdbint.Workflow{Pathway: "lab", NHSId: nhsid, Version: -1}); len(rows) != 1 || rows[0].XDW_Doc != doc {
+			t.Fatalf("select of %s returned %+v", nhsid, rows)
+		}
+	}
+	if n, err := s.Reencrypt(); err != nil || n != 0 {
+		t.Fatalf("second reencrypt updated %v rows, %v", n, err)
+	}
+}
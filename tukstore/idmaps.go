@@ -0,0 +1,138 @@
+package tukstore
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// oidPattern matches an ISO OID in dotted decimal notation, with an optional urn:oid: prefix as used for home community ids
+var oidPattern = regexp.MustCompile(`^(urn:oid:)?[0-2](\.(0|[1-9][0-9]*))+$`)
+
+// ValidateIdMap returns an error if the mapped id is empty or the local id is not a well formed OID
+func ValidateIdMap(mid string, lid string) error {
+	if strings.TrimSpace(mid) == "" {
+		return errors.New("idmap mapped id is not set")
+	}
+	if !oidPattern.MatchString(lid) {
+		return fmt.Errorf("idmap local id %s for %s is not a well formed oid", lid, mid)
+	}
+	return nil
+}
+
+// FindIdMaps returns the idmaps whose mapped and local ids match the like patterns, ordered by mapped id. An empty pattern matches any id
+func FindIdMaps(s Store, midpattern string, lidpattern string) ([]tukdbint.IdMap, error) {
+	var idmaps []tukdbint.IdMap
+	q := Query{}
+	if midpattern != "" {
+		q.Filter("mid", OP_LIKE, midpattern)
+	}
+	if lidpattern != "" {
+		q.Filter("lid", OP_LIKE, lidpattern)
+	}
+	err := s.Find(tukcnst.ID_MAPS, *q.Sort("mid", false), &idmaps)
+	return idmaps, err
+}
+
+// SetIdMap maps mid to the local id lid, adding the mapping if mid is not mapped. Duplicate mappings of mid, which
+// GetIDMapsLocalId ignores, are replaced. It returns true if the idmaps table was changed
+func SetIdMap(s Store, mid string, lid string) (bool, error) {
+	if err := ValidateIdMap(mid, lid); err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	var existing []tukdbint.IdMap
+	q := Query{}
+	if err := s.Find(tukcnst.ID_MAPS, *q.Filter("mid", OP_EQ, mid), &existing); err != nil {
+		return false, err
+	}
+	switch {
+	case len(existing) == 1 && existing[0].Lid == lid:
+		return false, nil
+	case len(existing) == 1:
+		return true, s.SetColumns(tukcnst.ID_MAPS, existing[0].Id, map[string]interface{}{"lid": lid})
+	case len(existing) > 1:
+		if err := DeleteIdMap(s, mid); err != nil {
+			return false, err
+		}
+	}
+	idmaps := tukdbint.IdMaps{Action: tukcnst.INSERT}
+	idmaps.LidMap = append(idmaps.LidMap, tukdbint.IdMap{Mid: mid, Lid: lid})
+	return true, s.IdMaps(&idmaps)
+}
+
+// DeleteIdMap deletes the mappings of mid
+func DeleteIdMap(s Store, mid string) error {
+	if mid == "" {
+		return errors.New("idmap mapped id is not set")
+	}
+	idmaps := tukdbint.IdMaps{Action: tukcnst.DELETE}
+	idmaps.LidMap = append(idmaps.LidMap, tukdbint.IdMap{Mid: mid})
+	return s.IdMaps(&idmaps)
+}
+
+// ImportIdMaps sets the mid,lid mappings read from csv, which may start with a mid,lid header row. Every row is validated before
+// any mapping is set, and the mappings are set in a single transaction. It returns the number of mappings added or changed
+func ImportIdMaps(s Store, r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	if len(records) > 0 && strings.EqualFold(records[0][0], "mid") && strings.EqualFold(records[0][1], "lid") {
+		records = records[1:]
+	}
+	mids := make(map[string]int)
+	for k, record := range records {
+		if err := ValidateIdMap(record[0], record[1]); err != nil {
+			return 0, fmt.Errorf("idmaps csv record %v: %s", k+1, err.Error())
+		}
+		if dup, ok := mids[strings.ToLower(record[0])]; ok {
+			return 0, fmt.Errorf("idmaps csv record %v: %s is also mapped by record %v", k+1, record[0], dup)
+		}
+		mids[strings.ToLower(record[0])] = k + 1
+	}
+	count := 0
+	err = WithTx(s, func(tx Store) error {
+		for _, record := range records {
+			changed, err := SetIdMap(tx, record[0], record[1])
+			if err != nil {
+				return err
+			}
+			if changed {
+				count = count + 1
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Imported %v idmaps, %v added or changed", len(records), count)
+	return count, nil
+}
+
+// ExportIdMaps writes the idmaps to w as csv with a mid,lid header row, ordered by mapped id
+func ExportIdMaps(s Store, w io.Writer) error {
+	idmaps, err := FindIdMaps(s, "", "")
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"mid", "lid"})
+	for _, idmap := range idmaps {
+		writer.Write([]string{idmap.Mid, idmap.Lid})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,70 @@
+package tukstore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateIdMap(t *testing.T) {
+	tests := []struct {
+		mid   string
+		lid   string
+		valid bool
+	}{
+		{"lth", "2.16.840.1.113883.2.1.3.31.2.1.1", true},
+		{"XDSDOMAIN", "urn:oid:2.16.840.1.113883.2.1.3.31", true},
+		{"", "2.16.840.1.113883", false},
+		{" ", "2.16.840.1.113883", false},
+		{"lth", "", false},
+		{"lth", "lth", false},
+		{"lth", "3.16.840", false},
+		{"lth", "2.16.0840", false},
+		{"lth", "2", false},
+		{"lth", "oid:2.16.840", false},
+	}
+	for _, test := range tests {
+		if err := ValidateIdMap(test.mid, test.lid); (err == nil) != test.valid {
+			t.Errorf("ValidateIdMap(%q, %q) = %v, want valid %v", test.mid, test.lid, err, test.valid)
+		}
+	}
+}
+
+func TestImportIdMaps(t *testing.T) {
+	s := NewCachedStore(NewMemStore(), time.Minute)
+	if lid := GetIDMapsLocalId(s, "lth"); lid != "lth" {
+		t.Fatalf("unmapped lth is %s", lid)
+	}
+	csv := "mid,lid\nlth,2.16.840.1.113883.2.1.3.31.2.1.1\nXDSDOMAIN, urn:oid:2.16.840.1.113883.2.1.3.31\n"
+	if n, err := ImportIdMaps(s, strings.NewReader(csv)); err != nil || n != 2 {
+		t.Fatalf("import returned %v, %v", n, err)
+	}
+	if lid := GetIDMapsLocalId(s, "lth"); lid != "2.16.840.1.113883.2.1.3.31.2.1.1" {
+		t.Fatalf("lth is %s after the import, want the imported mapping", lid)
+	}
+	var exported bytes.Buffer
+	if err := ExportIdMaps(s, &exported); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mid,lid\nlth,2.16.840.1.113883.2.1.3.31.2.1.1\nXDSDOMAIN,urn:oid:2.16.840.1.113883.2.1.3.31\n"; exported.String() != want {
+		t.Fatalf("exported csv is %q, want %q", exported.String(), want)
+	}
+	if n, err := ImportIdMaps(s, bytes.NewReader(exported.Bytes())); err != nil || n != 0 {
+		t.Fatalf("import of the exported csv returned %v, %v, want no changes", n, err)
+	}
+	for _, invalid := range []string{"lth,2.16.840.1.113883.9\nrfs,lth\n", "lth,2.16.840.1.113883.9\nLTH,2.16.840.1.113883.8\n", "lth\n"} {
+		if _, err := ImportIdMaps(s, strings.NewReader(invalid)); err == nil {
+			t.Fatalf("import of %q succeeded", invalid)
+		}
+	}
+	if lid := GetIDMapsLocalId(s, "lth"); lid != "2.16.840.1.113883.2.1.3.31.2.1.1" {
+		t.Fatalf("lth is %s after invalid imports, want no mapping set", lid)
+	}
+	if changed, err := SetIdMap(s, "lth", "2.16.840.1.113883.7"); err != nil || !changed || GetIDMapsLocalId(s, "lth") != "2.16.840.1.113883.7" {
+		t.Fatalf("set returned %v, %v and lth is %s", changed, err, GetIDMapsLocalId(s, "lth"))
+	}
+	if GetIDMapsMappedId(s, "2.16.840.1.113883.7") != "lth" {
+		t.Fatal("mapped id of the set local id is not lth")
+	}
+}
@@ -0,0 +1,536 @@
+package tukstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+
+	"tukxdw-client/tukclock"
+)
+
+// MemStore is a pure Go Store that holds the tables in memory. When opened with OpenFileStore the tables are loaded from, and
+// saved to, a json file so state is retained between runs. String comparisons are case insensitive, matching the default MySQL collation
+type MemStore struct {
+	Clock  tukclock.Clock
+	mu     *sync.Mutex
+	path   string
+	tables *memTables
+	intx   bool
+	ctx    context.Context
+}
+type memTables struct {
+	Workflows        memTable[tukdbint.Workflow]     `json:"workflows"`
+	Events           memTable[tukdbint.Event]        `json:"events"`
+	Subscriptions    memTable[tukdbint.Subscription] `json:"subscriptions"`
+	XDWS             memTable[tukdbint.XDW]          `json:"xdws"`
+	Templates        memTable[tukdbint.Template]     `json:"templates"`
+	Statics          memTable[tukdbint.Static]       `json:"statics"`
+	IdMaps           memTable[tukdbint.IdMap]        `json:"idmaps"`
+	ServiceStates    memTable[tukdbint.ServiceState] `json:"servicestates"`
+	EventAcks        memTable[tukdbint.EventAck]     `json:"eventacks"`
+	AssetVersions    memTable[AssetVersion]          `json:"assetversions"`
+	WorkflowArchives memTable[WorkflowArchive]       `json:"workflowarchives"`
+	SubjectAudits    memTable[SubjectAudit]          `json:"subjectaudits"`
+	// Summaries holds the derived workflow columns by workflow id
+	Summaries map[int64]WorkflowSummary `json:"workflowsummaries"`
+}
+type memTable[T any] struct {
+	Name   string `json:"name"`
+	LastId int64  `json:"lastid"`
+	Rows   []T    `json:"rows"`
+}
+
+// NewMemStore returns an empty in memory store
+func NewMemStore() *MemStore {
+	s := MemStore{mu: &sync.Mutex{}, tables: &memTables{}}
+	s.createSchema()
+	return &s
+}
+
+// OpenFileStore returns an in memory store loaded from the json file at path. The file is created on the first write if it does not exist
+func OpenFileStore(path string) (*MemStore, error) {
+	s := NewMemStore()
+	s.path = path
+	filebytes, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("Store file %s does not exist. Created new store", path)
+			return s, nil
+		}
+		log.Println(err.Error())
+		return nil, err
+	}
+	if err := json.Unmarshal(filebytes, s.tables); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	s.createSchema()
+	log.Printf("Loaded store file %s", path)
+	return s, nil
+}
+func (s *MemStore) Workflows(i *tukdbint.Workflows) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.Workflows, i.Action, &i.Workflows, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) Events(i *tukdbint.Events) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.Events, i.Action, &i.Events, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) Subscriptions(i *tukdbint.Subscriptions) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.Subscriptions, i.Action, &i.Subscriptions, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) XDWS(i *tukdbint.XDWS) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.XDWS, i.Action, &i.XDW, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) Templates(i *tukdbint.Templates) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.Templates, i.Action, &i.Templates, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) Statics(i *tukdbint.Statics) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.Statics, i.Action, &i.Static, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) IdMaps(i *tukdbint.IdMaps) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.IdMaps, i.Action, &i.LidMap, &i.Cnt, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) ServiceStates(i *tukdbint.ServiceStates) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.ServiceStates, i.Action, &i.ServiceState, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) EventAcks(i *tukdbint.EventAcks) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.EventAcks, i.Action, &i.EventAck, &i.Cnt, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) AssetVersions(i *AssetVersions) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.AssetVersions, i.Action, &i.AssetVersions, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) WorkflowArchives(i *WorkflowArchives) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.WorkflowArchives, i.Action, &i.WorkflowArchives, &i.Count, &i.LastInsertId, s.now()))
+}
+func (s *MemStore) SubjectAudits(i *SubjectAudits) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.save(i.Action, execute(&s.tables.SubjectAudits, i.Action, &i.SubjectAudits, &i.Count, &i.LastInsertId, s.now()))
+}
+
+// Find appends the table rows matching the query to rows, a pointer to a slice of the tukdbint table row type
+func (s *MemStore) Find(table string, q Query, rows interface{}) error {
+	if err := q.validate(table, reflect.TypeOf(rows).Elem().Elem()); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	events := s.evalContext()
+	switch r := rows.(type) {
+	case *[]tukdbint.Workflow:
+		*r = append(*r, eval(q, s.tables.Workflows.Rows, events)...)
+	case *[]tukdbint.Event:
+		*r = append(*r, eval(q, s.tables.Events.Rows, events)...)
+	case *[]tukdbint.Subscription:
+		*r = append(*r, eval(q, s.tables.Subscriptions.Rows, events)...)
+	case *[]tukdbint.XDW:
+		*r = append(*r, eval(q, s.tables.XDWS.Rows, events)...)
+	case *[]tukdbint.Template:
+		*r = append(*r, eval(q, s.tables.Templates.Rows, events)...)
+	case *[]tukdbint.Static:
+		*r = append(*r, eval(q, s.tables.Statics.Rows, events)...)
+	case *[]tukdbint.IdMap:
+		*r = append(*r, eval(q, s.tables.IdMaps.Rows, events)...)
+	case *[]tukdbint.ServiceState:
+		*r = append(*r, eval(q, s.tables.ServiceStates.Rows, events)...)
+	case *[]tukdbint.EventAck:
+		*r = append(*r, eval(q, s.tables.EventAcks.Rows, events)...)
+	case *[]AssetVersion:
+		*r = append(*r, eval(q, s.tables.AssetVersions.Rows, events)...)
+	case *[]WorkflowArchive:
+		*r = append(*r, eval(q, s.tables.WorkflowArchives.Rows, events)...)
+	case *[]SubjectAudit:
+		*r = append(*r, eval(q, s.tables.SubjectAudits.Rows, events)...)
+	default:
+		return errors.New("unsupported find rows type")
+	}
+	return nil
+}
+
+// SetColumns sets the column values of the table row with the id
+func (s *MemStore) SetColumns(table string, id int64, values map[string]interface{}) error {
+	if err := checkColumns(table, values); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	var err error
+	switch table {
+	case tukcnst.WORKFLOWS:
+		err = setColumns(&s.tables.Workflows, id, values)
+	case tukcnst.EVENTS:
+		err = setColumns(&s.tables.Events, id, values)
+	case tukcnst.SUBSCRIPTIONS:
+		err = setColumns(&s.tables.Subscriptions, id, values)
+	case tukcnst.XDWS:
+		err = setColumns(&s.tables.XDWS, id, values)
+	case tukcnst.TEMPLATES:
+		err = setColumns(&s.tables.Templates, id, values)
+	case tukcnst.STATICS:
+		err = setColumns(&s.tables.Statics, id, values)
+	case tukcnst.ID_MAPS:
+		err = setColumns(&s.tables.IdMaps, id, values)
+	case tukcnst.SERVICE_STATES:
+		err = setColumns(&s.tables.ServiceStates, id, values)
+	case tukcnst.EVENT_ACKS:
+		err = setColumns(&s.tables.EventAcks, id, values)
+	case ASSET_VERSIONS:
+		err = setColumns(&s.tables.AssetVersions, id, values)
+	case WORKFLOW_ARCHIVES:
+		err = setColumns(&s.tables.WorkflowArchives, id, values)
+	case SUBJECT_AUDITS:
+		err = setColumns(&s.tables.SubjectAudits, id, values)
+	}
+	return s.save(tukcnst.UPDATE, err)
+}
+func setColumns[T any](t *memTable[T], id int64, values map[string]interface{}) error {
+	for k := range t.Rows {
+		row := reflect.ValueOf(&t.Rows[k]).Elem()
+		if row.FieldByName("Id").Int() != id {
+			continue
+		}
+		for f := 0; f < row.NumField(); f++ {
+			if val, ok := values[strings.ToLower(row.Type().Field(f).Name)]; ok {
+				v := reflect.ValueOf(val)
+				if !v.IsValid() || !v.CanConvert(row.Field(f).Type()) {
+					return fmt.Errorf("invalid value for column %s of table %s", strings.ToLower(row.Type().Field(f).Name), t.Name)
+				}
+				row.Field(f).Set(v.Convert(row.Field(f).Type()))
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no row with id %v in table %s", id, t.Name)
+}
+
+func (s *MemStore) evalContext() evalContext {
+	acked := make(map[int64]bool)
+	for _, ack := range s.tables.EventAcks.Rows {
+		acked[ack.EventID] = true
+	}
+	return evalContext{events: s.tables.Events.Rows, summaries: s.tables.Summaries, acked: acked}
+}
+
+// WithContext returns the store with operations that fail with the context error once the context is done. Operations that are
+// waiting for a transaction to finish run when it does, then fail if the context is done
+func (s *MemStore) WithContext(ctx context.Context) Store {
+	ctxs := *s
+	ctxs.ctx = ctx
+	return &ctxs
+}
+func (s *MemStore) err() error {
+	if s.ctx == nil {
+		return nil
+	}
+	return s.ctx.Err()
+}
+
+// Close saves a file store. It is a no-op for an in memory store
+func (s *MemStore) Close() error {
+	defer s.lock()()
+	return s.save(tukcnst.INSERT, nil)
+}
+
+// Begin starts a transaction. The store is locked until the transaction is committed or rolled back, so transactions are serialised
+func (s *MemStore) Begin() (Tx, error) {
+	if s.intx {
+		return nil, errors.New("transaction already started")
+	}
+	s.mu.Lock()
+	snapshot, err := json.Marshal(s.tables)
+	if err != nil {
+		s.mu.Unlock()
+		log.Println(err.Error())
+		return nil, err
+	}
+	txs := *s
+	txs.intx = true
+	return &memTx{MemStore: &txs, snapshot: snapshot}, nil
+}
+
+type memTx struct {
+	*MemStore
+	snapshot []byte
+	done     bool
+}
+
+// Commit saves a file store and releases the store lock
+func (t *memTx) Commit() error {
+	if t.done {
+		return errors.New("transaction has already been committed or rolled back")
+	}
+	t.done = true
+	defer t.mu.Unlock()
+	t.intx = false
+	return t.save(tukcnst.INSERT, nil)
+}
+
+// Rollback restores the tables to their state when the transaction started and releases the store lock
+func (t *memTx) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	defer t.mu.Unlock()
+	restored := memTables{}
+	if err := json.Unmarshal(t.snapshot, &restored); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	*t.tables = restored
+	return nil
+}
+
+// Close rolls back the transaction if it has not been committed
+func (t *memTx) Close() error {
+	return t.Rollback()
+}
+
+// lock locks the store, unless the caller is a transaction that already holds the lock, and returns the unlock func
+func (s *MemStore) lock() func() {
+	if s.intx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+func (s *MemStore) createSchema() {
+	s.tables.Workflows.Name = tukcnst.WORKFLOWS
+	s.tables.Events.Name = tukcnst.EVENTS
+	s.tables.Subscriptions.Name = tukcnst.SUBSCRIPTIONS
+	s.tables.XDWS.Name = tukcnst.XDWS
+	s.tables.Templates.Name = tukcnst.TEMPLATES
+	s.tables.Statics.Name = tukcnst.STATICS
+	s.tables.IdMaps.Name = tukcnst.ID_MAPS
+	s.tables.ServiceStates.Name = tukcnst.SERVICE_STATES
+	s.tables.EventAcks.Name = tukcnst.EVENT_ACKS
+	s.tables.AssetVersions.Name = ASSET_VERSIONS
+	s.tables.WorkflowArchives.Name = WORKFLOW_ARCHIVES
+	s.tables.SubjectAudits.Name = SUBJECT_AUDITS
+}
+func (s *MemStore) now() string {
+	return tukclock.TimeNow(s.Clock)
+}
+func (s *MemStore) save(action string, err error) error {
+	if err != nil || s.path == "" || action == tukcnst.SELECT || s.intx {
+		return err
+	}
+	filebytes, err := json.MarshalIndent(s.tables, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err = os.WriteFile(s.path, filebytes, 0644); err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// execute runs the action against the table. The first element of rows is the filter or the row to insert
+func execute[T any](t *memTable[T], action string, rows *[]T, count *int, lastid *int64, now string) error {
+	var filter map[string]interface{}
+	if len(*rows) > 0 {
+		filter = params(reflect.ValueOf((*rows)[0]))
+	}
+	switch action {
+	case tukcnst.SELECT:
+		for _, row := range t.Rows {
+			if matches(filter, reflect.ValueOf(row)) {
+				*rows = append(*rows, row)
+				*count = *count + 1
+			}
+		}
+	case tukcnst.INSERT:
+		if len(*rows) == 0 {
+			return nil
+		}
+		row := (*rows)[0]
+		t.LastId = t.LastId + 1
+		v := reflect.ValueOf(&row).Elem()
+		v.FieldByName("Id").SetInt(t.LastId)
+		for _, created := range []string{"Created", "Creationtime", "CreationTime"} {
+			if f := v.FieldByName(created); f.IsValid() && f.String() == "" {
+				f.SetString(now)
+			}
+		}
+		t.Rows = append(t.Rows, row)
+		*lastid = t.LastId
+	case tukcnst.DELETE:
+		if len(filter) == 0 {
+			return nil
+		}
+		kept := t.Rows[:0]
+		for _, row := range t.Rows {
+			if !matches(filter, reflect.ValueOf(row)) {
+				kept = append(kept, row)
+			}
+		}
+		t.Rows = kept
+	case tukcnst.DEPRECATE:
+		var keys []string
+		switch t.Name {
+		case tukcnst.WORKFLOWS:
+			keys = []string{"xdw_key"}
+		case tukcnst.EVENTS:
+			keys = []string{"pathway", "nhsid"}
+		default:
+			return errors.New("deprecate is not supported for table " + t.Name)
+		}
+		where, err := subset(filter, keys)
+		if err != nil {
+			return err
+		}
+		for k := range t.Rows {
+			v := reflect.ValueOf(&t.Rows[k]).Elem()
+			if matches(where, v) {
+				v.FieldByName("Version").SetInt(v.FieldByName("Version").Int() + 1)
+			}
+		}
+	case tukcnst.UPDATE:
+		if t.Name != tukcnst.WORKFLOWS {
+			return errors.New("update is not supported for table " + t.Name)
+		}
+		where, err := subset(filter, []string{"pathway", "nhsid", "version"})
+		if err != nil {
+			return err
+		}
+		src := reflect.ValueOf((*rows)[0])
+		for k := range t.Rows {
+			v := reflect.ValueOf(&t.Rows[k]).Elem()
+			if matches(where, v) {
+				for _, field := range []string{"XDW_Doc", "Published", "Status"} {
+					v.FieldByName(field).Set(src.FieldByName(field))
+				}
+			}
+		}
+	default:
+		return errors.New("unsupported action " + action)
+	}
+	return nil
+}
+
+// params returns the filter for a row using the same rules as the tukdbint prepared statements. Id's are included when set,
+// Version and TaskId unless -1, strings when not empty and bools always
+func params(v reflect.Value) map[string]interface{} {
+	params := make(map[string]interface{})
+	for f := 0; f < v.NumField(); f++ {
+		name := v.Type().Field(f).Name
+		field := v.Field(f)
+		switch field.Kind() {
+		case reflect.Int64:
+			if field.Int() > 0 {
+				params[strings.ToLower(name)] = field.Int()
+			}
+		case reflect.Int:
+			if field.Int() != -1 {
+				params[strings.ToLower(name)] = field.Int()
+			}
+		case reflect.String:
+			if field.String() != "" {
+				params[strings.ToLower(name)] = field.String()
+			}
+		case reflect.Bool:
+			params[strings.ToLower(name)] = field.Bool()
+		}
+	}
+	return params
+}
+func matches(filter map[string]interface{}, v reflect.Value) bool {
+	row := params(v)
+	for key, val := range filter {
+		rowval, ok := row[key]
+		if !ok {
+			if s, isstr := val.(string); isstr && s != "" {
+				return false
+			}
+			if _, isint := val.(int64); isint {
+				return false
+			}
+			continue
+		}
+		if s, isstr := val.(string); isstr {
+			if !strings.EqualFold(s, rowval.(string)) {
+				return false
+			}
+			continue
+		}
+		if val != rowval {
+			return false
+		}
+	}
+	return true
+}
+func conflict(wf reflect.Value) error {
+	return &ConflictError{Pathway: wf.FieldByName("Pathway").String(), NHSId: wf.FieldByName("NHSId").String(), Version: int(wf.FieldByName("Version").Int())}
+}
+func subset(filter map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	sub := make(map[string]interface{})
+	for _, key := range keys {
+		val, ok := filter[key]
+		if !ok {
+			return nil, errors.New("missing " + key + " value")
+		}
+		sub[key] = val
+	}
+	return sub, nil
+}
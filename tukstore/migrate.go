@@ -0,0 +1,271 @@
+package tukstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tukxdw-client/tukclock"
+)
+
+// SCHEMA_MIGRATIONS is the table recording the migrations applied to a database
+const SCHEMA_MIGRATIONS = "schema_migrations"
+
+// MIGRATION_TIMEOUT is the maximum duration of a single migration
+const MIGRATION_TIMEOUT = 5 * time.Minute
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is an embedded schema migration. Files are named migrations/<dialect>/<version>_<name>.<up|down>.sql and
+// statements are separated by a semicolon at the end of a line
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState is a migration and the time it was applied to the database, empty if it is pending
+type MigrationState struct {
+	Migration
+	Applied string
+}
+
+// Migrations returns the embedded migrations for the dialect in version order
+func Migrations(dialectname string) ([]Migration, error) {
+	dir := path.Join("migrations", dialectname)
+	files, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for sql dialect %s", dialectname)
+	}
+	migrations := make(map[int]*Migration)
+	for _, file := range files {
+		name := file.Name()
+		direction := path.Ext(strings.TrimSuffix(name, ".sql"))
+		ver, desc, ok := strings.Cut(strings.TrimSuffix(strings.TrimSuffix(name, ".sql"), direction), "_")
+		version, err := strconv.Atoi(ver)
+		if !ok || err != nil || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		filebytes, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if migrations[version] == nil {
+			migrations[version] = &Migration{Version: version, Name: desc}
+		}
+		if direction == ".up" {
+			migrations[version].Up = string(filebytes)
+		} else {
+			migrations[version].Down = string(filebytes)
+		}
+	}
+	var sorted []Migration
+	for _, m := range migrations {
+		sorted = append(sorted, *m)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted, nil
+}
+
+// LatestSchemaVersion returns the schema version required by this build, the version of the last embedded migration
+func LatestSchemaVersion(dialectname string) int {
+	migrations, err := Migrations(dialectname)
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrateUp applies the pending migrations up to and including version target. A target of 0 applies all pending migrations
+func (s *SQLStore) MigrateUp(target int) error {
+	return migrator{db: s.DB, dialect: s.dialect}.up(target)
+}
+
+// MigrateDown reverts the applied migrations above version target, latest first. A target of -1 reverts the latest migration
+func (s *SQLStore) MigrateDown(target int) error {
+	return migrator{db: s.DB, dialect: s.dialect}.down(target)
+}
+
+// MigrationStatus returns the state of each embedded migration
+func (s *SQLStore) MigrationStatus() ([]MigrationState, error) {
+	return migrator{db: s.DB, dialect: s.dialect}.status()
+}
+
+// CheckSchema returns an error if the database schema version is not the version required by this build
+func (s *SQLStore) CheckSchema() error {
+	return migrator{db: s.DB, dialect: s.dialect}.check()
+}
+
+// CheckSchema returns an error if the MySQL database schema version is not the version required by this build. It is not
+// possible to check the schema behind an AWS API Gateway url
+func (s *DBStore) CheckSchema() error {
+	if s.Connection.DB_URL != "" {
+		return nil
+	}
+	return s.mysql().CheckSchema()
+}
+
+type migrator struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func (m migrator) up(target int) error {
+	states, err := m.status()
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if state.Applied != "" || (target > 0 && state.Version > target) {
+			continue
+		}
+		log.Printf("Applying %s migration %v %s", m.dialect.name, state.Version, state.Name)
+		if err := m.apply(state.Migration, state.Up, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (m migrator) down(target int) error {
+	states, err := m.status()
+	if err != nil {
+		return err
+	}
+	for k := len(states) - 1; k >= 0; k-- {
+		state := states[k]
+		if state.Applied == "" || state.Version <= target {
+			continue
+		}
+		log.Printf("Reverting %s migration %v %s", m.dialect.name, state.Version, state.Name)
+		if err := m.apply(state.Migration, state.Down, false); err != nil {
+			return err
+		}
+		if target == -1 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// apply runs the migration statements and records the change in schema_migrations in a single transaction. MySQL commits
+// DDL statements implicitly, so a failed MySQL migration may be partially applied
+func (m migrator) apply(migration Migration, sqlstr string, isup bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), MIGRATION_TIMEOUT)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmnt := range splitStatements(sqlstr) {
+		if _, err := tx.ExecContext(ctx, stmnt); err != nil {
+			log.Println(err.Error())
+			return fmt.Errorf("migration %v %s failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+	d := m.dialect
+	if isup {
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+d.quote(SCHEMA_MIGRATIONS)+" ("+d.quote("version")+", "+d.quote("name")+", "+d.quote("applied")+") VALUES ("+d.param(1)+", "+d.param(2)+", "+d.param(3)+")", migration.Version, migration.Name, time.Now().UTC())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+d.quote(SCHEMA_MIGRATIONS)+" WHERE "+d.quote("version")+" = "+d.param(1), migration.Version)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return tx.Commit()
+}
+func (m migrator) status() ([]MigrationState, error) {
+	migrations, err := Migrations(m.dialect.name)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	for _, migration := range migrations {
+		states = append(states, MigrationState{Migration: migration, Applied: applied[migration.Version]})
+		delete(applied, migration.Version)
+	}
+	for version := range applied {
+		states = append(states, MigrationState{Migration: Migration{Version: version, Name: "unknown"}, Applied: applied[version]})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// applied returns the time each migration version was applied, creating the schema_migrations table if it does not exist
+func (m migrator) applied() (map[int]string, error) {
+	d := m.dialect
+	ctx, cancel := context.WithTimeout(context.Background(), STATEMENT_TIMEOUT)
+	defer cancel()
+	if _, err := m.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+d.quote(SCHEMA_MIGRATIONS)+" ("+d.quote("version")+" INTEGER NOT NULL PRIMARY KEY, "+d.quote("name")+" VARCHAR(255) NOT NULL, "+d.quote("applied")+" TIMESTAMP NOT NULL)"); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT "+d.quote("version")+", "+d.quote("applied")+" FROM "+d.quote(SCHEMA_MIGRATIONS))
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		applied[version] = tukclock.Format(at)
+	}
+	return applied, rows.Err()
+}
+func (m migrator) check() error {
+	states, err := m.status()
+	if err != nil {
+		return err
+	}
+	latest := LatestSchemaVersion(m.dialect.name)
+	for _, state := range states {
+		switch {
+		case state.Applied == "" && state.Version <= latest:
+			return fmt.Errorf("database schema is missing migration %v %s required by this build, run migrate up", state.Version, state.Name)
+		case state.Version > latest:
+			return fmt.Errorf("database schema version %v is newer than version %v supported by this build", state.Version, latest)
+		}
+	}
+	log.Printf("Database schema is at version %v", latest)
+	return nil
+}
+func splitStatements(sqlstr string) []string {
+	var stmnts []string
+	var stmnt strings.Builder
+	for _, line := range strings.Split(sqlstr, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		stmnt.WriteString(line + "\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmnts = append(stmnts, strings.TrimSuffix(strings.TrimSpace(stmnt.String()), ";"))
+			stmnt.Reset()
+		}
+	}
+	if strings.TrimSpace(stmnt.String()) != "" {
+		stmnts = append(stmnts, strings.TrimSpace(stmnt.String()))
+	}
+	return stmnts
+}
@@ -0,0 +1,9 @@
+-- TUK Event Service tables. IF NOT EXISTS baselines databases created before migrations were introduced
+CREATE TABLE IF NOT EXISTS `workflows` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `created` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, `pathway` VARCHAR(255), `nhsid` VARCHAR(32), `xdw_key` VARCHAR(255), `xdw_uid` VARCHAR(255), `xdw_doc` MEDIUMTEXT, `xdw_def` MEDIUMTEXT, `version` INT NOT NULL DEFAULT 0, `published` BOOLEAN NOT NULL DEFAULT FALSE, `status` VARCHAR(32));
+CREATE TABLE IF NOT EXISTS `events` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `creationtime` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, `docname` VARCHAR(255), `classcode` VARCHAR(255), `confcode` VARCHAR(255), `formatcode` VARCHAR(255), `facilitycode` VARCHAR(255), `practicecode` VARCHAR(255), `expression` VARCHAR(255), `authors` VARCHAR(255), `xdspid` VARCHAR(255), `xdsdocentryuid` VARCHAR(255), `repositoryuniqueid` VARCHAR(255), `nhsid` VARCHAR(32), `user` VARCHAR(255), `org` VARCHAR(255), `role` VARCHAR(255), `speciality` VARCHAR(255), `topic` VARCHAR(255), `pathway` VARCHAR(255), `comments` TEXT, `version` INT NOT NULL DEFAULT 0, `taskid` INT NOT NULL DEFAULT 0, `brokerref` VARCHAR(255));
+CREATE TABLE IF NOT EXISTS `subscriptions` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `created` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, `brokerref` VARCHAR(255), `pathway` VARCHAR(255), `topic` VARCHAR(255), `expression` VARCHAR(255));
+CREATE TABLE IF NOT EXISTS `xdws` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` VARCHAR(255), `isxdsmeta` BOOLEAN NOT NULL DEFAULT FALSE, `xdw` MEDIUMTEXT);
+CREATE TABLE IF NOT EXISTS `templates` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` VARCHAR(255), `isxml` BOOLEAN NOT NULL DEFAULT FALSE, `template` MEDIUMTEXT);
+CREATE TABLE IF NOT EXISTS `statics` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` VARCHAR(255), `content` LONGBLOB);
+CREATE TABLE IF NOT EXISTS `idmaps` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `lid` VARCHAR(255), `mid` VARCHAR(255));
+CREATE TABLE IF NOT EXISTS `servicestates` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` VARCHAR(255), `service` MEDIUMTEXT);
@@ -0,0 +1,3 @@
+-- Derived workflow columns maintained by the content creator and updater, and populated for existing rows by xdw backfill
+ALTER TABLE `workflows` ADD COLUMN `completeby` TIMESTAMP NULL DEFAULT NULL, ADD COLUMN `escalateby` TIMESTAMP NULL DEFAULT NULL, ADD COLUMN `closedtime` TIMESTAMP NULL DEFAULT NULL, ADD COLUMN `lasteventtime` TIMESTAMP NULL DEFAULT NULL, ADD COLUMN `overdue` BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN `currenttask` INT NOT NULL DEFAULT 0;
+CREATE INDEX `workflows_status` ON `workflows` (`status`, `version`, `pathway`);
@@ -0,0 +1,3 @@
+-- Fails if the columns hold hashed or encrypted values, which must be removed first
+ALTER TABLE `workflows` MODIFY `nhsid` VARCHAR(32);
+ALTER TABLE `events` MODIFY `nhsid` VARCHAR(32), MODIFY `user` VARCHAR(255), MODIFY `authors` VARCHAR(255), MODIFY `docname` VARCHAR(255), MODIFY `xdspid` VARCHAR(255);
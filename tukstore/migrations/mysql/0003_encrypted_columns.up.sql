@@ -0,0 +1,3 @@
+-- Widen the columns that hold keyed hashes and encrypted values when field level encryption is enabled
+ALTER TABLE `workflows` MODIFY `nhsid` VARCHAR(128);
+ALTER TABLE `events` MODIFY `nhsid` VARCHAR(128), MODIFY `user` VARCHAR(1024), MODIFY `authors` VARCHAR(1024), MODIFY `docname` VARCHAR(1024), MODIFY `xdspid` VARCHAR(1024);
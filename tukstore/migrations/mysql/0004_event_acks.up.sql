@@ -0,0 +1,3 @@
+-- Event acknowledgements, recording the user who saw a workflow event or task notification
+CREATE TABLE IF NOT EXISTS `eventacks` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `creationtime` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, `eventid` BIGINT NOT NULL DEFAULT 0, `user` VARCHAR(1024), `org` VARCHAR(255), `role` VARCHAR(255));
+CREATE INDEX `eventacks_eventid` ON `eventacks` (`eventid`);
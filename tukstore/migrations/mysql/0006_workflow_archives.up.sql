@@ -0,0 +1,3 @@
+-- Archived workflows, with their events and acknowledgements, removed from the workflows and events tables by the retention policies
+CREATE TABLE IF NOT EXISTS `workflowarchives` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `archived` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, `pathway` VARCHAR(255), `nhsid` VARCHAR(128), `xdw_key` VARCHAR(255), `version` INT NOT NULL DEFAULT 0, `status` VARCHAR(32), `content` LONGTEXT);
+CREATE INDEX `workflowarchives_xdw_key` ON `workflowarchives` (`xdw_key`);
@@ -0,0 +1,3 @@
+-- Audit of the subject access exports and erasures of a patient. subject is the hashed nhs id
+CREATE TABLE IF NOT EXISTS `subjectaudits` (`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, `created` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, `subject` VARCHAR(128), `action` VARCHAR(32), `user` VARCHAR(255), `reason` TEXT, `pseudonym` VARCHAR(255), `workflows` INT NOT NULL DEFAULT 0, `events` INT NOT NULL DEFAULT 0, `eventacks` INT NOT NULL DEFAULT 0, `archivedworkflows` INT NOT NULL DEFAULT 0);
+CREATE INDEX `subjectaudits_subject` ON `subjectaudits` (`subject`);
@@ -0,0 +1 @@
+ALTER TABLE `workflows` DROP COLUMN `seqno`;
@@ -0,0 +1 @@
+ALTER TABLE `workflows` CHANGE COLUMN `targetmissed` `overdue` BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+-- Rename overdue to targetmissed, it is only set for workflows closed after their complete by time. Open workflows are queried as overdue by completeby
+ALTER TABLE `workflows` CHANGE COLUMN `overdue` `targetmissed` BOOLEAN NOT NULL DEFAULT FALSE;
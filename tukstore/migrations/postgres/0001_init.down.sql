@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS "servicestates";
+DROP TABLE IF EXISTS "idmaps";
+DROP TABLE IF EXISTS "statics";
+DROP TABLE IF EXISTS "templates";
+DROP TABLE IF EXISTS "xdws";
+DROP TABLE IF EXISTS "subscriptions";
+DROP TABLE IF EXISTS "events";
+DROP TABLE IF EXISTS "workflows";
@@ -0,0 +1,9 @@
+-- TUK Event Service tables. IF NOT EXISTS baselines databases created before migrations were introduced
+CREATE TABLE IF NOT EXISTS "workflows" ("id" BIGSERIAL PRIMARY KEY, "created" TIMESTAMPTZ NOT NULL DEFAULT now(), "pathway" VARCHAR(255), "nhsid" VARCHAR(32), "xdw_key" VARCHAR(255), "xdw_uid" VARCHAR(255), "xdw_doc" TEXT, "xdw_def" TEXT, "version" INTEGER NOT NULL DEFAULT 0, "published" BOOLEAN NOT NULL DEFAULT FALSE, "status" VARCHAR(32));
+CREATE TABLE IF NOT EXISTS "events" ("id" BIGSERIAL PRIMARY KEY, "creationtime" TIMESTAMPTZ NOT NULL DEFAULT now(), "docname" VARCHAR(255), "classcode" VARCHAR(255), "confcode" VARCHAR(255), "formatcode" VARCHAR(255), "facilitycode" VARCHAR(255), "practicecode" VARCHAR(255), "expression" VARCHAR(255), "authors" VARCHAR(255), "xdspid" VARCHAR(255), "xdsdocentryuid" VARCHAR(255), "repositoryuniqueid" VARCHAR(255), "nhsid" VARCHAR(32), "user" VARCHAR(255), "org" VARCHAR(255), "role" VARCHAR(255), "speciality" VARCHAR(255), "topic" VARCHAR(255), "pathway" VARCHAR(255), "comments" TEXT, "version" INTEGER NOT NULL DEFAULT 0, "taskid" INTEGER NOT NULL DEFAULT 0, "brokerref" VARCHAR(255));
+CREATE TABLE IF NOT EXISTS "subscriptions" ("id" BIGSERIAL PRIMARY KEY, "created" TIMESTAMPTZ NOT NULL DEFAULT now(), "brokerref" VARCHAR(255), "pathway" VARCHAR(255), "topic" VARCHAR(255), "expression" VARCHAR(255));
+CREATE TABLE IF NOT EXISTS "xdws" ("id" BIGSERIAL PRIMARY KEY, "name" VARCHAR(255), "isxdsmeta" BOOLEAN NOT NULL DEFAULT FALSE, "xdw" TEXT);
+CREATE TABLE IF NOT EXISTS "templates" ("id" BIGSERIAL PRIMARY KEY, "name" VARCHAR(255), "isxml" BOOLEAN NOT NULL DEFAULT FALSE, "template" TEXT);
+CREATE TABLE IF NOT EXISTS "statics" ("id" BIGSERIAL PRIMARY KEY, "name" VARCHAR(255), "content" BYTEA);
+CREATE TABLE IF NOT EXISTS "idmaps" ("id" BIGSERIAL PRIMARY KEY, "lid" VARCHAR(255), "mid" VARCHAR(255));
+CREATE TABLE IF NOT EXISTS "servicestates" ("id" BIGSERIAL PRIMARY KEY, "name" VARCHAR(255), "service" TEXT);
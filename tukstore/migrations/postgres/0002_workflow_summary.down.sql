@@ -0,0 +1,2 @@
+DROP INDEX "workflows_status";
+ALTER TABLE "workflows" DROP COLUMN "completeby", DROP COLUMN "escalateby", DROP COLUMN "closedtime", DROP COLUMN "lasteventtime", DROP COLUMN "overdue", DROP COLUMN "currenttask";
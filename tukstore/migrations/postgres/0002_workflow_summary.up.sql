@@ -0,0 +1,3 @@
+-- Derived workflow columns maintained by the content creator and updater, and populated for existing rows by xdw backfill
+ALTER TABLE "workflows" ADD COLUMN "completeby" TIMESTAMPTZ NULL, ADD COLUMN "escalateby" TIMESTAMPTZ NULL, ADD COLUMN "closedtime" TIMESTAMPTZ NULL, ADD COLUMN "lasteventtime" TIMESTAMPTZ NULL, ADD COLUMN "overdue" BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN "currenttask" INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX "workflows_status" ON "workflows" ("status", "version", "pathway");
@@ -0,0 +1,3 @@
+-- Fails if the columns hold hashed or encrypted values, which must be removed first
+ALTER TABLE "workflows" ALTER COLUMN "nhsid" TYPE VARCHAR(32);
+ALTER TABLE "events" ALTER COLUMN "nhsid" TYPE VARCHAR(32), ALTER COLUMN "user" TYPE VARCHAR(255), ALTER COLUMN "authors" TYPE VARCHAR(255), ALTER COLUMN "docname" TYPE VARCHAR(255), ALTER COLUMN "xdspid" TYPE VARCHAR(255);
@@ -0,0 +1,3 @@
+-- Widen the columns that hold keyed hashes and encrypted values when field level encryption is enabled
+ALTER TABLE "workflows" ALTER COLUMN "nhsid" TYPE VARCHAR(128);
+ALTER TABLE "events" ALTER COLUMN "nhsid" TYPE VARCHAR(128), ALTER COLUMN "user" TYPE VARCHAR(1024), ALTER COLUMN "authors" TYPE VARCHAR(1024), ALTER COLUMN "docname" TYPE VARCHAR(1024), ALTER COLUMN "xdspid" TYPE VARCHAR(1024);
@@ -0,0 +1,3 @@
+-- Versions of the templates and static files, with the active version of each served from the templates and statics tables
+CREATE TABLE IF NOT EXISTS "assetversions" ("id" BIGSERIAL PRIMARY KEY, "created" TIMESTAMPTZ NOT NULL DEFAULT now(), "kind" VARCHAR(32), "name" VARCHAR(255), "version" INTEGER NOT NULL DEFAULT 0, "hash" VARCHAR(64), "mimetype" VARCHAR(255), "content" BYTEA, "active" BOOLEAN NOT NULL DEFAULT FALSE);
+CREATE UNIQUE INDEX "assetversions_version" ON "assetversions" ("kind", "name", "version");
@@ -0,0 +1,3 @@
+-- Audit of the subject access exports and erasures of a patient. subject is the hashed nhs id
+CREATE TABLE IF NOT EXISTS "subjectaudits" ("id" BIGSERIAL PRIMARY KEY, "created" TIMESTAMPTZ NOT NULL DEFAULT now(), "subject" VARCHAR(128), "action" VARCHAR(32), "user" VARCHAR(255), "reason" TEXT, "pseudonym" VARCHAR(255), "workflows" INTEGER NOT NULL DEFAULT 0, "events" INTEGER NOT NULL DEFAULT 0, "eventacks" INTEGER NOT NULL DEFAULT 0, "archivedworkflows" INTEGER NOT NULL DEFAULT 0);
+CREATE INDEX "subjectaudits_subject" ON "subjectaudits" ("subject");
@@ -0,0 +1,2 @@
+-- Workflow document sequence number, a workflow update is applied only if the stored seqno is the seqno of the document it read
+ALTER TABLE "workflows" ADD COLUMN "seqno" INTEGER NOT NULL DEFAULT 0;
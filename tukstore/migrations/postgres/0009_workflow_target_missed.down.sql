@@ -0,0 +1 @@
+ALTER TABLE "workflows" RENAME COLUMN "targetmissed" TO "overdue";
@@ -0,0 +1,497 @@
+package tukstore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// Query condition operators. OP_EVENT is only valid on the workflows table and matches workflows with an event, for the same
+// pathway, nhs id and version, whose Column has one of the Values. OP_UNACKED matches notification events that have no
+// acknowledgement, or workflows with such an event, and when Values are given only events whose Column has one of the Values.
+// Creation events, with the CREATION_EVENT_TOPIC, are not notifications
+const (
+	OP_EQ      = "="
+	OP_NE      = "!="
+	OP_LT      = "<"
+	OP_LTE     = "<="
+	OP_GT      = ">"
+	OP_GTE     = ">="
+	OP_IN      = "in"
+	OP_LIKE    = "like"
+	OP_EVENT   = "event"
+	OP_UNACKED = "unacked"
+)
+
+// CREATION_EVENT_TOPIC is the topic of the events written to obtain the ID's of the task and workflow events of a workflow document
+// as it is created and updated, which are not notifications to be acknowledged
+const CREATION_EVENT_TOPIC = "$XDWCreationEvent"
+
+// Query is a typed store query. Unlike the tukdbint collection filters, every condition is explicit, so false, 0 and "" can be
+// queried. String comparisons are case insensitive and LIKE patterns use % and _. Results are ordered by OrderBy and then id
+type Query struct {
+	Where   []Condition `json:"where"`
+	OrderBy []Order     `json:"orderby"`
+	Limit   int         `json:"limit"`
+	Offset  int         `json:"offset"`
+}
+
+// Condition compares a table column with one value, or with a list of values for OP_IN, OP_EVENT and OP_UNACKED. Values of the created and
+// creationtime columns can be a time.Time or an RFC3339 string
+type Condition struct {
+	Column string        `json:"column"`
+	Op     string        `json:"op"`
+	Values []interface{} `json:"values"`
+}
+
+// Order sorts the query results by a table column
+type Order struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc"`
+}
+
+// Filter adds a condition to the query
+func (q *Query) Filter(column string, op string, values ...interface{}) *Query {
+	q.Where = append(q.Where, Condition{Column: column, Op: op, Values: values})
+	return q
+}
+
+// Sort adds an order to the query
+func (q *Query) Sort(column string, desc bool) *Query {
+	q.OrderBy = append(q.OrderBy, Order{Column: column, Desc: desc})
+	return q
+}
+
+// Paginate limits the results to page number page (from 1) of size results
+func (q *Query) Paginate(page int, size int) *Query {
+	if page < 1 {
+		page = 1
+	}
+	q.Limit = size
+	q.Offset = (page - 1) * size
+	return q
+}
+
+// WorkflowQuery builds a Query on the workflows table
+type WorkflowQuery struct {
+	Query
+}
+
+// NewWorkflowQuery returns a query matching all workflows
+func NewWorkflowQuery() *WorkflowQuery {
+	return &WorkflowQuery{}
+}
+func (q *WorkflowQuery) Where(column string, op string, values ...interface{}) *WorkflowQuery {
+	q.Filter(column, op, values...)
+	return q
+}
+func (q *WorkflowQuery) Pathway(pathways ...string) *WorkflowQuery {
+	return q.Where("pathway", OP_IN, strs(pathways)...)
+}
+func (q *WorkflowQuery) NHSId(nhsid string) *WorkflowQuery {
+	return q.Where("nhsid", OP_EQ, nhsid)
+}
+func (q *WorkflowQuery) XDWKey(xdwkey string) *WorkflowQuery {
+	return q.Where("xdw_key", OP_EQ, xdwkey)
+}
+func (q *WorkflowQuery) Version(version int) *WorkflowQuery {
+	return q.Where("version", OP_EQ, version)
+}
+
+// Current matches the current version of each workflow
+func (q *WorkflowQuery) Current() *WorkflowQuery {
+	return q.Version(0)
+}
+func (q *WorkflowQuery) Published(published bool) *WorkflowQuery {
+	return q.Where("published", OP_EQ, published)
+}
+
+// Status matches workflows with any of the statuses, eg. tukcnst.OPEN
+func (q *WorkflowQuery) Status(statuses ...string) *WorkflowQuery {
+	return q.Where("status", OP_IN, strs(statuses)...)
+}
+
+// Overdue matches open workflows that are not complete at their complete by time, at time now. Closed workflows that missed
+// their complete by time have the targetmissed column set
+func (q *WorkflowQuery) Overdue(now time.Time) *WorkflowQuery {
+	return q.Status(tukcnst.OPEN).Where("completeby", OP_LTE, now)
+}
+
+// CreatedFrom matches workflows created at or after from
+func (q *WorkflowQuery) CreatedFrom(from time.Time) *WorkflowQuery {
+	return q.Where("created", OP_GTE, from)
+}
+
+// CreatedBefore matches workflows created before to
+func (q *WorkflowQuery) CreatedBefore(to time.Time) *WorkflowQuery {
+	return q.Where("created", OP_LT, to)
+}
+
+// Org matches workflows with an event raised by any of the organisations
+func (q *WorkflowQuery) Org(orgs ...string) *WorkflowQuery {
+	return q.Where("org", OP_EVENT, strs(orgs)...)
+}
+
+// Unacknowledged matches workflows with an event that has not been acknowledged, and when expressions are given only events
+// with any of the expressions
+func (q *WorkflowQuery) Unacknowledged(expressions ...string) *WorkflowQuery {
+	return q.Where("expression", OP_UNACKED, strs(expressions)...)
+}
+func (q *WorkflowQuery) NewestFirst() *WorkflowQuery {
+	q.Sort("created", true)
+	return q
+}
+func (q *WorkflowQuery) OldestFirst() *WorkflowQuery {
+	q.Sort("created", false)
+	return q
+}
+func (q *WorkflowQuery) Page(page int, size int) *WorkflowQuery {
+	q.Paginate(page, size)
+	return q
+}
+
+// EventQuery builds a Query on the events table
+type EventQuery struct {
+	Query
+}
+
+// NewEventQuery returns a query matching all events
+func NewEventQuery() *EventQuery {
+	return &EventQuery{}
+}
+func (q *EventQuery) Where(column string, op string, values ...interface{}) *EventQuery {
+	q.Filter(column, op, values...)
+	return q
+}
+func (q *EventQuery) Pathway(pathways ...string) *EventQuery {
+	return q.Where("pathway", OP_IN, strs(pathways)...)
+}
+func (q *EventQuery) NHSId(nhsid string) *EventQuery {
+	return q.Where("nhsid", OP_EQ, nhsid)
+}
+func (q *EventQuery) Expression(expressions ...string) *EventQuery {
+	return q.Where("expression", OP_IN, strs(expressions)...)
+}
+func (q *EventQuery) User(user string) *EventQuery {
+	return q.Where("user", OP_EQ, user)
+}
+func (q *EventQuery) Org(orgs ...string) *EventQuery {
+	return q.Where("org", OP_IN, strs(orgs)...)
+}
+func (q *EventQuery) Role(role string) *EventQuery {
+	return q.Where("role", OP_EQ, role)
+}
+func (q *EventQuery) TaskId(taskid int) *EventQuery {
+	return q.Where("taskid", OP_EQ, taskid)
+}
+func (q *EventQuery) Version(version int) *EventQuery {
+	return q.Where("version", OP_EQ, version)
+}
+
+// Current matches the events of the current version of each workflow
+func (q *EventQuery) Current() *EventQuery {
+	return q.Version(0)
+}
+
+// CreatedFrom matches events created at or after from
+func (q *EventQuery) CreatedFrom(from time.Time) *EventQuery {
+	return q.Where("creationtime", OP_GTE, from)
+}
+
+// CreatedBefore matches events created before to
+func (q *EventQuery) CreatedBefore(to time.Time) *EventQuery {
+	return q.Where("creationtime", OP_LT, to)
+}
+
+// Unacknowledged matches notification events that have not been acknowledged
+func (q *EventQuery) Unacknowledged() *EventQuery {
+	return q.Where("id", OP_UNACKED)
+}
+func (q *EventQuery) NewestFirst() *EventQuery {
+	q.Sort("creationtime", true)
+	return q
+}
+func (q *EventQuery) OldestFirst() *EventQuery {
+	q.Sort("creationtime", false)
+	return q
+}
+func (q *EventQuery) Page(page int, size int) *EventQuery {
+	q.Paginate(page, size)
+	return q
+}
+
+// FindWorkflows returns the workflows matching the query. Unlike GetWorkflows, the results start at index 0
+func FindWorkflows(s Store, q *WorkflowQuery) (tukdbint.Workflows, error) {
+	wfs := tukdbint.Workflows{Action: tukcnst.SELECT}
+	err := s.Find(tukcnst.WORKFLOWS, q.Query, &wfs.Workflows)
+	wfs.Count = len(wfs.Workflows)
+	return wfs, err
+}
+
+// FindEvents returns the events matching the query. Unlike GetEvents, the results start at index 0
+func FindEvents(s Store, q *EventQuery) (tukdbint.Events, error) {
+	evs := tukdbint.Events{Action: tukcnst.SELECT}
+	err := s.Find(tukcnst.EVENTS, q.Query, &evs.Events)
+	evs.Count = len(evs.Events)
+	return evs, err
+}
+func strs(vals []string) []interface{} {
+	var i []interface{}
+	for _, val := range vals {
+		i = append(i, val)
+	}
+	return i
+}
+
+// validate returns an error if a condition or order column is not a column of the table row type, or an operator is invalid
+func (q Query) validate(table string, row reflect.Type) error {
+	columns := make(map[string]bool)
+	for _, column := range columnNames(row) {
+		columns[column] = true
+	}
+	if table == tukcnst.WORKFLOWS {
+		for _, column := range summaryColumns {
+			columns[column] = true
+		}
+	}
+	eventColumns := make(map[string]bool)
+	for _, column := range columnNames(reflect.TypeOf(tukdbint.Event{})) {
+		eventColumns[column] = true
+	}
+	for _, c := range q.Where {
+		switch c.Op {
+		case OP_EQ, OP_NE, OP_LT, OP_LTE, OP_GT, OP_GTE, OP_LIKE:
+			if len(c.Values) != 1 {
+				return fmt.Errorf("%s condition on %s requires one value", c.Op, c.Column)
+			}
+		case OP_IN:
+			if len(c.Values) == 0 {
+				return fmt.Errorf("in condition on %s requires a value", c.Column)
+			}
+		case OP_EVENT:
+			if table != tukcnst.WORKFLOWS || !eventColumns[c.Column] || len(c.Values) == 0 {
+				return fmt.Errorf("invalid event condition on %s %s", table, c.Column)
+			}
+			continue
+		case OP_UNACKED:
+			if (table != tukcnst.WORKFLOWS && table != tukcnst.EVENTS) || !eventColumns[c.Column] {
+				return fmt.Errorf("invalid unacked condition on %s %s", table, c.Column)
+			}
+			continue
+		default:
+			return fmt.Errorf("unsupported query operator %s", c.Op)
+		}
+		if !columns[c.Column] {
+			return fmt.Errorf("%s is not a column of %s", c.Column, table)
+		}
+	}
+	for _, o := range q.OrderBy {
+		if !columns[o.Column] {
+			return fmt.Errorf("%s is not a column of %s", o.Column, table)
+		}
+	}
+	if q.Limit < 0 || q.Offset < 0 {
+		return errors.New("query limit and offset cannot be negative")
+	}
+	return nil
+}
+
+// evalContext holds the tables eval needs for OP_EVENT and OP_UNACKED conditions and derived workflow columns
+type evalContext struct {
+	events    []tukdbint.Event
+	summaries map[int64]WorkflowSummary
+	acked     map[int64]bool
+}
+
+// eval returns the rows matching the query, sorted and paginated
+func eval[T any](q Query, rows []T, ctx evalContext) []T {
+	var matched []T
+	for _, row := range rows {
+		v := reflect.ValueOf(row)
+		ismatch := true
+		for _, c := range q.Where {
+			if !evalCondition(c, v, ctx) {
+				ismatch = false
+				break
+			}
+		}
+		if ismatch {
+			matched = append(matched, row)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		vi, vj := reflect.ValueOf(matched[i]), reflect.ValueOf(matched[j])
+		for _, o := range q.OrderBy {
+			cmp := compare(o.Column, ctx.field(vi, o.Column), ctx.field(vj, o.Column))
+			if cmp != 0 {
+				return (cmp < 0) != o.Desc
+			}
+		}
+		return vi.FieldByName("Id").Int() < vj.FieldByName("Id").Int()
+	})
+	if q.Offset >= len(matched) {
+		return nil
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	return matched
+}
+func evalCondition(c Condition, row reflect.Value, ctx evalContext) bool {
+	if c.Op == OP_EVENT {
+		for _, ev := range ctx.events {
+			evrow := reflect.ValueOf(ev)
+			if strings.EqualFold(ev.Pathway, row.FieldByName("Pathway").String()) && ev.NhsId == row.FieldByName("NHSId").String() && int64(ev.Version) == row.FieldByName("Version").Int() && evalCondition(Condition{Column: c.Column, Op: OP_IN, Values: c.Values}, evrow, evalContext{}) {
+				return true
+			}
+		}
+		return false
+	}
+	if c.Op == OP_UNACKED {
+		matches := func(ev reflect.Value) bool {
+			return !ctx.acked[ev.FieldByName("Id").Int()] && ev.FieldByName("Topic").String() != CREATION_EVENT_TOPIC && (len(c.Values) == 0 || evalCondition(Condition{Column: c.Column, Op: OP_IN, Values: c.Values}, ev, evalContext{}))
+		}
+		if row.Type() == reflect.TypeOf(tukdbint.Event{}) {
+			return matches(row)
+		}
+		for _, ev := range ctx.events {
+			if strings.EqualFold(ev.Pathway, row.FieldByName("Pathway").String()) && ev.NhsId == row.FieldByName("NHSId").String() && int64(ev.Version) == row.FieldByName("Version").Int() && matches(reflect.ValueOf(ev)) {
+				return true
+			}
+		}
+		return false
+	}
+	val := ctx.field(row, c.Column)
+	if isTimeColumn(c.Column) && val == "" {
+		// an unset time is NULL in a sql store and matches no condition
+		return false
+	}
+	switch c.Op {
+	case OP_IN:
+		for _, v := range c.Values {
+			if compare(c.Column, val, v) == 0 {
+				return true
+			}
+		}
+		return false
+	case OP_LIKE:
+		return likeRegexp(fmt.Sprint(c.Values[0])).MatchString(fmt.Sprint(val))
+	}
+	cmp := compare(c.Column, val, c.Values[0])
+	switch c.Op {
+	case OP_EQ:
+		return cmp == 0
+	case OP_NE:
+		return cmp != 0
+	case OP_LT:
+		return cmp < 0
+	case OP_LTE:
+		return cmp <= 0
+	case OP_GT:
+		return cmp > 0
+	case OP_GTE:
+		return cmp >= 0
+	}
+	return false
+}
+
+// field returns the column value of the row, or of the row summary for a derived workflows column
+func (ctx evalContext) field(row reflect.Value, column string) interface{} {
+	if val := field(row, column); val != nil {
+		return val
+	}
+	if row.Type() == reflect.TypeOf(tukdbint.Workflow{}) {
+		return field(reflect.ValueOf(ctx.summaries[row.FieldByName("Id").Int()]), column)
+	}
+	return nil
+}
+func field(row reflect.Value, column string) interface{} {
+	for f := 0; f < row.NumField(); f++ {
+		if strings.ToLower(row.Type().Field(f).Name) == column {
+			return row.Field(f).Interface()
+		}
+	}
+	return nil
+}
+
+// compare returns -1, 0 or 1 comparing a column value with a query value
+func compare(column string, a interface{}, b interface{}) int {
+	if isTimeColumn(column) {
+		ta, tb := toTime(a), toTime(b)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+	switch av := a.(type) {
+	case string:
+		return strings.Compare(strings.ToLower(av), strings.ToLower(fmt.Sprint(b)))
+	case bool:
+		bv, _ := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case !av:
+			return -1
+		}
+		return 1
+	case int, int64:
+		ai, bi := reflect.ValueOf(a).Int(), toInt(b)
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+func toTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case string:
+		parsed, _ := time.Parse(time.RFC3339, t)
+		return parsed
+	}
+	return time.Time{}
+}
+func toInt(v interface{}) int64 {
+	switch i := v.(type) {
+	case int:
+		return int64(i)
+	case int64:
+		return i
+	case float64:
+		return int64(i)
+	}
+	return 0
+}
+func likeRegexp(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
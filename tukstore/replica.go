@@ -0,0 +1,113 @@
+package tukstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+// ErrReadOnly is returned by a store opened with DBReader_Only set for any action other than SELECT
+var ErrReadOnly = errors.New("store is a read only reader connection")
+
+// ReplicaStore routes SELECT actions, queries and dashboards to the Reader store and all other actions to the Writer store, so
+// reporting reads do not contend with event ingestion. Transactions are started on the Writer, so reads within a transaction see
+// its writes. Use Writer(store) for a read that must see a preceding write, as replicas may lag the writer
+type ReplicaStore struct {
+	Writer Store
+	Reader Store
+}
+
+// NewReplicaStore returns a ReplicaStore for the writer and reader stores
+func NewReplicaStore(writer Store, reader Store) *ReplicaStore {
+	return &ReplicaStore{Writer: writer, Reader: reader}
+}
+
+// Writer returns the writer of a ReplicaStore, or of the ReplicaStore wrapped by an EncryptedStore or CachedStore, or the store
+// itself for any other store. The writer of a CachedStore is not cached
+func Writer(s Store) Store {
+	switch t := s.(type) {
+	case *ReplicaStore:
+		return t.Writer
+	case *EncryptedStore:
+		return NewEncryptedStore(Writer(t.Store), t.Keys)
+	case *CachedStore:
+		return Writer(t.Store)
+	}
+	return s
+}
+func (s *ReplicaStore) Workflows(i *tukdbint.Workflows) error {
+	return s.route(i.Action).Workflows(i)
+}
+func (s *ReplicaStore) Events(i *tukdbint.Events) error {
+	return s.route(i.Action).Events(i)
+}
+func (s *ReplicaStore) Subscriptions(i *tukdbint.Subscriptions) error {
+	return s.route(i.Action).Subscriptions(i)
+}
+func (s *ReplicaStore) XDWS(i *tukdbint.XDWS) error {
+	return s.route(i.Action).XDWS(i)
+}
+func (s *ReplicaStore) Templates(i *tukdbint.Templates) error {
+	return s.route(i.Action).Templates(i)
+}
+func (s *ReplicaStore) Statics(i *tukdbint.Statics) error {
+	return s.route(i.Action).Statics(i)
+}
+func (s *ReplicaStore) IdMaps(i *tukdbint.IdMaps) error {
+	return s.route(i.Action).IdMaps(i)
+}
+func (s *ReplicaStore) ServiceStates(i *tukdbint.ServiceStates) error {
+	return s.route(i.Action).ServiceStates(i)
+}
+func (s *ReplicaStore) EventAcks(i *tukdbint.EventAcks) error {
+	return s.route(i.Action).EventAcks(i)
+}
+func (s *ReplicaStore) AssetVersions(i *AssetVersions) error {
+	return s.route(i.Action).AssetVersions(i)
+}
+func (s *ReplicaStore) WorkflowArchives(i *WorkflowArchives) error {
+	return s.route(i.Action).WorkflowArchives(i)
+}
+func (s *ReplicaStore) SubjectAudits(i *SubjectAudits) error {
+	return s.route(i.Action).SubjectAudits(i)
+}
+func (s *ReplicaStore) Find(table string, q Query, rows interface{}) error {
+	return s.Reader.Find(table, q, rows)
+}
+func (s *ReplicaStore) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	return s.Writer.UpdateWorkflow(wf, seqno, expected)
+}
+func (s *ReplicaStore) SetWorkflowSummary(sum WorkflowSummary) error {
+	return s.Writer.SetWorkflowSummary(sum)
+}
+func (s *ReplicaStore) SetColumns(table string, id int64, values map[string]interface{}) error {
+	return s.Writer.SetColumns(table, id, values)
+}
+func (s *ReplicaStore) Dashboard(q Query, now time.Time) (tukxdw.Dashboard, error) {
+	return s.Reader.Dashboard(q, now)
+}
+func (s *ReplicaStore) WithContext(ctx context.Context) Store {
+	return &ReplicaStore{Writer: s.Writer.WithContext(ctx), Reader: s.Reader.WithContext(ctx)}
+}
+func (s *ReplicaStore) Begin() (Tx, error) {
+	return s.Writer.Begin()
+}
+
+// Close closes the reader and the writer
+func (s *ReplicaStore) Close() error {
+	rerr := s.Reader.Close()
+	if err := s.Writer.Close(); err != nil {
+		return err
+	}
+	return rerr
+}
+func (s *ReplicaStore) route(action string) Store {
+	if action == tukcnst.SELECT {
+		return s.Reader
+	}
+	return s.Writer
+}
@@ -0,0 +1,485 @@
+package tukstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// Retention
+//
+// A RetentionPolicy archives the CLOSED workflows of a pathway a number of days after they closed, and purges the deprecated
+// versions of its workflows (version > 0) a number of days after they were created. An archived workflow is written, with its
+// events and their acknowledgements, to an Archive and then deleted from the store in one transaction. Purged versions and their
+// events are deleted without being archived. Archived workflows are retrieved by XDW_Key with GetArchivedWorkflows.
+const (
+	WORKFLOW_ARCHIVES          = "workflowarchives"
+	ARCHIVE_TABLE              = "table"
+	RETENTION_CONFIG           = "./config/retention.json"
+	RETENTION_ANY_PATHWAY      = "*"
+	RETENTION_ARCHIVE          = "archive"
+	RETENTION_PURGE            = "purge"
+	RETENTION_PAGE_SIZE        = 100
+	DEFAULT_RETENTION_INTERVAL = 24 * time.Hour
+)
+
+// RetentionPolicy is the retention of the workflows of a pathway, or of the pathways without a policy of their own when Pathway is
+// RETENTION_ANY_PATHWAY. A value of 0 days disables archiving or purging
+type RetentionPolicy struct {
+	Pathway             string `json:"pathway"`
+	ArchiveClosedDays   int    `json:"archiveclosed"`
+	PurgeDeprecatedDays int    `json:"purgedeprecated"`
+}
+
+// RetentionConfig is the config/retention.json file. Archive is ARCHIVE_TABLE, the default, to archive to the workflowarchives
+// table, or a directory to archive to compressed json files. Interval is the time between scheduled runs, eg. 24h
+type RetentionConfig struct {
+	Archive  string            `json:"archive"`
+	Interval string            `json:"interval"`
+	Policies []RetentionPolicy `json:"policies"`
+}
+
+// WorkflowArchive is a row of the workflowarchives table. Content is the base64 gzip compressed ArchivedWorkflow json
+type WorkflowArchive struct {
+	Id       int64  `json:"id"`
+	Archived string `json:"archived"`
+	Pathway  string `json:"pathway"`
+	NHSId    string `json:"nhsid"`
+	XDW_Key  string `json:"xdw_key"`
+	Version  int    `json:"version"`
+	Status   string `json:"status"`
+	Content  string `json:"content"`
+}
+
+// WorkflowArchives is the workflowarchives table collection, in the form of the tukdbint collections
+type WorkflowArchives struct {
+	Action           string            `json:"action"`
+	LastInsertId     int64             `json:"lastinsertid"`
+	Count            int               `json:"count"`
+	WorkflowArchives []WorkflowArchive `json:"workflowarchives"`
+}
+
+// ArchivedWorkflow is an archived workflow with its events and their acknowledgements
+type ArchivedWorkflow struct {
+	Archived  string              `json:"archived"`
+	Workflow  tukdbint.Workflow   `json:"workflow"`
+	Events    []tukdbint.Event    `json:"events"`
+	EventAcks []tukdbint.EventAck `json:"eventacks"`
+}
+
+// Archive stores archived workflows. Put is called with the store transaction the workflow is deleted in, Get returns the
+// archived workflows with the xdw key, newest first, and Delete deletes them and returns the number deleted
+type Archive interface {
+	Put(s Store, rec ArchivedWorkflow) error
+	Get(s Store, xdwkey string) ([]ArchivedWorkflow, error)
+	Delete(s Store, xdwkey string) (int, error)
+}
+
+// TableArchive archives workflows to the workflowarchives table of the store. Its content, nhsid and xdw_key columns are encrypted
+// and hashed when the store is encrypted
+type TableArchive struct{}
+
+// DirArchive archives workflows to <Dir>/<pathway>/<xdw key>.<workflow id>.json.gz files. When Keys is set, the file names use
+// the hashed xdw key and the files are encrypted, with a .enc suffix
+type DirArchive struct {
+	Dir  string
+	Keys *Keyring
+}
+
+// RetainedWorkflow is a workflow version archived or purged by Retain. Action is RETENTION_ARCHIVE or RETENTION_PURGE
+type RetainedWorkflow struct {
+	Action  string `json:"action"`
+	Pathway string `json:"pathway"`
+	XDW_Key string `json:"xdw_key"`
+	Version int    `json:"version"`
+	Status  string `json:"status"`
+	Created string `json:"created"`
+	Events  int    `json:"events"`
+}
+
+// RetentionReport lists the workflow versions archived or purged by Retain, or that would be when DryRun is true
+type RetentionReport struct {
+	DryRun    bool               `json:"dryrun"`
+	Workflows []RetainedWorkflow `json:"workflows"`
+}
+
+// LoadRetentionConfig returns the RetentionConfig in the json file, or an error if a policy is invalid
+func LoadRetentionConfig(path string) (RetentionConfig, error) {
+	config := RetentionConfig{}
+	filebytes, err := os.ReadFile(path)
+	if err != nil {
+		log.Println(err.Error())
+		return config, err
+	}
+	if err := json.Unmarshal(filebytes, &config); err != nil {
+		log.Println(err.Error())
+		return config, err
+	}
+	if _, err := config.Schedule(); err != nil {
+		return config, err
+	}
+	pathways := make(map[string]bool)
+	for _, policy := range config.Policies {
+		switch {
+		case policy.Pathway == "":
+			return config, errors.New("retention policy pathway is not set, use " + RETENTION_ANY_PATHWAY + " for any pathway")
+		case pathways[policy.Pathway]:
+			return config, errors.New("more than one retention policy for pathway " + policy.Pathway)
+		case policy.ArchiveClosedDays < 0 || policy.PurgeDeprecatedDays < 0:
+			return config, errors.New("retention policy days for pathway " + policy.Pathway + " can not be negative")
+		}
+		pathways[policy.Pathway] = true
+	}
+	return config, nil
+}
+
+// Schedule returns the Interval duration, or DEFAULT_RETENTION_INTERVAL if it is not set
+func (c RetentionConfig) Schedule() (time.Duration, error) {
+	if c.Interval == "" {
+		return DEFAULT_RETENTION_INTERVAL, nil
+	}
+	interval, err := time.ParseDuration(c.Interval)
+	if err == nil && interval <= 0 {
+		err = errors.New("retention interval must be positive")
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return interval, err
+}
+
+// OpenArchive returns the Archive for the target, a TableArchive for ARCHIVE_TABLE or an empty target, or a DirArchive for the
+// directory, encrypted with the keyring of an encrypted store
+func OpenArchive(s Store, target string) Archive {
+	if target == "" || target == ARCHIVE_TABLE {
+		return TableArchive{}
+	}
+	return DirArchive{Dir: target, Keys: StoreKeyring(s)}
+}
+
+// Retain applies the policies at time now, archiving closed workflows to the archive and purging deprecated versions. When dryrun
+// is true the store is not changed and the report lists the workflow versions that would be archived or purged
+func Retain(s Store, a Archive, policies []RetentionPolicy, now time.Time, dryrun bool) (RetentionReport, error) {
+	report := RetentionReport{DryRun: dryrun}
+	var named []string
+	for _, policy := range policies {
+		if policy.Pathway != RETENTION_ANY_PATHWAY {
+			named = append(named, policy.Pathway)
+		}
+	}
+	for _, policy := range policies {
+		if policy.ArchiveClosedDays > 0 {
+			q := retentionQuery(policy.Pathway, named).Current().Status(tukcnst.CLOSED).Where("closedtime", OP_LT, now.AddDate(0, 0, -policy.ArchiveClosedDays))
+			if err := retain(s, a, q, RETENTION_ARCHIVE, now, dryrun, &report); err != nil {
+				return report, err
+			}
+		}
+		if policy.PurgeDeprecatedDays > 0 {
+			q := retentionQuery(policy.Pathway, named).Where("version", OP_GT, 0).CreatedBefore(now.AddDate(0, 0, -policy.PurgeDeprecatedDays))
+			if err := retain(s, nil, q, RETENTION_PURGE, now, dryrun, &report); err != nil {
+				return report, err
+			}
+		}
+	}
+	log.Printf("Retention %s workflows", report.Summary())
+	return report, nil
+}
+
+// Summary returns the number of workflow versions archived and purged
+func (r RetentionReport) Summary() string {
+	counts := make(map[string]int)
+	for _, wf := range r.Workflows {
+		counts[wf.Action] = counts[wf.Action] + 1
+	}
+	summary := fmt.Sprintf("archived %v and purged %v", counts[RETENTION_ARCHIVE], counts[RETENTION_PURGE])
+	if r.DryRun {
+		summary = "dry run " + summary
+	}
+	return summary
+}
+
+// GetArchivedWorkflows returns the archived workflows with the xdw key, newest first
+func GetArchivedWorkflows(s Store, a Archive, xdwkey string) ([]ArchivedWorkflow, error) {
+	if xdwkey == "" {
+		return nil, errors.New("xdw key is not set")
+	}
+	return a.Get(s, xdwkey)
+}
+
+// retentionQuery matches the workflows of the pathway, or for RETENTION_ANY_PATHWAY the workflows of pathways that are not named
+func retentionQuery(pathway string, named []string) *WorkflowQuery {
+	q := NewWorkflowQuery()
+	if pathway != RETENTION_ANY_PATHWAY {
+		return q.Pathway(pathway)
+	}
+	for _, name := range named {
+		q.Where("pathway", OP_NE, name)
+	}
+	return q
+}
+
+// retain archives or purges the workflows matching the query a page at a time. As retained workflows are deleted, the first page
+// is read until no workflows match, unless it is a dry run. Archived workflows are archived at time now
+func retain(s Store, a Archive, q *WorkflowQuery, action string, now time.Time, dryrun bool, report *RetentionReport) error {
+	q.OldestFirst()
+	for page := 1; ; page++ {
+		if !dryrun {
+			page = 1
+		}
+		var wfs []tukdbint.Workflow
+		if err := s.Find(tukcnst.WORKFLOWS, q.Page(page, RETENTION_PAGE_SIZE).Query, &wfs); err != nil {
+			return err
+		}
+		for _, wf := range wfs {
+			rec, err := archivedWorkflow(s, wf, now)
+			if err != nil {
+				return err
+			}
+			report.Workflows = append(report.Workflows, RetainedWorkflow{Action: action, Pathway: wf.Pathway, XDW_Key: wf.XDW_Key, Version: wf.Version, Status: wf.Status, Created: wf.Created, Events: len(rec.Events)})
+			if dryrun {
+				continue
+			}
+			if err := WithTx(s, func(tx Store) error {
+				if a != nil {
+					if err := a.Put(tx, rec); err != nil {
+						return err
+					}
+				}
+				return deleteWorkflow(tx, rec)
+			}); err != nil {
+				return err
+			}
+		}
+		if len(wfs) < RETENTION_PAGE_SIZE {
+			return nil
+		}
+	}
+}
+
+// archivedWorkflow returns the workflow archived at time now with the events of its version and their acknowledgements
+func archivedWorkflow(s Store, wf tukdbint.Workflow, now time.Time) (ArchivedWorkflow, error) {
+	rec := ArchivedWorkflow{Archived: now.Format(time.RFC3339), Workflow: wf}
+	evs, err := FindEvents(s, NewEventQuery().Pathway(wf.Pathway).NHSId(wf.NHSId).Version(wf.Version).OldestFirst())
+	if err != nil {
+		return rec, err
+	}
+	rec.Events = evs.Events
+	rec.EventAcks, err = findEventAcks(s, rec.Events)
+	return rec, err
+}
+
+// deleteWorkflow deletes the workflow, its events and their acknowledgements
+func deleteWorkflow(s Store, rec ArchivedWorkflow) error {
+	if err := deleteEvents(s, rec.Events, rec.EventAcks); err != nil {
+		return err
+	}
+	wfs := tukdbint.Workflows{Action: tukcnst.DELETE}
+	wfs.Workflows = append(wfs.Workflows, tukdbint.Workflow{Id: rec.Workflow.Id, Version: -1, Published: rec.Workflow.Published})
+	return s.Workflows(&wfs)
+}
+
+// deleteEvents deletes the acknowledgements and events
+func deleteEvents(s Store, evs []tukdbint.Event, eventacks []tukdbint.EventAck) error {
+	for _, ack := range eventacks {
+		acks := tukdbint.EventAcks{Action: tukcnst.DELETE}
+		acks.EventAck = append(acks.EventAck, tukdbint.EventAck{Id: ack.Id})
+		if err := s.EventAcks(&acks); err != nil {
+			return err
+		}
+	}
+	for _, ev := range evs {
+		del := tukdbint.Events{Action: tukcnst.DELETE}
+		del.Events = append(del.Events, tukdbint.Event{Id: ev.Id, Version: -1, TaskId: -1})
+		if err := s.Events(&del); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put inserts the archived workflow into the workflowarchives table
+func (TableArchive) Put(s Store, rec ArchivedWorkflow) error {
+	content, err := compress(rec)
+	if err != nil {
+		return err
+	}
+	archives := WorkflowArchives{Action: tukcnst.INSERT}
+	archives.WorkflowArchives = append(archives.WorkflowArchives, WorkflowArchive{Archived: rec.Archived, Pathway: rec.Workflow.Pathway, NHSId: rec.Workflow.NHSId, XDW_Key: rec.Workflow.XDW_Key, Version: rec.Workflow.Version, Status: rec.Workflow.Status, Content: base64.StdEncoding.EncodeToString(content)})
+	return s.WorkflowArchives(&archives)
+}
+
+// Get returns the archived workflows with the xdw key from the workflowarchives table
+func (TableArchive) Get(s Store, xdwkey string) ([]ArchivedWorkflow, error) {
+	archives := WorkflowArchives{Action: tukcnst.SELECT}
+	archives.WorkflowArchives = append(archives.WorkflowArchives, WorkflowArchive{XDW_Key: xdwkey, Version: -1})
+	if err := s.WorkflowArchives(&archives); err != nil {
+		return nil, err
+	}
+	var recs []ArchivedWorkflow
+	for k := len(archives.WorkflowArchives) - 1; k > 0; k-- {
+		content, err := base64.StdEncoding.DecodeString(archives.WorkflowArchives[k].Content)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		rec, err := decompress(content)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// Delete deletes the archived workflows with the xdw key from the workflowarchives table
+func (TableArchive) Delete(s Store, xdwkey string) (int, error) {
+	archives := WorkflowArchives{Action: tukcnst.SELECT}
+	archives.WorkflowArchives = append(archives.WorkflowArchives, WorkflowArchive{XDW_Key: xdwkey, Version: -1})
+	if err := s.WorkflowArchives(&archives); err != nil {
+		return 0, err
+	}
+	for k, archive := range archives.WorkflowArchives[1:] {
+		del := WorkflowArchives{Action: tukcnst.DELETE}
+		del.WorkflowArchives = append(del.WorkflowArchives, WorkflowArchive{Id: archive.Id, Version: -1})
+		if err := s.WorkflowArchives(&del); err != nil {
+			return k, err
+		}
+	}
+	return len(archives.WorkflowArchives) - 1, nil
+}
+
+// Put writes the archived workflow to a compressed json file, replacing the file of a previous attempt to archive the workflow
+func (a DirArchive) Put(s Store, rec ArchivedWorkflow) error {
+	content, err := compress(rec)
+	if err != nil {
+		return err
+	}
+	name := a.fileName(rec.Workflow.XDW_Key) + "." + strconv.FormatInt(rec.Workflow.Id, 10) + ".json.gz"
+	if a.Keys != nil {
+		enc, err := a.Keys.Encrypt(base64.StdEncoding.EncodeToString(content))
+		if err != nil {
+			return err
+		}
+		content, name = []byte(enc), name+".enc"
+	}
+	dir := filepath.Join(a.Dir, safeFileName.ReplaceAllString(rec.Workflow.Pathway, "_"))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// Get returns the archived workflows with the xdw key from the archive directory
+func (a DirArchive) Get(s Store, xdwkey string) ([]ArchivedWorkflow, error) {
+	files, err := filepath.Glob(filepath.Join(a.Dir, "*", a.fileName(xdwkey)+".*.json.gz*"))
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	var recs []ArchivedWorkflow
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if strings.HasSuffix(file, ".enc") {
+			if a.Keys == nil {
+				return nil, errors.New("archive file " + file + " is encrypted and no keyring is configured")
+			}
+			plaintext, err := a.Keys.Decrypt(string(content))
+			if err != nil {
+				return nil, err
+			}
+			if content, err = base64.StdEncoding.DecodeString(plaintext); err != nil {
+				log.Println(err.Error())
+				return nil, err
+			}
+		}
+		rec, err := decompress(content)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Workflow.Id > recs[j].Workflow.Id })
+	return recs, nil
+}
+
+// Delete removes the archive files of the workflows with the xdw key
+func (a DirArchive) Delete(s Store, xdwkey string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(a.Dir, "*", a.fileName(xdwkey)+".*.json.gz*"))
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	for k, file := range files {
+		if err := os.Remove(file); err != nil {
+			log.Println(err.Error())
+			return k, err
+		}
+	}
+	return len(files), nil
+}
+
+// safeFileName matches the characters replaced in archive file names
+var safeFileName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// fileName returns the archive file name of the xdw key, which is hashed when the archive is encrypted
+func (a DirArchive) fileName(xdwkey string) string {
+	if a.Keys != nil {
+		xdwkey = strings.TrimPrefix(a.Keys.Hash(xdwkey), HASHED_PREFIX)
+	}
+	return safeFileName.ReplaceAllString(xdwkey, "_")
+}
+func compress(rec ArchivedWorkflow) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(rec); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+func decompress(content []byte) (ArchivedWorkflow, error) {
+	rec := ArchivedWorkflow{}
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		log.Println(err.Error())
+		return rec, err
+	}
+	defer zr.Close()
+	jsonbytes, err := io.ReadAll(zr)
+	if err != nil {
+		log.Println(err.Error())
+		return rec, err
+	}
+	if err := json.Unmarshal(jsonbytes, &rec); err != nil {
+		log.Println(err.Error())
+	}
+	return rec, err
+}
@@ -0,0 +1,111 @@
+package tukstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// retentionWorkflows inserts lab workflows for retention at time now: 1111111111 closed 40 days before now with an acknowledged
+// event, 2222222222 closed 10 days before now, 3333333333 open, and a deprecated version 1 of 4444444444 with an event
+func retentionWorkflows(t *testing.T, s Store, now time.Time) {
+	t.Helper()
+	for _, sum := range []WorkflowSummary{
+		{NHSId: "1111111111", ClosedTime: now.AddDate(0, 0, -40).Format(time.RFC3339)},
+		{NHSId: "2222222222", ClosedTime: now.AddDate(0, 0, -10).Format(time.RFC3339)},
+		{NHSId: "3333333333"},
+		{NHSId: "4444444444", Version: 1},
+	} {
+		wf := testWorkflow("lab", sum.NHSId, "doc")
+		wf.Version = sum.Version
+		if sum.ClosedTime != "" {
+			wf.Status = tukcnst.CLOSED
+		}
+		insertWorkflow(t, s, wf)
+		sum.Pathway = "lab"
+		if err := s.SetWorkflowSummary(sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ev := range []tukdbint.Event{{NhsId: "1111111111"}, {NhsId: "4444444444", Version: 1}} {
+		evs := tukdbint.Events{Action: tukcnst.INSERT}
+		evs.Events = append(evs.Events, tukdbint.Event{Pathway: "lab", NhsId: ev.NhsId, Version: ev.Version, Expression: "Lab_Result", User: "u", Org: "o", Role: "r"})
+		if err := s.Events(&evs); err != nil {
+			t.Fatal(err)
+		}
+		if ev.NhsId == "1111111111" {
+			acks := tukdbint.EventAcks{Action: tukcnst.INSERT}
+			acks.EventAck = append(acks.EventAck, tukdbint.EventAck{EventID: evs.LastInsertId, User: "u", Org: "o", Role: "r"})
+			if err := s.EventAcks(&acks); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// testRetain runs the lab retention policy against the retentionWorkflows, dry run first, and checks the archive
+func testRetain(t *testing.T, s Store, a Archive) {
+	now := time.Now().AddDate(0, 0, 100).Truncate(time.Second)
+	retentionWorkflows(t, s, now)
+	policies := []RetentionPolicy{{Pathway: "lab", ArchiveClosedDays: 30, PurgeDeprecatedDays: 90}, {Pathway: RETENTION_ANY_PATHWAY, ArchiveClosedDays: 1}}
+	retained := func(report RetentionReport) map[string]string {
+		actions := make(map[string]string)
+		for _, wf := range report.Workflows {
+			actions[wf.XDW_Key] = wf.Action
+		}
+		return actions
+	}
+	report, err := Retain(s, a, policies, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := retained(report); len(actions) != 2 || actions["lab1111111111"] != RETENTION_ARCHIVE || actions["lab4444444444"] != RETENTION_PURGE {
+		t.Fatalf("dry run retained %v, want 1111111111 archived and 4444444444 purged", actions)
+	}
+	if wfs := selectWorkflows(t, s, tukdbint.Workflow{Pathway: "lab", Version: -1}); len(wfs) != 4 {
+		t.Fatalf("dry run left %v workflows, want 4", len(wfs))
+	}
+	if recs, err := GetArchivedWorkflows(s, a, "lab1111111111"); err != nil || len(recs) != 0 {
+		t.Fatalf("dry run archived %v workflows, %v", len(recs), err)
+	}
+	report, err = Retain(s, a, policies, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := retained(report); len(actions) != 2 || report.Summary() != "archived 1 and purged 1" {
+		t.Fatalf("retained %v, %s", actions, report.Summary())
+	}
+	wfs := selectWorkflows(t, s, tukdbint.Workflow{Pathway: "lab", Version: -1})
+	if len(wfs) != 2 {
+		t.Fatalf("retention left %v workflows, want 2222222222 and 3333333333", len(wfs))
+	}
+	evs, err := FindEvents(s, NewEventQuery().Pathway("lab"))
+	if err != nil || evs.Count != 0 {
+		t.Fatalf("retention left %v events, %v", evs.Count, err)
+	}
+	recs, err := GetArchivedWorkflows(s, a, "lab1111111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Archived != now.Format(time.RFC3339) || recs[0].Workflow.NHSId != "1111111111" || len(recs[0].Events) != 1 || len(recs[0].EventAcks) != 1 {
+		t.Fatalf("archived workflows are %+v, want 1111111111 archived at %s with its event and acknowledgement", recs, now.Format(time.RFC3339))
+	}
+	if recs, err := GetArchivedWorkflows(s, a, "lab4444444444"); err != nil || len(recs) != 0 {
+		t.Fatalf("purged workflow was archived %v times, %v", len(recs), err)
+	}
+	if _, err := GetArchivedWorkflows(s, a, ""); err == nil {
+		t.Fatal("archived workflows were returned for an empty xdw key")
+	}
+}
+
+func TestRetainTableArchive(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		testRetain(t, s, TableArchive{})
+	})
+}
+
+func TestRetainDirArchive(t *testing.T) {
+	testRetain(t, NewMemStore(), DirArchive{Dir: t.TempDir()})
+}
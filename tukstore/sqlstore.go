@@ -0,0 +1,505 @@
+package tukstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+
+	"tukxdw-client/tukclock"
+)
+
+// STATEMENT_TIMEOUT is the maximum duration of a SQLStore statement
+const STATEMENT_TIMEOUT = 5 * time.Second
+
+// SQLStore is a database/sql Store for MySQL and PostgreSQL. Unlike DBStore it holds its own connection pool, so any number can be open.
+// Statements match the tukdbint prepared statements, with the id of inserted rows returned by RETURNING id on PostgreSQL
+type SQLStore struct {
+	Dialect    string
+	Connection tukdbint.TukDBConnection
+	DB         *sql.DB
+	dialect    dialect
+	tx         *sql.Tx
+	ctx        context.Context
+}
+
+// sqlConn is implemented by sql.DB and sql.Tx
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NewSQLStore opens a connection pool to the dialect (tukcnst.MYSQL or POSTGRES) database described by conn. params are added to the
+// driver data source name, eg. sslmode=verify-full for PostgreSQL or tls=true for MySQL
+func NewSQLStore(dialectname string, conn tukdbint.TukDBConnection, params url.Values) (*SQLStore, error) {
+	d, err := newDialect(dialectname)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	s := SQLStore{Dialect: dialectname, Connection: conn, dialect: d}
+	log.Printf("Opening %s connection to %s:%s/%s", dialectname, conn.DBHost, conn.DBPort, conn.DBName)
+	if s.DB, err = sql.Open(d.driver, d.dsn(conn, params)); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), STATEMENT_TIMEOUT)
+	defer cancel()
+	if err = s.DB.PingContext(ctx); err != nil {
+		log.Println(err.Error())
+		s.DB.Close()
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Begin starts a database transaction
+func (s *SQLStore) Begin() (Tx, error) {
+	if s.tx != nil {
+		return nil, errors.New("transaction already started")
+	}
+	base := s.ctx
+	if base == nil {
+		base = context.Background()
+	}
+	tx, err := s.DB.BeginTx(base, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	txs := *s
+	txs.tx = tx
+	return &sqlTx{SQLStore: &txs}, nil
+}
+
+// WithContext returns the store with statements run in the context. If the context has no deadline, each statement is limited to
+// STATEMENT_TIMEOUT. A transaction started by the returned store is rolled back if the context is cancelled
+func (s *SQLStore) WithContext(ctx context.Context) Store {
+	ctxs := *s
+	ctxs.ctx = ctx
+	return &ctxs
+}
+func (s *SQLStore) context() (context.Context, context.CancelFunc) {
+	return opContext(s.ctx, STATEMENT_TIMEOUT)
+}
+
+type sqlTx struct {
+	*SQLStore
+}
+
+func (t *sqlTx) Commit() error {
+	return t.tx.Commit()
+}
+func (t *sqlTx) Rollback() error {
+	if err := t.tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return err
+	}
+	return nil
+}
+
+// Close rolls back the transaction if it has not been committed
+func (t *sqlTx) Close() error {
+	return t.Rollback()
+}
+func (s *SQLStore) conn() sqlConn {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.DB
+}
+func (s *SQLStore) Workflows(i *tukdbint.Workflows) error {
+	return sqlExecute(s, tukcnst.WORKFLOWS, i.Action, &i.Workflows, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) Events(i *tukdbint.Events) error {
+	return sqlExecute(s, tukcnst.EVENTS, i.Action, &i.Events, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) Subscriptions(i *tukdbint.Subscriptions) error {
+	return sqlExecute(s, tukcnst.SUBSCRIPTIONS, i.Action, &i.Subscriptions, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) XDWS(i *tukdbint.XDWS) error {
+	return sqlExecute(s, tukcnst.XDWS, i.Action, &i.XDW, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) Templates(i *tukdbint.Templates) error {
+	return sqlExecute(s, tukcnst.TEMPLATES, i.Action, &i.Templates, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) Statics(i *tukdbint.Statics) error {
+	return sqlExecute(s, tukcnst.STATICS, i.Action, &i.Static, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) IdMaps(i *tukdbint.IdMaps) error {
+	return sqlExecute(s, tukcnst.ID_MAPS, i.Action, &i.LidMap, &i.Cnt, &i.LastInsertId)
+}
+func (s *SQLStore) ServiceStates(i *tukdbint.ServiceStates) error {
+	return sqlExecute(s, tukcnst.SERVICE_STATES, i.Action, &i.ServiceState, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) EventAcks(i *tukdbint.EventAcks) error {
+	return sqlExecute(s, tukcnst.EVENT_ACKS, i.Action, &i.EventAck, &i.Cnt, &i.LastInsertId)
+}
+func (s *SQLStore) AssetVersions(i *AssetVersions) error {
+	return sqlExecute(s, ASSET_VERSIONS, i.Action, &i.AssetVersions, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) WorkflowArchives(i *WorkflowArchives) error {
+	return sqlExecute(s, WORKFLOW_ARCHIVES, i.Action, &i.WorkflowArchives, &i.Count, &i.LastInsertId)
+}
+func (s *SQLStore) SubjectAudits(i *SubjectAudits) error {
+	return sqlExecute(s, SUBJECT_AUDITS, i.Action, &i.SubjectAudits, &i.Count, &i.LastInsertId)
+}
+
+// Close closes the connection pool
+func (s *SQLStore) Close() error {
+	return s.DB.Close()
+}
+
+// SetColumns sets the column values of the table row with the id
+func (s *SQLStore) SetColumns(table string, id int64, values map[string]interface{}) error {
+	if s.Connection.DBReader_Only {
+		return ErrReadOnly
+	}
+	if err := checkColumns(table, values); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	d := s.dialect
+	var set []string
+	var vals []interface{}
+	for _, column := range sortedKeys(values) {
+		vals = append(vals, columnValue(column, values[column]))
+		set = append(set, d.quote(column)+" = "+d.param(len(vals)))
+	}
+	vals = append(vals, id)
+	ctx, cancel := s.context()
+	defer cancel()
+	if _, err := s.conn().ExecContext(ctx, "UPDATE "+d.quote(table)+" SET "+strings.Join(set, ", ")+" WHERE "+d.quote("id")+" = "+d.param(len(vals)), vals...); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// sqlExecute runs the action against the table. The first element of rows is the filter or the row to insert
+func sqlExecute[T any](s *SQLStore, table string, action string, rows *[]T, count *int, lastid *int64) error {
+	if action != tukcnst.SELECT && s.Connection.DBReader_Only {
+		return ErrReadOnly
+	}
+	var filter map[string]interface{}
+	if len(*rows) > 0 {
+		filter = params(reflect.ValueOf((*rows)[0]))
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	d := s.dialect
+	var stmnt string
+	var vals []interface{}
+	switch action {
+	case tukcnst.SELECT:
+		var t T
+		var columns []string
+		for _, column := range columnNames(reflect.TypeOf(t)) {
+			columns = append(columns, d.quote(column))
+		}
+		stmnt = "SELECT " + strings.Join(columns, ", ") + " FROM " + d.quote(table)
+		if where := d.where(filter, &vals); where != "" {
+			stmnt = stmnt + " WHERE " + where
+		}
+		stmnt = stmnt + " ORDER BY " + d.quote("id")
+		return d.query(ctx, s.conn(), stmnt, vals, rows, count)
+	case tukcnst.INSERT:
+		if len(*rows) == 0 {
+			return nil
+		}
+		insert := params(reflect.ValueOf((*rows)[0]))
+		v := reflect.ValueOf((*rows)[0])
+		for f := 0; f < v.NumField(); f++ {
+			if v.Field(f).Kind() == reflect.Slice && v.Field(f).Len() > 0 {
+				insert[strings.ToLower(v.Type().Field(f).Name)] = v.Field(f).Bytes()
+			}
+		}
+		var columns, placeholders []string
+		for _, column := range sortedKeys(insert) {
+			vals = append(vals, columnValue(column, insert[column]))
+			columns = append(columns, d.quote(column))
+			placeholders = append(placeholders, d.param(len(vals)))
+		}
+		stmnt = "INSERT INTO " + d.quote(table) + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")"
+		if d.returning() {
+			stmnt = stmnt + " RETURNING " + d.quote("id")
+			if err := s.conn().QueryRowContext(ctx, stmnt, vals...).Scan(lastid); err != nil {
+				log.Println(err.Error())
+				return err
+			}
+			return nil
+		}
+		rslt, err := s.conn().ExecContext(ctx, stmnt, vals...)
+		if err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		if *lastid, err = rslt.LastInsertId(); err != nil {
+			log.Println(err.Error())
+		}
+		return err
+	case tukcnst.DELETE:
+		if len(filter) == 0 {
+			return nil
+		}
+		stmnt = "DELETE FROM " + d.quote(table) + " WHERE " + d.where(filter, &vals)
+	case tukcnst.DEPRECATE:
+		var keys []string
+		switch table {
+		case tukcnst.WORKFLOWS:
+			keys = []string{"xdw_key"}
+		case tukcnst.EVENTS:
+			keys = []string{"pathway", "nhsid"}
+		default:
+			return errors.New("deprecate is not supported for table " + table)
+		}
+		where, err := subset(filter, keys)
+		if err != nil {
+			return err
+		}
+		stmnt = "UPDATE " + d.quote(table) + " SET " + d.quote("version") + " = " + d.quote("version") + " + 1 WHERE " + d.where(where, &vals)
+	case tukcnst.UPDATE:
+		if table != tukcnst.WORKFLOWS {
+			return errors.New("update is not supported for table " + table)
+		}
+		where, err := subset(filter, []string{"pathway", "nhsid", "version"})
+		if err != nil {
+			return err
+		}
+		src := reflect.ValueOf((*rows)[0])
+		var set []string
+		for _, field := range []string{"XDW_Doc", "Published", "Status"} {
+			vals = append(vals, src.FieldByName(field).Interface())
+			set = append(set, d.quote(strings.ToLower(field))+" = "+d.param(len(vals)))
+		}
+		stmnt = "UPDATE " + d.quote(table) + " SET " + strings.Join(set, ", ") + " WHERE " + d.where(where, &vals)
+	default:
+		return errors.New("unsupported action " + action)
+	}
+	if _, err := s.conn().ExecContext(ctx, stmnt, vals...); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// query appends the rows returned by the statement to rows
+func (d dialect) query(ctx context.Context, db sqlConn, stmnt string, vals []interface{}, rows interface{}, count *int) error {
+	sqlrows, err := db.QueryContext(ctx, stmnt, vals...)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer sqlrows.Close()
+	slice := reflect.ValueOf(rows).Elem()
+	for sqlrows.Next() {
+		row := reflect.New(slice.Type().Elem()).Elem()
+		var dest []interface{}
+		for f := 0; f < row.NumField(); f++ {
+			dest = append(dest, scanner(row.Type().Field(f).Name, row.Field(f).Kind()))
+		}
+		if err := sqlrows.Scan(dest...); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		for f := 0; f < row.NumField(); f++ {
+			setField(row.Field(f), dest[f])
+		}
+		slice.Set(reflect.Append(slice, row))
+		*count = *count + 1
+	}
+	return sqlrows.Err()
+}
+
+// where returns the AND of the filter comparisons, appending the filter values to vals
+func (d dialect) where(filter map[string]interface{}, vals *[]interface{}) string {
+	var clauses []string
+	for _, column := range sortedKeys(filter) {
+		*vals = append(*vals, columnValue(column, filter[column]))
+		_, isstring := filter[column].(string)
+		clauses = append(clauses, d.equals(column, len(*vals), isstring && !isTimeColumn(column)))
+	}
+	return strings.Join(clauses, " AND ")
+}
+func columnNames(t reflect.Type) []string {
+	var names []string
+	for f := 0; f < t.NumField(); f++ {
+		names = append(names, strings.ToLower(t.Field(f).Name))
+	}
+	return names
+}
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+func isTimeColumn(column string) bool {
+	switch column {
+	case "created", "creationtime", "completeby", "escalateby", "closedtime", "lasteventtime", "archived":
+		return true
+	}
+	return false
+}
+
+// columnValue converts the RFC3339 times held in tukdbint string fields to time.Time for the TIMESTAMP columns
+func columnValue(column string, val interface{}) interface{} {
+	if s, ok := val.(string); ok && isTimeColumn(column) {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t
+		}
+	}
+	return val
+}
+func scanner(name string, kind reflect.Kind) interface{} {
+	switch {
+	case isTimeColumn(strings.ToLower(name)):
+		return &sql.NullTime{}
+	case kind == reflect.String:
+		return &sql.NullString{}
+	case kind == reflect.Int, kind == reflect.Int64:
+		return &sql.NullInt64{}
+	case kind == reflect.Bool:
+		return &sql.NullBool{}
+	}
+	return &[]byte{}
+}
+func setField(field reflect.Value, dest interface{}) {
+	switch v := dest.(type) {
+	case *sql.NullTime:
+		if v.Valid {
+			field.SetString(tukclock.Format(v.Time))
+		}
+	case *sql.NullString:
+		field.SetString(v.String)
+	case *sql.NullInt64:
+		field.SetInt(v.Int64)
+	case *sql.NullBool:
+		field.SetBool(v.Bool)
+	case *[]byte:
+		field.SetBytes(*v)
+	}
+}
+
+// Find appends the table rows matching the query to rows, a pointer to a slice of the tukdbint table row type
+func (s *SQLStore) Find(table string, q Query, rows interface{}) error {
+	rowtype := reflect.TypeOf(rows).Elem().Elem()
+	if err := q.validate(table, rowtype); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	d := s.dialect
+	var columns, where, order []string
+	var vals []interface{}
+	for _, column := range columnNames(rowtype) {
+		columns = append(columns, d.quote(column))
+	}
+	stmnt := "SELECT " + strings.Join(columns, ", ") + " FROM " + d.quote(table)
+	for _, c := range q.Where {
+		where = append(where, d.condition(table, c, &vals))
+	}
+	if len(where) > 0 {
+		stmnt = stmnt + " WHERE " + strings.Join(where, " AND ")
+	}
+	for _, o := range q.OrderBy {
+		if o.Desc {
+			order = append(order, d.quote(o.Column)+" DESC")
+		} else {
+			order = append(order, d.quote(o.Column))
+		}
+	}
+	stmnt = stmnt + " ORDER BY " + strings.Join(append(order, d.quote("id")), ", ")
+	switch {
+	case q.Limit > 0:
+		stmnt = stmnt + fmt.Sprintf(" LIMIT %v OFFSET %v", q.Limit, q.Offset)
+	case q.Offset > 0 && d.name == tukcnst.MYSQL:
+		stmnt = stmnt + fmt.Sprintf(" LIMIT 18446744073709551615 OFFSET %v", q.Offset)
+	case q.Offset > 0:
+		stmnt = stmnt + fmt.Sprintf(" OFFSET %v", q.Offset)
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	count := 0
+	return d.query(ctx, s.conn(), stmnt, vals, rows, &count)
+}
+
+// condition returns the where clause for the query condition, appending its values to vals
+func (d dialect) condition(table string, c Condition, vals *[]interface{}) string {
+	if c.Op == OP_UNACKED {
+		return d.unacked(table, c, vals)
+	}
+	_, isstring := c.Values[0].(string)
+	isstring = isstring && !isTimeColumn(c.Column)
+	column := d.quote(table) + "." + d.quote(c.Column)
+	var params []string
+	for _, v := range c.Values {
+		*vals = append(*vals, columnValue(c.Column, v))
+		params = append(params, d.fold(d.param(len(*vals)), isstring))
+	}
+	switch c.Op {
+	case OP_IN:
+		return d.fold(column, isstring) + " IN (" + strings.Join(params, ", ") + ")"
+	case OP_LIKE:
+		if d.name == POSTGRES {
+			return column + " ILIKE " + d.param(len(*vals))
+		}
+		return column + " LIKE " + d.param(len(*vals))
+	case OP_EVENT:
+		ev := func(column string) string { return d.quote("e") + "." + d.quote(column) }
+		wf := func(column string) string { return d.quote(table) + "." + d.quote(column) }
+		return "EXISTS (SELECT 1 FROM " + d.quote(tukcnst.EVENTS) + " " + d.quote("e") + " WHERE " + d.fold(ev("pathway"), true) + " = " + d.fold(wf("pathway"), true) +
+			" AND " + ev("nhsid") + " = " + wf("nhsid") + " AND " + ev("version") + " = " + wf("version") +
+			" AND " + d.fold(ev(c.Column), isstring) + " IN (" + strings.Join(params, ", ") + "))"
+	case OP_NE:
+		return d.fold(column, isstring) + " <> " + params[0]
+	}
+	return d.fold(column, isstring) + " " + c.Op + " " + params[0]
+}
+
+// unacked returns the OP_UNACKED condition. An events row is matched if it is not a creation event and no eventacks row has its id.
+// A workflows row is matched if it has such an event
+func (d dialect) unacked(table string, c Condition, vals *[]interface{}) string {
+	alias := table
+	if table == tukcnst.WORKFLOWS {
+		alias = "e"
+	}
+	ev := func(column string) string { return d.quote(alias) + "." + d.quote(column) }
+	cond := ""
+	if len(c.Values) > 0 {
+		_, isstring := c.Values[0].(string)
+		isstring = isstring && !isTimeColumn(c.Column)
+		var params []string
+		for _, v := range c.Values {
+			*vals = append(*vals, columnValue(c.Column, v))
+			params = append(params, d.fold(d.param(len(*vals)), isstring))
+		}
+		cond = d.fold(ev(c.Column), isstring) + " IN (" + strings.Join(params, ", ") + ") AND "
+	}
+	*vals = append(*vals, CREATION_EVENT_TOPIC)
+	cond = cond + "COALESCE(" + ev("topic") + ", '') <> " + d.param(len(*vals)) + " AND NOT EXISTS (SELECT 1 FROM " + d.quote(tukcnst.EVENT_ACKS) + " " + d.quote("a") + " WHERE " + d.quote("a") + "." + d.quote("eventid") + " = " + ev("id") + ")"
+	if table != tukcnst.WORKFLOWS {
+		return "(" + cond + ")"
+	}
+	wf := func(column string) string { return d.quote(table) + "." + d.quote(column) }
+	return "EXISTS (SELECT 1 FROM " + d.quote(tukcnst.EVENTS) + " " + d.quote("e") + " WHERE " + d.fold(ev("pathway"), true) + " = " + d.fold(wf("pathway"), true) +
+		" AND " + ev("nhsid") + " = " + wf("nhsid") + " AND " + ev("version") + " = " + wf("version") + " AND " + cond + ")"
+}
+
+// fold lower cases a PostgreSQL string expression, for comparisons matching the default MySQL collation
+func (d dialect) fold(expr string, isstring bool) string {
+	if d.name == POSTGRES && isstring {
+		return "lower(" + expr + ")"
+	}
+	return expr
+}
@@ -0,0 +1,470 @@
+package tukstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// Subject access
+//
+// A SubjectAccess is everything held for an NHS id: the workflows with their XDW documents, events, notes (the event comments) and
+// acknowledgements, the events of the patient that are not part of a workflow, the subscriptions of the patient's pathways and the
+// archived workflows. ExportSubject gathers it for a subject access request, and EraseSubject erases or pseudonymises it in one
+// transaction. Both record a SubjectAudit in the subjectaudits table, which holds a keyed hash of the NHS id rather than the NHS id.
+// The hash key is the keyring hash key of an encrypted store, or the base64 key of at least 32 bytes in TUK_SUBJECT_HASH_KEY.
+// Subject requests are refused when there is no hash key, as an unkeyed hash of an NHS id can be reversed by trying every id.
+const (
+	SUBJECT_AUDITS           = "subjectaudits"
+	SUBJECT_EXPORT           = "export"
+	SUBJECT_ERASE            = "erase"
+	SUBJECT_PSEUDONYMISE     = "pseudonymise"
+	PSEUDONYM_PREFIX         = "ANON"
+	REDACTED                 = "[redacted]"
+	ENV_TUK_SUBJECT_HASH_KEY = "TUK_SUBJECT_HASH_KEY"
+)
+
+// ErrNoSubjectHashKey is returned by subject requests when the store is not encrypted and TUK_SUBJECT_HASH_KEY is not set
+var ErrNoSubjectHashKey = errors.New("subject requests require a keyring or a " + ENV_TUK_SUBJECT_HASH_KEY + " hash key")
+
+// SubjectAccess is the data held for an NHS id. Workflows are the workflow versions of the patient, each with its events and their
+// acknowledgements, and Events and EventAcks are the patient events that are not part of a workflow version
+type SubjectAccess struct {
+	NHSId         string                  `json:"nhsid"`
+	Generated     string                  `json:"generated"`
+	Workflows     []ArchivedWorkflow      `json:"workflows"`
+	Events        []tukdbint.Event        `json:"events"`
+	EventAcks     []tukdbint.EventAck     `json:"eventacks"`
+	Subscriptions []tukdbint.Subscription `json:"subscriptions"`
+	Archived      []ArchivedWorkflow      `json:"archived"`
+}
+
+// SubjectAudit is a row of the subjectaudits table recording a subject access export or an erasure. Subject is the SubjectHash
+// of the NHS id. Action is SUBJECT_EXPORT,
+// SUBJECT_ERASE or SUBJECT_PSEUDONYMISE, and Pseudonym is the id that replaced the NHS id when it is pseudonymised. The counts are
+// the rows exported or erased
+type SubjectAudit struct {
+	Id                int64  `json:"id"`
+	Created           string `json:"created"`
+	Subject           string `json:"subject"`
+	Action            string `json:"action"`
+	User              string `json:"user"`
+	Reason            string `json:"reason"`
+	Pseudonym         string `json:"pseudonym"`
+	Workflows         int    `json:"workflows"`
+	Events            int    `json:"events"`
+	EventAcks         int    `json:"eventacks"`
+	ArchivedWorkflows int    `json:"archivedworkflows"`
+}
+
+// SubjectAudits is the subjectaudits table collection, in the form of the tukdbint collections
+type SubjectAudits struct {
+	Action        string         `json:"action"`
+	LastInsertId  int64          `json:"lastinsertid"`
+	Count         int            `json:"count"`
+	SubjectAudits []SubjectAudit `json:"subjectaudits"`
+}
+
+// GetSubjectAccess returns the data held for the NHS id in the store and archive
+func GetSubjectAccess(s Store, a Archive, nhsid string) (SubjectAccess, error) {
+	sar := SubjectAccess{NHSId: nhsid, Generated: time.Now().Format(time.RFC3339)}
+	if nhsid == "" {
+		return sar, errors.New("nhs id is not set")
+	}
+	wfs, err := FindWorkflows(s, NewWorkflowQuery().NHSId(nhsid).OldestFirst())
+	if err != nil {
+		return sar, err
+	}
+	pathways := make(map[string]bool)
+	inworkflow := make(map[int64]bool)
+	for _, wf := range wfs.Workflows {
+		rec, err := archivedWorkflow(s, wf, time.Now())
+		if err != nil {
+			return sar, err
+		}
+		rec.Archived = ""
+		for _, ev := range rec.Events {
+			inworkflow[ev.Id] = true
+		}
+		pathways[wf.Pathway] = true
+		sar.Workflows = append(sar.Workflows, rec)
+	}
+	evs, err := FindEvents(s, NewEventQuery().NHSId(nhsid).OldestFirst())
+	if err != nil {
+		return sar, err
+	}
+	for _, ev := range evs.Events {
+		if !inworkflow[ev.Id] {
+			pathways[ev.Pathway] = true
+			sar.Events = append(sar.Events, ev)
+		}
+	}
+	if sar.EventAcks, err = findEventAcks(s, sar.Events); err != nil {
+		return sar, err
+	}
+	var definitions []tukdbint.XDW
+	if err := s.Find(tukcnst.XDWS, Query{}, &definitions); err != nil {
+		return sar, err
+	}
+	for _, xdw := range definitions {
+		if _, ok := pathways[xdw.Name]; !ok && !xdw.IsXDSMeta {
+			pathways[xdw.Name] = false
+		}
+	}
+	names := make([]string, 0, len(pathways))
+	for pathway := range pathways {
+		names = append(names, pathway)
+	}
+	sort.Strings(names)
+	for _, pathway := range names {
+		recs, err := a.Get(s, strings.ToUpper(pathway)+nhsid)
+		if err != nil {
+			return sar, err
+		}
+		for _, rec := range recs {
+			if rec.Workflow.NHSId == nhsid {
+				sar.Archived = append(sar.Archived, rec)
+				pathways[pathway] = true
+			}
+		}
+	}
+	var held []interface{}
+	for pathway, ok := range pathways {
+		if ok {
+			held = append(held, pathway)
+		}
+	}
+	if len(held) > 0 {
+		q := Query{}
+		if err := s.Find(tukcnst.SUBSCRIPTIONS, *q.Filter("pathway", OP_IN, held...).Sort("id", false), &sar.Subscriptions); err != nil {
+			return sar, err
+		}
+	}
+	return sar, nil
+}
+
+// ExportSubject returns the data held for the NHS id and records the export, by the user for the reason, in the subjectaudits table
+func ExportSubject(s Store, a Archive, nhsid string, user string, reason string) (SubjectAccess, error) {
+	if err := checkSubjectRequest(SUBJECT_EXPORT, user, reason); err != nil {
+		return SubjectAccess{}, err
+	}
+	subject, err := SubjectHash(s, nhsid)
+	if err != nil {
+		return SubjectAccess{}, err
+	}
+	sar, err := GetSubjectAccess(s, a, nhsid)
+	if err != nil {
+		return sar, err
+	}
+	audit := sar.audit(subject, SUBJECT_EXPORT, user, reason)
+	return sar, insertSubjectAudit(s, &audit)
+}
+
+// EraseSubject erases the data held for the NHS id, or pseudonymises it when mode is SUBJECT_PSEUDONYMISE, and records the erasure
+// by the user for the reason in the subjectaudits table. The store rows and the audit are written in one transaction, with the
+// archived workflows of a TableArchive. The files of a DirArchive are changed after the transaction commits. Erasing
+// deletes the workflows, events, acknowledgements and archived workflows of the patient. Pseudonymising replaces the NHS id in
+// the workflows, their XDW documents, the events and the archived workflows with a new PSEUDONYM_PREFIX id and redacts the notes
+func EraseSubject(s Store, a Archive, nhsid string, mode string, user string, reason string) (SubjectAudit, error) {
+	if err := checkSubjectRequest(mode, user, reason); err != nil {
+		return SubjectAudit{}, err
+	}
+	subject, err := SubjectHash(s, nhsid)
+	if err != nil {
+		return SubjectAudit{}, err
+	}
+	sar, err := GetSubjectAccess(s, a, nhsid)
+	if err != nil {
+		return SubjectAudit{}, err
+	}
+	audit := sar.audit(subject, mode, user, reason)
+	p := pseudonymiser{nhsid: nhsid}
+	if mode == SUBJECT_PSEUDONYMISE {
+		if p.pseudonym, err = newPseudonym(); err != nil {
+			return audit, err
+		}
+		audit.Pseudonym = p.pseudonym
+	}
+	// archive files can not be rolled back, so only a TableArchive is changed in the transaction and other archives after it commits
+	_, intx := a.(TableArchive)
+	err = WithTx(s, func(tx Store) error {
+		for _, rec := range sar.Workflows {
+			if err := p.apply(tx, rec.Workflow, rec.Events, rec.EventAcks); err != nil {
+				return err
+			}
+		}
+		if err := p.apply(tx, tukdbint.Workflow{}, sar.Events, sar.EventAcks); err != nil {
+			return err
+		}
+		if intx {
+			if err := p.applyArchive(tx, a, sar.Archived); err != nil {
+				return err
+			}
+		}
+		return insertSubjectAudit(tx, &audit)
+	})
+	if err != nil {
+		return audit, err
+	}
+	if !intx {
+		if err := p.applyArchive(s, a, sar.Archived); err != nil {
+			err = fmt.Errorf("subject %s %s in the store, but the archive was not updated: %w", audit.Subject, mode, err)
+			log.Println(err.Error())
+			return audit, err
+		}
+	}
+	log.Printf("Subject %s %s by %s. %v workflows, %v events, %v acknowledgements and %v archived workflows", audit.Subject, mode, user, audit.Workflows, audit.Events, audit.EventAcks, audit.ArchivedWorkflows)
+	return audit, nil
+}
+
+// GetSubjectAudits returns the subject access exports and erasures recorded for the NHS id, oldest first
+func GetSubjectAudits(s Store, nhsid string) ([]SubjectAudit, error) {
+	var audits []SubjectAudit
+	subject, err := SubjectHash(s, nhsid)
+	if err != nil {
+		return nil, err
+	}
+	q := Query{}
+	err = s.Find(SUBJECT_AUDITS, *q.Filter("subject", OP_EQ, subject).Sort("id", false), &audits)
+	return audits, err
+}
+
+// SubjectHash returns the subjectaudits subject of the NHS id, its HMAC with the keyring hash key of the store, or with the
+// TUK_SUBJECT_HASH_KEY key when the store is not encrypted. ErrNoSubjectHashKey is returned if there is no hash key
+func SubjectHash(s Store, nhsid string) (string, error) {
+	if keys := StoreKeyring(s); keys != nil {
+		return keys.Hash(nhsid), nil
+	}
+	envkey := os.Getenv(ENV_TUK_SUBJECT_HASH_KEY)
+	if envkey == "" {
+		log.Println(ErrNoSubjectHashKey.Error())
+		return "", ErrNoSubjectHashKey
+	}
+	hashkey, err := base64.StdEncoding.DecodeString(envkey)
+	if err != nil || len(hashkey) < 32 {
+		err = errors.New(ENV_TUK_SUBJECT_HASH_KEY + " is not a base64 key of at least 32 bytes")
+		log.Println(err.Error())
+		return "", err
+	}
+	keys := Keyring{hashkey: hashkey}
+	return keys.Hash(nhsid), nil
+}
+
+// HTML returns the subject access rendered as an html document
+func (sar SubjectAccess) HTML() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := subjectAccessTemplate.Execute(&buf, sar); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// audit returns the SubjectAudit of the action on the subject access
+func (sar SubjectAccess) audit(subject string, action string, user string, reason string) SubjectAudit {
+	audit := SubjectAudit{Subject: subject, Action: action, User: user, Reason: reason, Workflows: len(sar.Workflows), Events: len(sar.Events), EventAcks: len(sar.EventAcks), ArchivedWorkflows: len(sar.Archived)}
+	for _, rec := range sar.Workflows {
+		audit.Events = audit.Events + len(rec.Events)
+		audit.EventAcks = audit.EventAcks + len(rec.EventAcks)
+	}
+	return audit
+}
+
+// checkSubjectRequest returns an error if the action is not a subject request action, or the user or reason are not set
+func checkSubjectRequest(action string, user string, reason string) error {
+	switch {
+	case action != SUBJECT_EXPORT && action != SUBJECT_ERASE && action != SUBJECT_PSEUDONYMISE:
+		return errors.New("subject request action " + action + " is not " + SUBJECT_EXPORT + ", " + SUBJECT_ERASE + " or " + SUBJECT_PSEUDONYMISE)
+	case user == "" || reason == "":
+		return errors.New("subject request " + action + " requires a user and a reason")
+	}
+	return nil
+}
+func insertSubjectAudit(s Store, audit *SubjectAudit) error {
+	audits := SubjectAudits{Action: tukcnst.INSERT}
+	audits.SubjectAudits = append(audits.SubjectAudits, *audit)
+	if err := s.SubjectAudits(&audits); err != nil {
+		return err
+	}
+	audit.Id = audits.LastInsertId
+	return nil
+}
+
+// findEventAcks returns the acknowledgements of the events
+func findEventAcks(s Store, evs []tukdbint.Event) ([]tukdbint.EventAck, error) {
+	var ids []interface{}
+	for _, ev := range evs {
+		ids = append(ids, ev.Id)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var acks []tukdbint.EventAck
+	q := Query{}
+	err := s.Find(tukcnst.EVENT_ACKS, *q.Filter("eventid", OP_IN, ids...), &acks)
+	return acks, err
+}
+
+// newPseudonym returns a random PSEUDONYM_PREFIX id, which can not be mistaken for an NHS number
+func newPseudonym() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err.Error())
+		return "", err
+	}
+	return PSEUDONYM_PREFIX + strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+// pseudonymiser replaces the nhs id with the pseudonym, or deletes the rows when the pseudonym is not set
+type pseudonymiser struct {
+	nhsid     string
+	pseudonym string
+}
+
+// apply erases or pseudonymises the workflow, when it is set, and the events and acknowledgements
+func (p pseudonymiser) apply(s Store, wf tukdbint.Workflow, evs []tukdbint.Event, acks []tukdbint.EventAck) error {
+	if p.pseudonym == "" {
+		if err := deleteEvents(s, evs, acks); err != nil {
+			return err
+		}
+		if wf.Id == 0 {
+			return nil
+		}
+		wfs := tukdbint.Workflows{Action: tukcnst.DELETE}
+		wfs.Workflows = append(wfs.Workflows, tukdbint.Workflow{Id: wf.Id, Version: -1, Published: wf.Published})
+		return s.Workflows(&wfs)
+	}
+	for _, ev := range evs {
+		pev := p.event(ev)
+		if err := s.SetColumns(tukcnst.EVENTS, ev.Id, map[string]interface{}{"nhsid": pev.NhsId, "xdspid": pev.XdsPid, "docname": pev.DocName, "comments": pev.Comments}); err != nil {
+			return err
+		}
+	}
+	if wf.Id == 0 {
+		return nil
+	}
+	pwf := p.workflow(wf)
+	return s.SetColumns(tukcnst.WORKFLOWS, wf.Id, map[string]interface{}{"nhsid": pwf.NHSId, "xdw_key": pwf.XDW_Key, "xdw_doc": pwf.XDW_Doc})
+}
+func (p pseudonymiser) replace(val string) string {
+	return strings.ReplaceAll(val, p.nhsid, p.pseudonym)
+}
+func (p pseudonymiser) workflow(wf tukdbint.Workflow) tukdbint.Workflow {
+	wf.NHSId = p.pseudonym
+	wf.XDW_Key = p.replace(wf.XDW_Key)
+	wf.XDW_Doc = p.replace(wf.XDW_Doc)
+	return wf
+}
+func (p pseudonymiser) event(ev tukdbint.Event) tukdbint.Event {
+	ev.NhsId = p.pseudonym
+	ev.XdsPid = p.replace(ev.XdsPid)
+	ev.DocName = p.replace(ev.DocName)
+	if ev.Comments != "" {
+		ev.Comments = REDACTED
+	}
+	return ev
+}
+
+// applyArchive deletes the archived workflows, or replaces them with the pseudonymised workflows. The pseudonymised workflows are
+// archived before the workflows are deleted, so a failure does not lose them
+func (p pseudonymiser) applyArchive(s Store, a Archive, recs []ArchivedWorkflow) error {
+	done := make(map[string]bool)
+	if p.pseudonym != "" {
+		for _, rec := range recs {
+			pseudonymised := p.archived(rec)
+			if err := a.Put(s, pseudonymised); err != nil {
+				return err
+			}
+			done[pseudonymised.Workflow.XDW_Key] = true
+		}
+	}
+	for _, rec := range recs {
+		if !done[rec.Workflow.XDW_Key] {
+			if _, err := a.Delete(s, rec.Workflow.XDW_Key); err != nil {
+				return err
+			}
+			done[rec.Workflow.XDW_Key] = true
+		}
+	}
+	return nil
+}
+func (p pseudonymiser) archived(rec ArchivedWorkflow) ArchivedWorkflow {
+	rec.Workflow = p.workflow(rec.Workflow)
+	evs := make([]tukdbint.Event, len(rec.Events))
+	for k, ev := range rec.Events {
+		evs[k] = p.event(ev)
+	}
+	rec.Events = evs
+	return rec
+}
+
+// subjectAccessTemplate renders a SubjectAccess as html
+var subjectAccessTemplate = template.Must(template.New("subjectaccess").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Subject access {{.NHSId}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #999; padding: 0.25em 0.5em; text-align: left; vertical-align: top; }
+pre { white-space: pre-wrap; max-height: 30em; overflow: auto; background: #f4f4f4; padding: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Subject access for NHS id {{.NHSId}}</h1>
+<p>Generated {{.Generated}}. {{len .Workflows}} workflows, {{len .Events}} other events, {{len .Subscriptions}} subscriptions and {{len .Archived}} archived workflows.</p>
+{{define "workflow"}}
+<h3>{{.Workflow.Pathway}} version {{.Workflow.Version}}</h3>
+<table>
+<tr><th>XDW key</th><td>{{.Workflow.XDW_Key}}</td></tr>
+<tr><th>XDW uid</th><td>{{.Workflow.XDW_UID}}</td></tr>
+<tr><th>Created</th><td>{{.Workflow.Created}}</td></tr>
+<tr><th>Status</th><td>{{.Workflow.Status}}</td></tr>
+<tr><th>Published</th><td>{{.Workflow.Published}}</td></tr>
+{{if .Archived}}<tr><th>Archived</th><td>{{.Archived}}</td></tr>{{end}}
+</table>
+{{template "events" .Events}}
+{{template "acks" .EventAcks}}
+<details><summary>XDW document</summary><pre>{{.Workflow.XDW_Doc}}</pre></details>
+{{end}}
+{{define "events"}}{{if .}}
+<table>
+<tr><th>Id</th><th>Created</th><th>Pathway</th><th>Version</th><th>Task</th><th>Expression</th><th>User</th><th>Org</th><th>Role</th><th>Document</th><th>Notes</th></tr>
+{{range .}}<tr><td>{{.Id}}</td><td>{{.Creationtime}}</td><td>{{.Pathway}}</td><td>{{.Version}}</td><td>{{.TaskId}}</td><td>{{.Expression}}</td><td>{{.User}}</td><td>{{.Org}}</td><td>{{.Role}}</td><td>{{.DocName}}</td><td>{{.Comments}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+{{define "acks"}}{{if .}}
+<table>
+<tr><th>Acknowledged event</th><th>Created</th><th>User</th><th>Org</th><th>Role</th></tr>
+{{range .}}<tr><td>{{.EventID}}</td><td>{{.CreationTime}}</td><td>{{.User}}</td><td>{{.Org}}</td><td>{{.Role}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+<h2>Workflows</h2>
+{{range .Workflows}}{{template "workflow" .}}{{else}}<p>None</p>{{end}}
+<h2>Other events</h2>
+{{template "events" .Events}}{{template "acks" .EventAcks}}{{if not .Events}}<p>None</p>{{end}}
+<h2>Subscriptions</h2>
+{{if .Subscriptions}}
+<table>
+<tr><th>Pathway</th><th>Topic</th><th>Expression</th><th>Broker ref</th><th>Created</th></tr>
+{{range .Subscriptions}}<tr><td>{{.Pathway}}</td><td>{{.Topic}}</td><td>{{.Expression}}</td><td>{{.BrokerRef}}</td><td>{{.Created}}</td></tr>
+{{end}}</table>
+{{else}}<p>None</p>{{end}}
+<h2>Archived workflows</h2>
+{{range .Archived}}{{template "workflow" .}}{{else}}<p>None</p>{{end}}
+</body>
+</html>
+`))
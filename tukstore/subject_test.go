@@ -0,0 +1,84 @@
+package tukstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+func TestSubjectHash(t *testing.T) {
+	t.Setenv(ENV_TUK_SUBJECT_HASH_KEY, "")
+	if _, err := SubjectHash(NewMemStore(), "9999999468"); !errors.Is(err, ErrNoSubjectHashKey) {
+		t.Fatalf("subject hash without a key returned %v", err)
+	}
+	t.Setenv(ENV_TUK_SUBJECT_HASH_KEY, NewKey())
+	hash, err := SubjectHash(NewMemStore(), "9999999468")
+	if err != nil || !strings.HasPrefix(hash, HASHED_PREFIX) || strings.Contains(hash, "9999999468") {
+		t.Fatalf("subject hash is %s, %v", hash, err)
+	}
+	keys, err := ParseKeyring([]byte(`{"current": "k1", "keys": {"k1": "` + NewKey() + `"}, "hashkey": "` + NewKey() + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewCachedStore(NewEncryptedStore(NewMemStore(), keys), time.Minute)
+	if hash, err = SubjectHash(s, "9999999468"); err != nil || hash != keys.Hash("9999999468") {
+		t.Fatalf("subject hash of a wrapped encrypted store is %s, %v", hash, err)
+	}
+}
+
+// auditFailure is a store whose subject audit inserts fail, so a subject request transaction is rolled back
+type auditFailure struct {
+	Store
+}
+
+func (s auditFailure) SubjectAudits(i *SubjectAudits) error {
+	return errors.New("subject audit failed")
+}
+func (s auditFailure) Begin() (Tx, error) {
+	tx, err := s.Store.Begin()
+	return auditFailureTx{tx}, err
+}
+
+type auditFailureTx struct {
+	Tx
+}
+
+func (auditFailureTx) SubjectAudits(i *SubjectAudits) error {
+	return errors.New("subject audit failed")
+}
+
+func TestEraseSubjectDirArchive(t *testing.T) {
+	t.Setenv(ENV_TUK_SUBJECT_HASH_KEY, NewKey())
+	s := NewMemStore()
+	xdws := tukdbint.XDWS{Action: tukcnst.INSERT, XDW: []tukdbint.XDW{{Name: "lab", XDW: "{}"}}}
+	if err := s.XDWS(&xdws); err != nil {
+		t.Fatal(err)
+	}
+	a := DirArchive{Dir: t.TempDir()}
+	wf := testWorkflow("lab", "9999999468", "<xdw>9999999468</xdw>")
+	wf.Id, wf.XDW_Key = 1, "LAB9999999468"
+	if err := a.Put(s, ArchivedWorkflow{Archived: "2024-01-01T09:00:00Z", Workflow: wf}); err != nil {
+		t.Fatal(err)
+	}
+	archived := func(xdwkey string) int {
+		recs, err := a.Get(s, xdwkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(recs)
+	}
+	if _, err := EraseSubject(auditFailure{s}, a, "9999999468", SUBJECT_ERASE, "u", "request"); err == nil || archived("LAB9999999468") != 1 {
+		t.Fatalf("rolled back erasure returned %v and left %v archived workflows, want the archive unchanged", err, archived("LAB9999999468"))
+	}
+	audit, err := EraseSubject(s, a, "9999999468", SUBJECT_PSEUDONYMISE, "u", "request")
+	if err != nil || audit.ArchivedWorkflows != 1 || archived("LAB9999999468") != 0 || archived("LAB"+audit.Pseudonym) != 1 {
+		t.Fatalf("pseudonymise returned %+v, %v", audit, err)
+	}
+	if _, err := EraseSubject(s, a, audit.Pseudonym, SUBJECT_ERASE, "u", "request"); err != nil || archived("LAB"+audit.Pseudonym) != 0 {
+		t.Fatalf("erasure returned %v and left %v archived workflows", err, archived("LAB"+audit.Pseudonym))
+	}
+}
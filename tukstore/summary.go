@@ -0,0 +1,329 @@
+package tukstore
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+// WorkflowSummary holds the workflow columns derived from the XDW document and definition, so dashboards and searches do not have
+// to parse every document. Times are RFC3339 strings and are empty when not applicable. The columns are independent of the current
+// time, so TargetMissed is only true if the workflow was closed after its complete by time, matching XDWState.IsOverdue. Whether
+// an open workflow is overdue depends on the time and is queried from CompleteBy, see WorkflowQuery.Overdue. CurrentTask is the
+// first task that is not complete, or 0. SeqNo is the WorkflowDocumentSequenceNumber of the document, see UpdateWorkflow
+type WorkflowSummary struct {
+	Pathway       string `json:"pathway"`
+	NHSId         string `json:"nhsid"`
+	Version       int    `json:"version"`
+	CompleteBy    string `json:"completeby"`
+	EscalateBy    string `json:"escalateby"`
+	ClosedTime    string `json:"closedtime"`
+	LastEventTime string `json:"lasteventtime"`
+	TargetMissed  bool   `json:"targetmissed"`
+	CurrentTask   int    `json:"currenttask"`
+	SeqNo         int    `json:"seqno"`
+}
+
+// summaryColumns are the derived workflows columns that can be used in workflow queries
+var summaryColumns = []string{"completeby", "escalateby", "closedtime", "lasteventtime", "targetmissed", "currenttask", "seqno"}
+
+// GetDashboard returns the dashboard counts for the workflows matching the query at time now. Sorting and pagination are ignored
+func GetDashboard(s Store, q *WorkflowQuery, now time.Time) (tukxdw.Dashboard, error) {
+	if q == nil {
+		q = NewWorkflowQuery()
+	}
+	return s.Dashboard(q.Query, now)
+}
+
+// SetWorkflowSummary sets the derived columns of the workflow with the summary pathway, nhs id and version
+func (s *SQLStore) SetWorkflowSummary(sum WorkflowSummary) error {
+	if s.Connection.DBReader_Only {
+		return ErrReadOnly
+	}
+	d := s.dialect
+	var set []string
+	var vals []interface{}
+	v := reflect.ValueOf(sum)
+	for _, column := range summaryColumns {
+		val := field(v, column)
+		if str, ok := val.(string); ok {
+			if str == "" {
+				val = nil
+			} else {
+				val = columnValue(column, str)
+			}
+		}
+		vals = append(vals, val)
+		set = append(set, d.quote(column)+" = "+d.param(len(vals)))
+	}
+	where := d.where(map[string]interface{}{"pathway": sum.Pathway, "nhsid": sum.NHSId, "version": sum.Version}, &vals)
+	ctx, cancel := s.context()
+	defer cancel()
+	if _, err := s.conn().ExecContext(ctx, "UPDATE "+d.quote(tukcnst.WORKFLOWS)+" SET "+strings.Join(set, ", ")+" WHERE "+where, vals...); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// UpdateWorkflow updates the workflow with a single statement conditioned on the stored seqno
+func (s *SQLStore) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	if s.Connection.DBReader_Only {
+		return ErrReadOnly
+	}
+	d := s.dialect
+	var set []string
+	vals := []interface{}{wf.XDW_Doc, wf.Published, wf.Status, seqno}
+	for k, column := range []string{"xdw_doc", "published", "status", "seqno"} {
+		set = append(set, d.quote(column)+" = "+d.param(k+1))
+	}
+	where := d.where(map[string]interface{}{"pathway": wf.Pathway, "nhsid": wf.NHSId, "version": wf.Version}, &vals)
+	vals = append(vals, expected)
+	where = where + " AND (" + d.quote("seqno") + " = " + d.param(len(vals)) + " OR " + d.quote("seqno") + " = 0)"
+	ctx, cancel := s.context()
+	defer cancel()
+	rslt, err := s.conn().ExecContext(ctx, "UPDATE "+d.quote(tukcnst.WORKFLOWS)+" SET "+strings.Join(set, ", ")+" WHERE "+where, vals...)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	n, err := rslt.RowsAffected()
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if n == 0 {
+		return conflict(reflect.ValueOf(wf))
+	}
+	return nil
+}
+
+// Dashboard returns the dashboard counts for the workflows matching the query at time now, using SQL aggregates
+func (s *SQLStore) Dashboard(q Query, now time.Time) (tukxdw.Dashboard, error) {
+	dashboard := tukxdw.Dashboard{}
+	if err := q.validate(tukcnst.WORKFLOWS, reflect.TypeOf(tukdbint.Workflow{})); err != nil {
+		log.Println(err.Error())
+		return dashboard, err
+	}
+	d := s.dialect
+	var vals []interface{}
+	sum := func(cond string) string {
+		return "COALESCE(SUM(CASE WHEN " + cond + " THEN 1 ELSE 0 END), 0)"
+	}
+	param := func(val interface{}) string {
+		vals = append(vals, val)
+		return d.param(len(vals))
+	}
+	status := d.quote("status")
+	open := status + " = " + param(tukcnst.OPEN)
+	inprogress := sum(open)
+	escalated := sum(status + " = " + param(tukcnst.OPEN) + " AND " + d.quote("escalateby") + " IS NOT NULL AND " + d.quote("escalateby") + " < " + param(now))
+	complete := sum(status + " <> " + param(tukcnst.OPEN))
+	missed := sum(status + " = " + param(tukcnst.CLOSED) + " AND " + d.quote("targetmissed") + " = " + param(true))
+	met := sum(status + " = " + param(tukcnst.CLOSED) + " AND " + d.quote("targetmissed") + " = " + param(false))
+	stmnt := "SELECT COUNT(*), " + strings.Join([]string{inprogress, escalated, complete, missed, met}, ", ") + " FROM " + d.quote(tukcnst.WORKFLOWS)
+	var where []string
+	for _, c := range q.Where {
+		where = append(where, d.condition(tukcnst.WORKFLOWS, c, &vals))
+	}
+	if len(where) > 0 {
+		stmnt = stmnt + " WHERE " + strings.Join(where, " AND ")
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.conn().QueryRowContext(ctx, stmnt, vals...).Scan(&dashboard.Total, &dashboard.InProgress, &dashboard.Escalated, &dashboard.Complete, &dashboard.TargetMissed, &dashboard.TargetMet); err != nil {
+		log.Println(err.Error())
+		return dashboard, err
+	}
+	return dashboard, nil
+}
+
+// SetWorkflowSummary sets the summary of the workflow with the summary pathway, nhs id and version
+func (s *MemStore) SetWorkflowSummary(sum WorkflowSummary) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	if s.tables.Summaries == nil {
+		s.tables.Summaries = make(map[int64]WorkflowSummary)
+	}
+	for _, wf := range s.tables.Workflows.Rows {
+		if strings.EqualFold(wf.Pathway, sum.Pathway) && strings.EqualFold(wf.NHSId, sum.NHSId) && wf.Version == sum.Version {
+			derived := sum
+			derived.Pathway, derived.NHSId, derived.Version = "", "", 0
+			s.tables.Summaries[wf.Id] = derived
+		}
+	}
+	return s.save(tukcnst.UPDATE, nil)
+}
+
+// UpdateWorkflow updates the workflow if the seqno of its summary is expected or 0
+func (s *MemStore) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return err
+	}
+	if s.tables.Summaries == nil {
+		s.tables.Summaries = make(map[int64]WorkflowSummary)
+	}
+	updated := 0
+	for k, row := range s.tables.Workflows.Rows {
+		if !strings.EqualFold(row.Pathway, wf.Pathway) || !strings.EqualFold(row.NHSId, wf.NHSId) || row.Version != wf.Version {
+			continue
+		}
+		sum := s.tables.Summaries[row.Id]
+		if sum.SeqNo != expected && sum.SeqNo != 0 {
+			continue
+		}
+		s.tables.Workflows.Rows[k].XDW_Doc, s.tables.Workflows.Rows[k].Published, s.tables.Workflows.Rows[k].Status = wf.XDW_Doc, wf.Published, wf.Status
+		sum.SeqNo = seqno
+		s.tables.Summaries[row.Id] = sum
+		updated = updated + 1
+	}
+	if updated == 0 {
+		return conflict(reflect.ValueOf(wf))
+	}
+	return s.save(tukcnst.UPDATE, nil)
+}
+
+// Dashboard returns the dashboard counts for the workflows matching the query at time now
+func (s *MemStore) Dashboard(q Query, now time.Time) (tukxdw.Dashboard, error) {
+	dashboard := tukxdw.Dashboard{}
+	if err := q.validate(tukcnst.WORKFLOWS, reflect.TypeOf(tukdbint.Workflow{})); err != nil {
+		log.Println(err.Error())
+		return dashboard, err
+	}
+	defer s.lock()()
+	if err := s.err(); err != nil {
+		return dashboard, err
+	}
+	q.OrderBy, q.Limit, q.Offset = nil, 0, 0
+	for _, wf := range eval(q, s.tables.Workflows.Rows, s.evalContext()) {
+		sum := s.tables.Summaries[wf.Id]
+		dashboard.Total = dashboard.Total + 1
+		if wf.Status == tukcnst.OPEN {
+			dashboard.InProgress = dashboard.InProgress + 1
+			if sum.EscalateBy != "" && toTime(sum.EscalateBy).Before(now) {
+				dashboard.Escalated = dashboard.Escalated + 1
+			}
+		} else {
+			dashboard.Complete = dashboard.Complete + 1
+		}
+		if wf.Status == tukcnst.CLOSED {
+			if sum.TargetMissed {
+				dashboard.TargetMissed = dashboard.TargetMissed + 1
+			} else {
+				dashboard.TargetMet = dashboard.TargetMet + 1
+			}
+		}
+	}
+	return dashboard, nil
+}
+
+// SetWorkflowSummary sets the derived columns with the MySQL connection pool, or posts the summary json to the AWS API Gateway
+// workflows/summary resource
+func (s *DBStore) SetWorkflowSummary(sum WorkflowSummary) error {
+	if s.Connection.DBReader_Only {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().SetWorkflowSummary(sum)
+	}
+	body, _ := json.Marshal(sum)
+	_, err := s.awsRequest(tukcnst.WORKFLOWS+"/summary", tukcnst.UPDATE, body)
+	return err
+}
+
+// UpdateWorkflow updates the workflow with the MySQL connection pool, or posts {"workflow": <tukdbint.Workflow json>, "seqno": <seqno>,
+// "expected": <expected>} to the AWS API Gateway workflows/update resource with an Idempotency-Key. The API must set the xdw_doc,
+// published, status and seqno of the workflow only if its stored seqno is expected or 0, and respond 409 Conflict if it is not
+func (s *DBStore) UpdateWorkflow(wf tukdbint.Workflow, seqno int, expected int) error {
+	if s.Connection.DBReader_Only {
+		return ErrReadOnly
+	}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().UpdateWorkflow(wf, seqno, expected)
+	}
+	body, _ := json.Marshal(workflowUpdate{Workflow: wf, SeqNo: seqno, Expected: expected})
+	rsp, err := s.awsPost(tukcnst.WORKFLOWS+"/update", body, AWS_TIMEOUT, newIdempotencyKey())
+	if err != nil {
+		return err
+	}
+	switch rsp.status {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return conflict(reflect.ValueOf(wf))
+	}
+	err = awsAPIError(tukcnst.WORKFLOWS+"/update", rsp)
+	log.Println(err.Error())
+	return err
+}
+
+// workflowUpdate is the body of an AWS API Gateway workflows/update request
+type workflowUpdate struct {
+	Workflow tukdbint.Workflow `json:"workflow"`
+	SeqNo    int               `json:"seqno"`
+	Expected int               `json:"expected"`
+}
+
+// Dashboard returns the dashboard with the MySQL connection pool, or from the AWS API Gateway workflows/dashboard resource, which
+// is posted {"query": <Query json>, "now": <RFC3339 time>} and must respond with the tukxdw.Dashboard json
+func (s *DBStore) Dashboard(q Query, now time.Time) (tukxdw.Dashboard, error) {
+	dashboard := tukxdw.Dashboard{}
+	if s.Connection.DB_URL == "" {
+		return s.mysql().Dashboard(q, now)
+	}
+	body, _ := json.Marshal(struct {
+		Query Query  `json:"query"`
+		Now   string `json:"now"`
+	}{Query: q, Now: now.Format(time.RFC3339)})
+	rsp, err := s.awsRequest(tukcnst.WORKFLOWS+"/dashboard", tukcnst.SELECT, body)
+	if err != nil {
+		return dashboard, err
+	}
+	err = json.Unmarshal(rsp, &dashboard)
+	return dashboard, err
+}
+
+// awsRequest posts the body of the action to the AWS API Gateway resource and returns the response, or an AWSAPIError if the
+// status is not 200 OK. An INSERT or a DEPRECATE, which increments the version, is sent with an Idempotency-Key, so it is not
+// executed twice if it is retried
+func (s *DBStore) awsRequest(resource string, action string, body []byte) ([]byte, error) {
+	key := ""
+	if action == tukcnst.INSERT || action == tukcnst.DEPRECATE {
+		key = newIdempotencyKey()
+	}
+	rsp, err := s.awsPost(resource, body, AWS_TIMEOUT, key)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.status != http.StatusOK {
+		err := awsAPIError(resource, rsp)
+		log.Println(err.Error())
+		return nil, err
+	}
+	return rsp.body, nil
+}
+
+// awsPost posts the json body to the AWS API Gateway resource with the store transport and context, limited to timeout including
+// retries if the context has no deadline, and returns the response. key is the Idempotency-Key of a request that is not idempotent
+func (s *DBStore) awsPost(resource string, body []byte, timeout time.Duration, key string) (awsResponse, error) {
+	t := s.Transport
+	if t == nil {
+		var err error
+		if t, err = awsTransport(s.Connection.DB_URL); err != nil {
+			return awsResponse{}, err
+		}
+	}
+	ctx, cancel := opContext(s.ctx, timeout)
+	defer cancel()
+	return t.post(ctx, s.Connection.DB_URL+resource, body, key)
+}